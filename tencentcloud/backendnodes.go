@@ -0,0 +1,241 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	// labelNodeRoleMaster marks master nodes, which the service controller never balances to
+	labelNodeRoleMaster = "node-role.kubernetes.io/master"
+
+	backendNodesSyncPeriod = time.Minute
+
+	// LabelBackendGroup is the group a node belongs to, services register the nodes of the group named by their
+	// active backend group annotation only
+	LabelBackendGroup = "node.tencentcloud.com/backend-group"
+)
+
+// backendNodeSelector returns the selector of the nodes registered as backends of the service, everything by default.
+func backendNodeSelector(service *v1.Service) (labels.Selector, error) {
+	selector := labels.Everything()
+	if value, ok := service.Annotations[ServiceAnnotationLoadBalancerBackendsLabel]; ok {
+		var err error
+		if selector, err = labels.Parse(value); err != nil {
+			return nil, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q: %v", ServiceAnnotationLoadBalancerBackendsLabel, value, err)))
+		}
+	}
+	if group, ok := service.Annotations[ServiceAnnotationLoadBalancerActiveGroup]; ok {
+		requirement, err := labels.NewRequirement(LabelBackendGroup, selection.Equals, []string{group})
+		if err != nil {
+			return nil, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q, must be a label value", ServiceAnnotationLoadBalancerActiveGroup, group)))
+		}
+		selector = selector.Add(*requirement)
+	}
+	return selector, nil
+}
+
+// filterBackendNodes returns the nodes selected as backends by the service. An active backend group without
+// nodes is refused, switching to it would deregister every backend.
+func filterBackendNodes(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	selector, err := backendNodeSelector(service)
+	if err != nil {
+		return nil, err
+	}
+	if selector.Empty() {
+		return nodes, nil
+	}
+	selected := []*v1.Node{}
+	for _, node := range nodes {
+		if selector.Matches(labels.Set(node.Labels)) {
+			selected = append(selected, node)
+		}
+	}
+	if len(selected) == 0 {
+		if group, ok := service.Annotations[ServiceAnnotationLoadBalancerActiveGroup]; ok {
+			return nil, errors.New(fmt.Sprintf("no node of backend group %s matches the backend selector %q, keeping the current backends", group, selector))
+		}
+		glog.Warningf("no node matches the backend selector %q of service %s/%s", selector, service.Namespace, service.Name)
+	}
+	return selected, nil
+}
+
+// backendGroups remembers the backend group last registered with each clb, so switches to another group
+// can be reported. Groups are forgotten on restart, the first sync of a clb after it reports nothing.
+type backendGroups struct {
+	lock   sync.Mutex
+	active map[string]string
+}
+
+func newBackendGroups() *backendGroups {
+	return &backendGroups{active: map[string]string{}}
+}
+
+// trackBackendGroupSwitch reports the start of a switch of the clb of the service to another backend group,
+// the returned func reports its end once the backends are synced. New backends are always registered before
+// old ones are deregistered, so the clb keeps serving throughout the switch.
+func (cloud *Cloud) trackBackendGroupSwitch(service *v1.Service, backends int) func(error) {
+	loadBalancerName := loadBalancerSpecial(service)
+	group := service.Annotations[ServiceAnnotationLoadBalancerActiveGroup]
+
+	cloud.backendGroups.lock.Lock()
+	previous, known := cloud.backendGroups.active[loadBalancerName]
+	cloud.backendGroups.lock.Unlock()
+
+	switching := known && previous != group
+	if switching {
+		cloud.recorder.Eventf(service, v1.EventTypeNormal, "BackendGroupSwitching",
+			"Switching backends of loadbalancer %s from group %q to group %q, registering %d node(s) before deregistering the old ones",
+			loadBalancerName, previous, group, backends)
+	}
+	return func(err error) {
+		if err != nil {
+			if switching {
+				cloud.recorder.Eventf(service, v1.EventTypeWarning, "BackendGroupSwitchFailed",
+					"Switching backends of loadbalancer %s to group %q failed, it is retried: %v", loadBalancerName, group, err)
+			}
+			return
+		}
+		cloud.backendGroups.lock.Lock()
+		cloud.backendGroups.active[loadBalancerName] = group
+		cloud.backendGroups.lock.Unlock()
+		if switching {
+			cloud.recorder.Eventf(service, v1.EventTypeNormal, "BackendGroupSwitched",
+				"Backends of loadbalancer %s switched from group %q to group %q", loadBalancerName, previous, group)
+		}
+	}
+}
+
+// runBackendNodesSync keeps the backends of services selecting their backend nodes up to date, and of every
+// service when nodes are tainted for removal by the cluster autoscaler or lose that taint again. The service
+// controller only updates backends when nodes come and go, not when their labels or taints change.
+// Every service is synced right away when a node is deleted, see syncBackendNodesNow.
+func (cloud *Cloud) runBackendNodesSync() {
+	ticker := time.NewTicker(backendNodesSyncPeriod)
+	defer ticker.Stop()
+	toBeDeleted := cloud.syncBackendNodes("", false)
+	for {
+		select {
+		case <-ticker.C:
+			toBeDeleted = cloud.syncBackendNodes(toBeDeleted, false)
+		case <-cloud.backendNodesSyncNow:
+			toBeDeleted = cloud.syncBackendNodes(toBeDeleted, true)
+		}
+	}
+}
+
+// syncBackendNodesNow has the backends of every service synced without waiting for the next period.
+func (cloud *Cloud) syncBackendNodesNow() {
+	select {
+	case cloud.backendNodesSyncNow <- struct{}{}:
+	default:
+		// a sync is pending already
+	}
+}
+
+// syncBackendNodes returns the nodes to be deleted it synced the backends for, the previous sync's are passed in.
+// all syncs the backends of every service, not only of those selecting their backend nodes.
+func (cloud *Cloud) syncBackendNodes(lastToBeDeleted string, all bool) string {
+	if cloud.pause.isPaused() {
+		return lastToBeDeleted
+	}
+	nodes, err := cloud.listBalancedNodes()
+	if err != nil {
+		glog.Errorf("failed to list nodes for backend sync: %v", err)
+		return lastToBeDeleted
+	}
+	toBeDeleted := ""
+	if !cloud.config.KeepNodesToBeDeleted {
+		toBeDeleted = nodesToBeDeleted(nodes)
+	}
+
+	services, err := cloud.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list services for backend sync: %v", err)
+		return lastToBeDeleted
+	}
+
+	failed := false
+	for i := range services.Items {
+		service := &services.Items[i]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerStaticBackends]; ok {
+			continue
+		}
+		if len(unmanagedProtocols(cloud.config, service)) > 0 {
+			continue
+		}
+		_, selecting := service.Annotations[ServiceAnnotationLoadBalancerBackendsLabel]
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerActiveGroup]; ok {
+			selecting = true
+		}
+		if !selecting && !all && toBeDeleted == lastToBeDeleted {
+			continue
+		}
+		// clbs not created yet are left to the service controller
+		if len(service.Status.LoadBalancer.Ingress) == 0 {
+			continue
+		}
+
+		withPorts, _, _, err := portGroupServices(service)
+		if err != nil {
+			glog.Errorf("failed to sync backends of service %s/%s: %v", service.Namespace, service.Name, err)
+			continue
+		}
+		unlock := cloud.serviceLocks.lockService(service)
+		ctx, cancel, budget := cloud.withBackgroundReconcile()
+		for _, view := range withPorts {
+			err := cloud.ensureLoadBalancerBackends(ctx, "", view, nodes)
+			if err = cloud.endCallBudget(service, "backends", budget, err); err != nil {
+				glog.Errorf("failed to sync backends of service %s/%s: %v", service.Namespace, service.Name, err)
+				failed = true
+			}
+		}
+		cancel()
+		unlock()
+	}
+	// every service is synced again on failures, until all of them saw the nodes to be deleted
+	if failed {
+		return lastToBeDeleted
+	}
+	return toBeDeleted
+}
+
+// listBalancedNodes returns the nodes the service controller would pass to UpdateLoadBalancer.
+func (cloud *Cloud) listBalancedNodes() ([]*v1.Node, error) {
+	nodeList, err := cloud.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*v1.Node{}
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+		if node.Spec.Unschedulable {
+			continue
+		}
+		if _, ok := node.Labels[labelNodeRoleMaster]; ok {
+			continue
+		}
+		ready := false
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1.NodeReady {
+				ready = condition.Status == v1.ConditionTrue
+			}
+		}
+		if ready {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,70 @@
+package tencentcloud
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSyncBackendNodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		budget       int
+		wantRegister []string
+		wantEvents   []string
+	}{
+		{name: "selected nodes registered", wantRegister: []string{"ins-1"}},
+		{name: "budget used up", budget: 1, wantEvents: []string{"TaskAndLookupBudgetExceeded"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []interface{}{
+					map[string]interface{}{"loadBalancerId": "lb-1", "forward": ClbLoadBalancerKindApplication},
+				}})
+			})
+			api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+				fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP)))
+			api.handle("clb.RegisterInstancesWithForwardLBFourthListener", legacyTask)
+			api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+			kube := newFakeKube(t)
+			defer kube.close()
+			ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+			kube.nodes = []v1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.1", Labels: map[string]string{"role": "ingress"}}, Status: ready},
+				{ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.2", Labels: map[string]string{"role": "batch"}}, Status: ready},
+			}
+			service := fakeService(map[string]string{ServiceAnnotationLoadBalancerBackendsLabel: "role=ingress"},
+				fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+			kube.services = []v1.Service{*service}
+			cloud, recorder := newTestCloud(t, Config{ReconcileTaskAndLookupBudget: test.budget}, api, kube)
+
+			cloud.syncBackendNodes("", false)
+
+			registered := []string{}
+			for _, call := range api.callsOf("clb.RegisterInstancesWithForwardLBFourthListener") {
+				registered = append(registered, call.Get("backends.0.instanceId"))
+			}
+			if strings.Join(registered, ",") != strings.Join(test.wantRegister, ",") {
+				t.Errorf("registered %v, want %v", registered, test.wantRegister)
+			}
+			events := drainEvents(recorder)
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("events %v, want %v", events, test.wantEvents)
+			}
+			for i, event := range events {
+				if !strings.Contains(event, test.wantEvents[i]) {
+					t.Errorf("event %q, want %s", event, test.wantEvents[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// loadBalancerBandwidthPackageId returns the bandwidth package the public clb of the service is billed by,
+// "" if the clb is private or billed on its own. Accounts billing all public traffic by bandwidth packages
+// must name one, the clb would be created with a billing the account can't use otherwise.
+func (cloud *Cloud) loadBalancerBandwidthPackageId(service *v1.Service) (string, error) {
+	if service.Annotations[ServiceAnnotationLoadBalancerType] == LoadBalancerTypePrivate {
+		return "", nil
+	}
+	bandwidthPackageId := service.Annotations[ServiceAnnotationLoadBalancerBandwidthPackageId]
+	if bandwidthPackageId == "" && cloud.config.RequireBandwidthPackage {
+		return "", newSpecError(errors.New(fmt.Sprintf("public loadbalancers are billed by bandwidth packages in this account, annotation %s must be set",
+			ServiceAnnotationLoadBalancerBandwidthPackageId)))
+	}
+	return bandwidthPackageId, nil
+}
+
+// getLoadBalancerBandwidthPackage returns the bandwidth package of the service, nil if the service names none.
+// It is checked before a clb is created for the service.
+func (cloud *Cloud) getLoadBalancerBandwidthPackage(service *v1.Service) (*bandwidthPackage, error) {
+	bandwidthPackageId, err := cloud.loadBalancerBandwidthPackageId(service)
+	if err != nil || bandwidthPackageId == "" {
+		return nil, err
+	}
+	bandwidthPackage, err := cloud.describeBandwidthPackage(bandwidthPackageId)
+	if err != nil {
+		return nil, err
+	}
+	if bandwidthPackage == nil {
+		// packages of other regions can't be seen, nor hold clbs of this region
+		return nil, newSpecError(errors.New(fmt.Sprintf("bandwidth package %s of annotation %s does not exist in region %s, it must be in the region of the cluster",
+			bandwidthPackageId, ServiceAnnotationLoadBalancerBandwidthPackageId, cloud.config.Region)))
+	}
+	return bandwidthPackage, nil
+}
+
+// ensureLoadBalancerBandwidthPackage adds the public clb to the bandwidth package of the service. The clb leaves
+// the package when it is deleted, the package itself is the account's and never touched otherwise. Removing the
+// annotation leaves the clb in the package, taking it out changes how it is billed.
+// Changing the annotation moves the clb out of its current package into the new one if both packages are of the
+// same network type, a clb can't be moved between network types and keeps its package then.
+func (cloud *Cloud) ensureLoadBalancerBandwidthPackage(service *v1.Service, loadBalancer *clb.LoadBalancer) error {
+	bandwidthPackage, err := cloud.getLoadBalancerBandwidthPackage(service)
+	if err != nil || bandwidthPackage == nil {
+		return err
+	}
+	for _, resource := range bandwidthPackage.ResourceSet {
+		if resource.ResourceId == loadBalancer.LoadBalancerId {
+			return nil
+		}
+	}
+
+	currentPackages, err := cloud.describeResourceBandwidthPackages(loadBalancer.LoadBalancerId)
+	if err != nil {
+		return err
+	}
+	for _, currentPackage := range currentPackages {
+		if currentPackage.NetworkType != bandwidthPackage.NetworkType {
+			cloud.recorder.Eventf(service, v1.EventTypeWarning, "BandwidthPackageNotChanged",
+				"loadbalancer %s stays in bandwidth package %s, it can't move from network type %s to %s of bandwidth package %s, recreate the service to change it",
+				loadBalancer.LoadBalancerId, currentPackage.BandwidthPackageId, currentPackage.NetworkType, bandwidthPackage.NetworkType, bandwidthPackage.BandwidthPackageId)
+			return nil
+		}
+	}
+	// a clb is in one package at a time, it is taken out of its current one first. It goes back if it
+	// can't be moved, a clb in no package is billed by traffic.
+	removed := []string{}
+	restore := func(err error) error {
+		for _, bandwidthPackageId := range removed {
+			if restoreErr := cloud.addBandwidthPackageResource(bandwidthPackageId, BandwidthPackageResourceTypeLoadBalance, loadBalancer.LoadBalancerId); restoreErr != nil {
+				glog.Errorf("failed to put loadbalancer %s back into bandwidth package %s: %v", loadBalancer.LoadBalancerId, bandwidthPackageId, restoreErr)
+				cloud.recorder.Eventf(service, v1.EventTypeWarning, "BandwidthPackageLost",
+					"loadbalancer %s is in no bandwidth package, moving it to %s and back into %s failed", loadBalancer.LoadBalancerId,
+					bandwidthPackage.BandwidthPackageId, bandwidthPackageId)
+				continue
+			}
+			glog.Infof("put loadbalancer %s back into bandwidth package %s", loadBalancer.LoadBalancerId, bandwidthPackageId)
+		}
+		return err
+	}
+	for _, currentPackage := range currentPackages {
+		if err := cloud.removeBandwidthPackageResource(currentPackage.BandwidthPackageId, BandwidthPackageResourceTypeLoadBalance, loadBalancer.LoadBalancerId); err != nil {
+			return restore(err)
+		}
+		removed = append(removed, currentPackage.BandwidthPackageId)
+		glog.Infof("removed loadbalancer %s from bandwidth package %s", loadBalancer.LoadBalancerId, currentPackage.BandwidthPackageId)
+	}
+
+	if err := cloud.addBandwidthPackageResource(bandwidthPackage.BandwidthPackageId, BandwidthPackageResourceTypeLoadBalance, loadBalancer.LoadBalancerId); err != nil {
+		return restore(err)
+	}
+	glog.Infof("added loadbalancer %s to bandwidth package %s", loadBalancer.LoadBalancerId, bandwidthPackage.BandwidthPackageId)
+	for _, bandwidthPackageId := range removed {
+		cloud.recorder.Eventf(service, v1.EventTypeNormal, "BandwidthPackageChanged", "moved loadbalancer %s from bandwidth package %s to %s",
+			loadBalancer.LoadBalancerId, bandwidthPackageId, bandwidthPackage.BandwidthPackageId)
+	}
+	return nil
+}
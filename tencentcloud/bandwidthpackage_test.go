@@ -0,0 +1,128 @@
+package tencentcloud
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+)
+
+func TestEnsureLoadBalancerBandwidthPackage(t *testing.T) {
+	fakeBandwidthPackage := func(bandwidthPackageId string, networkType string, resourceIds ...string) map[string]interface{} {
+		resources := []map[string]interface{}{}
+		for _, resourceId := range resourceIds {
+			resources = append(resources, map[string]interface{}{"ResourceType": BandwidthPackageResourceTypeLoadBalance, "ResourceId": resourceId})
+		}
+		return map[string]interface{}{"BandwidthPackageId": bandwidthPackageId, "NetworkType": networkType, "ResourceSet": resources}
+	}
+	tests := []struct {
+		name string
+		// current are the packages holding the clb
+		current      []map[string]interface{}
+		target       map[string]interface{}
+		failAdds     map[string]bool
+		wantCalls    []string
+		wantErr      bool
+		wantEvents   []string
+		wantPackages []string
+	}{
+		{
+			name:      "clb in the package",
+			target:    fakeBandwidthPackage("bwp-new", "BGP", "lb-1"),
+			wantCalls: []string{"vpc.DescribeBandwidthPackages"},
+		},
+		{
+			name:         "clb added to the package",
+			target:       fakeBandwidthPackage("bwp-new", "BGP"),
+			wantCalls:    []string{"vpc.DescribeBandwidthPackages", "vpc.DescribeBandwidthPackages", "vpc.AddBandwidthPackageResources"},
+			wantPackages: []string{"bwp-new"},
+		},
+		{
+			name:    "clb moved to the package",
+			current: []map[string]interface{}{fakeBandwidthPackage("bwp-old", "BGP", "lb-1")},
+			target:  fakeBandwidthPackage("bwp-new", "BGP"),
+			wantCalls: []string{"vpc.DescribeBandwidthPackages", "vpc.DescribeBandwidthPackages", "vpc.RemoveBandwidthPackageResources",
+				"vpc.AddBandwidthPackageResources"},
+			wantEvents:   []string{"BandwidthPackageChanged"},
+			wantPackages: []string{"bwp-new"},
+		},
+		{
+			name:     "clb put back if the move fails",
+			current:  []map[string]interface{}{fakeBandwidthPackage("bwp-old", "BGP", "lb-1")},
+			target:   fakeBandwidthPackage("bwp-new", "BGP"),
+			failAdds: map[string]bool{"bwp-new": true},
+			wantCalls: []string{"vpc.DescribeBandwidthPackages", "vpc.DescribeBandwidthPackages", "vpc.RemoveBandwidthPackageResources",
+				"vpc.AddBandwidthPackageResources", "vpc.AddBandwidthPackageResources"},
+			wantErr:      true,
+			wantPackages: []string{"bwp-new", "bwp-old"},
+		},
+		{
+			name:     "clb lost if it can't be put back",
+			current:  []map[string]interface{}{fakeBandwidthPackage("bwp-old", "BGP", "lb-1")},
+			target:   fakeBandwidthPackage("bwp-new", "BGP"),
+			failAdds: map[string]bool{"bwp-new": true, "bwp-old": true},
+			wantCalls: []string{"vpc.DescribeBandwidthPackages", "vpc.DescribeBandwidthPackages", "vpc.RemoveBandwidthPackageResources",
+				"vpc.AddBandwidthPackageResources", "vpc.AddBandwidthPackageResources"},
+			wantErr:      true,
+			wantEvents:   []string{"BandwidthPackageLost"},
+			wantPackages: []string{"bwp-new", "bwp-old"},
+		},
+		{
+			name:       "clb kept in a package of another network type",
+			current:    []map[string]interface{}{fakeBandwidthPackage("bwp-old", "SINGLEISP", "lb-1")},
+			target:     fakeBandwidthPackage("bwp-new", "BGP"),
+			wantCalls:  []string{"vpc.DescribeBandwidthPackages", "vpc.DescribeBandwidthPackages"},
+			wantEvents: []string{"BandwidthPackageNotChanged"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("vpc.DescribeBandwidthPackages", func(params url.Values) interface{} {
+				packages := test.current
+				if params.Get("BandwidthPackageIds.0") != "" {
+					packages = []map[string]interface{}{test.target}
+				}
+				return v3Response(map[string]interface{}{"TotalCount": len(packages), "BandwidthPackageSet": packages})
+			})
+			api.handle("vpc.AddBandwidthPackageResources", func(params url.Values) interface{} {
+				if test.failAdds[params.Get("BandwidthPackageId")] {
+					return v3Error("InternalError", "internal error")
+				}
+				return v3Response(map[string]interface{}{})
+			})
+			api.handle("vpc.RemoveBandwidthPackageResources", func(url.Values) interface{} {
+				return v3Response(map[string]interface{}{})
+			})
+			cloud, recorder := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(map[string]string{ServiceAnnotationLoadBalancerBandwidthPackageId: "bwp-new"})
+			err := cloud.ensureLoadBalancerBandwidthPackage(service, &clb.LoadBalancer{LoadBalancerId: "lb-1"})
+			if (err != nil) != test.wantErr {
+				t.Errorf("ensureLoadBalancerBandwidthPackage = %v, want error %t", err, test.wantErr)
+			}
+
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %s", got, strings.Join(test.wantCalls, ","))
+			}
+			added := []string{}
+			for _, call := range api.callsOf("vpc.AddBandwidthPackageResources") {
+				added = append(added, call.Get("BandwidthPackageId"))
+			}
+			if strings.Join(added, ",") != strings.Join(test.wantPackages, ",") {
+				t.Errorf("clb added to packages %v, want %v", added, test.wantPackages)
+			}
+			events := drainEvents(recorder)
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("events %v, want %v", events, test.wantEvents)
+			}
+			for i, event := range events {
+				if !strings.Contains(event, test.wantEvents[i]) {
+					t.Errorf("event %q, want %s", event, test.wantEvents[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	defaultReconcileTaskAndLookupBudget = 500
+	// backgroundReconcileTimeout bounds the syncs of clbs the provider starts itself. They hold the lock of the
+	// service, a sync hanging on the api would hold up the service controller. The service controller gives its
+	// own reconciles no deadline, they are bounded by the budget of tasks and lookups only.
+	backgroundReconcileTimeout = 5 * time.Minute
+)
+
+var (
+	// reconcileCallsMax is the most clb tasks and instance lookups a single reconcile made since the start, a
+	// value close to the budget tells which specs are about to be refused.
+	reconcileCallsMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: providerName,
+			Name:      "reconcile_tasks_and_lookups_max",
+			Help:      "Most clb tasks started plus DescribeInstances attempts made by a single loadbalancer reconcile.",
+		},
+		[]string{"operation"},
+	)
+	reconcileCallsMaxLock sync.Mutex
+	reconcileCallsMaxSeen = map[string]int32{}
+)
+
+func init() {
+	prometheus.MustRegister(reconcileCallsMax)
+}
+
+type callBudgetKey struct{}
+
+// callBudget counts the clb tasks and instance lookups of a reconcile. They are counted by the wrappers taking a
+// context, waitUntilDone, invokeClbV3Task and describeInstances. The sdk builds its requests without a context,
+// so other describe calls can't be told apart by reconcile and are not counted.
+type callBudget struct {
+	limit int32
+	calls int32
+}
+
+// callBudgetExceededError aborts a reconcile which used up its budget.
+type callBudgetExceededError struct {
+	limit int32
+}
+
+func (e *callBudgetExceededError) Error() string {
+	return fmt.Sprintf("reconcile exceeded its budget of %d clb tasks and instance lookups, see reconcile_task_and_lookup_budget", e.limit)
+}
+
+// withCallBudget returns a context counting the clb tasks and instance lookups made with it against the configured budget.
+func (cloud *Cloud) withCallBudget(ctx context.Context) (context.Context, *callBudget) {
+	limit := cloud.config.ReconcileTaskAndLookupBudget
+	if limit == 0 {
+		limit = defaultReconcileTaskAndLookupBudget
+	}
+	budget := &callBudget{limit: int32(limit)}
+	return context.WithValue(ctx, callBudgetKey{}, budget), budget
+}
+
+// withBackgroundReconcile returns the context of a sync of a clb the provider starts itself, bounded by
+// backgroundReconcileTimeout and counting its tasks and lookups against the budget like reconciles of the service controller.
+func (cloud *Cloud) withBackgroundReconcile() (context.Context, context.CancelFunc, *callBudget) {
+	ctx, cancel := context.WithTimeout(context.Background(), backgroundReconcileTimeout)
+	ctx, budget := cloud.withCallBudget(withDescribedLoadBalancers(ctx))
+	return ctx, cancel, budget
+}
+
+// spendCall counts a clb task or instance lookup against the budget of ctx, if it has one, and fails once the
+// budget is used up.
+func spendCall(ctx context.Context) error {
+	budget, ok := ctx.Value(callBudgetKey{}).(*callBudget)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt32(&budget.calls, 1) > budget.limit {
+		return &callBudgetExceededError{limit: budget.limit}
+	}
+	return nil
+}
+
+// endCallBudget records the calls of the reconcile of the service and records an event for an exceeded budget.
+// The error is retried like any other: the tasks and lookups of a sync depend on the nodes as much as on the spec,
+// and the backends registered before the budget ran out stay registered, so the next sync needs fewer of them.
+func (cloud *Cloud) endCallBudget(service *v1.Service, operation string, budget *callBudget, err error) error {
+	calls := atomic.LoadInt32(&budget.calls)
+	reconcileCallsMaxLock.Lock()
+	if calls > reconcileCallsMaxSeen[operation] {
+		reconcileCallsMaxSeen[operation] = calls
+		reconcileCallsMax.WithLabelValues(operation).Set(float64(calls))
+	}
+	reconcileCallsMaxLock.Unlock()
+
+	exceeded, ok := err.(*callBudgetExceededError)
+	if !ok {
+		return err
+	}
+	cloud.recorder.Eventf(service, v1.EventTypeWarning, "TaskAndLookupBudgetExceeded",
+		"Syncing the loadbalancer needs more than %d clb tasks and instance lookups, reduce the ports or per port annotations of the service or raise reconcile_task_and_lookup_budget",
+		exceeded.limit)
+	return err
+}
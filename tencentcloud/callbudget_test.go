@@ -0,0 +1,90 @@
+package tencentcloud
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestCallBudget(t *testing.T) {
+	tests := []struct {
+		name string
+		// call makes one counted call
+		call       func(ctx context.Context, cloud *Cloud) error
+		wantAction string
+	}{
+		{"legacy clb task", func(ctx context.Context, cloud *Cloud) error {
+			_, err := waitUntilDone(ctx, func() (clb.AsyncTask, error) {
+				return cloud.clb.DeleteLoadBalancers([]string{"lb-1"})
+			}, cloud.clb)
+			return err
+		}, "clb.DeleteLoadBalancers"},
+		{"v3 clb task", func(ctx context.Context, cloud *Cloud) error {
+			return cloud.enableLoadBalancerSnatPro(ctx, "lb-1")
+		}, "clbv3.ModifyLoadBalancerAttributes"},
+		{"instance lookup", func(ctx context.Context, cloud *Cloud) error {
+			_, err := describeInstances(ctx, cloud.cvm, &cvm.DescribeInstancesArgs{
+				Version: cvm.DefaultVersion,
+				Filters: &[]cvm.Filter{cvm.NewFilter(cvm.FilterNameInstanceId, "ins-1")},
+			})
+			return err
+		}, "cvm.DescribeInstances"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DeleteLoadBalancers", legacyTask)
+			api.handle("clbv3.ModifyLoadBalancerAttributes", v3Task)
+			api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+			api.handle("cvm.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			cloud, _ := newTestCloud(t, Config{ReconcileTaskAndLookupBudget: 1}, api, nil)
+			ctx, budget := cloud.withCallBudget(context.Background())
+
+			if err := test.call(ctx, cloud); err != nil {
+				t.Fatalf("call within the budget failed: %v", err)
+			}
+			if _, ok := test.call(ctx, cloud).(*callBudgetExceededError); !ok {
+				t.Errorf("call beyond the budget not refused")
+			}
+			if got := len(api.callsOf(test.wantAction)); got != 1 {
+				t.Errorf("%d calls of %s, want the call beyond the budget not made", got, test.wantAction)
+			}
+			if budget.calls != 2 {
+				t.Errorf("%d calls counted, want 2", budget.calls)
+			}
+		})
+	}
+}
+
+func TestEndCallBudgetExceeded(t *testing.T) {
+	api := newFakeApi(t)
+	defer api.close()
+	cloud, recorder := newTestCloud(t, Config{ReconcileTaskAndLookupBudget: 1}, api, nil)
+	service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+	ctx, budget := cloud.withCallBudget(context.Background())
+	spendCall(ctx)
+
+	err := cloud.endCallBudget(service, "ensure", budget, spendCall(ctx))
+	if _, ok := err.(*callBudgetExceededError); !ok {
+		t.Fatalf("error %v, want the exceeded budget", err)
+	}
+	// the spec isn't to blame, the number of tasks depends on the nodes and shrinks with every attempt
+	if isSpecError(err) {
+		t.Errorf("exceeded budget reported as a spec error")
+	}
+	cloud.specErrors.record("ensure", service, err)
+	if err := cloud.specErrors.check("ensure", service); err != nil {
+		t.Errorf("service with an exceeded budget not retried: %v", err)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.Contains(events[0], "TaskAndLookupBudgetExceeded") {
+		t.Errorf("events %v, want a TaskAndLookupBudgetExceeded event", events)
+	}
+}
@@ -0,0 +1,83 @@
+package tencentcloud
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+)
+
+const (
+	// LabelMaxEni is the number of enis the instance type supports, as DescribeNetworkInterfaceLimit reports it.
+	LabelMaxEni = "node.tencentcloud.com/max-eni"
+	// LabelMaxIpsPerEni is the number of private ips each eni of the instance type supports.
+	LabelMaxIpsPerEni = "node.tencentcloud.com/max-ips-per-eni"
+)
+
+// eniCapacity is the eni quota of an instance type
+type eniCapacity struct {
+	MaxEni       int
+	MaxIpsPerEni int
+}
+
+// eniCapacityCache remembers the eni capacity of every instance type seen, so the capacity of a node
+// is only looked up again when its instance type changes. Types the api has no quota for are remembered
+// as unknown.
+type eniCapacityCache struct {
+	lock       sync.Mutex
+	capacities map[string]*eniCapacity
+}
+
+type describeNetworkInterfaceLimitArgs struct {
+	Version    string `qcloud_arg:"Version,required"`
+	InstanceId string `qcloud_arg:"InstanceId,required"`
+}
+
+type describeNetworkInterfaceLimitResponse struct {
+	EniQuantity                 int    `json:"EniQuantity"`
+	EniPrivateIpAddressQuantity int    `json:"EniPrivateIpAddressQuantity"`
+	RequestID                   string `json:"RequestId"`
+}
+
+// getEniCapacity returns the eni capacity of the type of the instance, false if it is unknown. The vpc api
+// reports the quota per instance, it is asked for the first instance of every type.
+func (cloud *Cloud) getEniCapacity(instance *cvm.InstanceInfo) (eniCapacity, bool) {
+	cloud.eniCapacities.lock.Lock()
+	defer cloud.eniCapacities.lock.Unlock()
+
+	if capacity, ok := cloud.eniCapacities.capacities[instance.InstanceType]; ok {
+		if capacity == nil {
+			return eniCapacity{}, false
+		}
+		return *capacity, true
+	}
+
+	response := &describeNetworkInterfaceLimitResponse{}
+	err := cloud.vpc.Invoke("DescribeNetworkInterfaceLimit", &describeNetworkInterfaceLimitArgs{
+		Version:    VpcDefaultVersion,
+		InstanceId: instance.InstanceID,
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		// don't cache, the type may be resolved on the next attempt
+		glog.Warningf("failed to describe the eni limit of instance %s of type %s, leaving its eni capacity labels unset: %v",
+			instance.InstanceID, instance.InstanceType, err)
+		return eniCapacity{}, false
+	}
+
+	if response.EniQuantity <= 0 || response.EniPrivateIpAddressQuantity <= 0 {
+		glog.Warningf("eni capacity of instance type %s is unknown, leaving the eni capacity labels of its nodes unset", instance.InstanceType)
+		cloud.eniCapacities.capacities[instance.InstanceType] = nil
+		return eniCapacity{}, false
+	}
+	capacity := &eniCapacity{MaxEni: response.EniQuantity, MaxIpsPerEni: response.EniPrivateIpAddressQuantity}
+	cloud.eniCapacities.capacities[instance.InstanceType] = capacity
+	return *capacity, true
+}
+
+func (capacity eniCapacity) labels() map[string]string {
+	return map[string]string{
+		LabelMaxEni:       strconv.Itoa(capacity.MaxEni),
+		LabelMaxIpsPerEni: strconv.Itoa(capacity.MaxIpsPerEni),
+	}
+}
@@ -0,0 +1,95 @@
+package tencentcloud
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+func TestNodeLabelsEniCapacity(t *testing.T) {
+	tests := []struct {
+		name string
+		// limits answer DescribeNetworkInterfaceLimit by instance id, an instance without limits gets an api error
+		limits map[string][2]int
+		// instances are labeled in order, by id and type
+		instances  [][2]string
+		wantLabels []map[string]string
+		wantCalls  []string
+	}{
+		{
+			name:       "limits of the instance type",
+			limits:     map[string][2]int{"ins-1": {4, 10}},
+			instances:  [][2]string{{"ins-1", "S5.LARGE8"}},
+			wantLabels: []map[string]string{{LabelMaxEni: "4", LabelMaxIpsPerEni: "10"}},
+			wantCalls:  []string{"ins-1"},
+		},
+		{
+			name:      "limits cached per instance type",
+			limits:    map[string][2]int{"ins-1": {4, 10}, "ins-2": {4, 10}, "ins-3": {8, 20}},
+			instances: [][2]string{{"ins-1", "S5.LARGE8"}, {"ins-2", "S5.LARGE8"}, {"ins-3", "S5.2XLARGE16"}},
+			wantLabels: []map[string]string{
+				{LabelMaxEni: "4", LabelMaxIpsPerEni: "10"},
+				{LabelMaxEni: "4", LabelMaxIpsPerEni: "10"},
+				{LabelMaxEni: "8", LabelMaxIpsPerEni: "20"},
+			},
+			wantCalls: []string{"ins-1", "ins-3"},
+		},
+		{
+			name:       "unknown instance type",
+			limits:     map[string][2]int{"ins-1": {0, 0}, "ins-2": {0, 0}},
+			instances:  [][2]string{{"ins-1", "X1.UNKNOWN"}, {"ins-2", "X1.UNKNOWN"}},
+			wantLabels: []map[string]string{{}, {}},
+			wantCalls:  []string{"ins-1"},
+		},
+		{
+			name:       "limits not described",
+			limits:     map[string][2]int{"ins-2": {4, 10}},
+			instances:  [][2]string{{"ins-1", "S5.LARGE8"}, {"ins-2", "S5.LARGE8"}},
+			wantLabels: []map[string]string{{}, {LabelMaxEni: "4", LabelMaxIpsPerEni: "10"}},
+			wantCalls:  []string{"ins-1", "ins-2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("vpc.DescribeNetworkInterfaceLimit", func(params url.Values) interface{} {
+				limit, ok := test.limits[params.Get("InstanceId")]
+				if !ok {
+					return v3Error("InternalError", "internal error")
+				}
+				return v3Response(map[string]interface{}{"EniQuantity": limit[0], "EniPrivateIpAddressQuantity": limit[1]})
+			})
+			cloud, _ := newTestCloud(t, Config{EnableEniCapacityLabels: true}, api, nil)
+
+			for i, instance := range test.instances {
+				labels, err := cloud.nodeLabels(fakeNode("node"), &cvm.InstanceInfo{InstanceID: instance[0], InstanceType: instance[1]})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(labels) != len(test.wantLabels[i]) {
+					t.Errorf("instance %s labeled %v, want %v", instance[0], labels, test.wantLabels[i])
+				}
+				for key, value := range test.wantLabels[i] {
+					if labels[key] != value {
+						t.Errorf("instance %s labeled %v, want %v", instance[0], labels, test.wantLabels[i])
+					}
+				}
+			}
+
+			calls := []string{}
+			for _, call := range api.callsOf("vpc.DescribeNetworkInterfaceLimit") {
+				calls = append(calls, call.Get("InstanceId"))
+			}
+			if len(calls) != len(test.wantCalls) {
+				t.Fatalf("limits described for %v, want %v", calls, test.wantCalls)
+			}
+			for i := range calls {
+				if calls[i] != test.wantCalls[i] {
+					t.Errorf("limits described for %v, want %v", calls, test.wantCalls)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	clbIsolationIsolated = 1
+)
+
+// loadBalancerAbnormalError is returned for a clb the api reports as unusable, every change to it would fail.
+type loadBalancerAbnormalError struct {
+	LoadBalancerId string
+	State          string
+	RequestId      string
+}
+
+func (e *loadBalancerAbnormalError) Error() string {
+	return fmt.Sprintf("loadbalancer %s is %s (RequestId %s)", e.LoadBalancerId, e.State, e.RequestId)
+}
+
+// checkLoadBalancerState returns a loadBalancerAbnormalError if the clb is isolated, usually for an overdue
+// account, or blocked. The clb is described once per reconcile, the description is reused by what follows.
+func (cloud *Cloud) checkLoadBalancerState(ctx context.Context, loadBalancer *clb.LoadBalancer) error {
+	response, err := cloud.describeLoadBalancerV3Once(ctx, loadBalancer.LoadBalancerId)
+	if err != nil {
+		return err
+	}
+
+	state := ""
+	switch described := response.LoadBalancerSet[0]; {
+	case described.Isolation == clbIsolationIsolated:
+		state = "isolated"
+	case described.IsBlock:
+		state = "blocked"
+	default:
+		return nil
+	}
+	return &loadBalancerAbnormalError{
+		LoadBalancerId: loadBalancer.LoadBalancerId,
+		State:          state,
+		RequestId:      response.RequestID,
+	}
+}
+
+// reportAbnormalLoadBalancer records an event for an abnormal clb, so the clb rather than the service is looked
+// at. Only EnsureLoadBalancer recreates abnormal clbs.
+func (cloud *Cloud) reportAbnormalLoadBalancer(service *v1.Service, err *loadBalancerAbnormalError, recreating bool) {
+	if recreating {
+		cloud.recorder.Eventf(service, v1.EventTypeWarning, "LoadBalancerAbnormal", "%v, recreating it", err)
+		return
+	}
+	cloud.recorder.Eventf(service, v1.EventTypeWarning, "LoadBalancerAbnormal", "%v, check the loadbalancer in the console", err)
+}
+
+type describedLoadBalancersKey struct{}
+
+// describedLoadBalancers remembers the clbs described by the v3 api during a reconcile, so the state, snat ips
+// and subnet of a clb cost a single call. Changes the reconcile makes to them drop the description.
+type describedLoadBalancers struct {
+	lock      sync.Mutex
+	responses map[string]*describeLoadBalancersV3Response
+}
+
+// withDescribedLoadBalancers returns a context remembering the clbs described with it.
+func withDescribedLoadBalancers(ctx context.Context) context.Context {
+	return context.WithValue(ctx, describedLoadBalancersKey{}, &describedLoadBalancers{responses: map[string]*describeLoadBalancersV3Response{}})
+}
+
+// describeLoadBalancerV3Once returns the clb as described earlier in the reconcile of ctx, describing it if it wasn't.
+func (cloud *Cloud) describeLoadBalancerV3Once(ctx context.Context, loadBalancerId string) (*describeLoadBalancersV3Response, error) {
+	described, ok := ctx.Value(describedLoadBalancersKey{}).(*describedLoadBalancers)
+	if !ok {
+		return cloud.describeLoadBalancerV3(loadBalancerId)
+	}
+	described.lock.Lock()
+	defer described.lock.Unlock()
+	if response, ok := described.responses[loadBalancerId]; ok {
+		return response, nil
+	}
+	response, err := cloud.describeLoadBalancerV3(loadBalancerId)
+	if err != nil {
+		return nil, err
+	}
+	described.responses[loadBalancerId] = response
+	return response, nil
+}
+
+// forgetLoadBalancerDescription drops the description of the clb remembered by ctx after the clb was changed.
+func forgetLoadBalancerDescription(ctx context.Context, loadBalancerId string) {
+	if described, ok := ctx.Value(describedLoadBalancersKey{}).(*describedLoadBalancers); ok {
+		described.lock.Lock()
+		delete(described.responses, loadBalancerId)
+		described.lock.Unlock()
+	}
+}
@@ -0,0 +1,105 @@
+package tencentcloud
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestUpdateLoadBalancerState(t *testing.T) {
+	tests := []struct {
+		name string
+		// described answers DescribeLoadBalancers of the clb v3 api
+		described    map[string]interface{}
+		wantAbnormal bool
+		wantErr      bool
+		wantEvents   int
+	}{
+		{"isolated clb", v3Response(map[string]interface{}{"LoadBalancerSet": []map[string]interface{}{{"LoadBalancerId": "lb-1", "Isolation": 1}}}), true, true, 1},
+		{"blocked clb", v3Response(map[string]interface{}{"LoadBalancerSet": []map[string]interface{}{{"LoadBalancerId": "lb-1", "IsBlock": true}}}), true, true, 1},
+		{"describe failed", v3Error("InternalError", "internal error"), false, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []map[string]interface{}{
+					{"loadBalancerId": "lb-1", "forward": ClbLoadBalancerKindApplication},
+				}})
+			})
+			api.handle("clbv3.DescribeLoadBalancers", func(url.Values) interface{} { return test.described })
+			cloud, recorder := newTestCloud(t, Config{RecreateAbnormalLoadBalancer: true}, api, nil)
+
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			err := cloud.updateLoadBalancer(withDescribedLoadBalancers(context.Background()), "kubernetes", service, nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("updateLoadBalancer returned %v, want an error %t", err, test.wantErr)
+			}
+			if _, abnormal := err.(*loadBalancerAbnormalError); abnormal != test.wantAbnormal {
+				t.Errorf("updateLoadBalancer returned %v, want abnormal %t", err, test.wantAbnormal)
+			}
+			if got := len(api.callsOf("clbv3.DescribeLoadBalancers")); got != 1 {
+				t.Errorf("clb described %d times, want once", got)
+			}
+			events := drainEvents(recorder)
+			if len(events) != test.wantEvents {
+				t.Fatalf("events %v, want %d", events, test.wantEvents)
+			}
+			for _, event := range events {
+				if strings.Contains(event, "recreating") {
+					t.Errorf("event %q announces a recreation the update doesn't make", event)
+				}
+			}
+		})
+	}
+}
+
+func TestDescribeLoadBalancerV3Once(t *testing.T) {
+	tests := []struct {
+		name string
+		// enable enables snat pro between the state check and the snat ip lookup
+		enable        bool
+		memo          bool
+		wantDescribed int
+	}{
+		{"described once per reconcile", false, true, 1},
+		{"described again once changed", true, true, 2},
+		{"described every time without a reconcile", false, false, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+			api.handle("clbv3.ModifyLoadBalancerAttributes", v3Task)
+			api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			ctx := context.Background()
+			if test.memo {
+				ctx = withDescribedLoadBalancers(ctx)
+			}
+			if err := cloud.checkLoadBalancerState(ctx, &clb.LoadBalancer{LoadBalancerId: "lb-1"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.enable {
+				if err := cloud.enableLoadBalancerSnatPro(ctx, "lb-1"); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if _, _, err := cloud.describeLoadBalancerSnatIps(ctx, "lb-1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := len(api.callsOf("clbv3.DescribeLoadBalancers")); got != test.wantDescribed {
+				t.Errorf("clb described %d times, want %d", got, test.wantDescribed)
+			}
+		})
+	}
+}
@@ -0,0 +1,507 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+)
+
+const (
+	ClbV3Host = "clb.tencentcloudapi.com"
+	ClbV3Path = "/"
+
+	ClbV3DefaultVersion = "2018-03-17"
+)
+
+// qcloudapi-sdk-go only ships the legacy clb api, which can't manage the security groups or snat ips of a clb.
+// The clb v3 api is called through the common client, clb ids are the same in both apis.
+
+type clbV3Response struct {
+	Response interface{} `json:"Response"`
+}
+
+type describeLoadBalancersV3Args struct {
+	Version         string   `qcloud_arg:"Version,required"`
+	LoadBalancerIds []string `qcloud_arg:"LoadBalancerIds,required"`
+}
+
+type describeLoadBalancersV3Response struct {
+	LoadBalancerSet []struct {
+		LoadBalancerId string   `json:"LoadBalancerId"`
+		SecureGroups   []string `json:"SecureGroups"`
+		SnatPro        bool     `json:"SnatPro"`
+		SnatIps        []snatIp `json:"SnatIps"`
+		SubnetId       string   `json:"SubnetId"`
+		Isolation      int      `json:"Isolation"`
+		IsBlock        bool     `json:"IsBlock"`
+	} `json:"LoadBalancerSet"`
+	RequestID string `json:"RequestId"`
+}
+
+type describeLoadBalancersByBackendArgs struct {
+	Version           string   `qcloud_arg:"Version,required"`
+	BackendPrivateIps []string `qcloud_arg:"BackendPrivateIps,required"`
+	Limit             int      `qcloud_arg:"Limit"`
+}
+
+type describeLoadBalancersByBackendResponse struct {
+	TotalCount      int `json:"TotalCount"`
+	LoadBalancerSet []struct {
+		LoadBalancerId   string   `json:"LoadBalancerId"`
+		LoadBalancerName string   `json:"LoadBalancerName"`
+		LoadBalancerVips []string `json:"LoadBalancerVips"`
+	} `json:"LoadBalancerSet"`
+	RequestID string `json:"RequestId"`
+}
+
+type setLoadBalancerSecurityGroupsArgs struct {
+	Version        string   `qcloud_arg:"Version,required"`
+	LoadBalancerId string   `qcloud_arg:"LoadBalancerId,required"`
+	SecurityGroups []string `qcloud_arg:"SecurityGroups"`
+}
+
+type clbV3RequestResponse struct {
+	RequestID string `json:"RequestId"`
+}
+
+type snatIp struct {
+	SubnetId string `json:"SubnetId"`
+	Ip       string `json:"Ip"`
+}
+
+type modifyLoadBalancerSnatProArgs struct {
+	Version        string `qcloud_arg:"Version,required"`
+	LoadBalancerId string `qcloud_arg:"LoadBalancerId,required"`
+	SnatPro        bool   `qcloud_arg:"SnatPro"`
+}
+
+type createLoadBalancerSnatIpsArgs struct {
+	Version        string         `qcloud_arg:"Version,required"`
+	LoadBalancerId string         `qcloud_arg:"LoadBalancerId,required"`
+	SnatIps        []snatIpSubnet `qcloud_arg:"SnatIps,required"`
+}
+
+// snatIpSubnet asks for a snat ip allocated from the subnet, an empty ip would be rejected.
+type snatIpSubnet struct {
+	SubnetId string `qcloud_arg:"SubnetId"`
+}
+
+type deleteLoadBalancerSnatIpsArgs struct {
+	Version        string   `qcloud_arg:"Version,required"`
+	LoadBalancerId string   `qcloud_arg:"LoadBalancerId,required"`
+	Ips            []string `qcloud_arg:"Ips,required"`
+}
+
+type describeTargetsArgs struct {
+	Version        string `qcloud_arg:"Version,required"`
+	LoadBalancerId string `qcloud_arg:"LoadBalancerId,required"`
+}
+
+type describeTargetsResponse struct {
+	Listeners []struct {
+		ListenerId string `json:"ListenerId"`
+		Targets    []struct {
+			Type               string   `json:"Type"`
+			Port               int      `json:"Port"`
+			PrivateIpAddresses []string `json:"PrivateIpAddresses"`
+		} `json:"Targets"`
+	} `json:"Listeners"`
+	RequestID string `json:"RequestId"`
+}
+
+type targetsArgs struct {
+	Version        string      `qcloud_arg:"Version,required"`
+	LoadBalancerId string      `qcloud_arg:"LoadBalancerId,required"`
+	ListenerId     string      `qcloud_arg:"ListenerId,required"`
+	Targets        []eniTarget `qcloud_arg:"Targets,required"`
+}
+
+// eniTarget is a backend registered by its ip rather than its instance id.
+type eniTarget struct {
+	EniIp string `qcloud_arg:"EniIp"`
+	Port  int    `qcloud_arg:"Port"`
+}
+
+type describeQuotaArgs struct {
+	Version string `qcloud_arg:"Version,required"`
+}
+
+type describeQuotaResponse struct {
+	QuotaSet []struct {
+		QuotaId      string `json:"QuotaId"`
+		QuotaCurrent *int   `json:"QuotaCurrent"`
+		QuotaLimit   int    `json:"QuotaLimit"`
+	} `json:"QuotaSet"`
+	RequestID string `json:"RequestId"`
+}
+
+type describeListenersV3Args struct {
+	Version        string `qcloud_arg:"Version,required"`
+	LoadBalancerId string `qcloud_arg:"LoadBalancerId,required"`
+}
+
+type describeListenersV3Response struct {
+	Listeners []struct {
+		ListenerId  string         `json:"ListenerId"`
+		Protocol    string         `json:"Protocol"`
+		Port        int            `json:"Port"`
+		EndPort     int            `json:"EndPort"`
+		HealthCheck *healthCheckV3 `json:"HealthCheck"`
+	} `json:"Listeners"`
+	RequestID string `json:"RequestId"`
+}
+
+type createListenerV3Args struct {
+	Version        string         `qcloud_arg:"Version,required"`
+	LoadBalancerId string         `qcloud_arg:"LoadBalancerId,required"`
+	Ports          []int32        `qcloud_arg:"Ports,required"`
+	Protocol       string         `qcloud_arg:"Protocol,required"`
+	ListenerNames  []string       `qcloud_arg:"ListenerNames"`
+	EndPort        *int32         `qcloud_arg:"EndPort"`
+	HealthCheck    *healthCheckV3 `qcloud_arg:"HealthCheck"`
+}
+
+type modifyListenerHealthCheckV3Args struct {
+	Version        string         `qcloud_arg:"Version,required"`
+	LoadBalancerId string         `qcloud_arg:"LoadBalancerId,required"`
+	ListenerId     string         `qcloud_arg:"ListenerId,required"`
+	HealthCheck    *healthCheckV3 `qcloud_arg:"HealthCheck,required"`
+}
+
+// healthCheckV3 is the health check of a listener in the clb v3 api, the http fields are left out of port checks.
+type healthCheckV3 struct {
+	HealthSwitch  int     `qcloud_arg:"HealthSwitch" json:"HealthSwitch"`
+	TimeOut       int     `qcloud_arg:"TimeOut" json:"TimeOut"`
+	IntervalTime  int     `qcloud_arg:"IntervalTime" json:"IntervalTime"`
+	HealthNum     int     `qcloud_arg:"HealthNum" json:"HealthNum"`
+	UnHealthNum   int     `qcloud_arg:"UnHealthNum" json:"UnHealthNum"`
+	CheckType     *string `qcloud_arg:"CheckType" json:"CheckType"`
+	CheckPort     *int    `qcloud_arg:"CheckPort" json:"CheckPort"`
+	HttpCheckPath *string `qcloud_arg:"HttpCheckPath" json:"HttpCheckPath"`
+	HttpCode      *int    `qcloud_arg:"HttpCode" json:"HttpCode"`
+	HttpVersion   *string `qcloud_arg:"HttpVersion" json:"HttpVersion"`
+}
+
+// healthCheckV3Of returns the v3 health check of the listener.
+func healthCheckV3Of(healthCheck listenerHealthCheck) *healthCheckV3 {
+	v3 := &healthCheckV3{
+		HealthSwitch: healthCheck.HealthSwitch,
+		TimeOut:      healthCheck.TimeOut,
+		IntervalTime: healthCheck.IntervalTime,
+		HealthNum:    healthCheck.HealthNum,
+		UnHealthNum:  healthCheck.UnhealthNum,
+	}
+	if healthCheck.CheckType == healthCheckTypeHTTP {
+		checkType, checkPort, path, code, version := healthCheckTypeHTTP, healthCheck.CheckPort, healthCheckPath, healthCheck.HttpCodes, "HTTP/1.1"
+		v3.CheckType = &checkType
+		v3.CheckPort = &checkPort
+		v3.HttpCheckPath = &path
+		v3.HttpCode = &code
+		v3.HttpVersion = &version
+	}
+	return v3
+}
+
+// listenerHealthCheckOfV3 returns the health check described by the v3 api. Checks of the backend port are
+// described with the check type of the listener protocol, they are all port checks here.
+func listenerHealthCheckOfV3(v3 *healthCheckV3) listenerHealthCheck {
+	if v3 == nil {
+		return listenerHealthCheck{}
+	}
+	healthCheck := listenerHealthCheck{
+		HealthSwitch: v3.HealthSwitch,
+		TimeOut:      v3.TimeOut,
+		IntervalTime: v3.IntervalTime,
+		HealthNum:    v3.HealthNum,
+		UnhealthNum:  v3.UnHealthNum,
+	}
+	if v3.CheckType != nil && *v3.CheckType == healthCheckTypeHTTP {
+		healthCheck.CheckType = healthCheckTypeHTTP
+		if v3.CheckPort != nil {
+			healthCheck.CheckPort = *v3.CheckPort
+		}
+		if v3.HttpCode != nil {
+			healthCheck.HttpCodes = *v3.HttpCode
+		}
+	}
+	return healthCheck
+}
+
+type describeTaskStatusArgs struct {
+	Version string `qcloud_arg:"Version,required"`
+	TaskId  string `qcloud_arg:"TaskId,required"`
+}
+
+type describeTaskStatusResponse struct {
+	Status    int    `json:"Status"`
+	RequestID string `json:"RequestId"`
+}
+
+func newClbV3Client(credential common.CredentialInterface, region string) (*common.Client, error) {
+	return common.NewClient(credential, common.Opts{Region: region, Host: ClbV3Host, Path: ClbV3Path})
+}
+
+func (cloud *Cloud) describeLoadBalancerSecurityGroups(loadBalancerId string) ([]string, error) {
+	response, err := cloud.describeLoadBalancerV3(loadBalancerId)
+	if err != nil {
+		return nil, err
+	}
+	return response.LoadBalancerSet[0].SecureGroups, nil
+}
+
+// describeLoadBalancerSnatIps returns whether snat pro is enabled on the clb and its snat ips.
+func (cloud *Cloud) describeLoadBalancerSnatIps(ctx context.Context, loadBalancerId string) (bool, []snatIp, error) {
+	response, err := cloud.describeLoadBalancerV3Once(ctx, loadBalancerId)
+	if err != nil {
+		return false, nil, err
+	}
+	return response.LoadBalancerSet[0].SnatPro, response.LoadBalancerSet[0].SnatIps, nil
+}
+
+// describeLoadBalancerSubnet returns the subnet of a private clb, the legacy api only knows its numeric id.
+func (cloud *Cloud) describeLoadBalancerSubnet(ctx context.Context, loadBalancerId string) (string, error) {
+	response, err := cloud.describeLoadBalancerV3Once(ctx, loadBalancerId)
+	if err != nil {
+		return "", err
+	}
+	return response.LoadBalancerSet[0].SubnetId, nil
+}
+
+// describeLoadBalancerV3 returns a response whose LoadBalancerSet holds exactly the clb.
+func (cloud *Cloud) describeLoadBalancerV3(loadBalancerId string) (*describeLoadBalancersV3Response, error) {
+	response := &describeLoadBalancersV3Response{}
+	err := cloud.clbV3.Invoke("DescribeLoadBalancers", &describeLoadBalancersV3Args{
+		Version:         ClbV3DefaultVersion,
+		LoadBalancerIds: []string{loadBalancerId},
+	}, &clbV3Response{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	for i := range response.LoadBalancerSet {
+		if response.LoadBalancerSet[i].LoadBalancerId == loadBalancerId {
+			response.LoadBalancerSet = response.LoadBalancerSet[i : i+1]
+			return response, nil
+		}
+	}
+	return nil, ErrCloudLoadBalancerNotFound
+}
+
+// describeLoadBalancersByBackend returns the clbs having a backend at any of the private ips, the first page
+// of up to 100 clbs and the total count.
+func (cloud *Cloud) describeLoadBalancersByBackend(ips []string) (*describeLoadBalancersByBackendResponse, error) {
+	response := &describeLoadBalancersByBackendResponse{}
+	err := cloud.clbV3.Invoke("DescribeLoadBalancers", &describeLoadBalancersByBackendArgs{
+		Version:           ClbV3DefaultVersion,
+		BackendPrivateIps: ips,
+		Limit:             100,
+	}, &clbV3Response{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// setLoadBalancerSecurityGroups replaces the security groups bound to the clb, none unbinds all of them.
+func (cloud *Cloud) setLoadBalancerSecurityGroups(loadBalancerId string, securityGroupIds []string) error {
+	return cloud.clbV3.Invoke("SetLoadBalancerSecurityGroups", &setLoadBalancerSecurityGroupsArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		SecurityGroups: securityGroupIds,
+	}, &clbV3Response{Response: &clbV3RequestResponse{}})
+}
+
+func (cloud *Cloud) enableLoadBalancerSnatPro(ctx context.Context, loadBalancerId string) error {
+	defer forgetLoadBalancerDescription(ctx, loadBalancerId)
+	return cloud.invokeClbV3Task(ctx, "ModifyLoadBalancerAttributes", &modifyLoadBalancerSnatProArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		SnatPro:        true,
+	})
+}
+
+func (cloud *Cloud) createLoadBalancerSnatIp(ctx context.Context, loadBalancerId string, subnetId string) error {
+	defer forgetLoadBalancerDescription(ctx, loadBalancerId)
+	return cloud.invokeClbV3Task(ctx, "CreateLoadBalancerSnatIps", &createLoadBalancerSnatIpsArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		SnatIps:        []snatIpSubnet{{SubnetId: subnetId}},
+	})
+}
+
+func (cloud *Cloud) deleteLoadBalancerSnatIps(ctx context.Context, loadBalancerId string, ips []string) error {
+	defer forgetLoadBalancerDescription(ctx, loadBalancerId)
+	return cloud.invokeClbV3Task(ctx, "DeleteLoadBalancerSnatIps", &deleteLoadBalancerSnatIpsArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		Ips:            ips,
+	})
+}
+
+// describeClbQuota returns the clbs used and the limit of the quota, by quota id.
+func (cloud *Cloud) describeClbQuota() (map[string]clbQuota, error) {
+	response := &describeQuotaResponse{}
+	err := cloud.clbV3.Invoke("DescribeQuota", &describeQuotaArgs{
+		Version: ClbV3DefaultVersion,
+	}, &clbV3Response{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	quotas := map[string]clbQuota{}
+	for _, quota := range response.QuotaSet {
+		// quotas not counted per account come without usage
+		if quota.QuotaCurrent == nil {
+			continue
+		}
+		quotas[quota.QuotaId] = clbQuota{Used: *quota.QuotaCurrent, Limit: quota.QuotaLimit}
+	}
+	return quotas, nil
+}
+
+// describeEniTargets returns the backends registered by ip of every listener of the clb by listener id.
+func (cloud *Cloud) describeEniTargets(loadBalancerId string) (map[string][]eniTarget, error) {
+	response := &describeTargetsResponse{}
+	err := cloud.clbV3.Invoke("DescribeTargets", &describeTargetsArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+	}, &clbV3Response{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string][]eniTarget{}
+	for _, listener := range response.Listeners {
+		for _, target := range listener.Targets {
+			if target.Type != clbTargetTypeEni || len(target.PrivateIpAddresses) == 0 {
+				continue
+			}
+			targets[listener.ListenerId] = append(targets[listener.ListenerId], eniTarget{EniIp: target.PrivateIpAddresses[0], Port: target.Port})
+		}
+	}
+	return targets, nil
+}
+
+func (cloud *Cloud) registerEniTargets(ctx context.Context, loadBalancerId string, listenerId string, targets []eniTarget) error {
+	return cloud.invokeClbV3Task(ctx, "RegisterTargets", &targetsArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		ListenerId:     listenerId,
+		Targets:        targets,
+	})
+}
+
+func (cloud *Cloud) deregisterEniTargets(ctx context.Context, loadBalancerId string, listenerId string, targets []eniTarget) error {
+	return cloud.invokeClbV3Task(ctx, "DeregisterTargets", &targetsArgs{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		ListenerId:     listenerId,
+		Targets:        targets,
+	})
+}
+
+// describeListenerEndPorts returns the last port of the range listeners of the clb by listener id, listeners
+// of a single port are left out. The legacy api describes range listeners by their first port alone.
+func (cloud *Cloud) describeListenerEndPorts(loadBalancerId string) (map[string]int, error) {
+	response := &describeListenersV3Response{}
+	err := cloud.clbV3.Invoke("DescribeListeners", &describeListenersV3Args{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+	}, &clbV3Response{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	endPorts := map[string]int{}
+	for _, listener := range response.Listeners {
+		if listener.EndPort > 0 {
+			endPorts[listener.ListenerId] = listener.EndPort
+		}
+	}
+	return endPorts, nil
+}
+
+// createListenerV3 creates a layer four listener of the application clb serving the ports from port to endPort,
+// or port alone if endPort is 0.
+func (cloud *Cloud) createListenerV3(ctx context.Context, loadBalancerId string, protocol string, port int32, endPort int32, name string, healthCheck listenerHealthCheck) error {
+	args := &createListenerV3Args{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		Ports:          []int32{port},
+		Protocol:       protocol,
+		ListenerNames:  []string{name},
+		HealthCheck:    healthCheckV3Of(healthCheck),
+	}
+	if endPort > 0 {
+		args.EndPort = &endPort
+	}
+	return cloud.invokeClbV3Task(ctx, "CreateListener", args)
+}
+
+// describeListenerHealthChecksV3 returns the health checks of the listeners of the application clb by listener id.
+func (cloud *Cloud) describeListenerHealthChecksV3(loadBalancerId string) (map[string]listenerHealthCheck, error) {
+	response := &describeListenersV3Response{}
+	err := cloud.clbV3.Invoke("DescribeListeners", &describeListenersV3Args{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+	}, &clbV3Response{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	healthChecks := map[string]listenerHealthCheck{}
+	for _, listener := range response.Listeners {
+		healthChecks[listener.ListenerId] = listenerHealthCheckOfV3(listener.HealthCheck)
+	}
+	return healthChecks, nil
+}
+
+func (cloud *Cloud) modifyListenerHealthCheckV3(ctx context.Context, loadBalancerId string, listenerId string, healthCheck listenerHealthCheck) error {
+	return cloud.invokeClbV3Task(ctx, "ModifyListener", &modifyListenerHealthCheckV3Args{
+		Version:        ClbV3DefaultVersion,
+		LoadBalancerId: loadBalancerId,
+		ListenerId:     listenerId,
+		HealthCheck:    healthCheckV3Of(healthCheck),
+	})
+}
+
+// invokeClbV3Task calls an async action of the clb v3 api and waits for the task it started,
+// the request id of the call is the id of the task.
+func (cloud *Cloud) invokeClbV3Task(ctx context.Context, action string, args interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := spendCall(ctx); err != nil {
+		return err
+	}
+	response := &clbV3RequestResponse{}
+	if err := cloud.clbV3.Invoke(action, args, &clbV3Response{Response: response}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clbTaskTimeout)
+	defer cancel()
+	ticker := time.NewTicker(clbTaskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			status := &describeTaskStatusResponse{}
+			err := cloud.clbV3.Invoke("DescribeTaskStatus", &describeTaskStatusArgs{
+				Version: ClbV3DefaultVersion,
+				TaskId:  response.RequestID,
+			}, &clbV3Response{Response: status})
+			if err != nil {
+				return err
+			}
+			switch status.Status {
+			case clb.TaskSuccceed:
+				return nil
+			case clb.TaskRunning:
+			default:
+				return errors.New(fmt.Sprintf("%s task %s is not succeed", action, response.RequestID))
+			}
+		}
+	}
+}
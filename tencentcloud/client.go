@@ -0,0 +1,219 @@
+package tencentcloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+)
+
+const (
+	// apiRequestTimeout bounds every http request to the tencentcloud api
+	apiRequestTimeout = 30 * time.Second
+
+	describeInstancesAttempts = 3
+
+	// clbTaskTimeout bounds the wait for an async clb task, like clb.WaitUntilDone does
+	clbTaskTimeout = 180 * time.Second
+)
+
+// clbTaskCheckInterval is how often async clb tasks are polled, a variable so tests submitting many tasks don't
+// wait for each of them.
+var clbTaskCheckInterval = clb.TaskCheckInterval
+
+// Version is the version of the cloud controller manager reported to the tencentcloud api,
+// it is set at build time with -ldflags "-X github.com/tencentcloud/tencentcloud-cloud-controller-manager/tencentcloud.Version=<version>"
+var Version = "unknown"
+
+// userAgentTransport sets the user agent of every api request so that api usage of accounts
+// shared by several clusters can be attributed per cluster. Requests are not tagged with the service or
+// node they are made for: the sdk builds its requests without a context, so the transport can't tell
+// the calls of concurrent reconciles apart, and the apis in use take no client token or metadata for it.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		r.Header[key] = values
+	}
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(r)
+}
+
+func (cloud *Cloud) userAgent() string {
+	clusterId := cloud.config.ClusterId
+	if clusterId == "" {
+		clusterId = "unknown"
+	}
+	return fmt.Sprintf("%s-cloud-controller-manager/%s (cluster-id %s)", providerName, Version, clusterId)
+}
+
+// wrapClient sets up the http client shared by every call of an api client.
+func (cloud *Cloud) wrapClient(client *common.Client) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &userAgentTransport{userAgent: cloud.userAgent(), base: base}
+	client.Timeout = apiRequestTimeout
+}
+
+// describeInstances calls DescribeInstances, retrying attempts which failed to reach the api while ctx allows.
+// Every attempt gets its own deadline derived from ctx, so a single slow attempt can't consume the whole
+// budget of ctx and prevent the retries.
+func describeInstances(ctx context.Context, client *cvm.Client, args *cvm.DescribeInstancesArgs) (*describeInstancesResponse, error) {
+	var err error
+	for attempt := 0; attempt < describeInstancesAttempts; attempt++ {
+		if err := spendCall(ctx); err != nil {
+			return nil, err
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout(ctx, describeInstancesAttempts-attempt))
+		var response *describeInstancesResponse
+		response, err = describeInstancesOnce(attemptCtx, client, args)
+		cancel()
+		if err == nil && len(response.incomplete) > 0 {
+			err = &incompleteInstancesError{missing: response.incomplete}
+		}
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !isRetriableError(err) {
+			return nil, err
+		}
+		glog.V(4).Infof("DescribeInstances attempt %d failed: %v", attempt+1, err)
+	}
+	return nil, err
+}
+
+// describeInstancesResponse is the response of DescribeInstances with the states of the instances, which the
+// sdk doesn't decode, by instance id.
+type describeInstancesResponse struct {
+	cvm.DescribeInstancesResponse
+	InstanceStates map[string]string
+	// RestrictStates tell whether instances are isolated, for example expired prepaid ones
+	RestrictStates map[string]string
+	// incomplete are the required fields missing by instance id, see requiredInstanceFields
+	incomplete map[string][]string
+}
+
+func (response *describeInstancesResponse) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &response.DescribeInstancesResponse); err != nil {
+		return err
+	}
+	states := struct {
+		InstanceSet []struct {
+			InstanceId    string `json:"InstanceId"`
+			InstanceState string `json:"InstanceState"`
+			RestrictState string `json:"RestrictState"`
+		} `json:"InstanceSet"`
+	}{}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+	response.InstanceStates = map[string]string{}
+	response.RestrictStates = map[string]string{}
+	for _, instance := range states.InstanceSet {
+		response.InstanceStates[instance.InstanceId] = instance.InstanceState
+		response.RestrictStates[instance.InstanceId] = instance.RestrictState
+	}
+	payloads := struct {
+		InstanceSet []json.RawMessage `json:"InstanceSet"`
+	}{}
+	if err := json.Unmarshal(data, &payloads); err != nil {
+		return err
+	}
+	response.incomplete = checkInstancePayloads(payloads.InstanceSet)
+	return nil
+}
+
+func describeInstancesOnce(ctx context.Context, client *cvm.Client, args *cvm.DescribeInstancesArgs) (*describeInstancesResponse, error) {
+	type result struct {
+		response *describeInstancesResponse
+		err      error
+	}
+	// the sdk doesn't take a context, an abandoned call is bounded by the timeout of the http client
+	done := make(chan result, 1)
+	go func() {
+		response := &describeInstancesResponse{}
+		err := client.Invoke("DescribeInstances", args, &cvm.CvmResponse{Response: response})
+		done <- result{response, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.response, r.err
+	}
+}
+
+// attemptTimeout splits what is left of the deadline of ctx evenly between the remaining attempts.
+func attemptTimeout(ctx context.Context, attemptsLeft int) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return apiRequestTimeout
+	}
+	timeout := time.Until(deadline) / time.Duration(attemptsLeft)
+	if timeout > apiRequestTimeout {
+		return apiRequestTimeout
+	}
+	return timeout
+}
+
+// isRetriableError returns true if err means the request didn't get an answer from the api,
+// errors returned by the api itself are not retried.
+func isRetriableError(err error) bool {
+	switch err.(type) {
+	case common.ClientError, *incompleteInstancesError:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// waitUntilDone starts an async clb task and waits for its result. Unlike clb.WaitUntilDone the wait is
+// aborted as soon as ctx is done, so a reconcile that is given up doesn't keep polling the task.
+func waitUntilDone(ctx context.Context, createFunc clb.CreateFunc, client *clb.Client) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return clb.TaskStatusUnknown, err
+	}
+	if err := spendCall(ctx); err != nil {
+		return clb.TaskStatusUnknown, err
+	}
+	asyncTask, err := createFunc()
+	if err != nil {
+		return clb.TaskFailed, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clbTaskTimeout)
+	defer cancel()
+	ticker := time.NewTicker(clbTaskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return clb.TaskStatusUnknown, ctx.Err()
+		case <-ticker.C:
+			response, err := client.DescribeLoadBalancersTaskResult(asyncTask.Id())
+			if err != nil {
+				return clb.TaskStatusUnknown, err
+			}
+			if response.Data.Status != clb.TaskRunning {
+				return response.Data.Status, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package tencentcloud
+
+import (
+	"context"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+func TestDescribeInstancesAttempts(t *testing.T) {
+	instance := fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)
+	incomplete := fakeInstance("ins-1", "", "vpc-test", []string{"10.0.0.1"}, nil)
+
+	tests := []struct {
+		name string
+		// answers are the answers of the attempts in order, a nil answer doesn't come before the attempt times out
+		answers   []interface{}
+		wantCalls int
+		wantErr   bool
+	}{
+		{"first attempt answered", []interface{}{instance}, 1, false},
+		{"first attempt times out", []interface{}{nil, instance}, 2, false},
+		{"incomplete instance retried", []interface{}{incomplete, instance}, 2, false},
+		{"api error not retried", []interface{}{v3Error("InternalError", "internal error"), instance}, 1, true},
+		{"every attempt times out", []interface{}{nil, nil, nil}, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			var calls int32
+			api.handle("cvm.DescribeInstances", func(params url.Values) interface{} {
+				answer := test.answers[atomic.AddInt32(&calls, 1)-1]
+				switch answer := answer.(type) {
+				case nil:
+					time.Sleep(time.Second)
+					return v3Response(map[string]interface{}{"TotalCount": 0, "InstanceSet": []interface{}{}})
+				case map[string]interface{}:
+					if _, ok := answer["Response"]; ok {
+						return answer
+					}
+					return describeInstancesResult(answer)(params)
+				}
+				return answer
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			// each of the three attempts gets 500ms at first, the answers that don't come take a second
+			ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			response, err := describeInstances(ctx, cloud.cvm, &cvm.DescribeInstancesArgs{
+				Version: cvm.DefaultVersion,
+				Filters: &[]cvm.Filter{cvm.NewFilter(cvm.FilterNameInstanceId, "ins-1")},
+			})
+			elapsed := time.Since(start)
+
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("describeInstances returned %v, want an error", response.InstanceSet)
+				}
+			} else if err != nil || len(response.InstanceSet) != 1 || response.InstanceSet[0].InstanceID != "ins-1" {
+				t.Errorf("describeInstances = %v, %v, want ins-1", response, err)
+			}
+			if got := len(api.callsOf("cvm.DescribeInstances")); got != test.wantCalls {
+				t.Errorf("%d attempts, want %d", got, test.wantCalls)
+			}
+			if elapsed > 1600*time.Millisecond {
+				t.Errorf("describeInstances took %s, want it bounded by the deadline", elapsed)
+			}
+		})
+	}
+}
+
+func TestTaskWaitCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		// cancelAfter is how long the task is waited for before the context is cancelled, the task never finishes
+		cancelAfter time.Duration
+		v3          bool
+		wantStarted bool
+	}{
+		{"legacy task", 1500 * time.Millisecond, false, true},
+		{"v3 task", 1500 * time.Millisecond, true, true},
+		{"legacy task of a cancelled reconcile", 0, false, false},
+		{"v3 task of a cancelled reconcile", 0, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancersTaskResult", func(url.Values) interface{} {
+				return map[string]interface{}{"code": 0, "data": map[string]interface{}{"status": clb.TaskRunning}}
+			})
+			api.handle("clb.DeleteLoadBalancers", legacyTask)
+			api.handle("clbv3.ModifyListener", v3Task)
+			api.handle("clbv3.DescribeTaskStatus", func(url.Values) interface{} {
+				return v3Response(map[string]interface{}{"Status": clb.TaskRunning})
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if test.cancelAfter == 0 {
+				cancel()
+			} else {
+				time.AfterFunc(test.cancelAfter, cancel)
+			}
+			start := time.Now()
+			var err error
+			if test.v3 {
+				err = cloud.invokeClbV3Task(ctx, "ModifyListener", &modifyListenerHealthCheckV3Args{
+					Version: ClbV3DefaultVersion, LoadBalancerId: "lb-1", ListenerId: "lbl-80", HealthCheck: healthCheckV3Of(listenerHealthCheck{HealthSwitch: 1}),
+				})
+			} else {
+				_, err = waitUntilDone(ctx, func() (clb.AsyncTask, error) {
+					return cloud.clb.DeleteLoadBalancers([]string{"lb-1"})
+				}, cloud.clb)
+			}
+			elapsed := time.Since(start)
+
+			if err != context.Canceled {
+				t.Errorf("wait returned %v, want %v", err, context.Canceled)
+			}
+			if elapsed > test.cancelAfter+200*time.Millisecond {
+				t.Errorf("wait returned after %s, want it aborted once the context is cancelled after %s", elapsed, test.cancelAfter)
+			}
+			if started := len(api.actions()) > 0; started != test.wantStarted {
+				t.Errorf("task started %t, want %t", started, test.wantStarted)
+			}
+		})
+	}
+}
@@ -3,16 +3,22 @@ package tencentcloud
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/dbdd4us/qcloudapi-sdk-go/ccs"
 	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
 	"github.com/dbdd4us/qcloudapi-sdk-go/common"
 	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
 
+	"k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 	"k8s.io/kubernetes/pkg/controller"
 )
@@ -41,9 +47,6 @@ func NewCloud(config io.Reader) (cloudprovider.Interface, error) {
 		}
 	}
 
-	if c.Region == "" {
-		c.Region = os.Getenv("TENCENTCLOUD_CLOUD_CONTROLLER_MANAGER_REGION")
-	}
 	if c.VpcId == "" {
 		c.VpcId = os.Getenv("TENCENTCLOUD_CLOUD_CONTROLLER_MANAGER_VPC_ID")
 	}
@@ -54,22 +57,88 @@ func NewCloud(config io.Reader) (cloudprovider.Interface, error) {
 		c.SecretKey = os.Getenv("TENCENTCLOUD_CLOUD_CONTROLLER_MANAGER_SECRET_KEY")
 	}
 
+	if c.ClusterId == "" {
+		c.ClusterId = os.Getenv("TENCENTCLOUD_CLOUD_CONTROLLER_MANAGER_CLUSTER_ID")
+	}
+
 	if c.ClusterRouteTable == "" {
 		c.ClusterRouteTable = os.Getenv("TENCENTCLOUD_CLOUD_CONTROLLER_MANAGER_CLUSTER_ROUTE_TABLE")
 	}
 
-	return &Cloud{config: c}, nil
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	localNode := newLocalNode(c.EnableIPv6)
+
+	var err error
+	if c.Region, err = resolveRegion(c.Region, localNode); err != nil {
+		return nil, err
+	}
+
+	return newCloud(c, localNode)
+}
+
+// newCloud returns the cloud of the validated config, its clients are set up by Initialize.
+func newCloud(c Config, localNode *localNode) (*Cloud, error) {
+	instanceNotFound, err := newInstanceNotFoundPolicy(c.InstanceNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cloud{
+		config:               c,
+		localNode:            localNode,
+		nodeDeletionReporter: newNodeDeletionReporter(),
+		eniCapacities:        &eniCapacityCache{capacities: map[string]*eniCapacity{}},
+		listenerDrainer:      newListenerDrainer(),
+		backendDrainer:       newBackendDrainer(),
+		specErrors:           newSpecErrorCache(),
+		instanceNotFound:     instanceNotFound,
+		subnetZones:          newSubnetZoneCache(),
+		serviceLocks:         newServiceLocks(),
+		quotas:               newQuotaCache(),
+		pause:                &pauseSwitch{},
+		backendGroups:        newBackendGroups(),
+		instanceIndex:        newInstanceIndex(c.InstanceIndexTTL, c.InstanceIndexSize),
+		loadBalancerCache:    newLoadBalancerCache(c.LoadBalancerCacheTTL),
+		tags:                 newTagPermission(),
+		backendNodesSyncNow:  make(chan struct{}, 1),
+	}, nil
 }
 
 type Cloud struct {
 	config Config
 
+	initOnce sync.Once
+
 	kubeClient kubernetes.Interface
+	recorder   record.EventRecorder
+	reconciles *reconcileRecorder
+
+	localNode            *localNode
+	nodeDeletionReporter *nodeDeletionReporter
+	eniCapacities        *eniCapacityCache
+	listenerDrainer      *listenerDrainer
+	backendDrainer       *backendDrainer
+	specErrors           *specErrorCache
+	instanceNotFound     instanceNotFoundPolicy
+	subnetZones          *subnetZoneCache
+	serviceLocks         *serviceLocks
+	quotas               *quotaCache
+	pause                *pauseSwitch
+	backendGroups        *backendGroups
+	instanceIndex        *instanceIndex
+	loadBalancerCache    *loadBalancerCache
+	tags                 *tagPermission
+	backendNodesSyncNow  chan struct{}
 
 	cvm   *cvm.Client
 	cvmV3 *cvm.Client
 	ccs   *ccs.Client
 	clb   *clb.Client
+	clbV3 *common.Client
+	vpc   *common.Client
 }
 
 type Config struct {
@@ -78,47 +147,288 @@ type Config struct {
 
 	SecretId  string `json:"secret_id"`
 	SecretKey string `json:"secret_key"`
+	// Credentials are the credentials of the api families cvm, clb, vpc and ccs by family, families without
+	// are called with secret_id and secret_key, see CredentialConfig
+	Credentials map[string]CredentialConfig `json:"credentials"`
+
+	// InstanceFilters narrow the lookups of instances by private ip or instance id, and of the backends of clbs.
+	// Nodes of instances they leave out are handled like nodes of missing instances, see instance_not_found.
+	// InstanceExistsByProviderID ignores them, such nodes are never deleted
+	InstanceFilters []InstanceFilterConfig `json:"instance_filters"`
 
 	ClusterRouteTable string `json:"cluster_route_table"`
+
+	ClusterId     string `json:"cluster_id"`
+	ClusterMaster string `json:"cluster_master"`
+	// EnableClusters exposes the configured cluster through the clusters interface
+	EnableClusters bool `json:"enable_clusters"`
+
+	// EnableEniZonesLabel labels nodes with every zone their enis span, see LabelEniZones
+	EnableEniZonesLabel bool `json:"enable_eni_zones_label"`
+	// EnablePlacementLabels labels nodes with the physical placement of their instance, see LabelDedicatedHostId
+	EnablePlacementLabels bool `json:"enable_placement_labels"`
+	// EnableEniCapacityLabels labels nodes with the eni capacity of their instance type, see LabelMaxEni
+	EnableEniCapacityLabels bool `json:"enable_eni_capacity_labels"`
+	// EnableInstanceTypeLabel updates the instance type label of kubernetes when the instance of the node is
+	// resized, the node controller only sets it when the node is initialized
+	EnableInstanceTypeLabel bool `json:"enable_instance_type_label"`
+
+	// NodeMetadataLabels lists the labels describing the network of the instance nodes are labeled with,
+	// see LabelPrimaryEniId and LabelSubnetId
+	NodeMetadataLabels []string `json:"node_metadata_labels"`
+	// NodeTagLabels maps the keys of cvm tags to the keys of the labels nodes are labeled with, tags not listed
+	// are ignored. Tag values are turned into valid label values.
+	NodeTagLabels map[string]string `json:"node_tag_labels"`
+	// EnableCreatedTimeAnnotation annotates nodes with the creation time of their instance, see AnnotationInstanceCreatedTime
+	EnableCreatedTimeAnnotation bool `json:"enable_created_time_annotation"`
+
+	// EnableIPv6 identifies instances without a private ipv4 address by their ipv6 address
+	EnableIPv6 bool `json:"enable_ipv6"`
+
+	// InstanceIndexTTL is the number of seconds the instances looked up for node addresses are remembered, node
+	// addresses are answered from them meanwhile. Instances still asked about are described again in the
+	// background shortly before they expire. 0 disables the index, every lookup goes to the api
+	InstanceIndexTTL int `json:"instance_index_ttl"`
+	// InstanceIndexSize is the number of instances the index holds, 5000 by default. The least recently used
+	// instance is evicted to index another
+	InstanceIndexSize int `json:"instance_index_size"`
+
+	// LoadBalancerCacheTTL is the number of seconds the clbs found by name are remembered, backend syncs and
+	// status lookups use them meanwhile. Ensuring or deleting a clb always describes it. 0 disables the cache
+	LoadBalancerCacheTTL int `json:"loadbalancer_cache_ttl"`
+
+	// InstanceNotFound overrides per method of the instances interface whether an instance which can't be
+	// found is reported as not found or retried, see InstanceNotFoundReport and InstanceNotFoundRetry. Every
+	// method retries by default, set InstanceExistsByProviderID to report to have the nodes of deleted
+	// instances deleted
+	InstanceNotFound map[string]string `json:"instance_not_found"`
+
+	// RequireBandwidthPackage rejects public loadbalancers without a bandwidth package, for accounts billing
+	// all public traffic by bandwidth packages
+	RequireBandwidthPackage bool `json:"require_bandwidth_package"`
+
+	// AutoSelectInternalSubnet creates private loadbalancers without the subnet annotation in the subnet
+	// holding most of their backend nodes, instead of rejecting them
+	AutoSelectInternalSubnet bool `json:"auto_select_internal_subnet"`
+
+	// LoadBalancerProtocols are the protocols of the services whose loadbalancers are managed, TCP, UDP or both.
+	// Services with ports of other protocols are left alone with an event. All protocols are managed by default
+	LoadBalancerProtocols []string `json:"loadbalancer_protocols"`
+
+	// IgnoreUnsupportedAnnotations only warns about services with annotations their loadbalancer can't honor
+	// instead of rejecting them, for clusters whose services relied on such annotations being ignored
+	IgnoreUnsupportedAnnotations bool `json:"ignore_unsupported_annotations"`
+
+	// KeepNodesToBeDeleted keeps nodes the cluster autoscaler is about to remove registered as backends until
+	// they are gone, instead of deregistering them once they are tainted
+	KeepNodesToBeDeleted bool `json:"keep_nodes_to_be_deleted"`
+
+	// LoadBalancerPageSize is the number of clbs listed per DescribeLoadBalancers request, 20 by default and at most 100
+	LoadBalancerPageSize int `json:"loadbalancer_page_size"`
+
+	// ReconcileTaskAndLookupBudget is the number of clb tasks a single sync of a service may start plus the
+	// DescribeInstances attempts it may make, 500 by default. Other describe calls are not counted. Syncs
+	// exceeding it are aborted with an event and retried, each of them getting further
+	ReconcileTaskAndLookupBudget int `json:"reconcile_task_and_lookup_budget"`
+
+	// ClbQuotaHeadroom checks the clb quota of the account before a clb is created if set. With fewer clbs of
+	// the type left than the headroom, creations are spaced out and warned about, so a burst of new services
+	// doesn't run into the quota halfway
+	ClbQuotaHeadroom int `json:"clb_quota_headroom"`
+
+	// LoadBalancerReadyTimeout withholds the vip of a new clb from the status of its service until the clb has a
+	// backend, for at most this many seconds after the clb was created. 0 publishes the vip right away
+	LoadBalancerReadyTimeout int `json:"loadbalancer_ready_timeout"`
+
+	// TerminateIsolatedNodes reports isolated instances, like expired prepaid ones in the recycle bin, and
+	// instances being terminated as nonexistent, so their nodes are deleted. By default their nodes are kept,
+	// isolated instances can be renewed
+	TerminateIsolatedNodes bool `json:"terminate_isolated_nodes"`
+
+	// CordonedNodeDrainSeconds drains cordoned nodes from application clbs, their backends get weight 0 and are
+	// deregistered this many seconds later. 0 deregisters them right away
+	CordonedNodeDrainSeconds int `json:"cordoned_node_drain_seconds"`
+
+	// NodeInitializationTimeout bounds in seconds the instance lookup of every method the cloud node controller
+	// initializes nodes with, all api calls and retries included, 0 leaves it to the per call deadlines
+	NodeInitializationTimeout int `json:"node_initialization_timeout"`
+
+	// EnableLoadBalancerStatusAnnotation annotates services with the outcome of the last reconcile of their
+	// clbs, see AnnotationLoadBalancerStatus
+	EnableLoadBalancerStatusAnnotation bool `json:"enable_loadbalancer_status_annotation"`
+
+	// RecreateAbnormalLoadBalancer recreates clbs which are isolated or blocked instead of failing every sync
+	// of their service, the recreated clb gets a new vip
+	RecreateAbnormalLoadBalancer bool `json:"recreate_abnormal_loadbalancer"`
+
+	// BackendRegistration is how nodes are registered with the listeners of application clbs, see
+	// BackendRegistrationInstance, the default, and BackendRegistrationEni
+	BackendRegistration string `json:"backend_registration"`
+
+	// ServiceNodePortRange is the node port range of the cluster like 30000-32767, the default, as given to
+	// kube-apiserver by --service-node-port-range. Services with node ports outside of it are rejected
+	ServiceNodePortRange string `json:"service_node_port_range"`
+}
+
+// Validate checks the config after the environment filled it in and reports every problem found at once.
+// The region is checked by resolveRegion, it may come from a flag or the metadata service.
+func (c *Config) Validate() error {
+	problems := []error{}
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, errors.New(fmt.Sprintf(format, args...)))
+	}
+
+	problems = append(problems, validateCredentials(c)...)
+	problems = append(problems, validateInstanceFilters(c.InstanceFilters)...)
+	if c.VpcId != "" && !strings.HasPrefix(c.VpcId, "vpc-") {
+		invalid("vpc_id %q is not a vpc id like vpc-xxxxxxxx", c.VpcId)
+	}
+	if c.EnableClusters && c.ClusterId == "" {
+		invalid("enable_clusters requires cluster_id")
+	}
+	if _, err := newInstanceNotFoundPolicy(c.InstanceNotFound); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateNodeMetadataLabels(c.NodeMetadataLabels); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateNodeTagLabels(c.NodeTagLabels); err != nil {
+		problems = append(problems, err)
+	}
+	if c.LoadBalancerCacheTTL < 0 {
+		invalid("invalid loadbalancer_cache_ttl %d, must not be negative", c.LoadBalancerCacheTTL)
+	}
+	if c.InstanceIndexTTL < 0 {
+		invalid("invalid instance_index_ttl %d, must not be negative", c.InstanceIndexTTL)
+	}
+	if c.InstanceIndexSize < 0 {
+		invalid("invalid instance_index_size %d, must not be negative", c.InstanceIndexSize)
+	}
+	if c.NodeInitializationTimeout < 0 {
+		invalid("invalid node_initialization_timeout %d, must not be negative", c.NodeInitializationTimeout)
+	}
+	for _, protocol := range c.LoadBalancerProtocols {
+		if v1.Protocol(protocol) != v1.ProtocolTCP && v1.Protocol(protocol) != v1.ProtocolUDP {
+			invalid("invalid loadbalancer_protocols protocol %q, must be %s or %s", protocol, v1.ProtocolTCP, v1.ProtocolUDP)
+		}
+	}
+	if c.BackendRegistration != "" && c.BackendRegistration != BackendRegistrationInstance && c.BackendRegistration != BackendRegistrationEni {
+		invalid("invalid backend_registration %q, must be %s or %s", c.BackendRegistration, BackendRegistrationInstance, BackendRegistrationEni)
+	}
+	if c.ReconcileTaskAndLookupBudget < 0 {
+		invalid("invalid reconcile_task_and_lookup_budget %d, must not be negative", c.ReconcileTaskAndLookupBudget)
+	}
+	if c.LoadBalancerReadyTimeout < 0 {
+		invalid("invalid loadbalancer_ready_timeout %d, must not be negative", c.LoadBalancerReadyTimeout)
+	}
+	if c.CordonedNodeDrainSeconds < 0 {
+		invalid("invalid cordoned_node_drain_seconds %d, must not be negative", c.CordonedNodeDrainSeconds)
+	}
+	if c.ClbQuotaHeadroom < 0 {
+		invalid("invalid clb_quota_headroom %d, must not be negative", c.ClbQuotaHeadroom)
+	}
+	if c.LoadBalancerPageSize < 0 || c.LoadBalancerPageSize > maxLoadBalancerPageSize {
+		invalid("invalid loadbalancer_page_size %d, must be within 1-%d", c.LoadBalancerPageSize, maxLoadBalancerPageSize)
+	}
+	if c.ServiceNodePortRange != "" {
+		if _, _, err := parsePortRange(c.ServiceNodePortRange); err != nil {
+			invalid("invalid service_node_port_range %q, must be a range of ports like %s", c.ServiceNodePortRange, defaultServiceNodePortRange)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(fmt.Sprintf("invalid cloud config: %v", utilerrors.NewAggregate(problems)))
+	}
+	return nil
 }
 
 // Initialize provides the cloud with a kubernetes client builder and may spawn goroutines
 // to perform housekeeping activities within the cloud provider.
 func (cloud *Cloud) Initialize(clientBuilder controller.ControllerClientBuilder) {
+	cloud.initOnce.Do(func() {
+		cloud.initialize(clientBuilder)
+	})
+}
+
+// initialize sets up every client before returning, the controllers start calling the cloud concurrently
+// right after. The background loops are started last, once everything they use is in place.
+func (cloud *Cloud) initialize(clientBuilder controller.ControllerClientBuilder) {
 	cloud.kubeClient = clientBuilder.ClientOrDie("tencentcloud-cloud-provider")
+	cloud.reconciles = newReconcileRecorder(cloud.newEventRecorder())
+	cloud.recorder = cloud.reconciles
+	cloud.logCredentialSources()
+	cvmCredential, _ := cloud.familyCredential(CredentialFamilyCvm)
+	clbCredential, _ := cloud.familyCredential(CredentialFamilyClb)
+	vpcCredential, _ := cloud.familyCredential(CredentialFamilyVpc)
+	ccsCredential, _ := cloud.familyCredential(CredentialFamilyCcs)
 	cvmClient, err := cvm.NewClient(
-		common.Credential{SecretId: cloud.config.SecretId, SecretKey: cloud.config.SecretKey},
+		cvmCredential,
 		common.Opts{Region: cloud.config.Region},
 	)
 	if err != nil {
 		panic(err)
 	}
+	cloud.wrapClient(cvmClient.Client)
 	cloud.cvm = cvmClient
 	cvmV3Client, err := cvm.NewClient(
-		common.Credential{SecretId: cloud.config.SecretId, SecretKey: cloud.config.SecretKey},
+		cvmCredential,
 		common.Opts{Region: cloud.config.Region, Host: cvm.CvmV3Host, Path: cvm.CvmV3Path},
 	)
 	if err != nil {
 		panic(err)
 	}
+	cloud.wrapClient(cvmV3Client.Client)
 	cloud.cvmV3 = cvmV3Client
 	ccsClient, err := ccs.NewClient(
-		common.Credential{SecretId: cloud.config.SecretId, SecretKey: cloud.config.SecretKey},
+		ccsCredential,
 		common.Opts{Region: cloud.config.Region},
 	)
 	if err != nil {
 		panic(err)
 	}
+	cloud.wrapClient(ccsClient.Client)
 	cloud.ccs = ccsClient
 	clbClient, err := clb.NewClient(
-		common.Credential{SecretId: cloud.config.SecretId, SecretKey: cloud.config.SecretKey},
+		clbCredential,
 		common.Opts{Region: cloud.config.Region},
 	)
 	if err != nil {
 		panic(err)
 	}
+	cloud.wrapClient(clbClient.Client)
 	cloud.clb = clbClient
-	return
+	clbV3Client, err := newClbV3Client(
+		clbCredential,
+		cloud.config.Region,
+	)
+	if err != nil {
+		panic(err)
+	}
+	cloud.wrapClient(clbV3Client)
+	cloud.clbV3 = clbV3Client
+	vpcClient, err := newVpcClient(
+		vpcCredential,
+		cloud.config.Region,
+	)
+	if err != nil {
+		panic(err)
+	}
+	cloud.wrapClient(vpcClient)
+	cloud.vpc = vpcClient
+
+	go cloud.runPauseWatch()
+	go cloud.runNodeDeletionReporter()
+	go cloud.runBackendNodesSync()
+	go cloud.runNodeInitializationWatch()
+	go cloud.runNodeDeletionWatch()
+	go cloud.runSecurityGroupDriftSync()
+
+	if cloud.nodeLabelsEnabled() {
+		go cloud.runNodeLabeler()
+	}
+	if cloud.config.InstanceIndexTTL > 0 {
+		go cloud.runInstanceIndexRefresh()
+	}
 }
 
 // LoadBalancer returns a balancer interface. Also returns true if the interface is supported, false otherwise.
@@ -138,7 +448,10 @@ func (cloud *Cloud) Zones() (cloudprovider.Zones, bool) {
 
 // Clusters returns a clusters interface.  Also returns true if the interface is supported, false otherwise.
 func (cloud *Cloud) Clusters() (cloudprovider.Clusters, bool) {
-	return nil, false
+	if !cloud.clustersSupported() {
+		return nil, false
+	}
+	return cloud, true
 }
 
 // Routes returns a routes interface along with whether the interface is supported.
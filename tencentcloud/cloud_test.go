@@ -0,0 +1,66 @@
+package tencentcloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/kubernetes/pkg/controller"
+)
+
+// countingClientBuilder counts the kubernetes clients asked for.
+type countingClientBuilder struct {
+	controller.SimpleControllerClientBuilder
+	clients int32
+}
+
+func (builder *countingClientBuilder) ClientOrDie(name string) clientset.Interface {
+	atomic.AddInt32(&builder.clients, 1)
+	return builder.SimpleControllerClientBuilder.ClientOrDie(name)
+}
+
+func TestInitializeOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		callers int
+	}{
+		{"single caller", 1},
+		{"concurrent callers", 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the background loops find no nodes or services and make no api calls
+			kube := httptest.NewServer(http.NotFoundHandler())
+			defer kube.Close()
+			builder := &countingClientBuilder{SimpleControllerClientBuilder: controller.SimpleControllerClientBuilder{
+				ClientConfig: &rest.Config{Host: kube.URL},
+			}}
+			cloud, err := newCloud(Config{Region: "ap-guangzhou", VpcId: "vpc-test", SecretId: "id", SecretKey: "key"}, newLocalNode(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < test.callers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					cloud.Initialize(builder)
+					if cloud.kubeClient == nil || cloud.recorder == nil || cloud.cvm == nil || cloud.cvmV3 == nil ||
+						cloud.ccs == nil || cloud.clb == nil || cloud.clbV3 == nil || cloud.vpc == nil {
+						t.Errorf("Initialize returned before every client was set up")
+					}
+				}()
+			}
+			wg.Wait()
+
+			if builder.clients != 1 {
+				t.Errorf("%d kubernetes clients built, want 1", builder.clients)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// clustersSupported returns true if the clusters interface is enabled and the cluster is configured.
+// It is opt-in because the provider only ever knows about the single cluster it is running in.
+func (cloud *Cloud) clustersSupported() bool {
+	return cloud.config.EnableClusters && cloud.config.ClusterId != ""
+}
+
+// ListClusters lists the names of the available clusters.
+func (cloud *Cloud) ListClusters(ctx context.Context) ([]string, error) {
+	return []string{cloud.config.ClusterId}, nil
+}
+
+// Master gets back the address (either DNS name or IP address) of the master node for the cluster.
+func (cloud *Cloud) Master(ctx context.Context, clusterName string) (string, error) {
+	if clusterName != cloud.config.ClusterId {
+		return "", errors.New(fmt.Sprintf("cluster %s not found", clusterName))
+	}
+	if cloud.config.ClusterMaster == "" {
+		return "", errors.New(fmt.Sprintf("master address of cluster %s is not configured", clusterName))
+	}
+	return cloud.config.ClusterMaster, nil
+}
@@ -0,0 +1,143 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultBackendWeight is the weight clb gives backends registered without one, drained backends of nodes which
+// are uncordoned again get it back.
+const defaultBackendWeight = 10
+
+// backendDrainer remembers when the backends of cordoned nodes were given weight 0. Drains are forgotten on
+// restart, backends still draining are drained for another period then.
+type backendDrainer struct {
+	lock    sync.Mutex
+	started map[string]time.Time
+}
+
+func newBackendDrainer() *backendDrainer {
+	return &backendDrainer{started: map[string]time.Time{}}
+}
+
+func backendDrainKey(listenerId string, instanceId string, port int) string {
+	return fmt.Sprintf("%s/%s/%d", listenerId, instanceId, port)
+}
+
+// start returns when the drain of the backend started, and true if it starts now.
+func (drainer *backendDrainer) start(key string, now time.Time) (time.Time, bool) {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+	if started, ok := drainer.started[key]; ok {
+		return started, false
+	}
+	drainer.started[key] = now
+	return now, true
+}
+
+// forget ends the drain of the backend, returns false if it wasn't draining.
+func (drainer *backendDrainer) forget(key string) bool {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+	_, ok := drainer.started[key]
+	delete(drainer.started, key)
+	return ok
+}
+
+// cordonedNodeInstances returns the names of the cordoned nodes by the id of their instance. The service
+// controller leaves cordoned nodes out of the nodes it passes, they would be deregistered right away.
+func (cloud *Cloud) cordonedNodeInstances() (map[string]string, error) {
+	nodes, err := cloud.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	cordoned := map[string]string{}
+	for _, node := range nodes.Items {
+		if !node.Spec.Unschedulable {
+			continue
+		}
+		if _, instanceId, err := parseProviderID(node.Spec.ProviderID); err == nil {
+			cordoned[instanceId] = node.Name
+		}
+	}
+	return cordoned, nil
+}
+
+// drainCordonedBackends gives the backends of cordoned nodes among those to deregister weight 0 first, so open
+// connections can complete, and returns the backends to deregister now: those of other instances and those
+// drained for cordoned_node_drain_seconds. The backends are synced again when their drain is over.
+func (cloud *Cloud) drainCordonedBackends(ctx context.Context, service *v1.Service, loadBalancerId string, listener *clb.ForwardLBListener,
+	backends []clb.ForwardLBListenerBackend, cordoned map[string]string) ([]clb.ForwardLBListenerBackend, error) {
+	if len(cordoned) == 0 {
+		return backends, nil
+	}
+	period := time.Duration(cloud.config.CordonedNodeDrainSeconds) * time.Second
+	now := time.Now()
+
+	deregister := []clb.ForwardLBListenerBackend{}
+	zero := []forwardFourthBackendWeight{}
+	draining := []string{}
+	for _, backend := range backends {
+		nodeName, ok := cordoned[backend.UnInstanceId]
+		if !ok {
+			deregister = append(deregister, backend)
+			continue
+		}
+		key := backendDrainKey(listener.ListenerId, backend.UnInstanceId, backend.Port)
+		started, starts := cloud.backendDrainer.start(key, now)
+		if !starts && now.Sub(started) >= period {
+			cloud.backendDrainer.forget(key)
+			deregister = append(deregister, backend)
+			continue
+		}
+		if backend.Weight != 0 {
+			zero = append(zero, forwardFourthBackendWeight{InstanceId: backend.UnInstanceId, Port: backend.Port, Weight: 0})
+		}
+		if starts {
+			draining = append(draining, nodeName)
+			time.AfterFunc(period, cloud.syncBackendNodesNow)
+		}
+	}
+
+	if err := cloud.setApplicationBackendWeights(ctx, loadBalancerId, listener.ListenerId, zero); err != nil {
+		return nil, err
+	}
+	if len(draining) > 0 {
+		sort.Strings(draining)
+		glog.Infof("draining cordoned nodes %s from listener %s of loadbalancer %s for %v", strings.Join(draining, ", "),
+			listener.ListenerId, loadBalancerId, period)
+		cloud.recorder.Eventf(service, v1.EventTypeNormal, "BackendNodesDraining",
+			"Draining cordoned nodes %s for %v before deregistering them", strings.Join(draining, ", "), period)
+	}
+	return deregister, nil
+}
+
+// restoreDrainedBackends gives the backends drained by drainCordonedBackends their weight back once their node
+// is balanced to again, because it was uncordoned before the drain was over.
+func (cloud *Cloud) restoreDrainedBackends(ctx context.Context, loadBalancerId string, listener *clb.ForwardLBListener, instances []cvm.InstanceInfo) error {
+	wanted := map[string]bool{}
+	for _, instance := range instances {
+		wanted[instance.InstanceID] = true
+	}
+	restore := []forwardFourthBackendWeight{}
+	for _, backend := range listener.Backends {
+		if !wanted[backend.UnInstanceId] {
+			continue
+		}
+		if cloud.backendDrainer.forget(backendDrainKey(listener.ListenerId, backend.UnInstanceId, backend.Port)) && backend.Weight == 0 {
+			restore = append(restore, forwardFourthBackendWeight{InstanceId: backend.UnInstanceId, Port: backend.Port, Weight: defaultBackendWeight})
+		}
+	}
+	return cloud.setApplicationBackendWeights(ctx, loadBalancerId, listener.ListenerId, restore)
+}
@@ -0,0 +1,262 @@
+package tencentcloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+	"github.com/dbdd4us/qcloudapi-sdk-go/metadata"
+	"github.com/golang/glog"
+)
+
+const (
+	CredentialFamilyCvm = "cvm"
+	CredentialFamilyClb = "clb"
+	CredentialFamilyVpc = "vpc"
+	CredentialFamilyCcs = "ccs"
+
+	StsHost    = "sts.tencentcloudapi.com"
+	StsPath    = "/"
+	StsVersion = "2018-08-13"
+
+	defaultRoleSessionName = "tencentcloud-cloud-controller-manager"
+
+	// temporary credentials are renewed this long before they expire
+	credentialRenewMargin = 5 * time.Minute
+	// lifetime of the credentials of an assumed role
+	assumeRoleDuration = 2 * time.Hour
+)
+
+// credentialFamilies are the api families credentials can be configured for. Tags are written through
+// the vpc and cvm apis and use their credentials.
+var credentialFamilies = []string{CredentialFamilyCvm, CredentialFamilyClb, CredentialFamilyVpc, CredentialFamilyCcs}
+
+// CredentialConfig is the credential block of an api family, see Config.Credentials. A block names static
+// keys or the cam role of the instance, and optionally a role assumed with those, or with the default keys
+// if it names neither.
+type CredentialConfig struct {
+	SecretId  string `json:"secret_id"`
+	SecretKey string `json:"secret_key"`
+	// CamRole is the cam role bound to the instance the controller manager runs on, its temporary keys are
+	// read from the metadata service
+	CamRole string `json:"cam_role"`
+	// RoleArn is a role assumed through sts, RoleSessionName names the session in the audit log
+	RoleArn         string `json:"role_arn"`
+	RoleSessionName string `json:"role_session_name"`
+}
+
+func (block CredentialConfig) static() bool {
+	return block.SecretId != "" || block.SecretKey != ""
+}
+
+// usesDefault returns true if the block assumes its role with the default keys.
+func (block CredentialConfig) usesDefault() bool {
+	return !block.static() && block.CamRole == ""
+}
+
+func (block CredentialConfig) validate() error {
+	switch {
+	case block.static() && (block.SecretId == "" || block.SecretKey == ""):
+		return errors.New("secret_id and secret_key must be given together")
+	case block.static() && block.CamRole != "":
+		return errors.New("secret_id and cam_role can't be used together")
+	case !block.static() && block.CamRole == "" && block.RoleArn == "":
+		return errors.New("secret_id and secret_key, cam_role or role_arn is required")
+	case block.RoleSessionName != "" && block.RoleArn == "":
+		return errors.New("role_session_name requires role_arn")
+	}
+	return nil
+}
+
+// validateCredentials checks the credential blocks, and that the default keys are given if any family uses them.
+func validateCredentials(c *Config) []error {
+	problems := []error{}
+	known := map[string]bool{}
+	for _, family := range credentialFamilies {
+		known[family] = true
+	}
+	families := make([]string, 0, len(c.Credentials))
+	for family := range c.Credentials {
+		families = append(families, family)
+	}
+	sort.Strings(families)
+	for _, family := range families {
+		if !known[family] {
+			problems = append(problems, errors.New(fmt.Sprintf("invalid credentials family %q, must be one of %s",
+				family, strings.Join(credentialFamilies, ", "))))
+			continue
+		}
+		if err := c.Credentials[family].validate(); err != nil {
+			problems = append(problems, errors.New(fmt.Sprintf("invalid credentials of %s: %v", family, err)))
+		}
+	}
+
+	defaultUsed := false
+	for _, family := range credentialFamilies {
+		block, ok := c.Credentials[family]
+		if !ok || block.usesDefault() {
+			defaultUsed = true
+		}
+	}
+	if defaultUsed && (c.SecretId == "" || c.SecretKey == "") {
+		problems = append(problems, errors.New("secret_id and secret_key are required unless every api family has credentials of its own"))
+	}
+	return problems
+}
+
+// familyCredential returns the credential the clients of the api family sign their requests with, and a
+// description of where it comes from.
+func (cloud *Cloud) familyCredential(family string) (common.CredentialInterface, string) {
+	defaultCredential := common.Credential{SecretId: cloud.config.SecretId, SecretKey: cloud.config.SecretKey}
+	block, ok := cloud.config.Credentials[family]
+	if !ok {
+		return defaultCredential, "default keys"
+	}
+
+	var credential common.CredentialInterface = defaultCredential
+	source := "default keys"
+	switch {
+	case block.static():
+		credential, source = common.Credential{SecretId: block.SecretId, SecretKey: block.SecretKey}, "static keys of its block"
+	case block.CamRole != "":
+		credential, source = newCamRoleCredential(block.CamRole), fmt.Sprintf("cam role %s of the instance", block.CamRole)
+	}
+	if block.RoleArn == "" {
+		return credential, source
+	}
+	sessionName := block.RoleSessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	return newAssumeRoleCredential(credential, cloud.config.Region, block.RoleArn, sessionName),
+		fmt.Sprintf("role %s assumed with %s", block.RoleArn, source)
+}
+
+// logCredentialSources logs the credential source of every api family on startup.
+func (cloud *Cloud) logCredentialSources() {
+	for _, family := range credentialFamilies {
+		_, source := cloud.familyCredential(family)
+		glog.Infof("%s apis use %s", family, source)
+	}
+}
+
+// temporaryCredential holds temporary keys and renews them through fetch before they expire. The sdk asks
+// for the token first and for the keys right after, the keys are renewed when the token is asked for only,
+// so a request is signed with the keys of its token.
+type temporaryCredential struct {
+	fetch func() (secretId string, secretKey string, token string, expires time.Time, err error)
+
+	lock      sync.Mutex
+	secretId  string
+	secretKey string
+	token     string
+	expires   time.Time
+}
+
+func (credential *temporaryCredential) GetSecretId() (string, error) {
+	credential.lock.Lock()
+	defer credential.lock.Unlock()
+	return credential.secretId, nil
+}
+
+func (credential *temporaryCredential) GetSecretKey() (string, error) {
+	credential.lock.Lock()
+	defer credential.lock.Unlock()
+	return credential.secretKey, nil
+}
+
+func (credential *temporaryCredential) Values() (common.CredentialValues, error) {
+	credential.lock.Lock()
+	defer credential.lock.Unlock()
+	if time.Until(credential.expires) < credentialRenewMargin {
+		secretId, secretKey, token, expires, err := credential.fetch()
+		if err != nil {
+			if credential.token == "" || time.Now().After(credential.expires) {
+				return nil, err
+			}
+			glog.Warningf("failed to renew temporary credentials, using the current ones until they expire at %s: %v", credential.expires, err)
+		} else {
+			credential.secretId, credential.secretKey, credential.token, credential.expires = secretId, secretKey, token, expires
+		}
+	}
+	return common.CredentialValues{"Token": credential.token}, nil
+}
+
+// newCamRoleCredential returns the temporary keys of the cam role bound to the instance.
+func newCamRoleCredential(role string) *temporaryCredential {
+	client := &http.Client{Timeout: metadataRequestTimeout}
+	return &temporaryCredential{fetch: func() (string, string, string, time.Time, error) {
+		response, err := client.Get(fmt.Sprintf("%s/cam/security-credentials/%s", metadata.ENDPOINT, role))
+		if err != nil {
+			return "", "", "", time.Time{}, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return "", "", "", time.Time{}, errors.New(fmt.Sprintf("unexpected status %d reading the keys of cam role %s from the metadata service", response.StatusCode, role))
+		}
+		keys := struct {
+			TmpSecretId  string `json:"TmpSecretId"`
+			TmpSecretKey string `json:"TmpSecretKey"`
+			Token        string `json:"Token"`
+			ExpiredTime  int64  `json:"ExpiredTime"`
+			Code         string `json:"Code"`
+		}{}
+		if err := json.NewDecoder(response.Body).Decode(&keys); err != nil {
+			return "", "", "", time.Time{}, err
+		}
+		if keys.Code != "Success" || keys.TmpSecretId == "" {
+			return "", "", "", time.Time{}, errors.New(fmt.Sprintf("the metadata service has no keys of cam role %s, code %q", role, keys.Code))
+		}
+		return keys.TmpSecretId, keys.TmpSecretKey, keys.Token, time.Unix(keys.ExpiredTime, 0), nil
+	}}
+}
+
+type assumeRoleArgs struct {
+	Version         string `qcloud_arg:"Version,required"`
+	RoleArn         string `qcloud_arg:"RoleArn,required"`
+	RoleSessionName string `qcloud_arg:"RoleSessionName,required"`
+	DurationSeconds int    `qcloud_arg:"DurationSeconds"`
+}
+
+type assumeRoleResponse struct {
+	Credentials struct {
+		TmpSecretId  string `json:"TmpSecretId"`
+		TmpSecretKey string `json:"TmpSecretKey"`
+		Token        string `json:"Token"`
+	} `json:"Credentials"`
+	ExpiredTime int64  `json:"ExpiredTime"`
+	RequestID   string `json:"RequestId"`
+}
+
+type stsResponse struct {
+	Response interface{} `json:"Response"`
+}
+
+// newAssumeRoleCredential returns the temporary keys of the role, assumed through sts with source.
+func newAssumeRoleCredential(source common.CredentialInterface, region string, roleArn string, sessionName string) *temporaryCredential {
+	return &temporaryCredential{fetch: func() (string, string, string, time.Time, error) {
+		client, err := common.NewClient(source, common.Opts{Region: region, Host: StsHost, Path: StsPath})
+		if err != nil {
+			return "", "", "", time.Time{}, err
+		}
+		client.Timeout = apiRequestTimeout
+		response := &assumeRoleResponse{}
+		err = client.Invoke("AssumeRole", &assumeRoleArgs{
+			Version:         StsVersion,
+			RoleArn:         roleArn,
+			RoleSessionName: sessionName,
+			DurationSeconds: int(assumeRoleDuration / time.Second),
+		}, &stsResponse{Response: response})
+		if err != nil {
+			return "", "", "", time.Time{}, err
+		}
+		keys := response.Credentials
+		return keys.TmpSecretId, keys.TmpSecretKey, keys.Token, time.Unix(response.ExpiredTime, 0), nil
+	}}
+}
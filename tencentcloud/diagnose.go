@@ -0,0 +1,146 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeDiagnosis is what the provider can tell about a node, for support. Lookups failing along the way are
+// listed in Problems, the fields they would fill are left empty.
+type NodeDiagnosis struct {
+	NodeName   string
+	ProviderID string
+	// ToBeDeleted is true if the cluster autoscaler is about to remove the node, it is no backend then
+	ToBeDeleted bool
+
+	// InstanceId is the instance the node resolves to, ResolvedBy tells how it was found
+	InstanceId   string
+	ResolvedBy   string
+	State        string
+	Zone         string
+	VpcId        string
+	InstanceType string
+	Addresses    []v1.NodeAddress
+
+	// Backends are the clbs the instance is registered with by any of its private ips
+	Backends []NodeBackend
+
+	Problems []string
+}
+
+// NodeBackend is a clb the node is a backend of.
+type NodeBackend struct {
+	LoadBalancerId   string
+	LoadBalancerName string
+	Vips             []string
+}
+
+// Diagnose gathers what the provider can tell about the node. It bypasses the instance index and makes one
+// DescribeInstances and one DescribeLoadBalancers call, whatever the state of the node. The cloud must be
+// initialized, nodes are read from the cluster.
+func (cloud *Cloud) Diagnose(ctx context.Context, nodeName string) *NodeDiagnosis {
+	diagnosis := &NodeDiagnosis{NodeName: nodeName}
+	problem := func(format string, args ...interface{}) {
+		diagnosis.Problems = append(diagnosis.Problems, fmt.Sprintf(format, args...))
+	}
+
+	ips := []string{}
+	if net.ParseIP(nodeName) != nil {
+		ips = append(ips, nodeName)
+	}
+	node, err := cloud.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		problem("node %s does not exist", nodeName)
+	case err != nil:
+		problem("failed to get node %s: %v", nodeName, err)
+	default:
+		diagnosis.ProviderID = node.Spec.ProviderID
+		diagnosis.ToBeDeleted = isNodeToBeDeleted(node)
+		for _, address := range node.Status.Addresses {
+			if address.Type == v1.NodeInternalIP && address.Address != nodeName && net.ParseIP(address.Address).To4() != nil {
+				ips = append(ips, address.Address)
+			}
+		}
+	}
+
+	args := &cvm.DescribeInstancesArgs{Version: cvm.DefaultVersion}
+	_, instanceId, err := parseProviderID(diagnosis.ProviderID)
+	if _, ok := err.(*malformedInstanceIDError); ok {
+		problem("provider id %s of node %s is corrupted: %v", diagnosis.ProviderID, nodeName, err)
+	}
+	switch {
+	case err == nil:
+		diagnosis.ResolvedBy = "instance id of the provider id"
+		args.InstanceIds = &[]string{instanceId}
+	case len(ips) > 0:
+		diagnosis.ResolvedBy = "private ip"
+		values := make([]interface{}, len(ips))
+		for i, ip := range ips {
+			values[i] = ip
+		}
+		args.Filters = &[]cvm.Filter{{Name: cvm.FilterNamePrivateIpAddress, Values: values}}
+	default:
+		problem("node %s has neither a provider id nor private ips to find its instance by", nodeName)
+		return diagnosis
+	}
+
+	response, err := describeInstances(ctx, cloud.cvmV3, args)
+	if err != nil {
+		problem("failed to describe the instance: %v", err)
+	} else {
+		var instance *cvm.InstanceInfo
+		for i := range response.InstanceSet {
+			candidate := &response.InstanceSet[i]
+			if instanceId != "" && candidate.InstanceID != instanceId {
+				continue
+			}
+			if instanceId == "" && candidate.VirtualPrivateCloud.VpcID != cloud.config.VpcId {
+				continue
+			}
+			instance = candidate
+			break
+		}
+		if instance == nil {
+			problem("no instance found by %s", diagnosis.ResolvedBy)
+		} else {
+			diagnosis.InstanceId = instance.InstanceID
+			diagnosis.State = response.InstanceStates[instance.InstanceID]
+			diagnosis.Zone = instance.Placement.Zone
+			diagnosis.VpcId = instance.VirtualPrivateCloud.VpcID
+			diagnosis.InstanceType = instance.InstanceType
+			diagnosis.Addresses = instanceNodeAddresses(instance)
+			if diagnosis.VpcId != cloud.config.VpcId {
+				problem("instance %s is in vpc %s rather than %s of the cluster", instance.InstanceID, diagnosis.VpcId, cloud.config.VpcId)
+			}
+			ips = instance.PrivateIPAddresses
+		}
+	}
+
+	if len(ips) == 0 {
+		return diagnosis
+	}
+	loadBalancers, err := cloud.describeLoadBalancersByBackend(ips)
+	if err != nil {
+		problem("failed to describe the loadbalancers of the node: %v", err)
+		return diagnosis
+	}
+	for _, loadBalancer := range loadBalancers.LoadBalancerSet {
+		diagnosis.Backends = append(diagnosis.Backends, NodeBackend{
+			LoadBalancerId:   loadBalancer.LoadBalancerId,
+			LoadBalancerName: loadBalancer.LoadBalancerName,
+			Vips:             loadBalancer.LoadBalancerVips,
+		})
+	}
+	if loadBalancers.TotalCount > len(loadBalancers.LoadBalancerSet) {
+		problem("the node is a backend of %d loadbalancers, only the first %d are listed", loadBalancers.TotalCount, len(loadBalancers.LoadBalancerSet))
+	}
+	return diagnosis
+}
@@ -0,0 +1,175 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// listenerDrainer keeps track of the listeners that are being drained in the background.
+type listenerDrainer struct {
+	lock     sync.Mutex
+	draining map[string]bool
+}
+
+func newListenerDrainer() *listenerDrainer {
+	return &listenerDrainer{draining: map[string]bool{}}
+}
+
+func (drainer *listenerDrainer) isDraining(listenerId string) bool {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+	return drainer.draining[listenerId]
+}
+
+// start marks the listener as draining, returns false if it already is.
+func (drainer *listenerDrainer) start(listenerId string) bool {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+	if drainer.draining[listenerId] {
+		return false
+	}
+	drainer.draining[listenerId] = true
+	return true
+}
+
+func (drainer *listenerDrainer) done(listenerId string) {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+	delete(drainer.draining, listenerId)
+}
+
+// listenerDrainTimeout returns how long the listeners dropped from the service are drained before deletion.
+func listenerDrainTimeout(service *v1.Service) (time.Duration, error) {
+	value, ok := service.Annotations[ServiceAnnotationLoadBalancerListenerDrainSeconds]
+	if !ok {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q, must be a non negative number of seconds", ServiceAnnotationLoadBalancerListenerDrainSeconds, value)))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// qcloudapi-sdk-go only ships the port modification of layer four backends, the weight modification
+// is called through the common client.
+
+type modifyForwardFourthBackendsWeightArgs struct {
+	LoadBalancerId string                       `qcloud_arg:"loadBalancerId,required"`
+	ListenerId     string                       `qcloud_arg:"listenerId,required"`
+	Backends       []forwardFourthBackendWeight `qcloud_arg:"backends,required"`
+}
+
+type forwardFourthBackendWeight struct {
+	InstanceId string `qcloud_arg:"instanceId"`
+	Port       int    `qcloud_arg:"port"`
+	Weight     int    `qcloud_arg:"weight"`
+}
+
+type modifyForwardFourthBackendsWeightResponse struct {
+	clb.Response
+	RequestId int `json:"requestId"`
+}
+
+func (response *modifyForwardFourthBackendsWeightResponse) Id() int {
+	return response.RequestId
+}
+
+// drainApplicationListener stops new connections to the listener by setting the weight of its backends
+// to zero, waits for the drain timeout and deletes the listener. It runs in the background so the sync
+// of the service isn't blocked for the drain timeout.
+func (cloud *Cloud) drainApplicationListener(loadBalancerId string, listenerId string, timeout time.Duration) {
+	if !cloud.listenerDrainer.start(listenerId) {
+		return
+	}
+
+	go func() {
+		defer cloud.listenerDrainer.done(listenerId)
+		// the drain outlives the sync which started it
+		ctx := context.Background()
+
+		glog.Infof("draining listener %s of loadbalancer %s for %v before deletion", listenerId, loadBalancerId, timeout)
+		if err := cloud.zeroApplicationListenerWeights(ctx, loadBalancerId, listenerId); err != nil {
+			// deleting the listener later is no worse than deleting it right away
+			glog.Errorf("failed to set backend weights of listener %s of loadbalancer %s to zero: %v", listenerId, loadBalancerId, err)
+		}
+
+		time.Sleep(timeout)
+
+		result, err := waitUntilDone(
+			ctx,
+			func() (clb.AsyncTask, error) {
+				return cloud.clb.DeleteForwardLBListener(&clb.DeleteForwardLBListenerArgs{
+					LoadBalancerId: loadBalancerId,
+					ListenerId:     listenerId,
+				})
+			},
+			cloud.clb,
+		)
+		if err != nil {
+			glog.Errorf("failed to delete drained listener %s of loadbalancer %s: %v", listenerId, loadBalancerId, err)
+			return
+		}
+		if result != clb.TaskSuccceed {
+			glog.Errorf("failed to delete drained listener %s of loadbalancer %s: task is not succeed", listenerId, loadBalancerId)
+		}
+	}()
+}
+
+func (cloud *Cloud) zeroApplicationListenerWeights(ctx context.Context, loadBalancerId string, listenerId string) error {
+	response, err := cloud.clb.DescribeForwardLBBackends(&clb.DescribeForwardLBBackendsArgs{
+		LoadBalancerId: loadBalancerId,
+		ListenerIds:    &[]string{listenerId},
+	})
+	if err != nil {
+		return err
+	}
+
+	backends := []forwardFourthBackendWeight{}
+	for _, listener := range response.Data {
+		for _, backend := range listener.Backends {
+			backends = append(backends, forwardFourthBackendWeight{InstanceId: backend.UnInstanceId, Port: backend.Port, Weight: 0})
+		}
+	}
+	return cloud.setApplicationBackendWeights(ctx, loadBalancerId, listenerId, backends)
+}
+
+// setApplicationBackendWeights sets the weights of backends of the listener.
+func (cloud *Cloud) setApplicationBackendWeights(ctx context.Context, loadBalancerId string, listenerId string, backends []forwardFourthBackendWeight) error {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	result, err := waitUntilDone(
+		ctx,
+		func() (clb.AsyncTask, error) {
+			response := &modifyForwardFourthBackendsWeightResponse{}
+			err := cloud.clb.Invoke("ModifyForwardFourthBackendsWeight", &modifyForwardFourthBackendsWeightArgs{
+				LoadBalancerId: loadBalancerId,
+				ListenerId:     listenerId,
+				Backends:       backends,
+			}, response)
+			if err != nil {
+				return nil, err
+			}
+			return response, nil
+		},
+		cloud.clb,
+	)
+	if err != nil {
+		return err
+	}
+	if result != clb.TaskSuccceed {
+		return errors.New("task is not succeed")
+	}
+	return nil
+}
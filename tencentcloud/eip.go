@@ -0,0 +1,167 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// TagKeyLoadBalancerEip marks eips allocated by the provider, the value is the name of the clb the eip is allocated for
+	TagKeyLoadBalancerEip = "tencentcloud-cloud-controller-manager/loadbalancer"
+)
+
+func eipRequested(service *v1.Service) bool {
+	return service.Annotations[ServiceAnnotationLoadBalancerAllocateEip] == "true"
+}
+
+// getOwnedAddresses returns the eips allocated for the clb. Eips are looked up by name, but only
+// those carrying our tag are owned, so an eip of the same name created by hand is never touched.
+// Once tagging is denied untagged eips bound to the clb of the id, or recorded when they were allocated
+// or last seen bound, are owned as well. loadBalancerId is empty if the clb is gone.
+func (cloud *Cloud) getOwnedAddresses(loadBalancerName string, loadBalancerId string) ([]address, error) {
+	addresses, err := cloud.describeAddressesByName(loadBalancerName)
+	if err != nil {
+		return nil, err
+	}
+	denied := cloud.tags.isDenied()
+	owned := []address{}
+	for _, address := range addresses {
+		switch {
+		case hasVpcTag(address.TagSet, TagKeyLoadBalancerEip, loadBalancerName):
+		case denied && loadBalancerId != "" && address.InstanceId == loadBalancerId:
+			cloud.tags.record(loadBalancerName, address.AddressId)
+		case denied && cloud.tags.isRecorded(loadBalancerName, address.AddressId):
+		default:
+			continue
+		}
+		owned = append(owned, address)
+	}
+	return owned, nil
+}
+
+// allocateLoadBalancerAddress allocates a tagged eip for the clb, or an untagged one once tagging is denied.
+func (cloud *Cloud) allocateLoadBalancerAddress(loadBalancerName string, bandwidthPackageId string) (string, error) {
+	if !cloud.tags.isDenied() {
+		addressId, err := cloud.allocateAddress(loadBalancerName, bandwidthPackageId,
+			[]vpcTag{{Key: TagKeyLoadBalancerEip, Value: loadBalancerName}})
+		if !isTagPermissionError(err) {
+			return addressId, err
+		}
+		cloud.tags.deny(err)
+	}
+	addressId, err := cloud.allocateAddress(loadBalancerName, bandwidthPackageId, nil)
+	if err != nil {
+		return "", err
+	}
+	cloud.tags.record(loadBalancerName, addressId)
+	return addressId, nil
+}
+
+// ensureLoadBalancerEip makes sure exactly one eip allocated by us is bound to the clb when the service
+// asks for it. An eip allocated by a previous attempt which failed before binding is picked up and
+// bound instead of allocating another one.
+func (cloud *Cloud) ensureLoadBalancerEip(service *v1.Service, loadBalancer *clb.LoadBalancer) error {
+	if !eipRequested(service) {
+		return nil
+	}
+	loadBalancerName := loadBalancerSpecial(service)
+
+	if service.Annotations[ServiceAnnotationLoadBalancerType] != LoadBalancerTypePrivate {
+		return newSpecError(errors.New("eip can only be allocated for private loadbalancer"))
+	}
+
+	addresses, err := cloud.getOwnedAddresses(loadBalancerName, loadBalancer.LoadBalancerId)
+	if err != nil {
+		return err
+	}
+
+	if len(addresses) == 0 {
+		addressId, err := cloud.allocateLoadBalancerAddress(
+			loadBalancerName,
+			service.Annotations[ServiceAnnotationLoadBalancerEipBandwidthPackageId],
+		)
+		if err != nil {
+			return err
+		}
+		glog.Infof("allocated eip %s for loadbalancer %s", addressId, loadBalancerName)
+		// the eip can't be bound before it is created, the next sync will bind it
+		return errors.New(fmt.Sprintf("waiting for eip %s of loadbalancer %s to be created", addressId, loadBalancerName))
+	}
+
+	bound := -1
+	for i, address := range addresses {
+		if address.InstanceId == loadBalancer.LoadBalancerId {
+			bound = i
+			break
+		}
+	}
+	if bound == -1 {
+		for i, address := range addresses {
+			if address.InstanceId == "" {
+				if err := cloud.associateAddress(address.AddressId, loadBalancer.LoadBalancerId); err != nil {
+					return err
+				}
+				bound = i
+				break
+			}
+		}
+	}
+	if bound == -1 {
+		return errors.New(fmt.Sprintf("eips allocated for loadbalancer %s are bound to other resources", loadBalancerName))
+	}
+
+	// more than one eip exists when an allocation was retried after its response was lost
+	for i, address := range addresses {
+		if i == bound || address.InstanceId != "" {
+			continue
+		}
+		if err := cloud.releaseAddress(address.AddressId); err != nil {
+			return err
+		}
+		cloud.tags.forget(loadBalancerName, address.AddressId)
+	}
+
+	return nil
+}
+
+// getLoadBalancerEipAddress returns the ip of the eip bound to the clb, or an empty string if there is none.
+func (cloud *Cloud) getLoadBalancerEipAddress(service *v1.Service, loadBalancer *clb.LoadBalancer) (string, error) {
+	addresses, err := cloud.getOwnedAddresses(loadBalancerSpecial(service), loadBalancer.LoadBalancerId)
+	if err != nil {
+		return "", err
+	}
+	for _, address := range addresses {
+		if address.InstanceId == loadBalancer.LoadBalancerId {
+			return address.AddressIp, nil
+		}
+	}
+	return "", nil
+}
+
+// deleteLoadBalancerEips releases the eips we allocated for the clb. Unbinding is asynchronous, so
+// a bound eip is unbound and an error is returned to release it on the next attempt.
+func (cloud *Cloud) deleteLoadBalancerEips(loadBalancerName string, loadBalancerId string) error {
+	addresses, err := cloud.getOwnedAddresses(loadBalancerName, loadBalancerId)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if address.InstanceId != "" {
+			if err := cloud.disassociateAddress(address.AddressId); err != nil {
+				return err
+			}
+			return errors.New(fmt.Sprintf("waiting for eip %s of loadbalancer %s to be unbound", address.AddressId, loadBalancerName))
+		}
+		if err := cloud.releaseAddress(address.AddressId); err != nil {
+			return err
+		}
+		cloud.tags.forget(loadBalancerName, address.AddressId)
+		glog.Infof("released eip %s of loadbalancer %s", address.AddressId, loadBalancerName)
+	}
+	return nil
+}
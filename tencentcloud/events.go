@@ -0,0 +1,82 @@
+package tencentcloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventSourceComponent = "tencentcloud-cloud-controller-manager"
+
+	nodeDeletionReportPeriod = time.Minute
+)
+
+// controllerReference is the object controller level events are recorded on. It is the leader election
+// lock of the cloud controller manager, so operators watching its namespace see them next to leader changes.
+var controllerReference = &v1.ObjectReference{
+	Kind:      "Endpoints",
+	Namespace: "kube-system",
+	Name:      "cloud-controller-manager",
+}
+
+func (cloud *Cloud) newEventRecorder() record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: cloud.kubeClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventSourceComponent})
+}
+
+// nodeDeletionReporter collects the nodes judged nonexistent by the provider and summarizes them
+// in a single controller level event per report period, the node controller deletes those nodes.
+type nodeDeletionReporter struct {
+	lock      sync.Mutex
+	decisions map[string]string
+}
+
+func newNodeDeletionReporter() *nodeDeletionReporter {
+	return &nodeDeletionReporter{decisions: map[string]string{}}
+}
+
+// record remembers that the node with the provider id was judged nonexistent for reason.
+func (reporter *nodeDeletionReporter) record(providerID string, reason string) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	reporter.decisions[providerID] = reason
+}
+
+// flush returns the decisions recorded since the last flush, sorted by provider id.
+func (reporter *nodeDeletionReporter) flush() []string {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	decisions := make([]string, 0, len(reporter.decisions))
+	for providerID, reason := range reporter.decisions {
+		decisions = append(decisions, fmt.Sprintf("%s (%s)", providerID, reason))
+	}
+	sort.Strings(decisions)
+	reporter.decisions = map[string]string{}
+	return decisions
+}
+
+func (cloud *Cloud) runNodeDeletionReporter() {
+	wait.Until(func() {
+		decisions := cloud.nodeDeletionReporter.flush()
+		if len(decisions) == 0 {
+			return
+		}
+		cloud.recorder.Eventf(controllerReference, v1.EventTypeWarning, "NodesNotFoundInCloud",
+			"%d node(s) whose instance is gone or isolated in tencentcloud will be deleted: %s", len(decisions), strings.Join(decisions, ", "))
+	}, nodeDeletionReportPeriod, wait.NeverStop)
+}
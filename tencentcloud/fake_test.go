@@ -0,0 +1,445 @@
+package tencentcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/ccs"
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeApiFamilies are the paths the clients of the fake api call, by api family.
+var fakeApiFamilies = map[string]string{
+	"/cvm":   "cvm",
+	"/cvmv3": "cvmv3",
+	"/ccs":   "ccs",
+	"/clb":   "clb",
+	"/clbv3": "clbv3",
+	"/vpc":   "vpc",
+}
+
+// fakeHandler answers a call of the fake api, the result is encoded as json unless it is a string.
+type fakeHandler func(params url.Values) interface{}
+
+// fakeApi is the tencentcloud api of the tests. Calls are answered by the handlers registered by family and
+// action, like "clb.DescribeLoadBalancers", and recorded in order. Unhandled calls fail the test.
+type fakeApi struct {
+	t      *testing.T
+	server *httptest.Server
+
+	lock     sync.Mutex
+	handlers map[string]fakeHandler
+	calls    []fakeCall
+}
+
+type fakeCall struct {
+	Action string
+	Params url.Values
+}
+
+func newFakeApi(t *testing.T) *fakeApi {
+	api := &fakeApi{t: t, handlers: map[string]fakeHandler{}}
+	api.server = httptest.NewServer(http.HandlerFunc(api.serve))
+	// clb tasks are polled until they are done
+	api.handle("clb.DescribeLoadBalancersTaskResult", func(url.Values) interface{} {
+		return map[string]interface{}{"code": 0, "data": map[string]interface{}{"status": clb.TaskSuccceed}}
+	})
+	return api
+}
+
+func (api *fakeApi) serve(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	action := fakeApiFamilies[r.URL.Path] + "." + params.Get("Action")
+
+	api.lock.Lock()
+	handler, ok := api.handlers[action]
+	if action != "clb.DescribeLoadBalancersTaskResult" {
+		api.calls = append(api.calls, fakeCall{Action: action, Params: params})
+	}
+	api.lock.Unlock()
+
+	if !ok {
+		api.t.Errorf("unexpected call %s %v", action, params)
+		http.Error(w, "unexpected call", http.StatusNotImplemented)
+		return
+	}
+	var body []byte
+	switch result := handler(params).(type) {
+	case string:
+		body = []byte(result)
+	default:
+		var err error
+		if body, err = json.Marshal(result); err != nil {
+			api.t.Fatalf("failed to encode the response of %s: %v", action, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (api *fakeApi) handle(action string, handler fakeHandler) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.handlers[action] = handler
+}
+
+// actions returns the actions called so far in order, task polls left out.
+func (api *fakeApi) actions() []string {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	actions := []string{}
+	for _, call := range api.calls {
+		actions = append(actions, call.Action)
+	}
+	return actions
+}
+
+// callsOf returns the parameters of the calls of the action in order.
+func (api *fakeApi) callsOf(action string) []url.Values {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	calls := []url.Values{}
+	for _, call := range api.calls {
+		if call.Action == action {
+			calls = append(calls, call.Params)
+		}
+	}
+	return calls
+}
+
+func (api *fakeApi) close() {
+	api.server.Close()
+}
+
+// opts returns the client options of an api family pointing at the fake api, the calls aren't logged.
+func (api *fakeApi) opts(family string) common.Opts {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return common.Opts{
+		Region: "ap-guangzhou",
+		Host:   strings.TrimPrefix(api.server.URL, "http://"),
+		Path:   "/" + family,
+		Schema: "http",
+		Logger: logger,
+	}
+}
+
+// v3Response wraps the response of a v3 api.
+func v3Response(response map[string]interface{}) map[string]interface{} {
+	if _, ok := response["RequestId"]; !ok {
+		response["RequestId"] = "fake-request"
+	}
+	return map[string]interface{}{"Response": response}
+}
+
+func v3Error(code string, message string) map[string]interface{} {
+	return v3Response(map[string]interface{}{"Error": map[string]interface{}{"Code": code, "Message": message}})
+}
+
+func legacyError(code int, message string) map[string]interface{} {
+	return map[string]interface{}{"code": code, "message": message, "codeDesc": "Fake" + fmt.Sprint(code)}
+}
+
+// fakeInstance is the v3 DescribeInstances payload of an instance.
+func fakeInstance(instanceId string, zone string, vpcId string, privateIps []string, publicIps []string) map[string]interface{} {
+	return map[string]interface{}{
+		"InstanceId":          instanceId,
+		"InstanceState":       instanceStateRunning,
+		"InstanceType":        "S5.MEDIUM4",
+		"Placement":           map[string]interface{}{"Zone": zone},
+		"VirtualPrivateCloud": map[string]interface{}{"VpcId": vpcId, "SubnetId": "subnet-1"},
+		"PrivateIpAddresses":  privateIps,
+		"PublicIpAddresses":   publicIps,
+	}
+}
+
+// describeInstancesResult answers DescribeInstances with the instances.
+func describeInstancesResult(instances ...map[string]interface{}) fakeHandler {
+	return func(url.Values) interface{} {
+		return v3Response(map[string]interface{}{"TotalCount": len(instances), "InstanceSet": instances})
+	}
+}
+
+// fakeKube is the kubernetes api of the tests, serving the nodes and services it holds. Writes are recorded.
+type fakeKube struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	nodes    []v1.Node
+	services []v1.Service
+	writes   []string
+}
+
+func newFakeKube(t *testing.T) *fakeKube {
+	kube := &fakeKube{}
+	kube.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kube.lock.Lock()
+		defer kube.lock.Unlock()
+		if r.Method != http.MethodGet {
+			body, _ := ioutil.ReadAll(r.Body)
+			kube.writes = append(kube.writes, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, body))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+		var result interface{}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "nodes":
+			result = &v1.NodeList{TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"}, Items: kube.nodes}
+		case len(parts) == 2 && parts[0] == "nodes":
+			for i := range kube.nodes {
+				if kube.nodes[i].Name == parts[1] {
+					node := kube.nodes[i]
+					node.TypeMeta = metav1.TypeMeta{Kind: "Node", APIVersion: "v1"}
+					result = &node
+				}
+			}
+		case len(parts) == 1 && parts[0] == "services":
+			result = &v1.ServiceList{TypeMeta: metav1.TypeMeta{Kind: "ServiceList", APIVersion: "v1"}, Items: kube.services}
+		default:
+			t.Errorf("unexpected kubernetes api call %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if result == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	return kube
+}
+
+func (kube *fakeKube) close() {
+	kube.server.Close()
+}
+
+func (kube *fakeKube) client() kubernetes.Interface {
+	return kubernetes.NewForConfigOrDie(&rest.Config{Host: kube.server.URL})
+}
+
+// newTestCloud returns a cloud of the config calling the fake apis, with the clients Initialize sets up.
+// Its events go to a fake recorder, no background loop is started.
+func newTestCloud(t *testing.T, config Config, api *fakeApi, kube *fakeKube) (*Cloud, *record.FakeRecorder) {
+	if config.VpcId == "" {
+		config.VpcId = "vpc-test"
+	}
+	if config.Region == "" {
+		config.Region = "ap-guangzhou"
+	}
+	cloud, err := newCloud(config, newLocalNode(config.EnableIPv6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(100)
+	cloud.reconciles = newReconcileRecorder(recorder)
+	cloud.recorder = cloud.reconciles
+	if kube != nil {
+		cloud.kubeClient = kube.client()
+	}
+
+	credential := common.Credential{SecretId: "id", SecretKey: "key"}
+	newClient := func(family string) *common.Client {
+		client, err := common.NewClient(credential, api.opts(family))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cloud.wrapClient(client)
+		return client
+	}
+	cloud.cvm = &cvm.Client{Client: newClient("cvm")}
+	cloud.cvmV3 = &cvm.Client{Client: newClient("cvmv3")}
+	cloud.ccs = &ccs.Client{Client: newClient("ccs")}
+	cloud.clb = &clb.Client{Client: newClient("clb")}
+	cloud.clbV3 = newClient("clbv3")
+	cloud.vpc = newClient("vpc")
+	return cloud, recorder
+}
+
+// drainEvents returns the events recorded so far.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// fakeNetworkInterface is the DescribeNetworkInterfaces payload of an eni attached to the instance.
+func fakeNetworkInterface(eniId string, instanceId string, zone string, primary bool, privateIps ...string) map[string]interface{} {
+	addresses := []map[string]interface{}{}
+	for i, ip := range privateIps {
+		addresses = append(addresses, map[string]interface{}{"PrivateIpAddress": ip, "Primary": i == 0})
+	}
+	return map[string]interface{}{
+		"NetworkInterfaceId":  eniId,
+		"VpcId":               "vpc-test",
+		"SubnetId":            "subnet-" + zone,
+		"Zone":                zone,
+		"Primary":             primary,
+		"State":               "AVAILABLE",
+		"PrivateIpAddressSet": addresses,
+		"Attachment":          map[string]interface{}{"InstanceId": instanceId},
+	}
+}
+
+// describeNetworkInterfacesResult answers DescribeNetworkInterfaces with the enis.
+func describeNetworkInterfacesResult(networkInterfaces ...map[string]interface{}) fakeHandler {
+	return func(url.Values) interface{} {
+		return v3Response(map[string]interface{}{"TotalCount": len(networkInterfaces), "NetworkInterfaceSet": networkInterfaces})
+	}
+}
+
+// legacyResponse answers a call of a legacy api successfully with the fields.
+func legacyResponse(fields map[string]interface{}) map[string]interface{} {
+	fields["code"] = 0
+	fields["codeDesc"] = "Success"
+	return fields
+}
+
+// legacyTask answers a call of the legacy clb api starting an async task.
+func legacyTask(url.Values) interface{} {
+	return legacyResponse(map[string]interface{}{"requestId": 1})
+}
+
+// v3Task answers a call of the clb v3 api starting an async task, DescribeTaskStatus has to be handled as well.
+func v3Task(url.Values) interface{} {
+	return v3Response(map[string]interface{}{})
+}
+
+// v3TaskSucceeded answers DescribeTaskStatus of the clb v3 api.
+func v3TaskSucceeded(url.Values) interface{} {
+	return v3Response(map[string]interface{}{"Status": clb.TaskSuccceed})
+}
+
+// fakeForwardListener is the DescribeForwardLBBackends payload of a layer four listener of an application clb.
+func fakeForwardListener(listenerId string, port int, protocol int, backends ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"listenerId":       listenerId,
+		"protocol":         protocol,
+		"loadBalancerPort": port,
+		"backends":         backends,
+	}
+}
+
+func fakeForwardBackend(instanceId string, port int) map[string]interface{} {
+	return map[string]interface{}{"UnInstanceId": instanceId, "Port": port, "Weight": 10}
+}
+
+// describeForwardLBBackendsResult answers DescribeForwardLBBackends with the listeners.
+func describeForwardLBBackendsResult(listeners ...map[string]interface{}) fakeHandler {
+	return func(url.Values) interface{} {
+		return legacyResponse(map[string]interface{}{"data": listeners})
+	}
+}
+
+// describeLoadBalancersV3Result answers DescribeLoadBalancers of the clb v3 api with a clb without snat ips.
+func describeLoadBalancersV3Result(loadBalancerId string) fakeHandler {
+	return func(url.Values) interface{} {
+		return v3Response(map[string]interface{}{"LoadBalancerSet": []map[string]interface{}{{"LoadBalancerId": loadBalancerId}}})
+	}
+}
+
+// fakeService is a service of type LoadBalancer with the ports.
+func fakeService(annotations map[string]string, ports ...v1.ServicePort) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-web", Annotations: annotations},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: ports, SessionAffinity: v1.ServiceAffinityNone},
+	}
+}
+
+func fakeServicePort(name string, port int32, protocol v1.Protocol, nodePort int32) v1.ServicePort {
+	return v1.ServicePort{Name: name, Port: port, Protocol: protocol, NodePort: nodePort}
+}
+
+func fakeNode(name string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+// fakeFourthLayerListener is the DescribeForwardLBListeners payload of a layer four listener of an application
+// clb, named and checked like the listener of the port of the fake service.
+func fakeFourthLayerListener(listenerId string, port int, protocol int) map[string]interface{} {
+	return map[string]interface{}{
+		"listenerId":       listenerId,
+		"protocol":         protocol,
+		"loadBalancerPort": port,
+		"listenerName":     fmt.Sprintf("default/web/%d", port),
+		"healthSwitch":     1,
+		"timeOut":          2,
+		"intervalTime":     5,
+		"healthNum":        3,
+		"unhealthNum":      3,
+	}
+}
+
+// describeForwardLBListenersResult answers DescribeForwardLBListeners with the listeners.
+func describeForwardLBListenersResult(listeners ...map[string]interface{}) fakeHandler {
+	return func(url.Values) interface{} {
+		return legacyResponse(map[string]interface{}{"listenerSet": listeners})
+	}
+}
+
+// fakeClassicListener is the DescribeLoadBalancerListeners payload of a listener of a classic clb, named and
+// checked like the listener of the port of the fake service.
+func fakeClassicListener(listenerId string, port int, instancePort int, protocol int) map[string]interface{} {
+	return map[string]interface{}{
+		"unListenerId":     listenerId,
+		"protocol":         protocol,
+		"loadBalancerPort": port,
+		"instancePort":     instancePort,
+		"listenerName":     fmt.Sprintf("default/web/%d", port),
+		"healthSwitch":     1,
+		"timeOut":          2,
+		"intervalTime":     5,
+		"healthNum":        3,
+		"unhealthNum":      3,
+	}
+}
+
+// describeLoadBalancerListenersResult answers DescribeLoadBalancerListeners with the listeners.
+func describeLoadBalancerListenersResult(listeners ...map[string]interface{}) fakeHandler {
+	return func(url.Values) interface{} {
+		return legacyResponse(map[string]interface{}{"listenerSet": listeners})
+	}
+}
+
+// fakeListenerV3 is the DescribeListeners payload of a listener in the clb v3 api, endPort is 0 unless it
+// serves a range of ports. It is checked like the listener of a port of the fake service.
+func fakeListenerV3(listenerId string, port int, endPort int, protocol string) map[string]interface{} {
+	return map[string]interface{}{"ListenerId": listenerId, "Port": port, "EndPort": endPort, "Protocol": protocol,
+		"HealthCheck": map[string]interface{}{"HealthSwitch": 1, "TimeOut": 2, "IntervalTime": 5, "HealthNum": 3, "UnHealthNum": 3,
+			"CheckType": protocol, "CheckPort": -1}}
+}
+
+// describeListenersV3Result answers DescribeListeners of the clb v3 api with the listeners.
+func describeListenersV3Result(listeners ...map[string]interface{}) fakeHandler {
+	return func(url.Values) interface{} {
+		return v3Response(map[string]interface{}{"Listeners": listeners})
+	}
+}
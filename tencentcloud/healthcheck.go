@@ -0,0 +1,178 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// the listeners of classic clbs are described with their health checks by the sdk neither. The health checks
+// of application clbs are described and modified through the clb v3 api, the legacy api can't configure http
+// checks.
+
+type describeListenerHealthChecksResponse struct {
+	clb.Response
+	ListenerSet []struct {
+		UnListenerId string `json:"unListenerId"`
+		ListenerId   string `json:"listenerId"`
+		HealthSwitch int    `json:"healthSwitch"`
+		TimeOut      int    `json:"timeOut"`
+		IntervalTime int    `json:"intervalTime"`
+		HealthNum    int    `json:"healthNum"`
+		UnhealthNum  int    `json:"unhealthNum"`
+	} `json:"listenerSet"`
+}
+
+// describeListenerHealthChecks returns the health checks of the listeners of the clb by listener id.
+func (cloud *Cloud) describeListenerHealthChecks(loadBalancer *clb.LoadBalancer) (map[string]listenerHealthCheck, error) {
+	if loadBalancer.Forward != ClbLoadBalancerKindClassic {
+		return cloud.describeListenerHealthChecksV3(loadBalancer.LoadBalancerId)
+	}
+	response := &describeListenerHealthChecksResponse{}
+	err := cloud.clb.Invoke("DescribeLoadBalancerListeners", &clb.DescribeLoadBalancerListenersArgs{
+		LoadBalancerId: loadBalancer.LoadBalancerId,
+	}, response)
+	if err != nil {
+		return nil, err
+	}
+
+	healthChecks := map[string]listenerHealthCheck{}
+	for _, listener := range response.ListenerSet {
+		listenerId := listener.UnListenerId
+		if listenerId == "" {
+			listenerId = listener.ListenerId
+		}
+		healthChecks[listenerId] = listenerHealthCheck{
+			HealthSwitch: listener.HealthSwitch,
+			TimeOut:      listener.TimeOut,
+			IntervalTime: listener.IntervalTime,
+			HealthNum:    listener.HealthNum,
+			UnhealthNum:  listener.UnhealthNum,
+		}
+	}
+	return healthChecks, nil
+}
+
+// ensureListenerHealthChecks modifies the health checks of the listeners which differ from the check of the
+// port they serve. Listeners are only created when their port is new, so changes of the service which don't
+// touch its ports, like its external traffic policy, are applied here.
+func (cloud *Cloud) ensureListenerHealthChecks(ctx context.Context, service *v1.Service, loadBalancer *clb.LoadBalancer, listenerPorts map[string]v1.ServicePort) error {
+	if len(listenerPorts) == 0 {
+		return nil
+	}
+	current, err := cloud.describeListenerHealthChecks(loadBalancer)
+	if err != nil {
+		return err
+	}
+
+	listenerIds := make([]string, 0, len(listenerPorts))
+	for listenerId := range listenerPorts {
+		listenerIds = append(listenerIds, listenerId)
+	}
+	sort.Strings(listenerIds)
+
+	for _, listenerId := range listenerIds {
+		healthCheck := cloud.listenerHealthCheck(service, loadBalancer, listenerPorts[listenerId])
+		if current[listenerId] == healthCheck {
+			continue
+		}
+		glog.Infof("modifying health check of listener %s of loadbalancer %s from %+v to %+v",
+			listenerId, loadBalancer.LoadBalancerId, current[listenerId], healthCheck)
+		if loadBalancer.Forward != ClbLoadBalancerKindClassic {
+			if err := cloud.modifyListenerHealthCheckV3(ctx, loadBalancer.LoadBalancerId, listenerId, healthCheck); err != nil {
+				return err
+			}
+			continue
+		}
+		result, err := waitUntilDone(
+			ctx,
+			func() (clb.AsyncTask, error) {
+				return cloud.clb.ModifyLoadBalancerListener(&clb.ModifyLoadBalancerListenerArgs{
+					LoadBalancerId: loadBalancer.LoadBalancerId,
+					ListenerId:     listenerId,
+					HealthSwitch:   &healthCheck.HealthSwitch,
+					TimeOut:        &healthCheck.TimeOut,
+					IntervalTime:   &healthCheck.IntervalTime,
+					HealthNum:      &healthCheck.HealthNum,
+					UnhealthNum:    &healthCheck.UnhealthNum,
+				})
+			},
+			cloud.clb,
+		)
+		if err != nil {
+			return err
+		}
+		if result != clb.TaskSuccceed {
+			return errors.New("task is not succeed")
+		}
+	}
+	return nil
+}
+
+// defaultHealthCheckHttpCodes is 2xx in the bit mask of the api
+const defaultHealthCheckHttpCodes = 2
+
+// healthCheckHttpCodes returns the status codes the http checks of the service accept, see
+// ServiceAnnotationLoadBalancerHealthCheckHttpCodes. Invalid annotations are rejected by PlanLoadBalancer.
+func healthCheckHttpCodes(service *v1.Service) int {
+	value, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthCheckHttpCodes]
+	if !ok {
+		return defaultHealthCheckHttpCodes
+	}
+	codes, err := parseHealthCheckHttpCodes(value)
+	if err != nil {
+		return defaultHealthCheckHttpCodes
+	}
+	return codes
+}
+
+// parseHealthCheckHttpCodes parses a comma separated list of status code classes like 2xx and ranges of whole
+// classes like 200-399 into the bit mask of the api, 1 for 1xx, 2 for 2xx, 4 for 3xx, 8 for 4xx and 16 for 5xx.
+// The clb only matches whole classes, ranges splitting one are rejected.
+func parseHealthCheckHttpCodes(value string) (int, error) {
+	codes := 0
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		from, to, err := parseHttpCodeClasses(entry)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("%q: %v", entry, err))
+		}
+		for class := from; class <= to; class++ {
+			codes |= 1 << uint(class-1)
+		}
+	}
+	return codes, nil
+}
+
+// parseHttpCodeClasses returns the first and the last status code class, 1 to 5, of a class like 2xx or a range
+// of whole classes like 200-399.
+func parseHttpCodeClasses(entry string) (int, int, error) {
+	if len(entry) == 3 && strings.EqualFold(entry[1:], "xx") {
+		class, err := strconv.Atoi(entry[:1])
+		if err != nil || class < 1 || class > 5 {
+			return 0, 0, errors.New("not a status code class within 1xx-5xx")
+		}
+		return class, class, nil
+	}
+	bounds := strings.SplitN(entry, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errors.New("not a status code class like 2xx or a range of status codes like 200-399")
+	}
+	from, fromErr := strconv.Atoi(bounds[0])
+	to, toErr := strconv.Atoi(bounds[1])
+	if fromErr != nil || toErr != nil || from < 100 || to > 599 || from > to {
+		return 0, 0, errors.New("not a range of status codes within 100-599")
+	}
+	if from%100 != 0 || to%100 != 99 {
+		return 0, 0, errors.New("the clb only matches whole classes of status codes, the range must start at x00 and end at x99")
+	}
+	return from / 100, to / 100, nil
+}
@@ -0,0 +1,281 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestListenerHealthCheck(t *testing.T) {
+	portCheck := listenerHealthCheck{HealthSwitch: 1, TimeOut: 2, IntervalTime: 5, HealthNum: 3, UnhealthNum: 3}
+	fastPortCheck := portCheck
+	fastPortCheck.UnhealthNum = 2
+	httpCheck := portCheck
+	httpCheck.CheckType = healthCheckTypeHTTP
+	httpCheck.CheckPort = 32000
+	httpCheck.HttpCodes = 2
+
+	tests := []struct {
+		name                string
+		policy              v1.ServiceExternalTrafficPolicyType
+		healthCheckNodePort int32
+		forward             int
+		protocol            v1.Protocol
+		want                listenerHealthCheck
+	}{
+		{"cluster policy tcp", v1.ServiceExternalTrafficPolicyTypeCluster, 0, ClbLoadBalancerKindApplication, v1.ProtocolTCP, portCheck},
+		{"cluster policy udp", v1.ServiceExternalTrafficPolicyTypeCluster, 0, ClbLoadBalancerKindApplication, v1.ProtocolUDP, portCheck},
+		{"local policy tcp", v1.ServiceExternalTrafficPolicyTypeLocal, 32000, ClbLoadBalancerKindApplication, v1.ProtocolTCP, httpCheck},
+		{"local policy udp", v1.ServiceExternalTrafficPolicyTypeLocal, 32000, ClbLoadBalancerKindApplication, v1.ProtocolUDP, portCheck},
+		{"local policy tcp on classic clb", v1.ServiceExternalTrafficPolicyTypeLocal, 32000, ClbLoadBalancerKindClassic, v1.ProtocolTCP, fastPortCheck},
+		{"local policy tcp without health check node port", v1.ServiceExternalTrafficPolicyTypeLocal, 0, ClbLoadBalancerKindApplication, v1.ProtocolTCP, fastPortCheck},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cloud := &Cloud{}
+			service := fakeService(nil)
+			service.Spec.ExternalTrafficPolicy = test.policy
+			service.Spec.HealthCheckNodePort = test.healthCheckNodePort
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: test.forward}
+
+			got := cloud.listenerHealthCheck(service, loadBalancer, fakeServicePort("p", 80, test.protocol, 30080))
+			if got != test.want {
+				t.Errorf("health check %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnsureApplicationLoadBalancerListenersHealthChecks(t *testing.T) {
+	ports := []v1.ServicePort{
+		fakeServicePort("http", 80, v1.ProtocolTCP, 30080),
+		fakeServicePort("dns", 53, v1.ProtocolUDP, 30053),
+	}
+	legacy := []map[string]interface{}{
+		fakeFourthLayerListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP),
+		fakeFourthLayerListener("lbl-53", 53, ClbLoadBalancerListenerProtocolUDP),
+	}
+	httpChecked := fakeListenerV3("lbl-80", 80, 0, "TCP")
+	httpChecked["HealthCheck"].(map[string]interface{})["CheckType"] = healthCheckTypeHTTP
+	httpChecked["HealthCheck"].(map[string]interface{})["CheckPort"] = 32000
+	httpChecked["HealthCheck"].(map[string]interface{})["HttpCode"] = 2
+
+	tests := []struct {
+		name        string
+		httpCodes   string
+		legacy      []map[string]interface{}
+		v3          []map[string]interface{}
+		wantCalls   []string
+		wantCreated []string
+	}{
+		{
+			name: "listeners created",
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.CreateForwardLBFourthLayerListeners",
+				"clbv3.CreateListener", "clbv3.DescribeTaskStatus"},
+			wantCreated: []string{"53"},
+		},
+		{
+			name:   "port checked listeners modified",
+			legacy: legacy,
+			v3:     []map[string]interface{}{fakeListenerV3("lbl-80", 80, 0, "TCP"), fakeListenerV3("lbl-53", 53, 0, "UDP")},
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.DescribeForwardLBListeners",
+				"clbv3.DescribeListeners", "clbv3.ModifyListener", "clbv3.DescribeTaskStatus"},
+		},
+		{
+			name:      "listeners checked as desired",
+			legacy:    legacy,
+			v3:        []map[string]interface{}{httpChecked, fakeListenerV3("lbl-53", 53, 0, "UDP")},
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.DescribeForwardLBListeners", "clbv3.DescribeListeners"},
+		},
+		{
+			name:      "listeners created with the status codes of the service",
+			httpCodes: "2xx,3xx",
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.CreateForwardLBFourthLayerListeners",
+				"clbv3.CreateListener", "clbv3.DescribeTaskStatus"},
+			wantCreated: []string{"53"},
+		},
+		{
+			name:      "status codes of the service changed",
+			httpCodes: "200-399",
+			legacy:    legacy,
+			v3:        []map[string]interface{}{httpChecked, fakeListenerV3("lbl-53", 53, 0, "UDP")},
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.DescribeForwardLBListeners",
+				"clbv3.DescribeListeners", "clbv3.ModifyListener", "clbv3.DescribeTaskStatus"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeForwardLBListeners", describeForwardLBListenersResult(test.legacy...))
+			api.handle("clbv3.DescribeListeners", describeListenersV3Result(test.v3...))
+			api.handle("clbv3.CreateListener", v3Task)
+			api.handle("clbv3.ModifyListener", v3Task)
+			api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+			api.handle("clb.CreateForwardLBFourthLayerListeners", legacyTask)
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			annotations := map[string]string{}
+			wantHttpCode := 2
+			if test.httpCodes != "" {
+				annotations[ServiceAnnotationLoadBalancerHealthCheckHttpCodes] = test.httpCodes
+				wantHttpCode = 6
+			}
+			service := fakeService(annotations, ports...)
+			service.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+			service.Spec.HealthCheckNodePort = 32000
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+			if err := cloud.ensureApplicationLoadBalancerListeners(context.Background(), "kubernetes", service, loadBalancer); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %s", got, strings.Join(test.wantCalls, ","))
+			}
+			created := []string{}
+			for _, call := range api.callsOf("clb.CreateForwardLBFourthLayerListeners") {
+				for i := 0; call.Get(fmt.Sprintf("listeners.%d.loadBalancerPort", i)) != ""; i++ {
+					created = append(created, call.Get(fmt.Sprintf("listeners.%d.loadBalancerPort", i)))
+				}
+			}
+			if strings.Join(created, ",") != strings.Join(test.wantCreated, ",") {
+				t.Errorf("legacy listeners created for ports %v, want %v", created, test.wantCreated)
+			}
+
+			checked := append(api.callsOf("clbv3.CreateListener"), api.callsOf("clbv3.ModifyListener")...)
+			for _, call := range checked {
+				if call.Get("Ports.0") != "" && call.Get("Ports.0") != "80" {
+					t.Errorf("listener of port %s created through the v3 api, want the tcp port only", call.Get("Ports.0"))
+				}
+				if call.Get("EndPort") != "" {
+					t.Errorf("listener of a single port created with end port %s", call.Get("EndPort"))
+				}
+				assertHttpHealthCheck(t, call, 32000, wantHttpCode)
+			}
+		})
+	}
+}
+
+func assertHttpHealthCheck(t *testing.T, call url.Values, checkPort int, httpCode int) {
+	want := map[string]string{
+		"HealthCheck.HealthSwitch":  "1",
+		"HealthCheck.CheckType":     healthCheckTypeHTTP,
+		"HealthCheck.CheckPort":     fmt.Sprint(checkPort),
+		"HealthCheck.HttpCheckPath": healthCheckPath,
+		"HealthCheck.HttpCode":      fmt.Sprint(httpCode),
+		"HealthCheck.HttpVersion":   "HTTP/1.1",
+	}
+	for key, value := range want {
+		if got := call.Get(key); got != value {
+			t.Errorf("%s is %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestEnsureListenerHealthChecks(t *testing.T) {
+	tests := []struct {
+		name       string
+		forward    int
+		policy     v1.ServiceExternalTrafficPolicyType
+		wantModify []string
+	}{
+		{"classic clb unchanged", ClbLoadBalancerKindClassic, v1.ServiceExternalTrafficPolicyTypeCluster, nil},
+		{"classic clb switched to local policy", ClbLoadBalancerKindClassic, v1.ServiceExternalTrafficPolicyTypeLocal,
+			[]string{"clb.ModifyLoadBalancerListener"}},
+		{"application clb unchanged", ClbLoadBalancerKindApplication, v1.ServiceExternalTrafficPolicyTypeCluster, nil},
+		{"application clb switched to local policy", ClbLoadBalancerKindApplication, v1.ServiceExternalTrafficPolicyTypeLocal,
+			[]string{"clbv3.ModifyListener"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancerListeners", describeLoadBalancerListenersResult(
+				fakeClassicListener("lbl-80", 80, 30080, ClbLoadBalancerListenerProtocolTCP)))
+			api.handle("clb.ModifyLoadBalancerListener", legacyTask)
+			api.handle("clbv3.DescribeListeners", describeListenersV3Result(fakeListenerV3("lbl-80", 80, 0, "TCP")))
+			api.handle("clbv3.ModifyListener", v3Task)
+			api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			port := fakeServicePort("http", 80, v1.ProtocolTCP, 30080)
+			service := fakeService(nil, port)
+			service.Spec.ExternalTrafficPolicy = test.policy
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: test.forward}
+			if err := cloud.ensureListenerHealthChecks(context.Background(), service, loadBalancer, map[string]v1.ServicePort{"lbl-80": port}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			modified := []string{}
+			for _, action := range api.actions() {
+				if strings.Contains(action, "Modify") {
+					modified = append(modified, action)
+				}
+			}
+			if strings.Join(modified, ",") != strings.Join(test.wantModify, ",") {
+				t.Errorf("modified by %v, want %v", modified, test.wantModify)
+			}
+			for _, call := range api.callsOf("clb.ModifyLoadBalancerListener") {
+				if call.Get("listenerId") != "lbl-80" || call.Get("unhealthNum") != "2" {
+					t.Errorf("listener modified with %v, want lbl-80 with the faster unhealthy threshold", call)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHealthCheckHttpCodes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "2xx", want: 2},
+		{value: "2xx,3xx", want: 6},
+		{value: " 2XX , 4xx", want: 10},
+		{value: "200-399", want: 6},
+		{value: "100-599", want: 31},
+		{value: "500-599,1xx", want: 17},
+		{value: "", wantErr: true},
+		{value: "2xx,", wantErr: true},
+		{value: "6xx", wantErr: true},
+		{value: "0xx", wantErr: true},
+		{value: "200", wantErr: true},
+		{value: "200-350", wantErr: true},
+		{value: "250-299", wantErr: true},
+		{value: "399-200", wantErr: true},
+		{value: "0-99", wantErr: true},
+		{value: "500-699", wantErr: true},
+		{value: "two-xx", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseHealthCheckHttpCodes(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parsed %q into %d, want an error", test.value, got)
+				}
+			} else if err != nil || got != test.want {
+				t.Errorf("parsed %q into %d, %v, want %d", test.value, got, err, test.want)
+			}
+
+			// invalid status codes fail the plan, before any api is called
+			service := fakeService(map[string]string{ServiceAnnotationLoadBalancerHealthCheckHttpCodes: test.value},
+				fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			_, err = PlanLoadBalancer(Config{}, service, []*v1.Node{fakeNode("10.0.0.1")})
+			planErr, ok := err.(*PlanError)
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.wantErr && (!ok || planErr.Reason != "InvalidHealthCheckHttpCodes") {
+				t.Errorf("PlanLoadBalancer error %v, want an InvalidHealthCheckHttpCodes plan error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+// InstanceFilterConfig is a DescribeInstances filter instance lookups are narrowed by, see Config.InstanceFilters.
+type InstanceFilterConfig struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// instanceFilterNames are the filters of the sdk instance_filters can use. The instance id and private ip
+// filters are set by the lookups themselves.
+var instanceFilterNames = []string{
+	cvm.FilterNameZone,
+	cvm.FilterNameProjectId,
+	cvm.FilterNameHostId,
+	cvm.FilterNameInstanceName,
+	cvm.FilterNameInstanceChargeType,
+	cvm.FilterNamePublicIpAddress,
+}
+
+func validateInstanceFilters(filters []InstanceFilterConfig) []error {
+	problems := []error{}
+	known := map[string]bool{}
+	for _, name := range instanceFilterNames {
+		known[name] = true
+	}
+	seen := map[string]bool{}
+	for _, filter := range filters {
+		switch {
+		case !known[filter.Name]:
+			problems = append(problems, errors.New(fmt.Sprintf("invalid instance_filters filter %q, must be one of %s",
+				filter.Name, strings.Join(instanceFilterNames, ", "))))
+		case seen[filter.Name]:
+			problems = append(problems, errors.New(fmt.Sprintf("invalid instance_filters, filter %q is given twice", filter.Name)))
+		case len(filter.Values) == 0:
+			problems = append(problems, errors.New(fmt.Sprintf("invalid instance_filters filter %q without values", filter.Name)))
+		}
+		seen[filter.Name] = true
+	}
+	return problems
+}
+
+// instanceFilters returns the filters of a lookup with the configured instance_filters added.
+func (cloud *Cloud) instanceFilters(filters ...cvm.Filter) *[]cvm.Filter {
+	for _, filter := range cloud.config.InstanceFilters {
+		values := make([]interface{}, len(filter.Values))
+		for i, value := range filter.Values {
+			values[i] = value
+		}
+		filters = append(filters, cvm.Filter{Name: filter.Name, Values: values})
+	}
+	return &filters
+}
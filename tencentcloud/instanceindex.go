@@ -0,0 +1,335 @@
+package tencentcloud
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	// instanceIndexLookups counts the node address lookups answered by the instance index and the ones which
+	// went to the api, a low hit rate with many nodes asks for a longer instance_index_ttl.
+	instanceIndexLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: providerName,
+			Name:      "instance_index_lookups_total",
+			Help:      "Number of node address lookups by whether the instance index answered them.",
+		},
+		[]string{"result"},
+	)
+	// instanceIndexRefreshes counts the instances the background refresh described again before their entries
+	// expired, by whether they were refreshed or dropped because they are gone or no longer running.
+	instanceIndexRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: providerName,
+			Name:      "instance_index_refreshes_total",
+			Help:      "Number of instances described by the background refresh of the instance index, by outcome.",
+		},
+		[]string{"result"},
+	)
+	// instanceIndexInstances is the number of instances held by the instance index, at instance_index_size the
+	// least recently used ones are evicted to index others.
+	instanceIndexInstances = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: providerName,
+			Name:      "instance_index_instances",
+			Help:      "Number of instances held by the instance index.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(instanceIndexLookups)
+	prometheus.MustRegister(instanceIndexRefreshes)
+	prometheus.MustRegister(instanceIndexInstances)
+}
+
+const (
+	// instanceStateRunning is the state of instances whose addresses are settled
+	instanceStateRunning = "RUNNING"
+
+	// instanceIndexJitter is the fraction of the ttl entries expire early by at most, so the entries of the
+	// nodes registered at once don't expire together
+	instanceIndexJitter = 0.2
+	// instanceIndexRefreshRounds is the number of refresh rounds per ttl, each refreshes the entries expiring
+	// before the next one
+	instanceIndexRefreshRounds = 4
+	// maxInstancesPerRefresh is the number of instances a DescribeInstances call accepts
+	maxInstancesPerRefresh = 100
+	// defaultInstanceIndexSize is the number of instances indexed unless instance_index_size is set
+	defaultInstanceIndexSize = 5000
+)
+
+// instanceIndex remembers the instances looked up for node addresses by their private ips and instance ids,
+// so the node controller asking for the addresses of every node every few seconds doesn't describe each
+// instance each time. Entries expire after the configured ttl, so changed addresses are picked up.
+// Only running instances are answered from the index. A stopped instance gets a new public ip when it is
+// started again, so instances in any other state are looked up every time until they run again.
+// The index holds a bounded number of instances, the least recently used one is evicted to index another,
+// so clusters recycling many instances don't grow it without bound.
+type instanceIndex struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]instanceIndexEntry
+	// instances are the keys of the entries by instance id
+	instances map[string]*indexedInstance
+	// lru holds the ids of the indexed instances, the most recently used first
+	lru *list.List
+	// states are the last states the api reported for the instances by instance id
+	states map[string]string
+}
+
+type instanceIndexEntry struct {
+	instance *cvm.InstanceInfo
+	expires  time.Time
+	// used is the last time the entry answered a lookup, entries not used for a ttl are not refreshed
+	used time.Time
+}
+
+type indexedInstance struct {
+	keys    map[string]bool
+	element *list.Element
+}
+
+func newInstanceIndex(ttlSeconds int, size int) *instanceIndex {
+	if size == 0 {
+		size = defaultInstanceIndexSize
+	}
+	return &instanceIndex{
+		ttl:       time.Duration(ttlSeconds) * time.Second,
+		size:      size,
+		entries:   map[string]instanceIndexEntry{},
+		instances: map[string]*indexedInstance{},
+		lru:       list.New(),
+		states:    map[string]string{},
+	}
+}
+
+// noteStates records the states of the instances of a DescribeInstances response.
+func (index *instanceIndex) noteStates(states map[string]string) {
+	if index.ttl == 0 {
+		return
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	for instanceId, state := range states {
+		index.states[instanceId] = state
+	}
+}
+
+// get returns the instance indexed under key, if the index is enabled and the entry is fresh.
+func (index *instanceIndex) get(key string) (*cvm.InstanceInfo, bool) {
+	if index.ttl == 0 {
+		return nil, false
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	entry, ok := index.entries[key]
+	if !ok || time.Now().After(entry.expires) || index.states[entry.instance.InstanceID] != instanceStateRunning {
+		if ok {
+			index.removeKey(key)
+			instanceIndexInstances.Set(float64(index.lru.Len()))
+		}
+		instanceIndexLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	instanceIndexLookups.WithLabelValues("hit").Inc()
+	entry.used = time.Now()
+	index.entries[key] = entry
+	index.lru.MoveToFront(index.instances[entry.instance.InstanceID].element)
+	return entry.instance, true
+}
+
+// add indexes the instance under its instance id, each of its private ips and the extra keys given, if it
+// was last seen running. The least recently used instances are evicted beyond the size of the index.
+func (index *instanceIndex) add(instance *cvm.InstanceInfo, keys ...string) {
+	if index.ttl == 0 {
+		return
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if index.states[instance.InstanceID] != instanceStateRunning {
+		return
+	}
+	now := time.Now()
+	ttl := time.Duration(float64(index.ttl) * (1 - instanceIndexJitter*rand.Float64()))
+	entry := instanceIndexEntry{instance: instance, expires: now.Add(ttl), used: now}
+	index.setKey(instance.InstanceID, entry)
+	for _, ip := range instance.PrivateIPAddresses {
+		index.setKey(ip, entry)
+	}
+	for _, key := range keys {
+		index.setKey(key, entry)
+	}
+	index.lru.MoveToFront(index.instances[instance.InstanceID].element)
+	for index.lru.Len() > index.size {
+		index.removeInstance(index.lru.Back().Value.(string))
+	}
+	instanceIndexInstances.Set(float64(index.lru.Len()))
+}
+
+// setKey indexes the entry under key. A key indexing another instance before, like the private ip of a
+// deleted instance, moves to the instance of the entry.
+func (index *instanceIndex) setKey(key string, entry instanceIndexEntry) {
+	if previous, ok := index.entries[key]; ok && previous.instance.InstanceID != entry.instance.InstanceID {
+		index.removeKey(key)
+	}
+	instanceId := entry.instance.InstanceID
+	indexed, ok := index.instances[instanceId]
+	if !ok {
+		indexed = &indexedInstance{keys: map[string]bool{}, element: index.lru.PushFront(instanceId)}
+		index.instances[instanceId] = indexed
+	}
+	indexed.keys[key] = true
+	index.entries[key] = entry
+}
+
+// removeKey removes the entry under key, and the instance once none of its keys are left.
+func (index *instanceIndex) removeKey(key string) {
+	instanceId := index.entries[key].instance.InstanceID
+	delete(index.entries, key)
+	indexed := index.instances[instanceId]
+	delete(indexed.keys, key)
+	if len(indexed.keys) == 0 {
+		index.lru.Remove(indexed.element)
+		delete(index.instances, instanceId)
+	}
+}
+
+// removeInstance removes the entries of the instance and its state.
+func (index *instanceIndex) removeInstance(instanceId string) {
+	indexed := index.instances[instanceId]
+	for key := range indexed.keys {
+		delete(index.entries, key)
+	}
+	index.lru.Remove(indexed.element)
+	delete(index.instances, instanceId)
+	delete(index.states, instanceId)
+}
+
+// prune removes the expired entries and the states of the instances which aren't indexed. Entries not used for
+// a ttl are not refreshed, they expire and are removed here, as are the states noted by lookups of instances
+// which were never indexed.
+func (index *instanceIndex) prune() {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	now := time.Now()
+	for key, entry := range index.entries {
+		if now.After(entry.expires) {
+			index.removeKey(key)
+		}
+	}
+	for instanceId := range index.states {
+		if _, ok := index.instances[instanceId]; !ok {
+			delete(index.states, instanceId)
+		}
+	}
+	instanceIndexInstances.Set(float64(index.lru.Len()))
+}
+
+// expiring returns the ids of the instances with entries used within the ttl which expire before deadline.
+func (index *instanceIndex) expiring(deadline time.Time) []string {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	usedSince := time.Now().Add(-index.ttl)
+	instanceIds := []string{}
+	seen := map[string]bool{}
+	for _, entry := range index.entries {
+		instanceId := entry.instance.InstanceID
+		if seen[instanceId] || entry.expires.After(deadline) || entry.used.Before(usedSince) {
+			continue
+		}
+		seen[instanceId] = true
+		instanceIds = append(instanceIds, instanceId)
+	}
+	return instanceIds
+}
+
+// refresh replaces the entries of the instances by the described ones, keeping their keys and the time they
+// were last used. Entries of instances which weren't described are removed.
+func (index *instanceIndex) refresh(instanceIds []string, described map[string]*cvm.InstanceInfo) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	refreshed := map[string]bool{}
+	for _, instanceId := range instanceIds {
+		refreshed[instanceId] = true
+	}
+	now := time.Now()
+	expires := map[string]time.Time{}
+	for key, entry := range index.entries {
+		instanceId := entry.instance.InstanceID
+		if !refreshed[instanceId] {
+			continue
+		}
+		instance, ok := described[instanceId]
+		if !ok || index.states[instanceId] != instanceStateRunning {
+			index.removeKey(key)
+			continue
+		}
+		// the keys of an instance share their expiry
+		if _, ok := expires[instanceId]; !ok {
+			expires[instanceId] = now.Add(time.Duration(float64(index.ttl) * (1 - instanceIndexJitter*rand.Float64())))
+		}
+		entry.instance, entry.expires = instance, expires[instanceId]
+		index.entries[key] = entry
+	}
+	instanceIndexInstances.Set(float64(index.lru.Len()))
+}
+
+// runInstanceIndexRefresh describes the instances of the index again shortly before their entries expire, a
+// hundred per call, so the lookups of the node controller keep being answered by the index.
+func (cloud *Cloud) runInstanceIndexRefresh() {
+	period := cloud.instanceIndex.ttl / instanceIndexRefreshRounds
+	if period < time.Second {
+		period = time.Second
+	}
+	wait.Until(func() {
+		cloud.refreshInstanceIndex(time.Now().Add(2 * period))
+	}, period, wait.NeverStop)
+}
+
+func (cloud *Cloud) refreshInstanceIndex(deadline time.Time) {
+	cloud.instanceIndex.prune()
+	instanceIds := cloud.instanceIndex.expiring(deadline)
+	// the refresh is bounded like the syncs of clbs the provider starts itself, a hanging api doesn't stall it
+	ctx, cancel, _ := cloud.withBackgroundReconcile()
+	defer cancel()
+	for start := 0; start < len(instanceIds); start += maxInstancesPerRefresh {
+		end := start + maxInstancesPerRefresh
+		if end > len(instanceIds) {
+			end = len(instanceIds)
+		}
+		chunk := instanceIds[start:end]
+		response, err := describeInstances(ctx, cloud.cvmV3, &cvm.DescribeInstancesArgs{
+			Version:     cvm.DefaultVersion,
+			InstanceIds: &chunk,
+		})
+		if err != nil {
+			// the entries expire and are looked up in the foreground
+			glog.V(4).Infof("failed to refresh %d instances of the instance index: %v", len(chunk), err)
+			continue
+		}
+		cloud.instanceIndex.noteStates(response.InstanceStates)
+		described := map[string]*cvm.InstanceInfo{}
+		for i := range response.InstanceSet {
+			instance := &response.InstanceSet[i]
+			described[instance.InstanceID] = instance
+		}
+		for _, instanceId := range chunk {
+			if instance, ok := described[instanceId]; ok && response.InstanceStates[instance.InstanceID] == instanceStateRunning {
+				instanceIndexRefreshes.WithLabelValues("refreshed").Inc()
+			} else {
+				instanceIndexRefreshes.WithLabelValues("dropped").Inc()
+			}
+		}
+		cloud.instanceIndex.refresh(chunk, described)
+	}
+}
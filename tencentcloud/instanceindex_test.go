@@ -0,0 +1,174 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstanceIndexInstanceStates(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  int
+		// states and publicIps are what the api reports for the instance on each lookup
+		states      []string
+		publicIps   []string
+		wantLookups int
+		want        []string
+	}{
+		{"running instance indexed", 60, []string{"RUNNING"}, []string{"1.1.1.1"}, 1, []string{"1.1.1.1", "1.1.1.1"}},
+		{"index disabled", 0, []string{"RUNNING", "RUNNING"}, []string{"1.1.1.1", "1.1.1.1"}, 2, []string{"1.1.1.1", "1.1.1.1"}},
+		{"stopped instance started with a new public ip", 60, []string{"STOPPED", "RUNNING", "RUNNING"}, []string{"1.1.1.1", "2.2.2.2", "2.2.2.2"},
+			2, []string{"1.1.1.1", "2.2.2.2", "2.2.2.2"}},
+		{"starting instance looked up every time", 60, []string{"STARTING", "STARTING"}, []string{"", ""}, 2, []string{"", ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			var lookups int32
+			api.handle("cvm.DescribeInstances", func(params url.Values) interface{} {
+				i := atomic.AddInt32(&lookups, 1) - 1
+				instance := fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, []string{test.publicIps[i]})
+				instance["InstanceState"] = test.states[i]
+				return describeInstancesResult(instance)(params)
+			})
+			cloud, _ := newTestCloud(t, Config{InstanceIndexTTL: test.ttl}, api, nil)
+
+			for i, want := range test.want {
+				addresses, err := cloud.NodeAddressesByProviderID(context.Background(), "tencentcloud:///ap-guangzhou-3/ins-1")
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got := ""
+				if len(addresses) > 1 {
+					got = addresses[1].Address
+				}
+				if got != want {
+					t.Errorf("external ip of call %d is %q, want %q", i, got, want)
+				}
+			}
+			if lookups != int32(test.wantLookups) {
+				t.Errorf("%d lookups, want %d", lookups, test.wantLookups)
+			}
+		})
+	}
+}
+
+func TestRefreshInstanceIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// refreshed is what the refresh describes, nil if the instance is gone
+		refreshed map[string]interface{}
+		wantHit   bool
+		want      string
+	}{
+		{"instance refreshed", fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, []string{"2.2.2.2"}), true, "2.2.2.2"},
+		{"instance gone", nil, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvmv3.DescribeInstances", func(params url.Values) interface{} {
+				if test.refreshed == nil {
+					return describeInstancesResult()(params)
+				}
+				return describeInstancesResult(test.refreshed)(params)
+			})
+			cloud, _ := newTestCloud(t, Config{InstanceIndexTTL: 60}, api, nil)
+			instance := &cvm.InstanceInfo{InstanceID: "ins-1", PrivateIPAddresses: []string{"10.0.0.1"}, PublicIPAddresses: []string{"1.1.1.1"}}
+			cloud.instanceIndex.noteStates(map[string]string{"ins-1": instanceStateRunning})
+			cloud.instanceIndex.add(instance)
+
+			cloud.refreshInstanceIndex(time.Now().Add(time.Hour))
+
+			calls := api.callsOf("cvmv3.DescribeInstances")
+			if len(calls) != 1 || calls[0].Get("InstanceIds.0") != "ins-1" {
+				t.Errorf("index refreshed by %v, want a lookup of ins-1", calls)
+			}
+			got, hit := cloud.instanceIndex.get("10.0.0.1")
+			if hit != test.wantHit {
+				t.Fatalf("index hit %t, want %t", hit, test.wantHit)
+			}
+			if hit && got.PublicIPAddresses[0] != test.want {
+				t.Errorf("indexed public ip %s, want %s", got.PublicIPAddresses[0], test.want)
+			}
+		})
+	}
+}
+
+// TestInstanceIndexChurn cycles 20000 instances through the index, like a fleet of spot instances recycled over
+// a day. The index keeps the 5000 used last, the instance looked up all along among them.
+func TestInstanceIndexChurn(t *testing.T) {
+	index := newInstanceIndex(60, 0)
+	for i := 0; i < 20000; i++ {
+		instanceId := fmt.Sprintf("ins-%d", i)
+		ip := fmt.Sprintf("10.%d.%d.%d", i/65536, i/256%256, i%256)
+		index.noteStates(map[string]string{instanceId: instanceStateRunning})
+		index.add(&cvm.InstanceInfo{InstanceID: instanceId, PrivateIPAddresses: []string{ip}}, "node-"+instanceId)
+		if i%1000 == 0 {
+			if _, hit := index.get("ins-0"); !hit {
+				t.Fatalf("ins-0 evicted after %d instances although it is looked up", i)
+			}
+		}
+	}
+
+	if index.lru.Len() != 5000 || len(index.instances) != 5000 || len(index.entries) != 3*5000 || len(index.states) != 5000 {
+		t.Errorf("index holds %d instances, %d entries and %d states, want 5000 instances with 3 keys and a state each",
+			len(index.instances), len(index.entries), len(index.states))
+	}
+	var gauge dto.Metric
+	if err := instanceIndexInstances.Write(&gauge); err != nil || gauge.GetGauge().GetValue() != 5000 {
+		t.Errorf("instance gauge %v, %v, want 5000", gauge.GetGauge().GetValue(), err)
+	}
+	for key, wantHit := range map[string]bool{"ins-0": true, "ins-1": false, "ins-15000": false, "ins-15001": true, "10.0.78.31": true, "node-ins-19999": true} {
+		if _, hit := index.get(key); hit != wantHit {
+			t.Errorf("index hit of %s %t, want %t", key, hit, wantHit)
+		}
+	}
+}
+
+func TestInstanceIndexPrune(t *testing.T) {
+	index := newInstanceIndex(60, 0)
+	// ins-2 was looked up stopped, its state is noted but it is never indexed
+	index.noteStates(map[string]string{"ins-1": instanceStateRunning, "ins-2": "STOPPED", "ins-3": instanceStateRunning})
+	index.add(&cvm.InstanceInfo{InstanceID: "ins-1", PrivateIPAddresses: []string{"10.0.0.1"}})
+	index.add(&cvm.InstanceInfo{InstanceID: "ins-3", PrivateIPAddresses: []string{"10.0.0.3"}})
+	// ins-1 wasn't used for a ttl, it wasn't refreshed and expired
+	for _, key := range []string{"ins-1", "10.0.0.1"} {
+		entry := index.entries[key]
+		entry.expires = time.Now().Add(-time.Second)
+		index.entries[key] = entry
+	}
+
+	index.prune()
+
+	if len(index.instances) != 1 || index.instances["ins-3"] == nil || len(index.entries) != 2 {
+		t.Errorf("index holds %d instances with %d entries, want ins-3 alone", len(index.instances), len(index.entries))
+	}
+	if len(index.states) != 1 || index.states["ins-3"] != instanceStateRunning {
+		t.Errorf("states %v, want the state of ins-3 alone", index.states)
+	}
+}
+
+func TestInstanceIndexReusedIp(t *testing.T) {
+	index := newInstanceIndex(60, 0)
+	index.noteStates(map[string]string{"ins-1": instanceStateRunning, "ins-2": instanceStateRunning})
+	index.add(&cvm.InstanceInfo{InstanceID: "ins-1", PrivateIPAddresses: []string{"10.0.0.1"}})
+	// ins-1 was deleted, ins-2 got its private ip
+	index.add(&cvm.InstanceInfo{InstanceID: "ins-2", PrivateIPAddresses: []string{"10.0.0.1"}})
+
+	if got, hit := index.get("10.0.0.1"); !hit || got.InstanceID != "ins-2" {
+		t.Errorf("10.0.0.1 indexes %v, want ins-2", got)
+	}
+	if keys := index.instances["ins-1"].keys; len(keys) != 1 || !keys["ins-1"] {
+		t.Errorf("keys of ins-1 %v, want its instance id alone", keys)
+	}
+}
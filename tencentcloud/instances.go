@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
 
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 )
@@ -18,18 +22,25 @@ import (
 // returns the address of the calling instance. We should do a rename to
 // make this clearer.
 func (cloud *Cloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
-	node, err := cloud.getInstanceByInstancePrivateIp(string(name))
-	if err != nil {
-		return []v1.NodeAddress{}, err
+	if cloud.isLocalNode(name) {
+		addresses, err := cloud.localNodeAddresses(ctx)
+		if err == nil {
+			return addresses, nil
+		}
+		recordMetadataFallback("NodeAddresses", err)
 	}
-	addresses := make([]v1.NodeAddress, len(node.PrivateIPAddresses)+len(node.PublicIPAddresses))
-	for idx, ip := range node.PrivateIPAddresses {
-		addresses[idx] = v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip}
+
+	if instance, ok := cloud.instanceIndex.get(string(name)); ok {
+		return cloud.nodeAddresses(instance)
 	}
-	for idx, ip := range node.PublicIPAddresses {
-		addresses[len(node.PrivateIPAddresses)+idx] = v1.NodeAddress{Type: v1.NodeExternalIP, Address: ip}
+	node, err := cloud.lookupInstance(ctx, "NodeAddresses", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		return cloud.getInstanceByNodeName(ctx, name)
+	})
+	if err != nil {
+		return []v1.NodeAddress{}, cloud.instanceNotFound.translate("NodeAddresses", err)
 	}
-	return addresses, nil
+	cloud.instanceIndex.add(node, string(name))
+	return cloud.nodeAddresses(node)
 }
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
@@ -38,31 +49,37 @@ func (cloud *Cloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]v
 // from the node whose nodeaddresses are being queried. i.e. local metadata
 // services cannot be used in this method to obtain nodeaddresses
 func (cloud *Cloud) NodeAddressesByProviderID(ctx context.Context, providerID string) ([]v1.NodeAddress, error) {
-	id := strings.TrimPrefix(providerID, fmt.Sprintf("%s://", providerName))
-	parts := strings.Split(id, "/")
-	if len(parts) == 3 {
-		instance, err := cloud.getInstanceByInstanceID(parts[2])
-		if err != nil {
-			return []v1.NodeAddress{}, err
-		}
-		addresses := make([]v1.NodeAddress, len(instance.PrivateIPAddresses)+len(instance.PublicIPAddresses))
-		for idx, ip := range instance.PrivateIPAddresses {
-			addresses[idx] = v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip}
+	if _, instanceID, err := parseProviderID(providerID); err == nil {
+		if instance, ok := cloud.instanceIndex.get(instanceID); ok {
+			return cloud.nodeAddresses(instance)
 		}
-		for idx, ip := range instance.PublicIPAddresses {
-			addresses[len(instance.PrivateIPAddresses)+idx] = v1.NodeAddress{Type: v1.NodeExternalIP, Address: ip}
-		}
-		return addresses, nil
 	}
-	return []v1.NodeAddress{}, errors.New(fmt.Sprintf("invalid format for providerId %s", providerID))
+	instance, err := cloud.lookupInstance(ctx, "NodeAddressesByProviderID", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		return cloud.getInstanceByProviderID(ctx, providerID)
+	})
+	if err != nil {
+		return []v1.NodeAddress{}, cloud.instanceNotFound.translate("NodeAddressesByProviderID", err)
+	}
+	cloud.instanceIndex.add(instance)
+	return cloud.nodeAddresses(instance)
 }
 
 // ExternalID returns the cloud provider ID of the node with the specified NodeName.
 // Note that if the instance does not exist or is no longer running, we must return ("", cloudprovider.InstanceNotFound)
 func (cloud *Cloud) ExternalID(ctx context.Context, nodeName types.NodeName) (string, error) {
-	node, err := cloud.getInstanceByInstancePrivateIp(string(nodeName))
+	if cloud.isLocalNode(nodeName) {
+		instanceID, err := cloud.localInstanceID()
+		if err == nil {
+			return instanceID, nil
+		}
+		recordMetadataFallback("ExternalID", err)
+	}
+
+	node, err := cloud.lookupInstance(ctx, "ExternalID", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		return cloud.getInstanceByNodeName(ctx, nodeName)
+	})
 	if err != nil {
-		return "", err
+		return "", cloud.instanceNotFound.translate("ExternalID", err)
 	}
 
 	return node.InstanceID, nil
@@ -70,9 +87,19 @@ func (cloud *Cloud) ExternalID(ctx context.Context, nodeName types.NodeName) (st
 
 // InstanceID returns the cloud provider ID of the node with the specified NodeName.
 func (cloud *Cloud) InstanceID(ctx context.Context, nodeName types.NodeName) (string, error) {
-	node, err := cloud.getInstanceByInstancePrivateIp(string(nodeName))
+	if cloud.isLocalNode(nodeName) {
+		instanceID, err := cloud.localZonedInstanceID()
+		if err == nil {
+			return instanceID, nil
+		}
+		recordMetadataFallback("InstanceID", err)
+	}
+
+	node, err := cloud.lookupInstance(ctx, "InstanceID", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		return cloud.getInstanceByNodeName(ctx, nodeName)
+	})
 	if err != nil {
-		return "", err
+		return "", cloud.instanceNotFound.translate("InstanceID", err)
 	}
 
 	return fmt.Sprintf("/%s/%s", node.Placement.Zone, node.InstanceID), nil
@@ -80,12 +107,24 @@ func (cloud *Cloud) InstanceID(ctx context.Context, nodeName types.NodeName) (st
 
 // InstanceType returns the type of the specified instance.
 func (cloud *Cloud) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
-	return providerName, nil
+	instance, err := cloud.lookupInstance(ctx, "InstanceType", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		return cloud.getInstanceByNodeName(ctx, name)
+	})
+	if err != nil {
+		return "", cloud.instanceNotFound.translate("InstanceType", err)
+	}
+	return instance.InstanceType, nil
 }
 
 // InstanceTypeByProviderID returns the type of the specified instance.
 func (cloud *Cloud) InstanceTypeByProviderID(ctx context.Context, providerID string) (string, error) {
-	return providerName, nil
+	instance, err := cloud.lookupInstance(ctx, "InstanceTypeByProviderID", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		return cloud.getInstanceByProviderID(ctx, providerID)
+	})
+	if err != nil {
+		return "", cloud.instanceNotFound.translate("InstanceTypeByProviderID", err)
+	}
+	return instance.InstanceType, nil
 }
 
 // AddSSHKeyToAllInstances adds an SSH public key as a legal identity for all instances
@@ -102,18 +141,102 @@ func (cloud *Cloud) CurrentNodeName(ctx context.Context, hostname string) (types
 
 // InstanceExistsByProviderID returns true if the instance for the given provider id still is running.
 // If false is returned with no error, the instance will be immediately deleted by the cloud controller manager.
+// False is only returned if the instance_not_found policy reports missing instances and the instance isn't found
+// by its id in any vpc, or if it is isolated and terminate_isolated_nodes is set. Instances of other vpcs and
+// instances left out by instance_filters exist.
 func (cloud *Cloud) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
+	_, instanceID, err := parseProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+	var isolation string
+	instance, err := cloud.lookupInstance(ctx, "InstanceExistsByProviderID", func(ctx context.Context) (*cvm.InstanceInfo, error) {
+		instance, state, err := cloud.getInstanceAnywhere(ctx, instanceID)
+		isolation = state
+		return instance, err
+	})
+	if err == CloudInstanceNotFound && cloud.instanceNotFound.reports("InstanceExistsByProviderID") {
+		// the node controller deletes the node
+		if cloud.pause.isPaused() {
+			return false, ErrCloudPaused
+		}
+		cloud.nodeDeletionReporter.record(providerID, "instance not found")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if instance.VirtualPrivateCloud.VpcID != cloud.config.VpcId {
+		glog.Warningf("instance %s of provider id %s is in vpc %s, not in vpc %s of the cluster",
+			instanceID, providerID, instance.VirtualPrivateCloud.VpcID, cloud.config.VpcId)
+	}
+	if isolation != "" && cloud.config.TerminateIsolatedNodes {
+		if cloud.pause.isPaused() {
+			return false, ErrCloudPaused
+		}
+		cloud.nodeDeletionReporter.record(providerID, fmt.Sprintf("instance isolated, %s", isolation))
+		return false, nil
+	}
 	return true, nil
 }
 
-func (cloud *Cloud) getInstanceByInstancePrivateIp(privateIp string) (*cvm.InstanceInfo, error) {
-	instances, err := cloud.cvm.DescribeInstances(&cvm.DescribeInstancesArgs{
+// getInstanceByNodeName finds the instance of the node, node names are expected to be the private ip of the instance.
+// Nodes registered under another name, like the VM-1-2-centos hostnames of the tencentcloud images, are found by
+// the provider id the kubelet was started with, or else through the internal ips the kubelet reported for them.
+// Each one is tried, nodes can have several. The api can't filter instances by hostname.
+func (cloud *Cloud) getInstanceByNodeName(ctx context.Context, name types.NodeName) (*cvm.InstanceInfo, error) {
+	if net.ParseIP(string(name)) != nil {
+		instance, err := cloud.getInstanceByInstancePrivateIp(ctx, string(name))
+		if err != CloudInstanceNotFound {
+			return instance, err
+		}
+	}
+
+	traceNodeLookupCall(ctx, "getting node "+string(name))
+	node, err := cloud.kubeClient.CoreV1().Nodes().Get(string(name), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, CloudInstanceNotFound
+		}
+		return nil, err
+	}
+	if strings.HasPrefix(node.Spec.ProviderID, providerName+"://") {
+		return cloud.getInstanceByProviderID(ctx, node.Spec.ProviderID)
+	}
+	tried := false
+	for _, address := range node.Status.Addresses {
+		if address.Type != v1.NodeInternalIP || address.Address == string(name) {
+			continue
+		}
+		tried = true
+		instance, err := cloud.getInstanceByInstancePrivateIp(ctx, address.Address)
+		if err == CloudInstanceNotFound {
+			continue
+		}
+		return instance, err
+	}
+	if !tried && net.ParseIP(string(name)) == nil {
+		return nil, errors.New(fmt.Sprintf("cannot resolve hostname-style node name %s without providerID, "+
+			"start the kubelet with --provider-id=%s:///<zone>/<instance-id> or let it report its internal ip", name, providerName))
+	}
+	return nil, CloudInstanceNotFound
+}
+
+func (cloud *Cloud) getInstanceByInstancePrivateIp(ctx context.Context, privateIp string) (*cvm.InstanceInfo, error) {
+	if cloud.config.EnableIPv6 && isIPv6(privateIp) {
+		return cloud.getInstanceByIPv6(ctx, privateIp)
+	}
+
+	traceNodeLookupCall(ctx, "DescribeInstances by private ip "+privateIp)
+	instances, err := describeInstances(ctx, cloud.cvm, &cvm.DescribeInstancesArgs{
 		Version: cvm.DefaultVersion,
-		Filters: &[]cvm.Filter{cvm.NewFilter(cvm.FilterNamePrivateIpAddress, privateIp)},
+		Filters: cloud.instanceFilters(cvm.NewFilter(cvm.FilterNamePrivateIpAddress, privateIp)),
 	})
 	if err != nil {
 		return nil, err
 	}
+	cloud.instanceIndex.noteStates(instances.InstanceStates)
 	for _, instance := range instances.InstanceSet {
 		if instance.VirtualPrivateCloud.VpcID != cloud.config.VpcId {
 			continue
@@ -124,17 +247,72 @@ func (cloud *Cloud) getInstanceByInstancePrivateIp(privateIp string) (*cvm.Insta
 			}
 		}
 	}
+
+	// nodes of vpc-cni may be addressed by an ip of an eni other than the primary ip of the instance,
+	// instances are filtered by their primary ips only
+	traceNodeLookupCall(ctx, "DescribeNetworkInterfaces by private ip "+privateIp)
+	networkInterfaces, err := cloud.describeNetworkInterfacesByIp(privateIp)
+	if err != nil {
+		return nil, err
+	}
+	return cloud.getInstanceByNetworkInterfaces(ctx, networkInterfaces)
+}
+
+// getInstanceByIPv6 finds the instance through the eni holding the ipv6 address,
+// instances can't be filtered by ipv6 addresses.
+func (cloud *Cloud) getInstanceByIPv6(ctx context.Context, ipv6 string) (*cvm.InstanceInfo, error) {
+	traceNodeLookupCall(ctx, "DescribeNetworkInterfaces by ipv6 "+ipv6)
+	networkInterfaces, err := cloud.describeNetworkInterfacesByIpv6(ipv6)
+	if err != nil {
+		return nil, err
+	}
+	return cloud.getInstanceByNetworkInterfaces(ctx, networkInterfaces)
+}
+
+// getInstanceByNetworkInterfaces returns the instance the first attached eni is attached to.
+func (cloud *Cloud) getInstanceByNetworkInterfaces(ctx context.Context, networkInterfaces []networkInterface) (*cvm.InstanceInfo, error) {
+	for _, networkInterface := range networkInterfaces {
+		if networkInterface.Attachment.InstanceId != "" {
+			return cloud.getInstanceByInstanceID(ctx, networkInterface.Attachment.InstanceId)
+		}
+	}
 	return nil, CloudInstanceNotFound
 }
 
-func (cloud *Cloud) getInstanceByInstanceID(instanceID string) (*cvm.InstanceInfo, error) {
-	instances, err := cloud.cvm.DescribeInstances(&cvm.DescribeInstancesArgs{
+// instanceIDPrefix starts the ids of cvm instances.
+const instanceIDPrefix = "ins-"
+
+// malformedInstanceIDError is returned for instance ids which can't be cvm instances, like the id of a clb or an
+// eni pasted into the provider id of a node. The api would find no such instance, and CloudInstanceNotFound
+// gets the node deleted, this error is logged and retried by the node controller instead.
+type malformedInstanceIDError struct {
+	instanceID string
+}
+
+func (e *malformedInstanceIDError) Error() string {
+	return fmt.Sprintf("malformed instance id %q, cvm instance ids start with %s", e.instanceID, instanceIDPrefix)
+}
+
+func validateInstanceID(instanceID string) error {
+	if !strings.HasPrefix(instanceID, instanceIDPrefix) || len(instanceID) == len(instanceIDPrefix) {
+		return &malformedInstanceIDError{instanceID: instanceID}
+	}
+	return nil
+}
+
+func (cloud *Cloud) getInstanceByInstanceID(ctx context.Context, instanceID string) (*cvm.InstanceInfo, error) {
+	if err := validateInstanceID(instanceID); err != nil {
+		return nil, err
+	}
+	traceNodeLookupCall(ctx, "DescribeInstances by instance id "+instanceID)
+	instances, err := describeInstances(ctx, cloud.cvm, &cvm.DescribeInstancesArgs{
 		Version: cvm.DefaultVersion,
-		Filters: &[]cvm.Filter{cvm.NewFilter(cvm.FilterNameInstanceId, instanceID)},
+		Filters: cloud.instanceFilters(cvm.NewFilter(cvm.FilterNameInstanceId, instanceID)),
 	})
 	if err != nil {
 		return nil, err
 	}
+	cloud.instanceIndex.noteStates(instances.InstanceStates)
 	for _, instance := range instances.InstanceSet {
 		if instance.VirtualPrivateCloud.VpcID != cloud.config.VpcId {
 			continue
@@ -145,3 +323,81 @@ func (cloud *Cloud) getInstanceByInstanceID(instanceID string) (*cvm.InstanceInf
 	}
 	return nil, CloudInstanceNotFound
 }
+
+// nodeAddresses returns the addresses of the instance, with its ipv6 addresses as internal addresses if ipv6 is enabled.
+func (cloud *Cloud) nodeAddresses(instance *cvm.InstanceInfo) ([]v1.NodeAddress, error) {
+	addresses := instanceNodeAddresses(instance)
+	if !cloud.config.EnableIPv6 {
+		return addresses, nil
+	}
+
+	networkInterfaces, err := cloud.describeInstanceNetworkInterfaces(instance.InstanceID)
+	if err != nil {
+		return []v1.NodeAddress{}, err
+	}
+	for _, networkInterface := range networkInterfaces {
+		for _, ipv6 := range networkInterface.Ipv6AddressSet {
+			if ipv6.Address != "" {
+				addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ipv6.Address})
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// instanceNodeAddresses returns the internal and external addresses of the instance.
+// The api may return partial instances with nil address lists or empty addresses, those are skipped.
+func instanceNodeAddresses(instance *cvm.InstanceInfo) []v1.NodeAddress {
+	addresses := make([]v1.NodeAddress, 0, len(instance.PrivateIPAddresses)+len(instance.PublicIPAddresses))
+	for _, ip := range instance.PrivateIPAddresses {
+		if ip == "" {
+			continue
+		}
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip})
+	}
+	for _, ip := range instance.PublicIPAddresses {
+		if ip == "" {
+			continue
+		}
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: ip})
+	}
+	return addresses
+}
+
+// parseProviderID splits a provider id of the form tencentcloud:///<zone>/<instance-id>
+// into its zone and instance id.
+func parseProviderID(providerID string) (zone string, instanceID string, err error) {
+	id := strings.TrimPrefix(providerID, fmt.Sprintf("%s://", providerName))
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 {
+		return "", "", errors.New(fmt.Sprintf("invalid format for providerId %s", providerID))
+	}
+	if err := validateInstanceID(parts[2]); err != nil {
+		return "", "", err
+	}
+	return parts[1], parts[2], nil
+}
+
+// instanceProviderID returns the provider id of the instance as the node controller sets it.
+func instanceProviderID(instance *cvm.InstanceInfo) string {
+	return fmt.Sprintf("%s:///%s/%s", providerName, instance.Placement.Zone, instance.InstanceID)
+}
+
+// getInstanceByProviderID finds the instance by the instance id part of the provider id only.
+// An instance can be associated with a different zone after some operations, so the zone part
+// may be stale. In that case the zone reported by the api wins and the corrected provider id is logged.
+func (cloud *Cloud) getInstanceByProviderID(ctx context.Context, providerID string) (*cvm.InstanceInfo, error) {
+	zone, instanceID, err := parseProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := cloud.getInstanceByInstanceID(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Placement.Zone != zone {
+		glog.Warningf("instance %s is in zone %s but provider id %s says %s, current provider id is %s",
+			instance.InstanceID, instance.Placement.Zone, providerID, zone, instanceProviderID(instance))
+	}
+	return instance, nil
+}
@@ -0,0 +1,369 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+func TestGetInstanceByProviderIDZoneDrift(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+		zone       string
+	}{
+		{"zone unchanged", "tencentcloud:///ap-guangzhou-3/ins-1", "ap-guangzhou-3"},
+		{"instance moved to another zone", "tencentcloud:///ap-guangzhou-1/ins-1", "ap-guangzhou-3"},
+		{"zone left out", "tencentcloud:////ins-1", "ap-guangzhou-3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", test.zone, "vpc-test", []string{"10.0.0.1"}, nil)))
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			instance, err := cloud.getInstanceByProviderID(context.Background(), test.providerID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if instance.InstanceID != "ins-1" {
+				t.Errorf("found instance %s, want ins-1", instance.InstanceID)
+			}
+			if got, want := instanceProviderID(instance), "tencentcloud:///"+test.zone+"/ins-1"; got != want {
+				t.Errorf("corrected provider id %s, want %s", got, want)
+			}
+			calls := api.callsOf("cvm.DescribeInstances")
+			if len(calls) != 1 || calls[0].Get("Filters.0.Name") != "instance-id" || calls[0].Get("Filters.0.Values.0") != "ins-1" {
+				t.Errorf("instance looked up by %v, want by instance id only", calls)
+			}
+
+			exists, err := cloud.InstanceExistsByProviderID(context.Background(), test.providerID)
+			if err != nil || !exists {
+				t.Errorf("InstanceExistsByProviderID = %v, %v, want true", exists, err)
+			}
+		})
+	}
+}
+
+func TestNodeAddressesByProviderID(t *testing.T) {
+	tests := []struct {
+		name       string
+		privateIps []string
+		publicIps  []string
+		want       []v1.NodeAddress
+	}{
+		{"private and public ips", []string{"10.0.0.1"}, []string{"1.2.3.4"},
+			[]v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeExternalIP, Address: "1.2.3.4"}}},
+		{"public ips only", nil, []string{"1.2.3.4"},
+			[]v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "1.2.3.4"}}},
+		{"empty addresses skipped", []string{"", "10.0.0.1"}, []string{""},
+			[]v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}}},
+		{"no ips", nil, nil, []v1.NodeAddress{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", test.privateIps, test.publicIps)))
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			addresses, err := cloud.NodeAddressesByProviderID(context.Background(), "tencentcloud:///ap-guangzhou-3/ins-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(addresses) != len(test.want) {
+				t.Fatalf("got %d addresses %v, want %v", len(addresses), addresses, test.want)
+			}
+			for i := range test.want {
+				if addresses[i] != test.want[i] {
+					t.Errorf("address %d is %v, want %v", i, addresses[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceExistsByProviderID(t *testing.T) {
+	isolated := fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)
+	isolated["RestrictState"] = restrictStateExpired
+
+	tests := []struct {
+		name      string
+		config    Config
+		noVpc     bool
+		instances []map[string]interface{}
+		want      bool
+		wantErr   bool
+	}{
+		{
+			name:      "instance in the vpc of the cluster",
+			instances: []map[string]interface{}{fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)},
+			want:      true,
+		},
+		{
+			name:      "instance in another vpc",
+			instances: []map[string]interface{}{fakeInstance("ins-1", "ap-guangzhou-3", "vpc-other", []string{"10.0.0.1"}, nil)},
+			want:      true,
+		},
+		{
+			name:      "vpc of the cluster not configured",
+			noVpc:     true,
+			instances: []map[string]interface{}{fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)},
+			want:      true,
+		},
+		{
+			name:      "instance left out by instance_filters",
+			config:    Config{InstanceFilters: []InstanceFilterConfig{{Name: "zone", Values: []string{"ap-guangzhou-4"}}}},
+			instances: []map[string]interface{}{fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)},
+			want:      true,
+		},
+		{
+			name:    "instance not found, retried by default",
+			wantErr: true,
+		},
+		{
+			name:   "instance not found, reported",
+			config: Config{InstanceNotFound: map[string]string{"InstanceExistsByProviderID": InstanceNotFoundReport}},
+			want:   false,
+		},
+		{
+			name:    "instance not found, retried",
+			config:  Config{InstanceNotFound: map[string]string{"InstanceExistsByProviderID": InstanceNotFoundRetry}},
+			wantErr: true,
+		},
+		{
+			name:      "isolated instance kept",
+			instances: []map[string]interface{}{isolated},
+			want:      true,
+		},
+		{
+			name:      "isolated instance terminated",
+			config:    Config{TerminateIsolatedNodes: true},
+			instances: []map[string]interface{}{isolated},
+			want:      false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(test.instances...))
+			cloud, _ := newTestCloud(t, test.config, api, nil)
+			if test.noVpc {
+				cloud.config.VpcId = ""
+			}
+
+			exists, err := cloud.InstanceExistsByProviderID(context.Background(), "tencentcloud:///ap-guangzhou-3/ins-1")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("InstanceExistsByProviderID = %v, want an error", exists)
+				}
+			} else if err != nil || exists != test.want {
+				t.Errorf("InstanceExistsByProviderID = %v, %v, want %v", exists, err, test.want)
+			}
+
+			calls := api.callsOf("cvm.DescribeInstances")
+			if len(calls) != 1 || calls[0].Get("Filters.0.Name") != "instance-id" || calls[0].Get("Filters.0.Values.0") != "ins-1" ||
+				calls[0].Get("Filters.1.Name") != "" {
+				t.Errorf("instance looked up by %v, want by instance id only", calls)
+			}
+		})
+	}
+}
+
+func TestInstanceExistsByProviderIDMalformed(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+		// wantMalformed is true if the instance id is refused rather than the provider id
+		wantMalformed bool
+	}{
+		{"clb id", "tencentcloud:///ap-guangzhou-3/lb-1", true},
+		{"eni id", "tencentcloud:///ap-guangzhou-3/eni-1", true},
+		{"lighthouse instance id", "tencentcloud:///ap-guangzhou-3/lhins-1", true},
+		{"prefix only", "tencentcloud:///ap-guangzhou-3/ins-", true},
+		{"without zone", "tencentcloud://ins-1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			if _, _, err := parseProviderID(test.providerID); err == nil {
+				t.Errorf("parseProviderID(%s) succeeded, want an error", test.providerID)
+			}
+			exists, err := cloud.InstanceExistsByProviderID(context.Background(), test.providerID)
+			if err == nil {
+				t.Errorf("InstanceExistsByProviderID(%s) = %v, want an error", test.providerID, exists)
+			}
+			if _, ok := err.(*malformedInstanceIDError); ok != test.wantMalformed {
+				t.Errorf("InstanceExistsByProviderID(%s) failed with %v, want a malformed instance id error: %t", test.providerID, err, test.wantMalformed)
+			}
+			if len(api.actions()) != 0 {
+				t.Errorf("api called with %v, want no calls", api.actions())
+			}
+		})
+	}
+}
+
+func TestGetInstanceByNodeName(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodeName   string
+		providerID string
+		addresses  []v1.NodeAddress
+		// wantLookup is the filter and value DescribeInstances is called with, none if empty
+		wantLookup string
+		wantErr    string
+	}{
+		{name: "named by ip", nodeName: "10.0.0.1", wantLookup: cvm.FilterNamePrivateIpAddress + "=10.0.0.1"},
+		{name: "hostname with provider id", nodeName: "VM-0-1-centos", providerID: "tencentcloud:///ap-guangzhou-3/ins-1",
+			wantLookup: cvm.FilterNameInstanceId + "=ins-1"},
+		{name: "hostname with internal ip", nodeName: "VM-0-1-centos",
+			addresses:  []v1.NodeAddress{{Type: v1.NodeHostName, Address: "VM-0-1-centos"}, {Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			wantLookup: cvm.FilterNamePrivateIpAddress + "=10.0.0.1"},
+		{name: "hostname without provider id or internal ip", nodeName: "VM-0-1-centos", wantErr: "--provider-id"},
+		{name: "unknown node", nodeName: "VM-0-2-centos", wantErr: CloudInstanceNotFound.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			kube := newFakeKube(t)
+			defer kube.close()
+			kube.nodes = []v1.Node{{
+				ObjectMeta: metav1.ObjectMeta{Name: "VM-0-1-centos"},
+				Spec:       v1.NodeSpec{ProviderID: test.providerID},
+				Status:     v1.NodeStatus{Addresses: test.addresses},
+			}}
+			cloud, _ := newTestCloud(t, Config{}, api, kube)
+
+			instance, err := cloud.getInstanceByNodeName(context.Background(), types.NodeName(test.nodeName))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("getInstanceByNodeName = %v, %v, want an error containing %q", instance, err, test.wantErr)
+				}
+			} else if err != nil || instance.InstanceID != "ins-1" {
+				t.Errorf("getInstanceByNodeName = %v, %v, want ins-1", instance, err)
+			}
+			lookups := []string{}
+			for _, call := range api.callsOf("cvm.DescribeInstances") {
+				lookups = append(lookups, call.Get("Filters.0.Name")+"="+call.Get("Filters.0.Values.0"))
+			}
+			if got := strings.Join(lookups, ","); got != test.wantLookup {
+				t.Errorf("instance looked up by %s, want %s", got, test.wantLookup)
+			}
+		})
+	}
+}
+
+func TestInstanceType(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		instances []map[string]interface{}
+		want      string
+		// wantErr is the error of a missing instance
+		wantErr error
+	}{
+		{name: "instance found", instances: []map[string]interface{}{fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)},
+			want: "S5.MEDIUM4"},
+		{name: "instance not found, retried by default", wantErr: CloudInstanceNotFound},
+		{name: "instance not found, reported", wantErr: cloudprovider.InstanceNotFound, config: Config{InstanceNotFound: map[string]string{
+			"InstanceType": InstanceNotFoundReport, "InstanceTypeByProviderID": InstanceNotFoundReport}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(test.instances...))
+			api.handle("vpc.DescribeNetworkInterfaces", describeNetworkInterfacesResult())
+			kube := newFakeKube(t)
+			defer kube.close()
+			cloud, _ := newTestCloud(t, test.config, api, kube)
+
+			byName, nameErr := cloud.InstanceType(context.Background(), types.NodeName("10.0.0.1"))
+			byProviderID, providerIDErr := cloud.InstanceTypeByProviderID(context.Background(), "tencentcloud:///ap-guangzhou-3/ins-1")
+			for _, got := range []struct {
+				instanceType string
+				err          error
+			}{{byName, nameErr}, {byProviderID, providerIDErr}} {
+				if test.wantErr != nil {
+					if got.err != test.wantErr {
+						t.Errorf("instance type %q, %v, want %v", got.instanceType, got.err, test.wantErr)
+					}
+				} else if got.err != nil || got.instanceType != test.want {
+					t.Errorf("instance type %q, %v, want %s", got.instanceType, got.err, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceLookupsNotByPublicIp(t *testing.T) {
+	// the eip of the node moved to another instance, a lookup by it would find ins-2
+	tests := []struct {
+		name   string
+		lookup func(cloud *Cloud) (string, error)
+	}{
+		{"NodeAddresses", func(cloud *Cloud) (string, error) {
+			addresses, err := cloud.NodeAddresses(context.Background(), types.NodeName("10.0.0.1"))
+			return fmt.Sprint(addresses), err
+		}},
+		{"NodeAddressesByProviderID", func(cloud *Cloud) (string, error) {
+			addresses, err := cloud.NodeAddressesByProviderID(context.Background(), "tencentcloud:///ap-guangzhou-3/ins-1")
+			return fmt.Sprint(addresses), err
+		}},
+		{"ExternalID", func(cloud *Cloud) (string, error) {
+			return cloud.ExternalID(context.Background(), types.NodeName("10.0.0.1"))
+		}},
+		{"InstanceID", func(cloud *Cloud) (string, error) {
+			return cloud.InstanceID(context.Background(), types.NodeName("10.0.0.1"))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", func(params url.Values) interface{} {
+				if params.Get("Filters.0.Name") == cvm.FilterNamePublicIpAddress {
+					return describeInstancesResult(fakeInstance("ins-2", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.2"}, []string{"1.2.3.4"}))(params)
+				}
+				return describeInstancesResult(fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil))(params)
+			})
+			// the controller manager runs on another node
+			metadata := newFakeMetadata(map[string]string{"local-ipv4": "10.0.0.9"})
+			defer metadata.close()
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+			cloud.localNode = metadata.localNode()
+
+			got, err := test.lookup(cloud)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Contains(got, "ins-2") || strings.Contains(got, "10.0.0.2") || strings.Contains(got, "1.2.3.4") {
+				t.Errorf("%s answered %s of the instance holding the eip now", test.name, got)
+			}
+			for _, call := range api.callsOf("cvm.DescribeInstances") {
+				if call.Get("Filters.0.Name") != cvm.FilterNamePrivateIpAddress && call.Get("Filters.0.Name") != cvm.FilterNameInstanceId {
+					t.Errorf("instance looked up by %s", call.Get("Filters.0.Name"))
+				}
+			}
+		})
+	}
+}
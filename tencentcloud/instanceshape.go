@@ -0,0 +1,115 @@
+package tencentcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// the api describes partially provisioned instances without some of their fields. The provider decides whether
+// a node still has an instance, and whether it is a backend, by the vpc and zone of the instance, so an instance
+// missing them can't be told apart from one of another vpc and is treated as unknown rather than as gone.
+
+// requiredInstanceFields are the fields every described instance must carry, as paths into its json.
+var requiredInstanceFields = [][]string{
+	{"InstanceId"},
+	{"InstanceState"},
+	{"Placement", "Zone"},
+	{"VirtualPrivateCloud", "VpcId"},
+}
+
+// redactedInstanceFields are left out of logged payloads, they identify the instance to anyone reading the logs.
+var redactedInstanceFields = map[string]bool{
+	"InstanceName":       true,
+	"PrivateIpAddresses": true,
+	"PublicIpAddresses":  true,
+	"Tags":               true,
+	"LoginSettings":      true,
+}
+
+// loggedInstanceShapes are the sets of missing fields a payload was logged for, each is logged once.
+var (
+	loggedInstanceShapesLock sync.Mutex
+	loggedInstanceShapes     = map[string]bool{}
+)
+
+// incompleteInstancesError is returned for responses describing instances without required fields,
+// the lookup is retried rather than deciding on partial data.
+type incompleteInstancesError struct {
+	missing map[string][]string
+}
+
+func (e *incompleteInstancesError) Error() string {
+	instances := []string{}
+	for instanceId, fields := range e.missing {
+		instances = append(instances, fmt.Sprintf("%s without %s", instanceId, strings.Join(fields, ", ")))
+	}
+	sort.Strings(instances)
+	return fmt.Sprintf("instances described partially, retrying: %s", strings.Join(instances, "; "))
+}
+
+// missingInstanceFields returns the required fields the instance payload lacks or has empty.
+func missingInstanceFields(payload map[string]interface{}) []string {
+	missing := []string{}
+	for _, path := range requiredInstanceFields {
+		var value interface{} = payload
+		for _, key := range path {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = object[key]
+		}
+		if text, ok := value.(string); !ok || text == "" {
+			missing = append(missing, strings.Join(path, "."))
+		}
+	}
+	return missing
+}
+
+// checkInstancePayloads returns the required fields missing by instance id, logging the redacted payload the
+// first time a set of fields is seen missing.
+func checkInstancePayloads(payloads []json.RawMessage) map[string][]string {
+	incomplete := map[string][]string{}
+	for i, raw := range payloads {
+		payload := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			continue
+		}
+		missing := missingInstanceFields(payload)
+		if len(missing) == 0 {
+			continue
+		}
+		instanceId, _ := payload["InstanceId"].(string)
+		if instanceId == "" {
+			instanceId = fmt.Sprintf("#%d", i)
+		}
+		incomplete[instanceId] = missing
+		logInstanceShape(missing, payload)
+	}
+	return incomplete
+}
+
+func logInstanceShape(missing []string, payload map[string]interface{}) {
+	shape := strings.Join(missing, ",")
+	loggedInstanceShapesLock.Lock()
+	logged := loggedInstanceShapes[shape]
+	loggedInstanceShapes[shape] = true
+	loggedInstanceShapesLock.Unlock()
+	if logged {
+		return
+	}
+	for key := range payload {
+		if redactedInstanceFields[key] {
+			payload[key] = "<redacted>"
+		}
+	}
+	redacted, _ := json.Marshal(payload)
+	glog.Warningf("DescribeInstances described an instance without %s, it is treated as unknown until the api describes it fully: %s",
+		strings.Join(missing, ", "), redacted)
+}
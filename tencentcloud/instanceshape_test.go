@@ -0,0 +1,85 @@
+package tencentcloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+func TestCheckInstancePayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    map[string][]string
+	}{
+		{"complete", `{"InstanceId":"ins-1","InstanceState":"RUNNING","Placement":{"Zone":"ap-guangzhou-3"},"VirtualPrivateCloud":{"VpcId":"vpc-1"}}`,
+			map[string][]string{}},
+		{"without vpc", `{"InstanceId":"ins-1","InstanceState":"PENDING","Placement":{"Zone":"ap-guangzhou-3"}}`,
+			map[string][]string{"ins-1": {"VirtualPrivateCloud.VpcId"}}},
+		{"empty zone and state", `{"InstanceId":"ins-1","InstanceState":"","Placement":{"Zone":""},"VirtualPrivateCloud":{"VpcId":"vpc-1"}}`,
+			map[string][]string{"ins-1": {"InstanceState", "Placement.Zone"}}},
+		{"placement of another shape", `{"InstanceId":"ins-1","InstanceState":"RUNNING","Placement":"ap-guangzhou-3","VirtualPrivateCloud":{"VpcId":"vpc-1"}}`,
+			map[string][]string{"ins-1": {"Placement.Zone"}}},
+		{"without instance id", `{"InstanceState":"PENDING"}`,
+			map[string][]string{"#0": {"InstanceId", "Placement.Zone", "VirtualPrivateCloud.VpcId"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := checkInstancePayloads([]json.RawMessage{json.RawMessage(test.payload)})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("missing fields %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDescribeInstancesIncomplete(t *testing.T) {
+	complete := fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)
+	withoutVpc := fakeInstance("ins-1", "ap-guangzhou-3", "", []string{"10.0.0.1"}, nil)
+
+	tests := []struct {
+		name      string
+		answers   []map[string]interface{}
+		wantCalls int
+		wantErr   string
+	}{
+		{"complete", []map[string]interface{}{complete}, 1, ""},
+		{"completed on retry", []map[string]interface{}{withoutVpc, complete}, 2, ""},
+		{"never completed", []map[string]interface{}{withoutVpc, withoutVpc, withoutVpc}, 3, "ins-1 without VirtualPrivateCloud.VpcId"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			var calls int32
+			api.handle("cvm.DescribeInstances", func(params url.Values) interface{} {
+				return describeInstancesResult(test.answers[atomic.AddInt32(&calls, 1)-1])(params)
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			response, err := describeInstances(ctx, cloud.cvm, &cvm.DescribeInstancesArgs{
+				Version: cvm.DefaultVersion,
+				Filters: &[]cvm.Filter{cvm.NewFilter(cvm.FilterNameInstanceId, "ins-1")},
+			})
+			if test.wantErr != "" {
+				if _, ok := err.(*incompleteInstancesError); !ok || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("describeInstances = %v, %v, want an error containing %q", response, err, test.wantErr)
+				}
+			} else if err != nil || response.InstanceSet[0].VirtualPrivateCloud.VpcID != "vpc-test" {
+				t.Errorf("describeInstances = %v, %v, want ins-1 of vpc-test", response, err)
+			}
+			if calls != int32(test.wantCalls) {
+				t.Errorf("%d calls, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// characters label values can't hold, they are replaced by dashes
+var invalidLabelValueChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// the sdk doesn't decode the tags of instances, they are described on their own.
+
+type describeInstanceTagsResponse struct {
+	InstanceSet []struct {
+		InstanceId string `json:"InstanceId"`
+		Tags       []struct {
+			Key   string `json:"Key"`
+			Value string `json:"Value"`
+		} `json:"Tags"`
+	} `json:"InstanceSet"`
+	RequestID string `json:"RequestId"`
+}
+
+// validateNodeTagLabels checks that node_tag_labels maps tag keys to valid label keys.
+func validateNodeTagLabels(tagLabels map[string]string) error {
+	for tagKey, labelKey := range tagLabels {
+		if tagKey == "" {
+			return errors.New("invalid node_tag_labels, tag keys can't be empty")
+		}
+		if problems := validation.IsQualifiedName(labelKey); len(problems) > 0 {
+			return errors.New(fmt.Sprintf("invalid node_tag_labels label key %q of tag %q: %s",
+				labelKey, tagKey, strings.Join(problems, ", ")))
+		}
+	}
+	return nil
+}
+
+// sanitizeLabelValue turns a tag value into a label value. Characters labels can't hold are replaced by
+// dashes, and the value is cut to the length allowed and trimmed to begin and end alphanumeric. Values left
+// empty yield no label.
+func sanitizeLabelValue(value string) string {
+	value = invalidLabelValueChars.ReplaceAllString(value, "-")
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+	return strings.Trim(value, "._-")
+}
+
+// instanceTagLabels returns the labels node_tag_labels maps the tags of the instance to. Only the tags listed
+// are looked at, so tagging instances freely doesn't flood nodes with labels.
+func (cloud *Cloud) instanceTagLabels(instance *cvm.InstanceInfo) (map[string]string, error) {
+	response := &describeInstanceTagsResponse{}
+	err := cloud.cvm.Invoke("DescribeInstances", &cvm.DescribeInstancesArgs{
+		Version:     cvm.DefaultVersion,
+		InstanceIds: &[]string{instance.InstanceID},
+	}, &cvm.CvmResponse{Response: response})
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	for _, info := range response.InstanceSet {
+		if info.InstanceId != instance.InstanceID {
+			continue
+		}
+		for _, tag := range info.Tags {
+			labelKey, ok := cloud.config.NodeTagLabels[tag.Key]
+			if !ok {
+				continue
+			}
+			if value := sanitizeLabelValue(tag.Value); value != "" {
+				labels[labelKey] = value
+			}
+		}
+	}
+	return labels, nil
+}
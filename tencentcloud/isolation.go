@@ -0,0 +1,54 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+// the states of instances which are stopped and don't come back unless they are renewed or restored
+const (
+	instanceStateShutdown    = "SHUTDOWN"
+	instanceStateTerminating = "TERMINATING"
+
+	restrictStateExpired              = "EXPIRED"
+	restrictStateProtectivelyIsolated = "PROTECTIVELY_ISOLATED"
+)
+
+// isolationState returns why an instance of the states is isolated, or "" if it isn't.
+func isolationState(instanceState string, restrictState string) string {
+	switch {
+	case restrictState == restrictStateExpired || restrictState == restrictStateProtectivelyIsolated:
+		return fmt.Sprintf("restricted as %s", restrictState)
+	case instanceState == instanceStateShutdown:
+		return "in the recycle bin"
+	case instanceState == instanceStateTerminating:
+		return "being terminated"
+	}
+	return ""
+}
+
+// getInstanceAnywhere finds the instance by its id alone, in any vpc and regardless of instance_filters, and returns
+// why it is isolated, or "" if it isn't. The other lookups are narrowed by the vpc and the filters, so an instance
+// they miss may still exist. Nodes are only judged nonexistent once this lookup finds no instance.
+func (cloud *Cloud) getInstanceAnywhere(ctx context.Context, instanceID string) (*cvm.InstanceInfo, string, error) {
+	if err := validateInstanceID(instanceID); err != nil {
+		return nil, "", err
+	}
+	traceNodeLookupCall(ctx, "DescribeInstances by instance id "+instanceID+" in any vpc")
+	response, err := describeInstances(ctx, cloud.cvm, &cvm.DescribeInstancesArgs{
+		Version: cvm.DefaultVersion,
+		Filters: &[]cvm.Filter{cvm.NewFilter(cvm.FilterNameInstanceId, instanceID)},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	cloud.instanceIndex.noteStates(response.InstanceStates)
+	for _, instance := range response.InstanceSet {
+		if instance.InstanceID == instanceID {
+			return &instance, isolationState(response.InstanceStates[instanceID], response.RestrictStates[instanceID]), nil
+		}
+	}
+	return nil, "", CloudInstanceNotFound
+}
@@ -0,0 +1,46 @@
+package tencentcloud
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIsolationLifecycle(t *testing.T) {
+	tests := []struct {
+		name          string
+		instanceState string
+		restrictState string
+		wantIsolation string
+	}{
+		{"running", "RUNNING", "NORMAL", ""},
+		{"stopped by the user", "STOPPED", "NORMAL", ""},
+		{"expired", "STOPPED", restrictStateExpired, "restricted as EXPIRED"},
+		{"protectively isolated", "RUNNING", restrictStateProtectivelyIsolated, "restricted as PROTECTIVELY_ISOLATED"},
+		{"in the recycle bin", instanceStateShutdown, "NORMAL", "in the recycle bin"},
+		{"being terminated", instanceStateTerminating, "NORMAL", "being terminated"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isolationState(test.instanceState, test.restrictState); got != test.wantIsolation {
+				t.Errorf("isolationState(%s, %s) = %q, want %q", test.instanceState, test.restrictState, got, test.wantIsolation)
+			}
+
+			// isolated instances keep existing unless terminate_isolated_nodes is set
+			for _, terminate := range []bool{false, true} {
+				api := newFakeApi(t)
+				instance := fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)
+				instance["InstanceState"] = test.instanceState
+				instance["RestrictState"] = test.restrictState
+				api.handle("cvm.DescribeInstances", describeInstancesResult(instance))
+				cloud, _ := newTestCloud(t, Config{TerminateIsolatedNodes: terminate}, api, nil)
+
+				exists, err := cloud.InstanceExistsByProviderID(context.Background(), "tencentcloud:///ap-guangzhou-3/ins-1")
+				want := !terminate || test.wantIsolation == ""
+				if err != nil || exists != want {
+					t.Errorf("InstanceExistsByProviderID with terminate_isolated_nodes %t = %v, %v, want %v", terminate, exists, err, want)
+				}
+				api.close()
+			}
+		})
+	}
+}
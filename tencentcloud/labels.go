@@ -0,0 +1,255 @@
+package tencentcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+const (
+	// LabelEniZones lists every zone the enis of the node are placed in, the primary zone included.
+	// Label values can not contain commas, so zones are joined with underscores.
+	LabelEniZones = "node.tencentcloud.com/eni-zones"
+	// LabelDedicatedHostId is the id of the cdh the instance is placed on, for spreading across physical hosts.
+	LabelDedicatedHostId = "node.tencentcloud.com/dedicated-host-id"
+	// LabelPrimaryEniId is the id of the primary eni of the instance, for cni daemons and ipam controllers.
+	LabelPrimaryEniId = "node.tencentcloud.com/primary-eni-id"
+	// LabelSubnetId is the id of the subnet of the primary eni of the instance.
+	LabelSubnetId = "node.tencentcloud.com/subnet-id"
+
+	// AnnotationInstanceCreatedTime is the time the instance of the node was created at, in RFC 3339, for
+	// correlating node age with billing.
+	AnnotationInstanceCreatedTime = "node.tencentcloud.com/instance-created-time"
+
+	nodeLabelSyncPeriod = 10 * time.Minute
+)
+
+// nodeMetadataLabels are the labels which can be listed in node_metadata_labels.
+var nodeMetadataLabels = map[string]bool{
+	LabelPrimaryEniId: true,
+	LabelSubnetId:     true,
+}
+
+func validateNodeMetadataLabels(keys []string) error {
+	for _, key := range keys {
+		if !nodeMetadataLabels[key] {
+			return errors.New(fmt.Sprintf("invalid node_metadata_labels key %q", key))
+		}
+	}
+	return nil
+}
+
+// nodeLabelsEnabled returns true if any of the labels managed by the node labeler is enabled.
+func (cloud *Cloud) nodeLabelsEnabled() bool {
+	return cloud.config.EnableEniZonesLabel || cloud.config.EnablePlacementLabels || cloud.config.EnableEniCapacityLabels ||
+		len(cloud.config.NodeMetadataLabels) > 0 || len(cloud.config.NodeTagLabels) > 0 || cloud.config.EnableCreatedTimeAnnotation ||
+		cloud.config.EnableInstanceTypeLabel
+}
+
+// runNodeLabeler periodically applies the labels and annotations the cloud node controller doesn't know about.
+func (cloud *Cloud) runNodeLabeler() {
+	wait.Until(cloud.syncNodeLabels, nodeLabelSyncPeriod, wait.NeverStop)
+}
+
+func (cloud *Cloud) syncNodeLabels() {
+	nodes, err := cloud.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list nodes for labeling: %v", err)
+		return
+	}
+	for i := range nodes.Items {
+		if err := cloud.syncNodeLabel(&nodes.Items[i]); err != nil {
+			glog.Errorf("failed to label node %s: %v", nodes.Items[i].Name, err)
+		}
+	}
+}
+
+func (cloud *Cloud) syncNodeLabel(node *v1.Node) error {
+	if cloud.pause.isPaused() {
+		return nil
+	}
+	// nodes are labeled after the cloud node controller has set the provider id
+	if !strings.HasPrefix(node.Spec.ProviderID, providerName+"://") {
+		return nil
+	}
+
+	instance, err := cloud.getInstanceByProviderID(context.TODO(), node.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+
+	labels, err := cloud.nodeLabels(node, instance)
+	if err != nil {
+		return err
+	}
+
+	labelsToPatch := map[string]string{}
+	for key, value := range labels {
+		if node.Labels[key] != value {
+			labelsToPatch[key] = value
+		}
+	}
+	annotationsToPatch := map[string]string{}
+	for key, value := range cloud.nodeAnnotations(instance) {
+		if node.Annotations[key] != value {
+			annotationsToPatch[key] = value
+		}
+	}
+	if len(labelsToPatch) == 0 && len(annotationsToPatch) == 0 {
+		return nil
+	}
+	if previous := node.Labels[kubeletapis.LabelInstanceType]; previous != "" && labelsToPatch[kubeletapis.LabelInstanceType] != "" {
+		cloud.recorder.Eventf(node, v1.EventTypeNormal, "InstanceResized",
+			"Instance %s was resized from %s to %s, updating the labels of the node", instance.InstanceID, previous, instance.InstanceType)
+	}
+
+	metadata := map[string]interface{}{}
+	if len(labelsToPatch) > 0 {
+		metadata["labels"] = labelsToPatch
+	}
+	if len(annotationsToPatch) > 0 {
+		metadata["annotations"] = annotationsToPatch
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cloud.kubeClient.CoreV1().Nodes().Patch(node.Name, types.StrategicMergePatchType, patch)
+	return err
+}
+
+// nodeLabels returns the labels the node of the instance should carry.
+func (cloud *Cloud) nodeLabels(node *v1.Node, instance *cvm.InstanceInfo) (map[string]string, error) {
+	labels := map[string]string{}
+
+	if cloud.config.EnableEniZonesLabel {
+		zones, err := cloud.instanceEniZones(instance)
+		if err != nil {
+			return nil, err
+		}
+		labels[LabelEniZones] = strings.Join(zones, "_")
+	}
+
+	if cloud.config.EnablePlacementLabels {
+		if hostId, ok := instance.Placement.HostID.(string); ok && hostId != "" {
+			labels[LabelDedicatedHostId] = hostId
+		}
+	}
+
+	// the node controller sets the instance type label of kubernetes from InstanceType when the node is
+	// initialized only, instances can be resized while their node lives on
+	if cloud.config.EnableInstanceTypeLabel && instance.InstanceType != "" {
+		labels[kubeletapis.LabelInstanceType] = instance.InstanceType
+	}
+
+	// the capacity follows the live instance type, resized instances get the capacity of their new type
+	if cloud.config.EnableEniCapacityLabels {
+		if capacity, ok := cloud.getEniCapacity(instance); ok {
+			for key, value := range capacity.labels() {
+				labels[key] = value
+			}
+		}
+	}
+
+	if len(cloud.config.NodeMetadataLabels) > 0 {
+		metadata, err := cloud.nodeMetadata(node, instance)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range metadata {
+			labels[key] = value
+		}
+	}
+
+	if len(cloud.config.NodeTagLabels) > 0 {
+		tagLabels, err := cloud.instanceTagLabels(instance)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range tagLabels {
+			labels[key] = value
+		}
+	}
+
+	return labels, nil
+}
+
+// nodeAnnotations returns the annotations the node of the instance should carry, for values labels can't hold.
+func (cloud *Cloud) nodeAnnotations(instance *cvm.InstanceInfo) map[string]string {
+	annotations := map[string]string{}
+
+	if cloud.config.EnableCreatedTimeAnnotation && !instance.CreatedTime.IsZero() {
+		annotations[AnnotationInstanceCreatedTime] = instance.CreatedTime.UTC().Format(time.RFC3339)
+	}
+
+	return annotations
+}
+
+// nodeMetadata returns the configured metadata labels of the node. The primary eni and subnet of an instance
+// never change, so labels the node carries already are kept instead of being looked up again.
+func (cloud *Cloud) nodeMetadata(node *v1.Node, instance *cvm.InstanceInfo) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, key := range cloud.config.NodeMetadataLabels {
+		if value := node.Labels[key]; value != "" {
+			metadata[key] = value
+			continue
+		}
+		switch key {
+		case LabelPrimaryEniId:
+			networkInterfaces, err := cloud.describeInstanceNetworkInterfaces(instance.InstanceID)
+			if err != nil {
+				return nil, err
+			}
+			for _, networkInterface := range networkInterfaces {
+				if networkInterface.Primary {
+					metadata[key] = networkInterface.NetworkInterfaceId
+				}
+			}
+		case LabelSubnetId:
+			if instance.VirtualPrivateCloud.SubnetID != "" {
+				metadata[key] = instance.VirtualPrivateCloud.SubnetID
+			}
+		}
+	}
+	return metadata, nil
+}
+
+// instanceEniZones returns the sorted set of zones the enis of the instance span.
+func (cloud *Cloud) instanceEniZones(instance *cvm.InstanceInfo) ([]string, error) {
+	networkInterfaces, err := cloud.describeInstanceNetworkInterfaces(instance.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneSet := map[string]bool{}
+	if instance.Placement.Zone != "" {
+		zoneSet[instance.Placement.Zone] = true
+	}
+	for _, networkInterface := range networkInterfaces {
+		if networkInterface.Zone != "" {
+			zoneSet[networkInterface.Zone] = true
+		}
+	}
+
+	zones := make([]string, 0, len(zoneSet))
+	for zone := range zoneSet {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
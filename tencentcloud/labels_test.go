@@ -0,0 +1,171 @@
+package tencentcloud
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+func TestNodeLabelsEniZones(t *testing.T) {
+	tests := []struct {
+		name              string
+		zone              string
+		networkInterfaces []map[string]interface{}
+		want              string
+	}{
+		{
+			name: "single eni",
+			zone: "ap-guangzhou-3",
+			networkInterfaces: []map[string]interface{}{
+				fakeNetworkInterface("eni-1", "ins-1", "ap-guangzhou-3", true, "10.0.0.1"),
+			},
+			want: "ap-guangzhou-3",
+		},
+		{
+			name: "enis in the primary zone",
+			zone: "ap-guangzhou-3",
+			networkInterfaces: []map[string]interface{}{
+				fakeNetworkInterface("eni-1", "ins-1", "ap-guangzhou-3", true, "10.0.0.1"),
+				fakeNetworkInterface("eni-2", "ins-1", "ap-guangzhou-3", false, "10.0.0.2", "10.0.0.3"),
+			},
+			want: "ap-guangzhou-3",
+		},
+		{
+			name: "secondary enis in other zones",
+			zone: "ap-guangzhou-3",
+			networkInterfaces: []map[string]interface{}{
+				fakeNetworkInterface("eni-1", "ins-1", "ap-guangzhou-3", true, "10.0.0.1"),
+				fakeNetworkInterface("eni-2", "ins-1", "ap-guangzhou-4", false, "10.0.1.1"),
+				fakeNetworkInterface("eni-3", "ins-1", "ap-guangzhou-1", false, "10.0.2.1"),
+				fakeNetworkInterface("eni-4", "ins-1", "ap-guangzhou-4", false, "10.0.1.2"),
+			},
+			want: "ap-guangzhou-1_ap-guangzhou-3_ap-guangzhou-4",
+		},
+		{
+			name:              "no eni listed",
+			zone:              "ap-guangzhou-3",
+			networkInterfaces: []map[string]interface{}{},
+			want:              "ap-guangzhou-3",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("vpc.DescribeNetworkInterfaces", describeNetworkInterfacesResult(test.networkInterfaces...))
+			cloud, _ := newTestCloud(t, Config{EnableEniZonesLabel: true}, api, nil)
+
+			instance := &cvm.InstanceInfo{InstanceID: "ins-1", Placement: cvm.Placement{Zone: test.zone}}
+			labels, err := cloud.nodeLabels(&v1.Node{}, instance)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if labels[LabelEniZones] != test.want {
+				t.Errorf("label %s = %q, want %q", LabelEniZones, labels[LabelEniZones], test.want)
+			}
+			calls := api.callsOf("vpc.DescribeNetworkInterfaces")
+			if len(calls) != 1 || calls[0].Get("Filters.0.Name") != VpcFilterNameAttachmentInstanceId || calls[0].Get("Filters.0.Values.0") != "ins-1" {
+				t.Errorf("enis looked up by %v, want by the attached instance", calls)
+			}
+		})
+	}
+}
+
+func TestSyncNodeLabelEniZones(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		label     string
+		wantPatch string
+	}{
+		{"disabled", false, "", ""},
+		{"label missing", true, "", `"node.tencentcloud.com/eni-zones":"ap-guangzhou-3_ap-guangzhou-4"`},
+		{"label stale", true, "ap-guangzhou-3", `"node.tencentcloud.com/eni-zones":"ap-guangzhou-3_ap-guangzhou-4"`},
+		{"label current", true, "ap-guangzhou-3_ap-guangzhou-4", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			api.handle("vpc.DescribeNetworkInterfaces", describeNetworkInterfacesResult(
+				fakeNetworkInterface("eni-1", "ins-1", "ap-guangzhou-3", true, "10.0.0.1"),
+				fakeNetworkInterface("eni-2", "ins-1", "ap-guangzhou-4", false, "10.0.1.1")))
+			kube := newFakeKube(t)
+			defer kube.close()
+			cloud, _ := newTestCloud(t, Config{EnableEniZonesLabel: test.enabled}, api, kube)
+
+			node := &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.1", Labels: map[string]string{}},
+				Spec:       v1.NodeSpec{ProviderID: "tencentcloud:///ap-guangzhou-3/ins-1"},
+			}
+			if test.label != "" {
+				node.Labels[LabelEniZones] = test.label
+			}
+			if err := cloud.syncNodeLabel(node); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch {
+			case test.wantPatch == "" && len(kube.writes) != 0:
+				t.Errorf("node written %v, want no write", kube.writes)
+			case test.wantPatch != "" && (len(kube.writes) != 1 || !strings.Contains(kube.writes[0], test.wantPatch)):
+				t.Errorf("node written %v, want a patch of %s", kube.writes, test.wantPatch)
+			}
+		})
+	}
+}
+
+func TestSyncNodeLabelInstanceType(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		label     string
+		wantPatch string
+		wantEvent bool
+	}{
+		{"disabled", false, "S5.SMALL2", "", false},
+		{"label current", true, "S5.MEDIUM4", "", false},
+		{"instance resized", true, "S5.SMALL2", `"beta.kubernetes.io/instance-type":"S5.MEDIUM4"`, true},
+		{"label missing", true, "", `"beta.kubernetes.io/instance-type":"S5.MEDIUM4"`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			kube := newFakeKube(t)
+			defer kube.close()
+			cloud, recorder := newTestCloud(t, Config{EnableInstanceTypeLabel: test.enabled}, api, kube)
+
+			node := &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.1", Labels: map[string]string{}},
+				Spec:       v1.NodeSpec{ProviderID: "tencentcloud:///ap-guangzhou-3/ins-1"},
+			}
+			if test.label != "" {
+				node.Labels[kubeletapis.LabelInstanceType] = test.label
+			}
+			if err := cloud.syncNodeLabel(node); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch {
+			case test.wantPatch == "" && len(kube.writes) != 0:
+				t.Errorf("node written %v, want no write", kube.writes)
+			case test.wantPatch != "" && (len(kube.writes) != 1 || !strings.Contains(kube.writes[0], test.wantPatch)):
+				t.Errorf("node written %v, want a patch of %s", kube.writes, test.wantPatch)
+			}
+			events := drainEvents(recorder)
+			if resized := len(events) == 1 && strings.Contains(events[0], "InstanceResized"); resized != test.wantEvent {
+				t.Errorf("events %v, want a resize event %t", events, test.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package tencentcloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// AnnotationLoadBalancerStatus carries the outcome of the last reconcile of the clbs of a service as json,
+	// see loadBalancerStatusRecord. Events expire, the annotation stays until the outcome changes.
+	AnnotationLoadBalancerStatus = "tencentcloud.com/loadbalancer-status"
+
+	LoadBalancerPhaseReady  = "Ready"
+	LoadBalancerPhaseFailed = "Failed"
+)
+
+// loadBalancerStatusRecord is the outcome of a reconcile of the clbs of a service, the value of
+// AnnotationLoadBalancerStatus and the reconcile summary logged.
+type loadBalancerStatusRecord struct {
+	Phase           string   `json:"phase"`
+	LoadBalancerIds []string `json:"lbIds,omitempty"`
+	Decisions       []string `json:"decisions,omitempty"`
+	Warnings        []string `json:"warnings,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	// LastSync is the time of the last sync which changed the record, syncs with the same outcome don't
+	// rewrite the service
+	LastSync string `json:"lastSync"`
+}
+
+// sameOutcome returns true if the records only differ in their sync time or error. Every write of the annotation
+// makes the service controller sync the service again, and errors carry request ids, so a failing service would
+// be synced in a loop if its error alone rewrote the annotation.
+func (outcome loadBalancerStatusRecord) sameOutcome(other loadBalancerStatusRecord) bool {
+	outcome.LastSync, other.LastSync = "", ""
+	outcome.Error, other.Error = "", ""
+	a, _ := json.Marshal(outcome)
+	b, _ := json.Marshal(other)
+	return string(a) == string(b)
+}
+
+// reconcileRecorder collects the outcome of the reconciles in progress. It wraps the event recorder, so
+// the warnings recorded on a service while it is reconciled end up in its record as well. Services are
+// reconciled one at a time, the service lock guarantees it.
+type reconcileRecorder struct {
+	record.EventRecorder
+
+	lock    sync.Mutex
+	records map[types.UID]*loadBalancerStatusRecord
+}
+
+func newReconcileRecorder(recorder record.EventRecorder) *reconcileRecorder {
+	return &reconcileRecorder{EventRecorder: recorder, records: map[types.UID]*loadBalancerStatusRecord{}}
+}
+
+func (recorder *reconcileRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	recorder.EventRecorder.Event(object, eventtype, reason, message)
+	recorder.noteWarning(object, eventtype, reason, message)
+}
+
+func (recorder *reconcileRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	recorder.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	recorder.noteWarning(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (recorder *reconcileRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	recorder.EventRecorder.PastEventf(object, timestamp, eventtype, reason, messageFmt, args...)
+	recorder.noteWarning(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (recorder *reconcileRecorder) noteWarning(object runtime.Object, eventtype, reason, message string) {
+	if eventtype != v1.EventTypeWarning {
+		return
+	}
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return
+	}
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if outcome, ok := recorder.records[accessor.GetUID()]; ok {
+		outcome.Warnings = append(outcome.Warnings, fmt.Sprintf("%s: %s", reason, message))
+	}
+}
+
+// begin starts collecting the outcome of a reconcile of the service.
+func (recorder *reconcileRecorder) begin(service *v1.Service) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.records[service.UID] = &loadBalancerStatusRecord{}
+}
+
+// noteLoadBalancer adds a clb ensured by the reconcile of the service and the decision taken for it.
+func (recorder *reconcileRecorder) noteLoadBalancer(service *v1.Service, loadBalancerId string, decision string) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if outcome, ok := recorder.records[service.UID]; ok {
+		outcome.LoadBalancerIds = append(outcome.LoadBalancerIds, loadBalancerId)
+		outcome.Decisions = append(outcome.Decisions, fmt.Sprintf("%s: %s", loadBalancerId, decision))
+	}
+}
+
+// end stops collecting and returns the outcome of the reconcile of the service.
+func (recorder *reconcileRecorder) end(service *v1.Service, err error) loadBalancerStatusRecord {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	outcome := recorder.records[service.UID]
+	delete(recorder.records, service.UID)
+	if outcome == nil {
+		outcome = &loadBalancerStatusRecord{}
+	}
+
+	outcome.Phase = LoadBalancerPhaseReady
+	if err != nil {
+		outcome.Phase = LoadBalancerPhaseFailed
+		outcome.Error = err.Error()
+	}
+	sort.Strings(outcome.LoadBalancerIds)
+	sort.Strings(outcome.Decisions)
+	outcome.LastSync = time.Now().UTC().Format(time.RFC3339)
+	return *outcome
+}
+
+// recordLoadBalancerStatus logs the reconcile summary of the service and annotates the service with it if
+// enabled. The service is only patched when the outcome changed.
+func (cloud *Cloud) recordLoadBalancerStatus(service *v1.Service, err error) {
+	outcome := cloud.reconciles.end(service, err)
+	value, marshalErr := json.Marshal(outcome)
+	if marshalErr != nil {
+		glog.Errorf("failed to encode loadbalancer status of service %s/%s: %v", service.Namespace, service.Name, marshalErr)
+		return
+	}
+	glog.V(4).Infof("reconciled loadbalancers of service %s/%s: %s", service.Namespace, service.Name, value)
+
+	if !cloud.config.EnableLoadBalancerStatusAnnotation {
+		return
+	}
+	if current, ok := service.Annotations[AnnotationLoadBalancerStatus]; ok {
+		previous := loadBalancerStatusRecord{}
+		if json.Unmarshal([]byte(current), &previous) == nil && previous.sameOutcome(outcome) {
+			return
+		}
+	}
+	if err := cloud.patchServiceAnnotation(service, string(value)); err != nil {
+		glog.Errorf("failed to annotate service %s/%s with its loadbalancer status: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// clearLoadBalancerStatus removes the status annotation of a service whose clbs are gone.
+func (cloud *Cloud) clearLoadBalancerStatus(service *v1.Service) {
+	if _, ok := service.Annotations[AnnotationLoadBalancerStatus]; !ok {
+		return
+	}
+	if err := cloud.patchServiceAnnotation(service, nil); err != nil {
+		glog.Errorf("failed to remove the loadbalancer status of service %s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// patchServiceAnnotation sets the status annotation of the service to value, or removes it if value is nil.
+func (cloud *Cloud) patchServiceAnnotation(service *v1.Service, value interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{AnnotationLoadBalancerStatus: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cloud.kubeClient.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch)
+	return err
+}
+
+// syncLoadBalancerIngress writes the ingress of the clbs of the service to its status if it changed, for example
+// because a clb was recreated with a new vip. The service controller only writes the status returned by
+// EnsureLoadBalancer, which it calls when the service changes, not when the clb does. Services without an
+// ingress yet are left to EnsureLoadBalancer.
+func (cloud *Cloud) syncLoadBalancerIngress(ctx context.Context, clusterName string, service *v1.Service) {
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer || len(service.Status.LoadBalancer.Ingress) == 0 {
+		return
+	}
+	status, exists, err := cloud.GetLoadBalancer(ctx, clusterName, service)
+	if err != nil || !exists {
+		return
+	}
+	current := ingressKeys(service.Status.LoadBalancer.Ingress)
+	live := ingressKeys(status.Ingress)
+	if current == live {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"loadBalancer": status},
+	})
+	if err != nil {
+		return
+	}
+	if _, err := cloud.kubeClient.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch, "status"); err != nil {
+		glog.Errorf("failed to update the ingress of service %s/%s from %s to %s: %v", service.Namespace, service.Name, current, live, err)
+		return
+	}
+	glog.Infof("updated the ingress of service %s/%s from %s to %s", service.Namespace, service.Name, current, live)
+	cloud.recorder.Eventf(service, v1.EventTypeNormal, "LoadBalancerIngressChanged",
+		"The ingress of the loadbalancer changed from %s to %s", current, live)
+}
+
+// ingressKeys describes the ingress regardless of its order.
+func ingressKeys(ingress []v1.LoadBalancerIngress) string {
+	keys := []string{}
+	for _, entry := range ingress {
+		if entry.IP != "" {
+			keys = append(keys, entry.IP)
+		}
+		if entry.Hostname != "" {
+			keys = append(keys, entry.Hostname)
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,69 @@
+package tencentcloud
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestSyncLoadBalancerIngress(t *testing.T) {
+	tests := []struct {
+		name string
+		// published is the ingress of the service, vips those of its clb, none if the clb is gone
+		published   []string
+		vips        []string
+		wantLookups int
+		wantPatch   string
+		wantEvents  []string
+	}{
+		{name: "vip changed", published: []string{"1.1.1.1"}, vips: []string{"2.2.2.2"}, wantLookups: 1,
+			wantPatch:  `PATCH /api/v1/namespaces/default/services/web/status {"status":{"loadBalancer":{"ingress":[{"ip":"2.2.2.2"}]}}}`,
+			wantEvents: []string{"LoadBalancerIngressChanged"}},
+		{name: "vip unchanged", published: []string{"1.1.1.1"}, vips: []string{"1.1.1.1"}, wantLookups: 1},
+		{name: "vips reordered", published: []string{"1.1.1.1", "2.2.2.2"}, vips: []string{"2.2.2.2", "1.1.1.1"}, wantLookups: 1},
+		{name: "clb gone", published: []string{"1.1.1.1"}, wantLookups: 1},
+		{name: "ingress not published yet", vips: []string{"2.2.2.2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				if test.vips == nil {
+					return legacyResponse(map[string]interface{}{"totalCount": 0, "loadBalancerSet": []interface{}{}})
+				}
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []interface{}{
+					map[string]interface{}{"loadBalancerId": "lb-1", "forward": ClbLoadBalancerKindApplication, "loadBalancerVips": test.vips},
+				}})
+			})
+			kube := newFakeKube(t)
+			defer kube.close()
+			cloud, recorder := newTestCloud(t, Config{}, api, kube)
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			for _, ip := range test.published {
+				service.Status.LoadBalancer.Ingress = append(service.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+			}
+
+			cloud.syncLoadBalancerIngress(context.Background(), "kubernetes", service)
+
+			if got := len(api.callsOf("clb.DescribeLoadBalancers")); got != test.wantLookups {
+				t.Errorf("%d clb lookups, want %d", got, test.wantLookups)
+			}
+			if got := strings.Join(kube.writes, "\n"); got != test.wantPatch {
+				t.Errorf("service written with %q, want %q", got, test.wantPatch)
+			}
+			events := drainEvents(recorder)
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("events %v, want %v", events, test.wantEvents)
+			}
+			for i, event := range events {
+				if !strings.Contains(event, test.wantEvents[i]) {
+					t.Errorf("event %q, want %s", event, test.wantEvents[i])
+				}
+			}
+		})
+	}
+}
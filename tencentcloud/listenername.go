@@ -0,0 +1,167 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// listenerNameMaxLength is the longest listener name the clb accepts, longer descriptions are truncated
+	listenerNameMaxLength = 50
+)
+
+// listenerDescriptions parses the listener description annotation, a comma separated list of
+// <service port>=<description> pairs.
+func listenerDescriptions(service *v1.Service) (map[int32]string, error) {
+	descriptions := map[int32]string{}
+	value, ok := service.Annotations[ServiceAnnotationLoadBalancerListenerDescriptions]
+	if !ok {
+		return descriptions, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		port, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || err != nil {
+			return nil, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation entry %q, must be <port>=<description>", ServiceAnnotationLoadBalancerListenerDescriptions, pair)))
+		}
+		descriptions[int32(port)] = strings.TrimSpace(parts[1])
+	}
+	return descriptions, nil
+}
+
+// listenerDescription returns the name of the listener serving port, so operators can tell which service
+// owns a listener in the console. It defaults to <namespace>/<name>/<port> of the service.
+func listenerDescription(service *v1.Service, port v1.ServicePort, descriptions map[int32]string) string {
+	description, ok := descriptions[port.Port]
+	if !ok || description == "" {
+		description = fmt.Sprintf("%s/%s/%d", service.Namespace, service.Name, port.Port)
+	}
+	if len(description) > listenerNameMaxLength {
+		description = description[:listenerNameMaxLength]
+	}
+	return description
+}
+
+// the listener structs of qcloudapi-sdk-go lack the listener name, and the sdk has no modification
+// of layer four listeners of application clbs. Those are called through the common client.
+
+type describeListenerNamesResponse struct {
+	clb.Response
+	ListenerSet []struct {
+		UnListenerId string `json:"unListenerId"`
+		ListenerId   string `json:"listenerId"`
+		ListenerName string `json:"listenerName"`
+	} `json:"listenerSet"`
+}
+
+type modifyForwardLBFourthListenerArgs struct {
+	LoadBalancerId string `qcloud_arg:"loadBalancerId,required"`
+	ListenerId     string `qcloud_arg:"listenerId,required"`
+	ListenerName   string `qcloud_arg:"listenerName,required"`
+}
+
+type modifyForwardLBFourthListenerResponse struct {
+	clb.Response
+	RequestId int `json:"requestId"`
+}
+
+func (response *modifyForwardLBFourthListenerResponse) Id() int {
+	return response.RequestId
+}
+
+// describeListenerNames returns the names of the listeners of the clb by listener id.
+func (cloud *Cloud) describeListenerNames(loadBalancer *clb.LoadBalancer) (map[string]string, error) {
+	response := &describeListenerNamesResponse{}
+	var err error
+	if loadBalancer.Forward == ClbLoadBalancerKindClassic {
+		err = cloud.clb.Invoke("DescribeLoadBalancerListeners", &clb.DescribeLoadBalancerListenersArgs{
+			LoadBalancerId: loadBalancer.LoadBalancerId,
+		}, response)
+	} else {
+		err = cloud.clb.Invoke("DescribeForwardLBListeners", &clb.DescribeForwardLBListenersArgs{
+			LoadBalancerId: loadBalancer.LoadBalancerId,
+		}, response)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	for _, listener := range response.ListenerSet {
+		if listener.UnListenerId != "" {
+			names[listener.UnListenerId] = listener.ListenerName
+		} else {
+			names[listener.ListenerId] = listener.ListenerName
+		}
+	}
+	return names, nil
+}
+
+// ensureListenerNames renames the listeners whose name differs from the description of the port they serve.
+func (cloud *Cloud) ensureListenerNames(ctx context.Context, service *v1.Service, loadBalancer *clb.LoadBalancer, listenerPorts map[string]v1.ServicePort) error {
+	if len(listenerPorts) == 0 {
+		return nil
+	}
+	descriptions, err := listenerDescriptions(service)
+	if err != nil {
+		return err
+	}
+	names, err := cloud.describeListenerNames(loadBalancer)
+	if err != nil {
+		return err
+	}
+
+	listenerIds := make([]string, 0, len(listenerPorts))
+	for listenerId := range listenerPorts {
+		listenerIds = append(listenerIds, listenerId)
+	}
+	sort.Strings(listenerIds)
+
+	for _, listenerId := range listenerIds {
+		name := listenerDescription(service, listenerPorts[listenerId], descriptions)
+		if names[listenerId] == name {
+			continue
+		}
+		result, err := waitUntilDone(
+			ctx,
+			func() (clb.AsyncTask, error) {
+				if loadBalancer.Forward == ClbLoadBalancerKindClassic {
+					return cloud.clb.ModifyLoadBalancerListener(&clb.ModifyLoadBalancerListenerArgs{
+						LoadBalancerId: loadBalancer.LoadBalancerId,
+						ListenerId:     listenerId,
+						ListenerName:   &name,
+					})
+				}
+				response := &modifyForwardLBFourthListenerResponse{}
+				err := cloud.clb.Invoke("ModifyForwardLBFourthListener", &modifyForwardLBFourthListenerArgs{
+					LoadBalancerId: loadBalancer.LoadBalancerId,
+					ListenerId:     listenerId,
+					ListenerName:   name,
+				}, response)
+				if err != nil {
+					return nil, err
+				}
+				return response, nil
+			},
+			cloud.clb,
+		)
+		if err != nil {
+			return err
+		}
+		if result != clb.TaskSuccceed {
+			return errors.New("task is not succeed")
+		}
+	}
+	return nil
+}
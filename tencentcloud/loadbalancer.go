@@ -3,11 +3,15 @@ package tencentcloud
 import (
 	"context"
 	"errors"
+	"fmt"
 	"k8s.io/api/core/v1"
-	"k8s.io/kubernetes/pkg/cloudprovider"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strings"
 
 	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
 	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
 )
 
 const (
@@ -28,6 +32,70 @@ const (
 	// name annotation for loadbalancer
 	ServiceAnnotationLoadBalancerName        = "service.beta.kubernetes.io/tencentcloud-loadbalancer-name"
 	ServiceAnnotationLoadBalancerNameDefault = "kubernetes-loadbalancer"
+
+	// allocate an eip for a private clb and release it with the clb, instead of using a public clb.
+	// the eip is only released when the service is deleted while the annotation is set
+	ServiceAnnotationLoadBalancerAllocateEip = "service.beta.kubernetes.io/tencentcloud-loadbalancer-allocate-eip"
+	// bandwidth package the allocated eip is billed by
+	ServiceAnnotationLoadBalancerEipBandwidthPackageId = "service.beta.kubernetes.io/tencentcloud-loadbalancer-eip-bandwidth-package-id"
+
+	// bandwidth package a public clb is billed by, the clb is added to it after creation
+	ServiceAnnotationLoadBalancerBandwidthPackageId = "service.beta.kubernetes.io/tencentcloud-loadbalancer-bandwidth-package-id"
+
+	// seconds the listener of a port removed from the service keeps serving established connections before
+	// it is deleted, new connections are stopped by setting the weight of its backends to zero.
+	// only application clbs support it, backend weights of classic clbs are shared by all listeners.
+	ServiceAnnotationLoadBalancerListenerDrainSeconds = "service.beta.kubernetes.io/tencentcloud-loadbalancer-listener-drain-seconds"
+
+	// names of the listeners shown in the console as a comma separated list of <service port>=<description>.
+	// listeners of ports not listed are named <namespace>/<name>/<port> of the service
+	ServiceAnnotationLoadBalancerListenerDescriptions = "service.beta.kubernetes.io/tencentcloud-loadbalancer-listener-descriptions"
+
+	// dns name pointing at the clb, reported as the ingress hostname of the service instead of the vip
+	ServiceAnnotationLoadBalancerHostname = "service.beta.kubernetes.io/tencentcloud-loadbalancer-hostname"
+
+	// what the ingress of the service reports: the ip, the hostname or both. the hostname is the hostname annotation
+	// or the domain of the clb. defaults to the hostname if the hostname annotation is set, to the ip otherwise
+	ServiceAnnotationLoadBalancerPublish = "service.beta.kubernetes.io/tencentcloud-loadbalancer-publish"
+	LoadBalancerPublishIP                = "ip"
+	LoadBalancerPublishHostname          = "hostname"
+	LoadBalancerPublishBoth              = "both"
+
+	// label selector of the nodes registered as backends, all nodes are registered by default
+	ServiceAnnotationLoadBalancerBackendsLabel = "service.beta.kubernetes.io/tencentcloud-loadbalancer-backends-label"
+
+	// backend group whose nodes are registered as backends, nodes are grouped by their LabelBackendGroup label.
+	// changing it moves the backends to the nodes of the new group without touching listeners or the vip
+	ServiceAnnotationLoadBalancerActiveGroup = "service.beta.kubernetes.io/tencentcloud-loadbalancer-active-group"
+
+	// subnet of the vpc of the clb snat ips are allocated in, enables registering nodes of other vpcs through snat pro
+	ServiceAnnotationLoadBalancerSnatProSubnetId = "service.beta.kubernetes.io/tencentcloud-loadbalancer-snat-pro-subnet-id"
+
+	// ports served by a clb of their own as a comma separated list of <group>:<port> or <group>:<port>-<port>,
+	// every group gets a clb. ports in no group stay on the clb of the service
+	ServiceAnnotationLoadBalancerPortGroups = "service.beta.kubernetes.io/tencentcloud-loadbalancer-port-groups"
+
+	// backends registered with every listener as a comma separated list of <instance id>:<port>, instead of
+	// the nodes of the cluster. node changes leave them alone, they are only synced when the service changes
+	ServiceAnnotationLoadBalancerStaticBackends = "service.beta.kubernetes.io/tencentcloud-loadbalancer-static-backends"
+
+	// "true" serves every run of ports of one protocol whose ports and node ports both go up by one with a single
+	// listener. Only application clbs support it, clbs refusing range listeners get a listener per port. Ports
+	// served by listeners of their own already keep them
+	ServiceAnnotationLoadBalancerPortRanges = "service.beta.kubernetes.io/tencentcloud-loadbalancer-port-ranges"
+
+	// status codes the http health checks of services with the Local external traffic policy accept, as a comma
+	// separated list of classes like 2xx or ranges of whole classes like 200-399. defaults to 2xx. only
+	// application clbs check over http
+	ServiceAnnotationLoadBalancerHealthCheckHttpCodes = "service.beta.kubernetes.io/tencentcloud-loadbalancer-health-check-http-codes"
+)
+
+const (
+	defaultLoadBalancerPageSize = 20
+	maxLoadBalancerPageSize     = 100
+
+	// defaultServiceNodePortRange is the default --service-node-port-range of kube-apiserver
+	defaultServiceNodePortRange = "30000-32767"
 )
 
 var (
@@ -46,7 +114,41 @@ var (
 )
 
 func (cloud *Cloud) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
-	loadBalancerName := cloudprovider.GetLoadBalancerName(service)
+	// the service controller asks about every service which isn't of type LoadBalancer on each sync, to clean up
+	// after type changes. Only services still reporting a loadbalancer can have one, the controller clears the
+	// status once EnsureLoadBalancerDeleted succeeded. So a type change deletes the clb once and other services
+	// never cost an api call, whatever annotations they carry.
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer && len(service.Status.LoadBalancer.Ingress) == 0 {
+		return nil, false, nil
+	}
+
+	withPorts, _, _, err := portGroupServices(service)
+	if err != nil {
+		// the clbs of a service no longer of type LoadBalancer are deleted whatever its port groups
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			return &service.Status.LoadBalancer, true, nil
+		}
+		return nil, false, err
+	}
+	status = &v1.LoadBalancerStatus{}
+	for _, view := range withPorts {
+		viewStatus, viewExists, err := cloud.getLoadBalancer(view)
+		if err != nil {
+			return nil, false, err
+		}
+		if viewExists {
+			status.Ingress = append(status.Ingress, viewStatus.Ingress...)
+			exists = true
+		}
+	}
+	if !exists {
+		return nil, false, nil
+	}
+	return status, true, nil
+}
+
+func (cloud *Cloud) getLoadBalancer(service *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
+	loadBalancerName := loadBalancerSpecial(service)
 
 	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
 	if err != nil {
@@ -56,26 +158,49 @@ func (cloud *Cloud) GetLoadBalancer(ctx context.Context, clusterName string, ser
 		return nil, false, err
 	}
 
-	ingresses := make([]v1.LoadBalancerIngress, len(loadBalancer.LoadBalancerVips))
-
-	for i, vip := range loadBalancer.LoadBalancerVips {
-		ingresses[i] = v1.LoadBalancerIngress{IP: vip}
+	status, err := cloud.getLoadBalancerStatus(service, loadBalancer)
+	if err != nil {
+		return nil, false, err
 	}
-
-	return &v1.LoadBalancerStatus{
-		Ingress: ingresses,
-	}, true, nil
+	return status, true, nil
 }
 
 func (cloud *Cloud) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	if service.Spec.SessionAffinity != v1.ServiceAffinityNone {
-		return nil, errors.New("SessionAffinity is not supported currently")
+	defer cloud.serviceLocks.lockService(service)()
+
+	if cloud.pause.isPaused() {
+		return nil, ErrCloudPaused
 	}
+	if err := cloud.specErrors.check("ensure", service); err != nil {
+		return nil, err
+	}
+	cloud.reconciles.begin(service)
+	ctx, budget := cloud.withCallBudget(withDescribedLoadBalancers(ctx))
+	status, err := cloud.ensurePortGroupLoadBalancers(ctx, clusterName, service, nodes)
+	err = cloud.endCallBudget(service, "ensure", budget, err)
+	cloud.recordLoadBalancerStatus(service, err)
+	cloud.specErrors.record("ensure", service, err)
+	return status, err
+}
 
-	// TODO check if kubernetes has already do validate
+func (cloud *Cloud) ensureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	plan, err := PlanLoadBalancer(cloud.config, service, nodes)
+	if err != nil {
+		if problem, ok := err.(*PlanError); ok {
+			cloud.recorder.Event(service, v1.EventTypeWarning, problem.Reason, problem.Message)
+			return nil, newSpecError(err)
+		}
+		return nil, err
+	}
+	for _, warning := range plan.Warnings {
+		cloud.recorder.Event(service, v1.EventTypeWarning, warning.Reason, warning.Message)
+	}
+	// the clb is described afresh and changed along the way
+	cloud.loadBalancerCache.forget(plan.Name)
+	defer cloud.loadBalancerCache.forget(plan.Name)
 
 	// 1. ensure loadbalancer created
-	err := cloud.ensureLoadBalancerInstance(ctx, clusterName, service)
+	decision, err := cloud.ensureLoadBalancerInstance(ctx, clusterName, service, nodes, plan)
 	if err != nil {
 		return nil, err
 	}
@@ -90,15 +215,68 @@ func (cloud *Cloud) EnsureLoadBalancer(ctx context.Context, clusterName string,
 		return nil, err
 	}
 
-	loadBalancer, err := cloud.getLoadBalancerByName(cloudprovider.GetLoadBalancerName(service))
+	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerSpecial(service))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. ensure public loadbalancer is billed by the bandwidth package if requested
+	err = cloud.ensureLoadBalancerBandwidthPackage(service, loadBalancer)
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. ensure eip is bounded to loadbalancer if requested
+	err = cloud.ensureLoadBalancerEip(service, loadBalancer)
+	if err != nil {
+		return nil, err
+	}
+
+	// 6. ensure access is restricted to loadBalancerSourceRanges
+	err = cloud.ensureLoadBalancerSecurityGroup(service, loadBalancer)
 	if err != nil {
 		return nil, err
 	}
 
-	ingresses := make([]v1.LoadBalancerIngress, len(loadBalancer.LoadBalancerVips))
+	// 7. warn if most backends of a private loadbalancer are in another zone
+	cloud.checkLoadBalancerZoneSpread(ctx, service, loadBalancer, nodes)
+
+	// 8. withhold the vip of a new loadbalancer until it has backends
+	if err := cloud.checkLoadBalancerReady(service, loadBalancer); err != nil {
+		return nil, err
+	}
+
+	glog.V(4).Infof("ensured loadbalancer %s of service %s/%s: %s", loadBalancer.LoadBalancerId, service.Namespace, service.Name, decision)
+	cloud.reconciles.noteLoadBalancer(service, loadBalancer.LoadBalancerId, decision)
+	return cloud.getLoadBalancerStatus(service, loadBalancer)
+}
 
-	for i, vip := range loadBalancer.LoadBalancerVips {
-		ingresses[i] = v1.LoadBalancerIngress{IP: vip}
+// getLoadBalancerStatus returns the ingress of the clb of the service as its publish annotation asks for. GetLoadBalancer
+// and EnsureLoadBalancer both report it, so dns records made from the status don't flap between them.
+func (cloud *Cloud) getLoadBalancerStatus(service *v1.Service, loadBalancer *clb.LoadBalancer) (*v1.LoadBalancerStatus, error) {
+	// invalid hostnames and publish annotations are rejected by EnsureLoadBalancer
+	hostname, _ := loadBalancerHostname(service)
+	if hostname == "" {
+		hostname = loadBalancer.Domain
+	}
+	publish, _ := loadBalancerPublish(service)
+	if publish != LoadBalancerPublishIP && hostname == "" {
+		glog.Warningf("loadbalancer %s of service %s/%s has no domain, publishing its ip instead", loadBalancer.LoadBalancerId, service.Namespace, service.Name)
+		publish = LoadBalancerPublishIP
+	}
+
+	ingresses := []v1.LoadBalancerIngress{}
+	if publish == LoadBalancerPublishIP || publish == LoadBalancerPublishBoth {
+		ips, err := cloud.getLoadBalancerIps(service, loadBalancer)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			ingresses = append(ingresses, v1.LoadBalancerIngress{IP: ip})
+		}
+	}
+	if publish == LoadBalancerPublishHostname || publish == LoadBalancerPublishBoth {
+		ingresses = append(ingresses, v1.LoadBalancerIngress{Hostname: hostname})
 	}
 
 	return &v1.LoadBalancerStatus{
@@ -106,59 +284,349 @@ func (cloud *Cloud) EnsureLoadBalancer(ctx context.Context, clusterName string,
 	}, nil
 }
 
+// getLoadBalancerIps returns the eip bound to the clb if the service requested one, the vips of the clb otherwise.
+func (cloud *Cloud) getLoadBalancerIps(service *v1.Service, loadBalancer *clb.LoadBalancer) ([]string, error) {
+	if eipRequested(service) {
+		eip, err := cloud.getLoadBalancerEipAddress(service, loadBalancer)
+		if err != nil {
+			return nil, err
+		}
+		if eip != "" {
+			return []string{eip}, nil
+		}
+	}
+	return loadBalancer.LoadBalancerVips, nil
+}
+
+// loadBalancerPublish returns what the ingress of the service reports, see ServiceAnnotationLoadBalancerPublish.
+func loadBalancerPublish(service *v1.Service) (string, error) {
+	value, ok := service.Annotations[ServiceAnnotationLoadBalancerPublish]
+	if !ok {
+		if service.Annotations[ServiceAnnotationLoadBalancerHostname] != "" {
+			return LoadBalancerPublishHostname, nil
+		}
+		return LoadBalancerPublishIP, nil
+	}
+	switch value {
+	case LoadBalancerPublishIP, LoadBalancerPublishHostname, LoadBalancerPublishBoth:
+		return value, nil
+	}
+	return LoadBalancerPublishIP, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q, must be %s, %s or %s",
+		ServiceAnnotationLoadBalancerPublish, value, LoadBalancerPublishIP, LoadBalancerPublishHostname, LoadBalancerPublishBoth)))
+}
+
+// loadBalancerHostname returns the hostname annotation of the service, if any.
+func loadBalancerHostname(service *v1.Service) (string, error) {
+	hostname := service.Annotations[ServiceAnnotationLoadBalancerHostname]
+	if hostname == "" {
+		return "", nil
+	}
+	if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+		return "", newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q: %s", ServiceAnnotationLoadBalancerHostname, hostname, strings.Join(errs, ", "))))
+	}
+	return hostname, nil
+}
+
+// serviceNodePortRange returns the node port range of the cluster, see Config.ServiceNodePortRange.
+func serviceNodePortRange(config Config) (int32, int32) {
+	value := config.ServiceNodePortRange
+	if value == "" {
+		value = defaultServiceNodePortRange
+	}
+	from, to, err := parsePortRange(value)
+	if err != nil {
+		// rejected by Config.Validate
+		return 1, 65535
+	}
+	return from, to
+}
+
+// invalidListeners checks the listeners the service asks for before any of them is created, and describes
+// each invalid one. Listeners are keyed by port and protocol, the backend port is the node port.
+func invalidListeners(config Config, service *v1.Service) []string {
+	nodePortFrom, nodePortTo := serviceNodePortRange(config)
+	invalid := []string{}
+	seen := map[string]string{}
+	for _, port := range service.Spec.Ports {
+		name := fmt.Sprintf("port %q (%d/%s)", port.Name, port.Port, port.Protocol)
+		if port.Protocol != v1.ProtocolTCP && port.Protocol != v1.ProtocolUDP {
+			invalid = append(invalid, fmt.Sprintf("%s: protocol %s is not supported", name, port.Protocol))
+		}
+		if port.Port < 1 || port.Port > 65535 {
+			invalid = append(invalid, fmt.Sprintf("%s: port %d is out of range 1-65535", name, port.Port))
+		}
+		if port.NodePort < nodePortFrom || port.NodePort > nodePortTo {
+			invalid = append(invalid, fmt.Sprintf("%s: node port %d is out of range %d-%d", name, port.NodePort, nodePortFrom, nodePortTo))
+		}
+		key := fmt.Sprintf("%d/%s", port.Port, port.Protocol)
+		if first, ok := seen[key]; ok {
+			invalid = append(invalid, fmt.Sprintf("%s: listener %s is already used by %s", name, key, first))
+			continue
+		}
+		seen[key] = name
+	}
+	return invalid
+}
+
+// unmanagedProtocols returns the protocols of the ports of the service which loadbalancer_protocols leaves
+// out, services using them are left alone.
+func unmanagedProtocols(config Config, service *v1.Service) []string {
+	if len(config.LoadBalancerProtocols) == 0 {
+		return nil
+	}
+	managed := map[v1.Protocol]bool{}
+	for _, protocol := range config.LoadBalancerProtocols {
+		managed[v1.Protocol(protocol)] = true
+	}
+	unmanaged := []string{}
+	seen := map[v1.Protocol]bool{}
+	for _, port := range service.Spec.Ports {
+		if !managed[port.Protocol] && !seen[port.Protocol] {
+			seen[port.Protocol] = true
+			unmanaged = append(unmanaged, string(port.Protocol))
+		}
+	}
+	return unmanaged
+}
+
+// unsupportedAnnotations describes each annotation of the service which the kind or type of its clb can't
+// honor, or which another annotation overrides. They would be ignored otherwise, leaving users to believe
+// they took effect.
+func unsupportedAnnotations(service *v1.Service) []string {
+	unsupported := []string{}
+	has := func(annotation string) bool {
+		_, ok := service.Annotations[annotation]
+		return ok
+	}
+	classic := service.Annotations[ServiceAnnotationLoadBalancerKind] == LoadBalancerKindClassic
+	private := service.Annotations[ServiceAnnotationLoadBalancerType] == LoadBalancerTypePrivate
+
+	if classic {
+		for _, annotation := range []string{
+			ServiceAnnotationLoadBalancerListenerDrainSeconds,
+			ServiceAnnotationLoadBalancerSnatProSubnetId,
+			ServiceAnnotationLoadBalancerStaticBackends,
+			ServiceAnnotationLoadBalancerPortRanges,
+			ServiceAnnotationLoadBalancerHealthCheckHttpCodes,
+		} {
+			if has(annotation) {
+				unsupported = append(unsupported, fmt.Sprintf("%s is only supported by application loadbalancers", annotation))
+			}
+		}
+	}
+	if private && has(ServiceAnnotationLoadBalancerBandwidthPackageId) {
+		unsupported = append(unsupported, fmt.Sprintf("%s is only supported by public loadbalancers, use %s for the eip of a private one",
+			ServiceAnnotationLoadBalancerBandwidthPackageId, ServiceAnnotationLoadBalancerEipBandwidthPackageId))
+	}
+	if private && !has(ServiceAnnotationLoadBalancerHostname) {
+		// private clbs have no domain
+		if publish := service.Annotations[ServiceAnnotationLoadBalancerPublish]; publish == LoadBalancerPublishHostname || publish == LoadBalancerPublishBoth {
+			unsupported = append(unsupported, fmt.Sprintf("%s %s requires %s for private loadbalancers, they have no domain",
+				ServiceAnnotationLoadBalancerPublish, publish, ServiceAnnotationLoadBalancerHostname))
+		}
+	}
+	if !private {
+		if has(ServiceAnnotationLoadBalancerTypeInternalSubnetId) {
+			unsupported = append(unsupported, fmt.Sprintf("%s is only supported by private loadbalancers", ServiceAnnotationLoadBalancerTypeInternalSubnetId))
+		}
+		if eipRequested(service) {
+			unsupported = append(unsupported, fmt.Sprintf("%s is only supported by private loadbalancers", ServiceAnnotationLoadBalancerAllocateEip))
+		}
+	}
+	if has(ServiceAnnotationLoadBalancerEipBandwidthPackageId) && !eipRequested(service) {
+		unsupported = append(unsupported, fmt.Sprintf("%s requires %s to be \"true\"",
+			ServiceAnnotationLoadBalancerEipBandwidthPackageId, ServiceAnnotationLoadBalancerAllocateEip))
+	}
+	if has(ServiceAnnotationLoadBalancerStaticBackends) {
+		for _, annotation := range []string{ServiceAnnotationLoadBalancerBackendsLabel, ServiceAnnotationLoadBalancerActiveGroup} {
+			if has(annotation) {
+				unsupported = append(unsupported, fmt.Sprintf("%s selects nodes, which %s replaces", annotation, ServiceAnnotationLoadBalancerStaticBackends))
+			}
+		}
+	}
+	return unsupported
+}
+
 func (cloud *Cloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	defer cloud.serviceLocks.lockService(service)()
+
+	if cloud.pause.isPaused() {
+		return ErrCloudPaused
+	}
+	if err := cloud.specErrors.check("update", service); err != nil {
+		return err
+	}
+	ctx, budget := cloud.withCallBudget(withDescribedLoadBalancers(ctx))
+	err := cloud.updatePortGroupLoadBalancers(ctx, clusterName, service, nodes)
+	err = cloud.endCallBudget(service, "update", budget, err)
+	cloud.specErrors.record("update", service, err)
+	if err == nil {
+		cloud.syncLoadBalancerIngress(ctx, clusterName, service)
+	}
+	return err
+}
+
+func (cloud *Cloud) updatePortGroupLoadBalancers(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	withPorts, _, _, err := portGroupServices(service)
+	if err != nil {
+		return err
+	}
+	for _, view := range withPorts {
+		if err := cloud.updateLoadBalancer(ctx, clusterName, view, nodes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cloud *Cloud) updateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	if unmanaged := unmanagedProtocols(cloud.config, service); len(unmanaged) > 0 {
+		glog.V(4).Infof("not updating backends of service %s/%s, its %s ports are not managed", service.Namespace, service.Name, strings.Join(unmanaged, ", "))
+		return nil
+	}
+	// static backends don't follow the nodes
+	if _, ok := service.Annotations[ServiceAnnotationLoadBalancerStaticBackends]; ok {
+		glog.V(4).Infof("not updating static backends of service %s/%s on node changes", service.Namespace, service.Name)
+		return nil
+	}
+	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerSpecial(service))
+	if err != nil {
+		return err
+	}
+	// abnormal clbs are only recreated by EnsureLoadBalancer, which creates their listeners again
+	if err := cloud.checkLoadBalancerState(ctx, loadBalancer); err != nil {
+		if abnormal, ok := err.(*loadBalancerAbnormalError); ok {
+			cloud.reportAbnormalLoadBalancer(service, abnormal, false)
+		}
+		cloud.loadBalancerCache.forget(loadBalancerSpecial(service))
+		return err
+	}
 	return cloud.ensureLoadBalancerBackends(ctx, clusterName, service, nodes)
 }
 
 func (cloud *Cloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
-	_, err := cloud.getLoadBalancerByName(cloudprovider.GetLoadBalancerName(service))
+	defer cloud.serviceLocks.lockService(service)()
+
+	if cloud.pause.isPaused() {
+		return ErrCloudPaused
+	}
+	if err := cloud.specErrors.check("delete", service); err != nil {
+		return err
+	}
+	ctx, budget := cloud.withCallBudget(ctx)
+	err := cloud.ensurePortGroupLoadBalancersDeleted(ctx, clusterName, service)
+	err = cloud.endCallBudget(service, "delete", budget, err)
+	if err == nil {
+		cloud.specErrors.forget(service)
+		cloud.clearLoadBalancerStatus(service)
+		return nil
+	}
+	cloud.specErrors.record("delete", service, err)
+	return err
+}
+
+func (cloud *Cloud) ensureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	loadBalancerName := loadBalancerSpecial(service)
+	cloud.loadBalancerCache.forget(loadBalancerName)
+	_, err := cloud.getLoadBalancerByName(loadBalancerName)
 	if err != nil {
-		if err == ErrCloudLoadBalancerNotFound {
-			return nil
+		if err != ErrCloudLoadBalancerNotFound {
+			return err
+		}
+		if eipRequested(service) {
+			// eips we allocated may outlive the clb if releasing them failed
+			if err := cloud.deleteLoadBalancerEips(loadBalancerName, ""); err != nil {
+				return err
+			}
 		}
+		// so may security groups
+		return cloud.deleteLoadBalancerSecurityGroups(service)
 	}
 
 	return cloud.deleteLoadBalancer(ctx, clusterName, service)
 }
 
 func (cloud *Cloud) getLoadBalancerByName(name string) (*clb.LoadBalancer, error) {
+	if loadBalancer, ok := cloud.loadBalancerCache.get(name); ok {
+		return loadBalancer, nil
+	}
 	// we don't need to check loadbalancer kind here because ensureLoadBalancerInstance will ensure the kind is right
 	forward := -1
-	response, err := cloud.clb.DescribeLoadBalancers(&clb.DescribeLoadBalancersArgs{
+	loadBalancers, err := cloud.describeLoadBalancers(&clb.DescribeLoadBalancersArgs{
 		Special: &name,
 		Forward: &forward,
 	})
 	if err != nil {
 		return nil, err
 	}
-	if len(response.LoadBalancerSet) < 1 {
+
+	// clbs of the legacy api carry no tags, the special field set on creation is all there is to tell
+	// owned clbs apart. The loadBalancerName is the display name of the name annotation.
+	var found *clb.LoadBalancer
+	for i := range loadBalancers {
+		candidate := &loadBalancers[i]
+		reason := "accepted"
+		if found != nil {
+			reason = fmt.Sprintf("rejected, duplicate of %s", found.LoadBalancerId)
+		} else {
+			found = candidate
+		}
+		glog.V(4).Infof("loadbalancer lookup %s: candidate %s (name %q, type %d, forward %d, vpc %s) %s",
+			name, candidate.LoadBalancerId, candidate.LoadBalancerName, candidate.LoadBalancerType, candidate.Forward, candidate.UniqVpcId, reason)
+	}
+
+	if found == nil {
+		glog.V(4).Infof("loadbalancer lookup %s: not found among %d candidates", name, len(loadBalancers))
 		return nil, ErrCloudLoadBalancerNotFound
 	}
+	cloud.loadBalancerCache.add(name, found)
+	return found, nil
+}
+
+// describeLoadBalancers returns every clb matching args, page by page of the configured page size.
+func (cloud *Cloud) describeLoadBalancers(args *clb.DescribeLoadBalancersArgs) ([]clb.LoadBalancer, error) {
+	loadBalancers := []clb.LoadBalancer{}
+
+	offset := 0
+	limit := cloud.config.LoadBalancerPageSize
+	if limit == 0 {
+		limit = defaultLoadBalancerPageSize
+	}
+	args.Offset = &offset
+	args.Limit = &limit
+
+	for {
+		response, err := cloud.clb.DescribeLoadBalancers(args)
+		if err != nil {
+			return nil, err
+		}
+		loadBalancers = append(loadBalancers, response.LoadBalancerSet...)
+
+		if len(response.LoadBalancerSet) > 0 && len(loadBalancers) < response.TotalCount {
+			offset = len(loadBalancers)
+		} else {
+			break
+		}
+	}
 
-	return &response.LoadBalancerSet[0], nil
+	return loadBalancers, nil
 }
 
-func (cloud *Cloud) ensureLoadBalancerInstance(ctx context.Context, clusterName string, service *v1.Service) error {
-	loadBalancerName := cloudprovider.GetLoadBalancerName(service)
+// ensureLoadBalancerInstance compares the clb of the plan with the live one, creating it if there is none and
+// recreating it if its type, kind or vpc differ from the desired ones, or if it is abnormal and
+// recreate_abnormal_loadbalancer is set. It returns the decision taken for the reconcile summary.
+func (cloud *Cloud) ensureLoadBalancerInstance(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node, plan *LoadBalancerPlan) (string, error) {
+	loadBalancerName := plan.Name
 
 	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
 	if err != nil {
 		if err != ErrCloudLoadBalancerNotFound {
-			return err
+			return "", err
 		}
-		loadBalancer, err = cloud.createLoadBalancer(ctx, clusterName, service)
-		if err != nil {
-			return err
+		if _, err = cloud.createLoadBalancer(ctx, clusterName, service, nodes, plan); err != nil {
+			return "", err
 		}
-	}
-
-	loadBalancerDesiredKind, ok := service.Annotations[ServiceAnnotationLoadBalancerKind]
-	if !ok || (loadBalancerDesiredKind != LoadBalancerKindClassic && loadBalancerDesiredKind != LoadBalancerKindApplication) {
-		loadBalancerDesiredKind = LoadBalancerKindApplication
-	}
-	loadBalancerDesiredType, ok := service.Annotations[ServiceAnnotationLoadBalancerType]
-	if !ok || (loadBalancerDesiredType != LoadBalancerTypePrivate && loadBalancerDesiredType != LoadBalancerTypePublic) {
-		loadBalancerDesiredType = LoadBalancerTypePublic
+		return "created, no existing clb found", nil
 	}
 
 	// don't check subnet id because clb could bound to instance in differnet subnet
@@ -170,42 +638,59 @@ func (cloud *Cloud) ensureLoadBalancerInstance(ctx context.Context, clusterName
 	// }
 	//}
 
-	needRecreate := false
-	switch {
-	case loadBalancerDesiredType == LoadBalancerTypePublic && loadBalancerDesiredKind == LoadBalancerKindApplication:
-		if !(loadBalancer.LoadBalancerType == ClbLoadBalancerTypePublic && loadBalancer.Forward == ClbLoadBalancerKindApplication && loadBalancer.UniqVpcId == cloud.config.VpcId) {
-			needRecreate = true
-		}
-	case loadBalancerDesiredType == LoadBalancerTypePublic && loadBalancerDesiredKind == LoadBalancerKindClassic:
-		if !(loadBalancer.LoadBalancerType == ClbLoadBalancerTypePublic && loadBalancer.Forward == ClbLoadBalancerKindClassic && loadBalancer.UniqVpcId == cloud.config.VpcId) {
-			needRecreate = true
-		}
-	case loadBalancerDesiredType == LoadBalancerTypePrivate && loadBalancerDesiredKind == LoadBalancerKindApplication:
-		if !(loadBalancer.LoadBalancerType == ClbLoadBalancerTypePrivate && loadBalancer.Forward == ClbLoadBalancerKindApplication && loadBalancer.UniqVpcId == cloud.config.VpcId) {
-			needRecreate = true
-		}
-	case loadBalancerDesiredType == LoadBalancerTypePrivate && loadBalancerDesiredKind == LoadBalancerKindClassic:
-		if !(loadBalancer.LoadBalancerType == ClbLoadBalancerTypePrivate && loadBalancer.Forward == ClbLoadBalancerKindClassic && loadBalancer.UniqVpcId == cloud.config.VpcId) {
-			needRecreate = true
+	mismatch := loadBalancerMismatch(loadBalancer, plan.Type, plan.Kind, cloud.config.VpcId)
+	if mismatch == "" {
+		if err := cloud.checkLoadBalancerState(ctx, loadBalancer); err != nil {
+			abnormal, ok := err.(*loadBalancerAbnormalError)
+			if !ok {
+				return "", err
+			}
+			cloud.reportAbnormalLoadBalancer(service, abnormal, cloud.config.RecreateAbnormalLoadBalancer)
+			if !cloud.config.RecreateAbnormalLoadBalancer {
+				return "", err
+			}
+			mismatch = err.Error()
 		}
-	default:
-		needRecreate = true
+	}
+	if mismatch == "" {
+		glog.V(4).Infof("loadbalancer %s: keeping %s, it matches the desired type and kind", loadBalancerName, loadBalancer.LoadBalancerId)
+		return fmt.Sprintf("found %s", loadBalancer.LoadBalancerId), nil
 	}
 
-	if needRecreate {
-		if err := cloud.deleteLoadBalancer(ctx, clusterName, service); err != nil {
-			return err
-		}
-		if loadBalancer, err = cloud.createLoadBalancer(ctx, clusterName, service); err != nil {
-			return err
-		}
+	glog.V(4).Infof("loadbalancer %s: recreating %s, %s", loadBalancerName, loadBalancer.LoadBalancerId, mismatch)
+	if err := cloud.deleteLoadBalancer(ctx, clusterName, service); err != nil {
+		return "", err
+	}
+	if _, err = cloud.createLoadBalancer(ctx, clusterName, service, nodes, plan); err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("recreated %s, %s", loadBalancer.LoadBalancerId, mismatch), nil
+}
 
-	return nil
+// loadBalancerMismatch returns why the clb doesn't match the desired type and kind, or "" if it does.
+func loadBalancerMismatch(loadBalancer *clb.LoadBalancer, desiredType string, desiredKind string, vpcId string) string {
+	clbType := ClbLoadBalancerTypePublic
+	if desiredType == LoadBalancerTypePrivate {
+		clbType = ClbLoadBalancerTypePrivate
+	}
+	clbKind := ClbLoadBalancerKindApplication
+	if desiredKind == LoadBalancerKindClassic {
+		clbKind = ClbLoadBalancerKindClassic
+	}
+
+	switch {
+	case loadBalancer.LoadBalancerType != clbType:
+		return fmt.Sprintf("network type %d mismatch, want %d", loadBalancer.LoadBalancerType, clbType)
+	case loadBalancer.Forward != clbKind:
+		return fmt.Sprintf("kind %d mismatch, want %d", loadBalancer.Forward, clbKind)
+	case loadBalancer.UniqVpcId != vpcId:
+		return fmt.Sprintf("vpc %s mismatch, want %s", loadBalancer.UniqVpcId, vpcId)
+	}
+	return ""
 }
 
 func (cloud *Cloud) ensureLoadBalancerListeners(ctx context.Context, clusterName string, service *v1.Service) error {
-	loadBalancerName := cloudprovider.GetLoadBalancerName(service)
+	loadBalancerName := loadBalancerSpecial(service)
 
 	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
 	if err != nil {
@@ -230,9 +715,15 @@ func (cloud *Cloud) ensureClassicLoadBalancerListeners(ctx context.Context, clus
 		return err
 	}
 
+	descriptions, err := listenerDescriptions(service)
+	if err != nil {
+		return err
+	}
+
 	loadBalancerListeners := response.ListenerSet
 
 	usedListenerIds := []string{}
+	usedListenerPorts := map[string]v1.ServicePort{}
 
 	createdServicePortNames := []string{}
 
@@ -253,9 +744,35 @@ func (cloud *Cloud) ensureClassicLoadBalancerListeners(ctx context.Context, clus
 		if listenerId != "" {
 			createdServicePortNames = append(createdServicePortNames, port.Name)
 			usedListenerIds = append(usedListenerIds, listenerId)
+			usedListenerPorts[listenerId] = port
 		}
 	}
 
+	// a listener of the port forwarding to another node port is replaced by one forwarding to the new node port. The
+	// legacy api can't change the backend port of a listener, so the new listener is created before the old one
+	// is deleted. Backends of classic clbs are registered with the clb rather than the listener, they serve both.
+	listenersToReplace := []string{}
+	replaced := map[string]bool{}
+	for _, port := range service.Spec.Ports {
+		if _, ok := usedListenerPorts[findOneListenerValid(port)]; ok {
+			continue
+		}
+		for _, listener := range loadBalancerListeners {
+			if _, used := usedListenerPorts[listener.UnListenerId]; used || replaced[listener.UnListenerId] {
+				continue
+			}
+			if listener.LoadBalancerPort == port.Port && cloud.mapClbProtoToServicePortProto(listener.Protocol) == port.Protocol {
+				replaced[listener.UnListenerId] = true
+				usedListenerIds = append(usedListenerIds, listener.UnListenerId)
+				listenersToReplace = append(listenersToReplace, listener.UnListenerId)
+				glog.Infof("replacing listener %s of loadbalancer %s to forward port %d to node port %d",
+					listener.UnListenerId, loadBalancer.LoadBalancerId, port.Port, port.NodePort)
+				break
+			}
+		}
+	}
+	sort.Strings(listenersToReplace)
+
 	listenersToCreate := []clb.CreateListenerOpts{}
 
 	for _, port := range service.Spec.Ports {
@@ -269,11 +786,18 @@ func (cloud *Cloud) ensureClassicLoadBalancerListeners(ctx context.Context, clus
 		}
 
 		if !ensured {
+			healthCheck := cloud.listenerHealthCheck(service, loadBalancer, port)
+			listenerName := listenerDescription(service, port, descriptions)
 			listenersToCreate = append(listenersToCreate, clb.CreateListenerOpts{
 				LoadBalancerPort: port.Port,
 				InstancePort:     port.NodePort,
 				Protocol:         cloud.mapServicePortProtoClbProto(port.Protocol),
-				ListenerName:     &port.Name,
+				ListenerName:     &listenerName,
+				HealthSwitch:     &healthCheck.HealthSwitch,
+				TimeOut:          &healthCheck.TimeOut,
+				IntervalTime:     &healthCheck.IntervalTime,
+				HealthNum:        &healthCheck.HealthNum,
+				UnhealthNum:      &healthCheck.UnhealthNum,
 			})
 		}
 	}
@@ -294,42 +818,81 @@ func (cloud *Cloud) ensureClassicLoadBalancerListeners(ctx context.Context, clus
 		}
 	}
 	if len(listenersToDelete) > 0 {
-		result, err := clb.WaitUntilDone(
-			func() (clb.AsyncTask, error) {
-				return cloud.clb.DeleteLoadBalancerListeners(
-					loadBalancer.LoadBalancerId,
-					listenersToDelete,
-				)
-			},
-			cloud.clb,
-		)
-		if err != nil {
-			return err
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerListenerDrainSeconds]; ok {
+			glog.Warningf("listeners of classic loadbalancer %s can not be drained, deleting %v right away", loadBalancer.LoadBalancerId, listenersToDelete)
 		}
-		if result != clb.TaskSuccceed {
-			return errors.New("task is not succeed")
+		if err := cloud.deleteClassicListeners(ctx, loadBalancer, listenersToDelete); err != nil {
+			return err
 		}
 	}
 
 	if len(listenersToCreate) > 0 {
-		result, err := clb.WaitUntilDone(
-			func() (clb.AsyncTask, error) {
-				return cloud.clb.CreateLoadBalancerListeners(&clb.CreateLoadBalancerListenersArgs{
-					LoadBalancerId: loadBalancer.LoadBalancerId,
-					Listeners:      listenersToCreate,
-				})
-			},
-			cloud.clb,
-		)
+		err := cloud.createClassicListeners(ctx, loadBalancer, listenersToCreate)
+		if err != nil && len(listenersToReplace) > 0 {
+			// a clb refusing a second listener of the port gets it once the old one is gone. The old listener serves
+			// nothing by then anyway, kube-proxy closes the old node port as soon as the service changed
+			glog.Warningf("creating listeners of loadbalancer %s next to %v failed, deleting those first: %v",
+				loadBalancer.LoadBalancerId, listenersToReplace, err)
+			if err := cloud.deleteClassicListeners(ctx, loadBalancer, listenersToReplace); err != nil {
+				return err
+			}
+			listenersToReplace = nil
+			err = cloud.createClassicListeners(ctx, loadBalancer, listenersToCreate)
+		}
 		if err != nil {
 			return err
 		}
-		if result != clb.TaskSuccceed {
-			return errors.New("task is not succeed")
+	}
+	if len(listenersToReplace) > 0 {
+		if err := cloud.deleteClassicListeners(ctx, loadBalancer, listenersToReplace); err != nil {
+			return err
 		}
+	}
 
+	// listeners created above are named and checked as desired already
+	if err := cloud.ensureListenerNames(ctx, service, loadBalancer, usedListenerPorts); err != nil {
+		return err
+	}
+	return cloud.ensureListenerHealthChecks(ctx, service, loadBalancer, usedListenerPorts)
+}
+
+func (cloud *Cloud) createClassicListeners(ctx context.Context, loadBalancer *clb.LoadBalancer, listeners []clb.CreateListenerOpts) error {
+	result, err := waitUntilDone(
+		ctx,
+		func() (clb.AsyncTask, error) {
+			return cloud.clb.CreateLoadBalancerListeners(&clb.CreateLoadBalancerListenersArgs{
+				LoadBalancerId: loadBalancer.LoadBalancerId,
+				Listeners:      listeners,
+			})
+		},
+		cloud.clb,
+	)
+	if err != nil {
+		return err
+	}
+	if result != clb.TaskSuccceed {
+		return errors.New("task is not succeed")
 	}
+	return nil
+}
 
+func (cloud *Cloud) deleteClassicListeners(ctx context.Context, loadBalancer *clb.LoadBalancer, listenerIds []string) error {
+	result, err := waitUntilDone(
+		ctx,
+		func() (clb.AsyncTask, error) {
+			return cloud.clb.DeleteLoadBalancerListeners(
+				loadBalancer.LoadBalancerId,
+				listenerIds,
+			)
+		},
+		cloud.clb,
+	)
+	if err != nil {
+		return err
+	}
+	if result != clb.TaskSuccceed {
+		return errors.New("task is not succeed")
+	}
 	return nil
 }
 
@@ -341,17 +904,41 @@ func (cloud *Cloud) ensureApplicationLoadBalancerListeners(ctx context.Context,
 		return err
 	}
 
-	loadBalancerListeners := response.ListenerSet
+	drainTimeout, err := listenerDrainTimeout(service)
+	if err != nil {
+		return err
+	}
+
+	// listeners being drained are gone as far as the service is concerned
+	loadBalancerListeners := make([]clb.FourthOrSeventeenLayerListener, 0, len(response.ListenerSet))
+	for _, listener := range response.ListenerSet {
+		if !cloud.listenerDrainer.isDraining(listener.ListenerId) {
+			loadBalancerListeners = append(loadBalancerListeners, listener)
+		}
+	}
+
+	descriptions, err := listenerDescriptions(service)
+	if err != nil {
+		return err
+	}
+
+	// range listeners look like listeners of their first port to the legacy api
+	endPorts, err := cloud.describeListenerEndPorts(loadBalancer.LoadBalancerId)
+	if err != nil {
+		return err
+	}
 
 	usedListenerIds := make([]string, 0)
+	usedListenerPorts := map[string]v1.ServicePort{}
 
 	createdServicePortNames := make([]string, 0)
 
-	findOneListenerValid := func(port v1.ServicePort) (listenerId string) {
+	findOneListenerValid := func(port v1.ServicePort, endPort int32) (listenerId string) {
 		listenerId = ""
 
 		for _, listener := range loadBalancerListeners {
-			if listener.LoadBalancerPort == int(port.Port) && cloud.mapClbProtoToServicePortProto(listener.Protocol) == port.Protocol {
+			if listener.LoadBalancerPort == int(port.Port) && cloud.mapClbProtoToServicePortProto(listener.Protocol) == port.Protocol &&
+				endPorts[listener.ListenerId] == int(endPort) {
 				return listener.ListenerId
 			}
 		}
@@ -359,18 +946,71 @@ func (cloud *Cloud) ensureApplicationLoadBalancerListeners(ctx context.Context,
 		return
 	}
 
+	// ports of a range are served by its listener, unless any of them is served by a listener of its own
+	rangePorts := map[string]bool{}
+	rangesToCreate := []portRange{}
+	for _, r := range servicePortRanges(service) {
+		if listenerId := findOneListenerValid(r.first(), r.endPort()); listenerId != "" {
+			usedListenerIds = append(usedListenerIds, listenerId)
+			usedListenerPorts[listenerId] = r.first()
+		} else {
+			served := false
+			for _, port := range r.Ports {
+				if findOneListenerValid(port, 0) != "" {
+					served = true
+				}
+			}
+			if served {
+				continue
+			}
+			rangesToCreate = append(rangesToCreate, r)
+		}
+		for _, port := range r.Ports {
+			rangePorts[listenerKey(port)] = true
+		}
+	}
+
 	for _, port := range service.Spec.Ports {
-		listenerId := findOneListenerValid(port)
+		if rangePorts[listenerKey(port)] {
+			continue
+		}
+		listenerId := findOneListenerValid(port, 0)
 		if listenerId != "" {
 			// TODO check if port name is unique
 			createdServicePortNames = append(createdServicePortNames, port.Name)
 			usedListenerIds = append(usedListenerIds, listenerId)
+			usedListenerPorts[listenerId] = port
 		}
 	}
 
 	listenersToCreate := make([]clb.CreateFourthLayerListenerOpts, 0)
+	// the legacy api can't configure http checks, the listeners checked over http are created through the v3 api
+	httpCheckedToCreate := []v1.ServicePort{}
+
+	listenerToCreate := func(port v1.ServicePort) {
+		healthCheck := cloud.listenerHealthCheck(service, loadBalancer, port)
+		if healthCheck.CheckType != "" {
+			httpCheckedToCreate = append(httpCheckedToCreate, port)
+			return
+		}
+		listenerName := listenerDescription(service, port, descriptions)
+		listenersToCreate = append(listenersToCreate, clb.CreateFourthLayerListenerOpts{
+			LoadBalancerPort: int(port.Port),
+			Protocol:         cloud.mapServicePortProtoClbProto(port.Protocol),
+			ListenerName:     &listenerName,
+			HealthSwitch:     &healthCheck.HealthSwitch,
+			TimeOut:          &healthCheck.TimeOut,
+			IntervalTime:     &healthCheck.IntervalTime,
+			HealthNum:        &healthCheck.HealthNum,
+			UnhealthNum:      &healthCheck.UnhealthNum,
+		})
+	}
 
 	for _, port := range service.Spec.Ports {
+		if rangePorts[listenerKey(port)] {
+			continue
+		}
+
 		ensured := false
 
 		for _, portName := range createdServicePortNames {
@@ -381,10 +1021,7 @@ func (cloud *Cloud) ensureApplicationLoadBalancerListeners(ctx context.Context,
 		}
 
 		if !ensured {
-			listenersToCreate = append(listenersToCreate, clb.CreateFourthLayerListenerOpts{
-				LoadBalancerPort: int(port.Port),
-				Protocol:         cloud.mapServicePortProtoClbProto(port.Protocol),
-			})
+			listenerToCreate(port)
 		}
 	}
 
@@ -405,7 +1042,12 @@ func (cloud *Cloud) ensureApplicationLoadBalancerListeners(ctx context.Context,
 	}
 
 	for _, unusedListener := range listenersToDelete {
-		result, err := clb.WaitUntilDone(
+		if drainTimeout > 0 {
+			cloud.drainApplicationListener(loadBalancer.LoadBalancerId, unusedListener, drainTimeout)
+			continue
+		}
+		result, err := waitUntilDone(
+			ctx,
 			func() (clb.AsyncTask, error) {
 				return cloud.clb.DeleteForwardLBListener(&clb.DeleteForwardLBListenerArgs{
 					LoadBalancerId: loadBalancer.LoadBalancerId,
@@ -422,8 +1064,27 @@ func (cloud *Cloud) ensureApplicationLoadBalancerListeners(ctx context.Context,
 		}
 	}
 
+	for _, r := range rangesToCreate {
+		first := r.first()
+		err := cloud.createListenerV3(ctx, loadBalancer.LoadBalancerId, mapServicePortProtoClbV3Proto(first.Protocol), first.Port, r.endPort(),
+			listenerDescription(service, first, descriptions), cloud.listenerHealthCheck(service, loadBalancer, first))
+		if err == nil {
+			glog.Infof("created listener of ports %s on loadbalancer %s", r, loadBalancer.LoadBalancerId)
+			continue
+		}
+		if !isPortRangeUnsupportedError(err) {
+			return err
+		}
+		cloud.recorder.Eventf(service, v1.EventTypeWarning, "PortRangeUnsupported",
+			"Loadbalancer %s can't serve ports %s with one listener, creating a listener per port: %v", loadBalancer.LoadBalancerId, r, err)
+		for _, port := range r.Ports {
+			listenerToCreate(port)
+		}
+	}
+
 	if len(listenersToCreate) > 0 {
-		result, err := clb.WaitUntilDone(
+		result, err := waitUntilDone(
+			ctx,
 			func() (clb.AsyncTask, error) {
 				return cloud.clb.CreateForwardLBFourthLayerListeners(&clb.CreateForwardLBFourthLayerListenersArgs{
 					LoadBalancerId: loadBalancer.LoadBalancerId,
@@ -439,26 +1100,134 @@ func (cloud *Cloud) ensureApplicationLoadBalancerListeners(ctx context.Context,
 			return errors.New("task is not succeed")
 		}
 	}
+	for _, port := range httpCheckedToCreate {
+		err := cloud.createListenerV3(ctx, loadBalancer.LoadBalancerId, mapServicePortProtoClbV3Proto(port.Protocol), port.Port, 0,
+			listenerDescription(service, port, descriptions), cloud.listenerHealthCheck(service, loadBalancer, port))
+		if err != nil {
+			return err
+		}
+	}
 
-	return nil
+	// listeners created above are named and checked as desired already
+	if err := cloud.ensureListenerNames(ctx, service, loadBalancer, usedListenerPorts); err != nil {
+		return err
+	}
+	return cloud.ensureListenerHealthChecks(ctx, service, loadBalancer, usedListenerPorts)
 }
 
-func (cloud *Cloud) ensureLoadBalancerBackends(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	loadBalancerName := cloudprovider.GetLoadBalancerName(service)
+// listenerHealthCheck is the health check configuration of a single listener
+type listenerHealthCheck struct {
+	HealthSwitch int
+	TimeOut      int
+	IntervalTime int
+	HealthNum    int
+	UnhealthNum  int
+	// CheckType is healthCheckTypeHTTP for http checks, empty for checks of the backend port
+	CheckType string
+	// CheckPort is the node port http checks are sent to
+	CheckPort int
+	// HttpCodes are the status codes http checks accept in the bit mask of the api, see parseHealthCheckHttpCodes
+	HttpCodes int
+}
+
+const (
+	healthCheckTypeHTTP = "HTTP"
+	// healthCheckPath is served by kube-proxy on the healthCheckNodePort of the service, answering 200 on
+	// nodes with a local endpoint and 503 on the others
+	healthCheckPath = "/healthz"
+)
+
+// listenerHealthCheck builds the health check of the listener of the clb serving port.
+// The check is built per listener because listeners of one service may use different protocols.
+//
+// Services with externalTrafficPolicy=Local get an http check against their healthCheckNodePort on the tcp
+// listeners of application clbs, so nodes without a local endpoint are taken out of rotation. Udp listeners
+// can't use http checks in all regions, they fall back to port checks against the node port of the service
+// port. The classic clb apis can only check the backend port, which is the node port as well.
+func (cloud *Cloud) listenerHealthCheck(service *v1.Service, loadBalancer *clb.LoadBalancer, port v1.ServicePort) listenerHealthCheck {
+	healthCheck := listenerHealthCheck{
+		HealthSwitch: 1,
+		TimeOut:      2,
+		IntervalTime: 5,
+		HealthNum:    3,
+		UnhealthNum:  3,
+	}
+	if service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		return healthCheck
+	}
+
+	switch {
+	case port.Protocol == v1.ProtocolUDP:
+		// port check against the node port of the service port
+	case loadBalancer.Forward == ClbLoadBalancerKindClassic || service.Spec.HealthCheckNodePort == 0:
+		// take nodes without local endpoints out of rotation faster, they refuse every connection
+		healthCheck.UnhealthNum = 2
+	default:
+		healthCheck.CheckType = healthCheckTypeHTTP
+		healthCheck.CheckPort = int(service.Spec.HealthCheckNodePort)
+		healthCheck.HttpCodes = healthCheckHttpCodes(service)
+	}
+	return healthCheck
+}
+
+func (cloud *Cloud) ensureLoadBalancerBackends(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (err error) {
+	// the clb may have changed under a failed call, it is described again next time
+	defer func() {
+		if err != nil {
+			cloud.loadBalancerCache.forget(loadBalancerSpecial(service))
+		}
+	}()
+	backends, static, err := staticBackends(service)
+	if err != nil {
+		return err
+	}
+	if static {
+		loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerSpecial(service))
+		if err != nil {
+			return err
+		}
+		return cloud.ensureStaticBackends(ctx, service, loadBalancer, backends)
+	}
+
+	nodes, err = filterBackendNodes(service, nodes)
+	if err != nil {
+		return err
+	}
+	nodes = cloud.excludeNodesToBeDeleted(service, nodes)
+
+	loadBalancerName := loadBalancerSpecial(service)
 
 	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
 	if err != nil {
 		return err
 	}
 
+	switched := cloud.trackBackendGroupSwitch(service, len(nodes))
 	switch loadBalancer.Forward {
 	case ClbLoadBalancerKindClassic:
-		return cloud.ensureClassicLoadBalancerBackends(ctx, clusterName, service, nodes, loadBalancer)
+		err = cloud.ensureClassicLoadBalancerBackends(ctx, clusterName, service, nodes, loadBalancer)
 	case ClbLoadBalancerKindApplication:
-		return cloud.ensureApplicationLoadBalancerBackends(ctx, clusterName, service, nodes, loadBalancer)
+		err = cloud.ensureApplicationLoadBalancerBackends(ctx, clusterName, service, nodes, loadBalancer)
 	default:
-		return errors.New("task is not succeed")
+		err = errors.New("task is not succeed")
+	}
+	switched(err)
+	return err
+}
+
+// maxBackendsPerRequest is the number of backends a single register or deregister request accepts.
+//
+// Backends are changed in chunks of that size, one task per chunk. Listeners are handled one after
+// another: the clb runs one task per loadbalancer at a time and rejects tasks submitted meanwhile.
+// A service with 10 ports on 300 new nodes takes 10*15 register tasks, at a few seconds per task
+// the first sync takes several minutes. Later syncs only submit tasks for the nodes that changed.
+const maxBackendsPerRequest = 20
+
+func backendsChunkEnd(start int, length int) int {
+	if start+maxBackendsPerRequest < length {
+		return start + maxBackendsPerRequest
 	}
+	return length
 }
 
 func (cloud *Cloud) ensureClassicLoadBalancerBackends(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node, loadBalancer *clb.LoadBalancer) error {
@@ -472,18 +1241,12 @@ func (cloud *Cloud) ensureClassicLoadBalancerBackends(ctx context.Context, clust
 		nodeLanIps = append(nodeLanIps, node.Name)
 	}
 
-	instancesInMultiVpc, err := cloud.describeInstancesByMultiLanIp(nodeLanIps)
+	instancesInMultiVpc, err := cloud.describeInstancesByMultiLanIp(ctx, nodeLanIps)
 	if err != nil {
 		return err
 	}
 
-	instances := []cvm.InstanceInfo{}
-
-	for _, instance := range instancesInMultiVpc {
-		if instance.VirtualPrivateCloud.VpcID == cloud.config.VpcId {
-			instances = append(instances, instance)
-		}
-	}
+	instances, _ := cloud.backendInstances(service, loadBalancer, instancesInMultiVpc)
 
 	backendsToAdd := []string{}
 	backendsToDelete := []string{}
@@ -516,6 +1279,10 @@ func (cloud *Cloud) ensureClassicLoadBalancerBackends(ctx context.Context, clust
 		}
 	}
 
+	// sorted so unchanged clusters produce identical requests
+	sort.Strings(backendsToAdd)
+	sort.Strings(backendsToDelete)
+
 	backendToRegister := []clb.RegisterInstancesOpts{}
 	backendToDeRegister := []string{}
 
@@ -529,12 +1296,14 @@ func (cloud *Cloud) ensureClassicLoadBalancerBackends(ctx context.Context, clust
 		backendToDeRegister = append(backendToDeRegister, backendToDelete)
 	}
 
-	if len(backendToRegister) > 0 {
-		result, err := clb.WaitUntilDone(
+	for start := 0; start < len(backendToRegister); start += maxBackendsPerRequest {
+		backends := backendToRegister[start:backendsChunkEnd(start, len(backendToRegister))]
+		result, err := waitUntilDone(
+			ctx,
 			func() (clb.AsyncTask, error) {
 				return cloud.clb.RegisterInstancesWithLoadBalancer(&clb.RegisterInstancesWithLoadBalancerArgs{
 					LoadBalancerId: loadBalancer.LoadBalancerId,
-					Backends:       backendToRegister,
+					Backends:       backends,
 				})
 			}, cloud.clb,
 		)
@@ -546,12 +1315,14 @@ func (cloud *Cloud) ensureClassicLoadBalancerBackends(ctx context.Context, clust
 		}
 	}
 
-	if len(backendToDeRegister) > 0 {
-		result, err := clb.WaitUntilDone(
+	for start := 0; start < len(backendToDeRegister); start += maxBackendsPerRequest {
+		backends := backendToDeRegister[start:backendsChunkEnd(start, len(backendToDeRegister))]
+		result, err := waitUntilDone(
+			ctx,
 			func() (clb.AsyncTask, error) {
 				return cloud.clb.DeregisterInstancesFromLoadBalancer(
 					loadBalancer.LoadBalancerId,
-					backendToDeRegister,
+					backends,
 				)
 			}, cloud.clb,
 		)
@@ -572,17 +1343,12 @@ func (cloud *Cloud) ensureApplicationLoadBalancerBackends(ctx context.Context, c
 		nodeLanIps = append(nodeLanIps, node.Name)
 	}
 
-	instancesInMultiVpc, err := cloud.describeInstancesByMultiLanIp(nodeLanIps)
+	instancesInMultiVpc, err := cloud.describeInstancesByMultiLanIp(ctx, nodeLanIps)
 	if err != nil {
 		return err
 	}
 
-	instances := []cvm.InstanceInfo{}
-	for _, instance := range instancesInMultiVpc {
-		if instance.VirtualPrivateCloud.VpcID == cloud.config.VpcId {
-			instances = append(instances, instance)
-		}
-	}
+	instances, instancesByIp := cloud.backendInstances(service, loadBalancer, instancesInMultiVpc)
 
 	response, err := cloud.clb.DescribeForwardLBBackends(&clb.DescribeForwardLBBackendsArgs{
 		LoadBalancerId: loadBalancer.LoadBalancerId,
@@ -592,55 +1358,69 @@ func (cloud *Cloud) ensureApplicationLoadBalancerBackends(ctx context.Context, c
 	}
 
 	forwardListeners := response.Data
+	listenerIds := map[string]string{}
+	// the listener of a range serves its other ports, registered with the node port of its first port
+	followers := portRangeFollowers(servicePortRanges(service))
 
-	// remove unused listener first
-	for _, port := range service.Spec.Ports {
-		// find listener match this service port
-		forwardListener := new(clb.ForwardLBListener)
-		for _, listener := range forwardListeners {
-			if listener.LoadBalancerPort == int(port.Port) && cloud.mapClbProtoToServicePortProto(listener.Protocol) == port.Protocol {
-				forwardListener = &listener
-				break
-			}
+	cordoned := map[string]string{}
+	if cloud.config.CordonedNodeDrainSeconds > 0 {
+		if cordoned, err = cloud.cordonedNodeInstances(); err != nil {
+			return err
 		}
+	}
 
+	// add backends needed first
+	for _, port := range service.Spec.Ports {
+		forwardListener := cloud.findForwardListener(forwardListeners, port)
+		if forwardListener == nil && followers[listenerKey(port)] {
+			continue
+		}
 		if forwardListener == nil {
-			return errors.New("Can not find loadbalancer listener for this service port")
+			return errors.New(fmt.Sprintf("can not find the listener of port %d/%s on loadbalancer %s", port.Port, port.Protocol, loadBalancer.LoadBalancerId))
 		}
+		listenerIds[listenerKey(port)] = forwardListener.ListenerId
 
-		backendsToDelete := make([]clb.ForwardLBListenerBackend, 0)
-
-		for _, backend := range forwardListener.Backends {
+		backendsToAdd := make([]string, 0)
 
+		for _, instance := range instances {
 			found := false
 
-			for _, instance := range instances {
+			for _, backend := range forwardListener.Backends {
 				if backend.UnInstanceId == instance.InstanceID && backend.Port == int(port.NodePort) {
 					found = true
 				}
 			}
 
 			if !found {
-				backendsToDelete = append(backendsToDelete, backend)
+				backendsToAdd = append(backendsToAdd, instance.InstanceID)
 			}
 		}
 
-		backendToDeRegister := make([]clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts, 0)
+		if err := cloud.restoreDrainedBackends(ctx, loadBalancer.LoadBalancerId, forwardListener, instances); err != nil {
+			return err
+		}
 
-		for _, backendToDelete := range backendsToDelete {
-			backendToDeRegister = append(backendToDeRegister, clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts{
-				InstanceId: backendToDelete.UnInstanceId,
-				Port:       backendToDelete.Port,
+		backendToRegister := make([]clb.RegisterInstancesWithForwardLBFourthListenerBackendOpts, 0)
+
+		for _, backendToAdd := range backendsToAdd {
+			backendToRegister = append(backendToRegister, clb.RegisterInstancesWithForwardLBFourthListenerBackendOpts{
+				InstanceId: backendToAdd,
+				Port:       int(port.NodePort),
 			})
 		}
+		sort.Slice(backendToRegister, func(i, j int) bool {
+			return backendToRegister[i].InstanceId < backendToRegister[j].InstanceId
+		})
 
-		if len(backendToDeRegister) > 0 {
-			result, err := clb.WaitUntilDone(
+		for start := 0; start < len(backendToRegister); start += maxBackendsPerRequest {
+			backends := backendToRegister[start:backendsChunkEnd(start, len(backendToRegister))]
+			result, err := waitUntilDone(
+				ctx,
 				func() (clb.AsyncTask, error) {
-					return cloud.clb.DeregisterInstancesFromForwardLBFourthListener(&clb.DeregisterInstancesFromForwardLBFourthListenerArgs{
+					return cloud.clb.RegisterInstancesWithForwardLBFourthListener(&clb.RegisterInstancesWithForwardLBFourthListenerArgs{
 						LoadBalancerId: loadBalancer.LoadBalancerId,
 						ListenerId:     forwardListener.ListenerId,
-						Backends:       backendToDeRegister,
+						Backends:       backends,
 					})
 				}, cloud.clb,
 			)
@@ -653,53 +1433,83 @@ func (cloud *Cloud) ensureApplicationLoadBalancerBackends(ctx context.Context, c
 		}
 	}
 
-	// then add listener needed
-	for _, port := range service.Spec.Ports {
-		// find listener match this service port
-		forwardListener := new(clb.ForwardLBListener)
-		for _, listener := range forwardListeners {
-			if listener.LoadBalancerPort == int(port.Port) && cloud.mapClbProtoToServicePortProto(listener.Protocol) == port.Protocol {
-				forwardListener = &listener
-				break
+	registeredByIp := false
+	for _, forwardListener := range forwardListeners {
+		for _, backend := range forwardListener.Backends {
+			if backend.UnInstanceId == "" {
+				registeredByIp = true
 			}
 		}
+	}
+	eniTargets, err := cloud.planEniTargets(ctx, service, loadBalancer, listenerIds, instancesByIp, registeredByIp)
+	if err != nil {
+		return err
+	}
+	if err := cloud.registerEniTargetsOfPlan(ctx, loadBalancer, eniTargets); err != nil {
+		return err
+	}
 
+	// then remove backends no longer needed, so a node port change never leaves the listener
+	// without backends serving the new node port
+	for _, port := range service.Spec.Ports {
+		forwardListener := cloud.findForwardListener(forwardListeners, port)
+		if forwardListener == nil && followers[listenerKey(port)] {
+			continue
+		}
 		if forwardListener == nil {
-			return errors.New("Can not find loadbalancer listener for this service port")
+			return errors.New(fmt.Sprintf("can not find the listener of port %d/%s on loadbalancer %s", port.Port, port.Protocol, loadBalancer.LoadBalancerId))
 		}
 
-		backendsToAdd := make([]string, 0)
+		backendsToDelete := make([]clb.ForwardLBListenerBackend, 0)
+
+		for _, backend := range forwardListener.Backends {
+			// backends registered by ip are left to the eni targets plan
+			if backend.UnInstanceId == "" {
+				continue
+			}
 
-		for _, instance := range instances {
 			found := false
 
-			for _, backend := range forwardListener.Backends {
+			for _, instance := range instances {
 				if backend.UnInstanceId == instance.InstanceID && backend.Port == int(port.NodePort) {
 					found = true
 				}
 			}
 
 			if !found {
-				backendsToAdd = append(backendsToAdd, instance.InstanceID)
+				backendsToDelete = append(backendsToDelete, backend)
 			}
 		}
 
-		backendToRegister := make([]clb.RegisterInstancesWithForwardLBFourthListenerBackendOpts, 0)
+		backendsToDelete, err = cloud.drainCordonedBackends(ctx, service, loadBalancer.LoadBalancerId, forwardListener, backendsToDelete, cordoned)
+		if err != nil {
+			return err
+		}
 
-		for _, backendToAdd := range backendsToAdd {
-			backendToRegister = append(backendToRegister, clb.RegisterInstancesWithForwardLBFourthListenerBackendOpts{
-				InstanceId: backendToAdd,
-				Port:       int(port.NodePort),
+		backendToDeRegister := make([]clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts, 0)
+
+		for _, backendToDelete := range backendsToDelete {
+			backendToDeRegister = append(backendToDeRegister, clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts{
+				InstanceId: backendToDelete.UnInstanceId,
+				Port:       backendToDelete.Port,
 			})
 		}
+		sort.Slice(backendToDeRegister, func(i, j int) bool {
+			if backendToDeRegister[i].InstanceId != backendToDeRegister[j].InstanceId {
+				return backendToDeRegister[i].InstanceId < backendToDeRegister[j].InstanceId
+			}
+			return backendToDeRegister[i].Port < backendToDeRegister[j].Port
+		})
 
-		if len(backendToRegister) > 0 {
-			result, err := clb.WaitUntilDone(
+		for start := 0; start < len(backendToDeRegister); start += maxBackendsPerRequest {
+			backends := backendToDeRegister[start:backendsChunkEnd(start, len(backendToDeRegister))]
+			result, err := waitUntilDone(
+				ctx,
 				func() (clb.AsyncTask, error) {
-					return cloud.clb.RegisterInstancesWithForwardLBFourthListener(&clb.RegisterInstancesWithForwardLBFourthListenerArgs{
+					return cloud.clb.DeregisterInstancesFromForwardLBFourthListener(&clb.DeregisterInstancesFromForwardLBFourthListenerArgs{
 						LoadBalancerId: loadBalancer.LoadBalancerId,
 						ListenerId:     forwardListener.ListenerId,
-						Backends:       backendToRegister,
+						Backends:       backends,
 					})
 				}, cloud.clb,
 			)
@@ -712,30 +1522,30 @@ func (cloud *Cloud) ensureApplicationLoadBalancerBackends(ctx context.Context, c
 		}
 	}
 
+	return cloud.deregisterEniTargetsOfPlan(ctx, loadBalancer, eniTargets)
+}
+
+// findForwardListener returns the listener of the application clb serving port, nil if there is none.
+func (cloud *Cloud) findForwardListener(listeners []clb.ForwardLBListener, port v1.ServicePort) *clb.ForwardLBListener {
+	for i := range listeners {
+		if listeners[i].LoadBalancerPort == int(port.Port) && cloud.mapClbProtoToServicePortProto(listeners[i].Protocol) == port.Protocol {
+			return &listeners[i]
+		}
+	}
 	return nil
 }
 
-func (cloud *Cloud) createLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*clb.LoadBalancer, error) {
-	// TODO replace variable with loadBalancerSpecial
-	loadBalancerName := cloudprovider.GetLoadBalancerName(service)
+func (cloud *Cloud) createLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node, plan *LoadBalancerPlan) (*clb.LoadBalancer, error) {
+	loadBalancerName := plan.Name
 
 	args := clb.CreateLoadBalancerArgs{
 		VpcId:   &cloud.config.VpcId,
 		Special: &loadBalancerName,
 	}
 
-	loadBalancerDesiredKind, ok := service.Annotations[ServiceAnnotationLoadBalancerKind]
-	if !ok || (loadBalancerDesiredKind != LoadBalancerKindClassic && loadBalancerDesiredKind != LoadBalancerKindApplication) {
-		loadBalancerDesiredKind = LoadBalancerKindApplication
-	}
-	loadBalancerDesiredType, ok := service.Annotations[ServiceAnnotationLoadBalancerType]
-	if !ok || (loadBalancerDesiredType != LoadBalancerTypePrivate && loadBalancerDesiredType != LoadBalancerTypePublic) {
-		loadBalancerDesiredType = LoadBalancerTypePublic
-	}
-	loadBalancerDesiredName, ok := service.Annotations[ServiceAnnotationLoadBalancerName]
-	if !ok {
-		loadBalancerDesiredName = ServiceAnnotationLoadBalancerNameDefault
-	}
+	loadBalancerDesiredKind := plan.Kind
+	loadBalancerDesiredType := plan.Type
+	loadBalancerDesiredName := plan.DisplayName
 
 	args.LoadBalancerName = &loadBalancerDesiredName
 
@@ -758,20 +1568,49 @@ func (cloud *Cloud) createLoadBalancer(ctx context.Context, clusterName string,
 	}
 
 	if loadBalancerDesiredType == LoadBalancerTypePrivate {
-		loadBalancerDesiredSubnetId, ok := service.Annotations[ServiceAnnotationLoadBalancerTypeInternalSubnetId]
-		if !ok {
-			return nil, errors.New("Subnet must be specified for private loadbalancer")
+		loadBalancerDesiredSubnetId := plan.SubnetId
+		if loadBalancerDesiredSubnetId == "" {
+			if !cloud.config.AutoSelectInternalSubnet {
+				return nil, newSpecError(errors.New("Subnet must be specified for private loadbalancer"))
+			}
+			subnetId, err := cloud.selectInternalSubnet(ctx, service, nodes)
+			if err != nil {
+				return nil, err
+			}
+			glog.Infof("creating private loadbalancer %s in subnet %s of most backend nodes", loadBalancerName, subnetId)
+			cloud.recorder.Eventf(service, v1.EventTypeNormal, "InternalSubnetSelected",
+				"Creating the private loadbalancer in subnet %s holding most backend nodes, set annotation %s to choose another one",
+				subnetId, ServiceAnnotationLoadBalancerTypeInternalSubnetId)
+			loadBalancerDesiredSubnetId = subnetId
 		}
 		args.SubnetId = &loadBalancerDesiredSubnetId
 	}
 
-	result, err := clb.WaitUntilDone(
+	if _, err := cloud.getLoadBalancerBandwidthPackage(service); err != nil {
+		return nil, err
+	}
+
+	if err := cloud.checkClbQuota(service, loadBalancerDesiredType); err != nil {
+		return nil, err
+	}
+
+	result, err := waitUntilDone(
+		ctx,
 		func() (clb.AsyncTask, error) {
 			return cloud.clb.CreateLoadBalancer(&args)
 		},
 		cloud.clb,
 	)
 	if err != nil {
+		// the create api takes no client token, a call timing out may still have created the clb. The special
+		// field is derived from the service alone, so a clb created anyway is found by it and adopted rather
+		// than duplicated by the next sync
+		if existing, lookupErr := cloud.getLoadBalancerByName(loadBalancerName); lookupErr == nil {
+			glog.Warningf("creating loadbalancer %s failed but %s exists with its name, adopting it: %v", loadBalancerName, existing.LoadBalancerId, err)
+			cloud.recorder.Eventf(service, v1.EventTypeNormal, "LoadBalancerAdopted",
+				"Creating the loadbalancer failed, but loadbalancer %s was created anyway and is used: %v", existing.LoadBalancerId, err)
+			return existing, nil
+		}
 		return nil, err
 	}
 	if result != clb.TaskSuccceed {
@@ -781,7 +1620,7 @@ func (cloud *Cloud) createLoadBalancer(ctx context.Context, clusterName string,
 }
 
 func (cloud *Cloud) deleteLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) error {
-	loadBalancerName := cloudprovider.GetLoadBalancerName(service)
+	loadBalancerName := loadBalancerSpecial(service)
 	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
 	if err != nil {
 		if err == ErrCloudLoadBalancerNotFound {
@@ -790,12 +1629,20 @@ func (cloud *Cloud) deleteLoadBalancer(ctx context.Context, clusterName string,
 		return err
 	}
 
-	result, err := clb.WaitUntilDone(
+	if eipRequested(service) {
+		if err := cloud.deleteLoadBalancerEips(loadBalancerName, loadBalancer.LoadBalancerId); err != nil {
+			return err
+		}
+	}
+
+	result, err := waitUntilDone(
+		ctx,
 		func() (clb.AsyncTask, error) {
 			return cloud.clb.DeleteLoadBalancers([]string{loadBalancer.LoadBalancerId})
 		},
 		cloud.clb,
 	)
+	cloud.loadBalancerCache.forget(loadBalancerName)
 	if err != nil {
 		return err
 	}
@@ -803,7 +1650,18 @@ func (cloud *Cloud) deleteLoadBalancer(ctx context.Context, clusterName string,
 		return errors.New("task is not succeed")
 	}
 
-	return nil
+	// the service controller only retries the deletion if an error is returned,
+	// so report success only once the clb is really gone
+	_, err = cloud.getLoadBalancerByName(loadBalancerName)
+	if err == nil {
+		return errors.New(fmt.Sprintf("loadbalancer %s still exists after deletion", loadBalancer.LoadBalancerId))
+	}
+	if err != ErrCloudLoadBalancerNotFound {
+		return err
+	}
+
+	// security groups can't be deleted while bound to the clb
+	return cloud.deleteLoadBalancerSecurityGroups(service)
 }
 
 func (cloud *Cloud) describeLoadBalancerListenersBackends(loadBalancerId string) ([]clb.LoadBalancerBackends, error) {
@@ -830,7 +1688,7 @@ func (cloud *Cloud) describeLoadBalancerListenersBackends(loadBalancerId string)
 	return backends, nil
 }
 
-func (cloud *Cloud) describeInstancesByMultiLanIp(ips []string) ([]cvm.InstanceInfo, error) {
+func (cloud *Cloud) describeInstancesByMultiLanIp(ctx context.Context, ips []string) ([]cvm.InstanceInfo, error) {
 	instances := []cvm.InstanceInfo{}
 
 	offset := 0
@@ -843,9 +1701,9 @@ func (cloud *Cloud) describeInstancesByMultiLanIp(ips []string) ([]cvm.InstanceI
 	}
 
 	for {
-		response, err := cloud.cvmV3.DescribeInstances(&cvm.DescribeInstancesArgs{
+		response, err := describeInstances(ctx, cloud.cvmV3, &cvm.DescribeInstancesArgs{
 			Version: cvm.DefaultVersion,
-			Filters: &[]cvm.Filter{{Name: cvm.FilterNamePrivateIpAddress, Values: ipsParas}},
+			Filters: cloud.instanceFilters(cvm.Filter{Name: cvm.FilterNamePrivateIpAddress, Values: ipsParas}),
 			Offset:  &offset,
 			Limit:   &limit,
 		})
@@ -0,0 +1,594 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestEnsureApplicationLoadBalancerBackendsListenerLookup(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []map[string]interface{}
+		wantErr   string
+		wantCalls []string
+	}{
+		{
+			name:      "listener of every port",
+			listeners: []map[string]interface{}{fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP)},
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends", "clb.RegisterInstancesWithForwardLBFourthListener", "clbv3.DescribeLoadBalancers"},
+		},
+		{
+			name:      "listener of the port missing",
+			listeners: []map[string]interface{}{fakeForwardListener("lbl-81", 81, ClbLoadBalancerListenerProtocolTCP)},
+			wantErr:   "can not find the listener of port 80/TCP on loadbalancer lb-1",
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends"},
+		},
+		{
+			name:      "listener of another protocol",
+			listeners: []map[string]interface{}{fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolUDP)},
+			wantErr:   "can not find the listener of port 80/TCP on loadbalancer lb-1",
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(test.listeners...))
+			api.handle("clb.RegisterInstancesWithForwardLBFourthListener", legacyTask)
+			api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+			err := cloud.ensureApplicationLoadBalancerBackends(context.Background(), "kubernetes", service, []*v1.Node{fakeNode("10.0.0.1")}, loadBalancer)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.wantErr != "" && (err == nil || err.Error() != test.wantErr):
+				t.Fatalf("error %v, want %s", err, test.wantErr)
+			}
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %s", got, strings.Join(test.wantCalls, ","))
+			}
+			for _, call := range api.callsOf("clb.RegisterInstancesWithForwardLBFourthListener") {
+				if call.Get("listenerId") != "lbl-80" || call.Get("backends.0.instanceId") != "ins-1" || call.Get("backends.0.port") != "30080" {
+					t.Errorf("registered %v, want ins-1:30080 with lbl-80", call)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureClassicLoadBalancerListenersNodePortChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []map[string]interface{}
+		ports     []v1.ServicePort
+		// refuseSecond makes the clb refuse a listener of a port another listener has
+		refuseSecond bool
+		wantCalls    []string
+		// wantCreated are the listeners created as port:node port, wantDeleted the listeners deleted, by call
+		wantCreated []string
+		wantDeleted []string
+	}{
+		{
+			name:      "node port unchanged",
+			listeners: []map[string]interface{}{fakeClassicListener("lbl-80", 80, 30080, ClbLoadBalancerListenerProtocolTCP)},
+			ports:     []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 30080)},
+			wantCalls: []string{"clb.DescribeLoadBalancerListeners", "clb.DescribeLoadBalancerListeners", "clb.DescribeLoadBalancerListeners"},
+		},
+		{
+			name:        "node port changed",
+			listeners:   []map[string]interface{}{fakeClassicListener("lbl-80", 80, 30080, ClbLoadBalancerListenerProtocolTCP)},
+			ports:       []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 31080)},
+			wantCalls:   []string{"clb.DescribeLoadBalancerListeners", "clb.CreateLoadBalancerListeners", "clb.DeleteLoadBalancerListeners"},
+			wantCreated: []string{"80:31080"},
+			wantDeleted: []string{"lbl-80"},
+		},
+		{
+			name:         "node port changed on a clb refusing a second listener of the port",
+			listeners:    []map[string]interface{}{fakeClassicListener("lbl-80", 80, 30080, ClbLoadBalancerListenerProtocolTCP)},
+			ports:        []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 31080)},
+			refuseSecond: true,
+			wantCalls: []string{"clb.DescribeLoadBalancerListeners", "clb.CreateLoadBalancerListeners", "clb.DeleteLoadBalancerListeners",
+				"clb.CreateLoadBalancerListeners"},
+			wantCreated: []string{"80:31080", "80:31080"},
+			wantDeleted: []string{"lbl-80"},
+		},
+		{
+			name: "node port changed and protocol of another port changed",
+			listeners: []map[string]interface{}{
+				fakeClassicListener("lbl-80", 80, 30080, ClbLoadBalancerListenerProtocolTCP),
+				fakeClassicListener("lbl-53", 53, 30053, ClbLoadBalancerListenerProtocolTCP),
+			},
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 31080), fakeServicePort("dns", 53, v1.ProtocolUDP, 30053)},
+			wantCalls: []string{"clb.DescribeLoadBalancerListeners", "clb.DeleteLoadBalancerListeners", "clb.CreateLoadBalancerListeners",
+				"clb.DeleteLoadBalancerListeners"},
+			wantCreated: []string{"80:31080,53:30053"},
+			wantDeleted: []string{"lbl-53", "lbl-80"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancerListeners", describeLoadBalancerListenersResult(test.listeners...))
+			api.handle("clb.DeleteLoadBalancerListeners", legacyTask)
+			api.handle("clb.CreateLoadBalancerListeners", func(params url.Values) interface{} {
+				if test.refuseSecond && len(api.callsOf("clb.DeleteLoadBalancerListeners")) == 0 {
+					return legacyError(4000, "port 80 is used by another listener")
+				}
+				return legacyTask(params)
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(map[string]string{ServiceAnnotationLoadBalancerKind: LoadBalancerKindClassic}, test.ports...)
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindClassic}
+			if err := cloud.ensureClassicLoadBalancerListeners(context.Background(), "kubernetes", service, loadBalancer); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %s", got, strings.Join(test.wantCalls, ","))
+			}
+			created := []string{}
+			for _, call := range api.callsOf("clb.CreateLoadBalancerListeners") {
+				listeners := []string{}
+				for i := 0; call.Get(fmt.Sprintf("listeners.%d.loadBalancerPort", i)) != ""; i++ {
+					listeners = append(listeners, call.Get(fmt.Sprintf("listeners.%d.loadBalancerPort", i))+":"+call.Get(fmt.Sprintf("listeners.%d.instancePort", i)))
+				}
+				created = append(created, strings.Join(listeners, ","))
+			}
+			if strings.Join(created, " ") != strings.Join(test.wantCreated, " ") {
+				t.Errorf("listeners created %v, want %v", created, test.wantCreated)
+			}
+			deleted := []string{}
+			for _, call := range api.callsOf("clb.DeleteLoadBalancerListeners") {
+				deleted = append(deleted, call.Get("listenerIds.0"))
+				if call.Get("listenerIds.1") != "" {
+					t.Errorf("listeners deleted with %v, want one listener per call", call)
+				}
+			}
+			if strings.Join(deleted, ",") != strings.Join(test.wantDeleted, ",") {
+				t.Errorf("listeners deleted %v, want %v", deleted, test.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestGetLoadBalancerTypeTransitions(t *testing.T) {
+	annotations := map[string]string{ServiceAnnotationLoadBalancerKind: LoadBalancerKindClassic}
+	ingress := []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+	tests := []struct {
+		name        string
+		serviceType v1.ServiceType
+		ingress     []v1.LoadBalancerIngress
+		wantLookups int
+	}{
+		{"ClusterIP with our annotations", v1.ServiceTypeClusterIP, nil, 0},
+		{"LoadBalancer", v1.ServiceTypeLoadBalancer, nil, 1},
+		{"LoadBalancer to ClusterIP", v1.ServiceTypeClusterIP, ingress, 1},
+		{"LoadBalancer to NodePort", v1.ServiceTypeNodePort, ingress, 1},
+		{"NodePort once the clb is deleted", v1.ServiceTypeNodePort, nil, 0},
+		{"NodePort back to LoadBalancer", v1.ServiceTypeLoadBalancer, nil, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				return legacyResponse(map[string]interface{}{"totalCount": 0, "loadBalancerSet": []interface{}{}})
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(annotations, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			service.Spec.Type = test.serviceType
+			service.Status.LoadBalancer.Ingress = test.ingress
+			if _, _, err := cloud.GetLoadBalancer(context.Background(), "kubernetes", service); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := len(api.callsOf("clb.DescribeLoadBalancers")); got != test.wantLookups {
+				t.Errorf("%d clb lookups, want %d", got, test.wantLookups)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerDeleted(t *testing.T) {
+	loadBalancer := map[string]interface{}{"loadBalancerId": "lb-1", "loadBalancerName": "kubernetes-service", "forward": ClbLoadBalancerKindClassic}
+	tests := []struct {
+		name string
+		// listed tells per lookup whether the clb is listed, the last answer repeats
+		listed       []bool
+		lookupErr    bool
+		deleteErr    bool
+		wantDeletion bool
+		wantErr      bool
+	}{
+		{name: "clb already gone", listed: []bool{false}},
+		{name: "lookup fails", lookupErr: true, wantErr: true},
+		{name: "clb deleted", listed: []bool{true, true, false}, wantDeletion: true},
+		{name: "deletion fails", listed: []bool{true}, deleteErr: true, wantDeletion: true, wantErr: true},
+		{name: "clb still listed after deletion", listed: []bool{true}, wantDeletion: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			lookups := 0
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				if test.lookupErr {
+					return legacyError(4000, "internal error")
+				}
+				listed := test.listed[len(test.listed)-1]
+				if lookups < len(test.listed) {
+					listed = test.listed[lookups]
+				}
+				lookups++
+				if !listed {
+					return legacyResponse(map[string]interface{}{"totalCount": 0, "loadBalancerSet": []interface{}{}})
+				}
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []interface{}{loadBalancer}})
+			})
+			api.handle("clb.DeleteLoadBalancers", func(params url.Values) interface{} {
+				if test.deleteErr {
+					return legacyError(4000, "internal error")
+				}
+				return legacyTask(params)
+			})
+			api.handle("vpc.DescribeSecurityGroups", func(url.Values) interface{} {
+				return v3Response(map[string]interface{}{"TotalCount": 0, "SecurityGroupSet": []interface{}{}})
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			service.Spec.Type = v1.ServiceTypeClusterIP
+			service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+			err := cloud.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", service)
+			if (err != nil) != test.wantErr {
+				t.Errorf("EnsureLoadBalancerDeleted = %v, want error %t", err, test.wantErr)
+			}
+
+			deletions := api.callsOf("clb.DeleteLoadBalancers")
+			if (len(deletions) > 0) != test.wantDeletion || (test.wantDeletion && deletions[0].Get("loadBalancerIds.0") != "lb-1") {
+				t.Errorf("deletions %v, want deletion of lb-1 %t", deletions, test.wantDeletion)
+			}
+			// security groups are only cleaned up once the clb is gone
+			if cleanedUp := len(api.callsOf("vpc.DescribeSecurityGroups")) > 0; cleanedUp == test.wantErr {
+				t.Errorf("security groups cleaned up %t, want %t", cleanedUp, !test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureApplicationLoadBalancerBackendsOrder(t *testing.T) {
+	api := newFakeApi(t)
+	defer api.close()
+	api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+		fakeInstance("ins-3", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.3"}, nil),
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil),
+		fakeInstance("ins-2", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.2"}, nil)))
+	api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+		fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP,
+			fakeForwardBackend("ins-5", 30080), fakeForwardBackend("ins-4", 30080))))
+	api.handle("clb.RegisterInstancesWithForwardLBFourthListener", legacyTask)
+	api.handle("clb.DeregisterInstancesFromForwardLBFourthListener", legacyTask)
+	api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+	cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+	service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+	loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+	nodes := []*v1.Node{fakeNode("10.0.0.2"), fakeNode("10.0.0.3"), fakeNode("10.0.0.1")}
+	if err := cloud.ensureApplicationLoadBalancerBackends(context.Background(), "kubernetes", service, nodes, loadBalancer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string][]string{
+		"clb.RegisterInstancesWithForwardLBFourthListener":   {"ins-1", "ins-2", "ins-3"},
+		"clb.DeregisterInstancesFromForwardLBFourthListener": {"ins-4", "ins-5"},
+	}
+	for action, wantIds := range want {
+		calls := api.callsOf(action)
+		if len(calls) != 1 {
+			t.Fatalf("%d calls of %s, want 1", len(calls), action)
+		}
+		ids := []string{}
+		for i := 0; calls[0].Get(fmt.Sprintf("backends.%d.instanceId", i)) != ""; i++ {
+			ids = append(ids, calls[0].Get(fmt.Sprintf("backends.%d.instanceId", i)))
+		}
+		if strings.Join(ids, ",") != strings.Join(wantIds, ",") {
+			t.Errorf("%s of %v, want %v", action, ids, wantIds)
+		}
+	}
+}
+
+// TestEnsureApplicationLoadBalancerBackendsChunks registers 300 new nodes on 10 ports, which takes the 10*15 register
+// tasks documented at maxBackendsPerRequest.
+func TestEnsureApplicationLoadBalancerBackendsChunks(t *testing.T) {
+	defer func(interval time.Duration) { clbTaskCheckInterval = interval }(clbTaskCheckInterval)
+	clbTaskCheckInterval = time.Millisecond
+
+	instances := []map[string]interface{}{}
+	nodes := []*v1.Node{}
+	for i := 0; i < 300; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)
+		instances = append(instances, fakeInstance(fmt.Sprintf("ins-%d", i), "ap-guangzhou-3", "vpc-test", []string{ip}, nil))
+		nodes = append(nodes, fakeNode(ip))
+	}
+	listeners := []map[string]interface{}{}
+	ports := []v1.ServicePort{}
+	for i := 0; i < 10; i++ {
+		port := 8000 + i
+		listeners = append(listeners, fakeForwardListener(fmt.Sprintf("lbl-%d", port), port, ClbLoadBalancerListenerProtocolTCP))
+		ports = append(ports, fakeServicePort(fmt.Sprintf("port-%d", port), int32(port), v1.ProtocolTCP, int32(30000+i)))
+	}
+
+	api := newFakeApi(t)
+	defer api.close()
+	api.handle("cvmv3.DescribeInstances", func(params url.Values) interface{} {
+		offset, _ := strconv.Atoi(params.Get("Offset"))
+		limit, _ := strconv.Atoi(params.Get("Limit"))
+		end := offset + limit
+		if end > len(instances) {
+			end = len(instances)
+		}
+		return v3Response(map[string]interface{}{"TotalCount": len(instances), "InstanceSet": instances[offset:end]})
+	})
+	api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(listeners...))
+	api.handle("clb.RegisterInstancesWithForwardLBFourthListener", legacyTask)
+	api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+	cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+	service := fakeService(nil, ports...)
+	loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+	if err := cloud.ensureApplicationLoadBalancerBackends(context.Background(), "kubernetes", service, nodes, loadBalancer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, action := range api.actions() {
+		counts[action]++
+	}
+	want := map[string]int{
+		"cvmv3.DescribeInstances":                          3,
+		"clb.DescribeForwardLBBackends":                    1,
+		"clb.RegisterInstancesWithForwardLBFourthListener": 150,
+		"clbv3.DescribeLoadBalancers":                      1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("calls %v, want %v", counts, want)
+	}
+	registered := map[string]int{}
+	for _, call := range api.callsOf("clb.RegisterInstancesWithForwardLBFourthListener") {
+		backends := 0
+		for ; call.Get(fmt.Sprintf("backends.%d.instanceId", backends)) != ""; backends++ {
+		}
+		if backends > maxBackendsPerRequest {
+			t.Errorf("%d backends registered by a single task, want at most %d", backends, maxBackendsPerRequest)
+		}
+		registered[call.Get("listenerId")] += backends
+	}
+	for _, listener := range listeners {
+		if id := listener["listenerId"].(string); registered[id] != 300 {
+			t.Errorf("%d backends registered on %s, want 300", registered[id], id)
+		}
+	}
+}
+
+func TestInvalidListeners(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		ports  []v1.ServicePort
+		want   []string
+	}{
+		{
+			name:  "valid listeners",
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 30080), fakeServicePort("dns", 80, v1.ProtocolUDP, 30053)},
+			want:  []string{},
+		},
+		{
+			name:  "duplicate listener",
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 30080), fakeServicePort("web", 80, v1.ProtocolTCP, 30081)},
+			want:  []string{`port "web" (80/TCP): listener 80/TCP is already used by port "http" (80/TCP)`},
+		},
+		{
+			name:  "port below range",
+			ports: []v1.ServicePort{fakeServicePort("http", 0, v1.ProtocolTCP, 30080)},
+			want:  []string{`port "http" (0/TCP): port 0 is out of range 1-65535`},
+		},
+		{
+			name:  "port above range",
+			ports: []v1.ServicePort{fakeServicePort("http", 65536, v1.ProtocolTCP, 30080)},
+			want:  []string{`port "http" (65536/TCP): port 65536 is out of range 1-65535`},
+		},
+		{
+			name:  "node port missing",
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 0)},
+			want:  []string{`port "http" (80/TCP): node port 0 is out of range 30000-32767`},
+		},
+		{
+			name:  "node port below the node port range",
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 8080)},
+			want:  []string{`port "http" (80/TCP): node port 8080 is out of range 30000-32767`},
+		},
+		{
+			name:  "node port above the node port range",
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 32768)},
+			want:  []string{`port "http" (80/TCP): node port 32768 is out of range 30000-32767`},
+		},
+		{
+			name:   "node port within the configured node port range",
+			config: Config{ServiceNodePortRange: "8000-9000"},
+			ports:  []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 8080)},
+			want:   []string{},
+		},
+		{
+			name:   "node port outside the configured node port range",
+			config: Config{ServiceNodePortRange: "8000-9000"},
+			ports:  []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 30080)},
+			want:   []string{`port "http" (80/TCP): node port 30080 is out of range 8000-9000`},
+		},
+		{
+			name:  "unsupported protocol",
+			ports: []v1.ServicePort{fakeServicePort("sctp", 80, v1.Protocol("SCTP"), 30080)},
+			want:  []string{`port "sctp" (80/SCTP): protocol SCTP is not supported`},
+		},
+		{
+			name: "every invalid entry enumerated",
+			ports: []v1.ServicePort{fakeServicePort("http", 80, v1.ProtocolTCP, 30080), fakeServicePort("web", 80, v1.ProtocolTCP, 70000),
+				fakeServicePort("dns", -1, v1.ProtocolUDP, 30053)},
+			want: []string{`port "web" (80/TCP): node port 70000 is out of range 30000-32767`,
+				`port "web" (80/TCP): listener 80/TCP is already used by port "http" (80/TCP)`,
+				`port "dns" (-1/UDP): port -1 is out of range 1-65535`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := fakeService(nil, test.ports...)
+			if got := invalidListeners(test.config, service); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("invalid listeners %q, want %q", got, test.want)
+			}
+
+			// invalid listeners fail the plan, before any api is called
+			_, err := PlanLoadBalancer(test.config, service, []*v1.Node{fakeNode("10.0.0.1")})
+			planErr, ok := err.(*PlanError)
+			if len(test.want) == 0 && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if len(test.want) > 0 && (!ok || planErr.Reason != "InvalidLoadBalancerListeners") {
+				t.Errorf("PlanLoadBalancer error %v, want an InvalidLoadBalancerListeners plan error", err)
+			}
+		})
+	}
+}
+
+func TestDescribeLoadBalancersPages(t *testing.T) {
+	tests := []struct {
+		name          string
+		pageSize      int
+		total         int
+		wantOffsets   string
+		wantLimit     string
+		wantBalancers int
+	}{
+		{"no clb", 0, 0, "0", "20", 0},
+		{"single page", 0, 20, "0", "20", 20},
+		{"several pages", 0, 45, "0,20,40", "20", 45},
+		{"configured page size", 100, 150, "0,100", "100", 150},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(params url.Values) interface{} {
+				offset, _ := strconv.Atoi(params.Get("offset"))
+				limit, _ := strconv.Atoi(params.Get("limit"))
+				page := []interface{}{}
+				for i := offset; i < offset+limit && i < test.total; i++ {
+					page = append(page, map[string]interface{}{"loadBalancerId": fmt.Sprintf("lb-%d", i)})
+				}
+				return legacyResponse(map[string]interface{}{"totalCount": test.total, "loadBalancerSet": page})
+			})
+			cloud, _ := newTestCloud(t, Config{LoadBalancerPageSize: test.pageSize}, api, nil)
+
+			loadBalancers, err := cloud.describeLoadBalancers(&clb.DescribeLoadBalancersArgs{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(loadBalancers) != test.wantBalancers {
+				t.Errorf("%d clbs, want %d", len(loadBalancers), test.wantBalancers)
+			}
+			for i, loadBalancer := range loadBalancers {
+				if loadBalancer.LoadBalancerId != fmt.Sprintf("lb-%d", i) {
+					t.Errorf("clb %d is %s, want every page in order", i, loadBalancer.LoadBalancerId)
+					break
+				}
+			}
+			offsets := []string{}
+			for _, call := range api.callsOf("clb.DescribeLoadBalancers") {
+				offsets = append(offsets, call.Get("offset"))
+				if call.Get("limit") != test.wantLimit {
+					t.Errorf("page of limit %s, want %s", call.Get("limit"), test.wantLimit)
+				}
+			}
+			if got := strings.Join(offsets, ","); got != test.wantOffsets {
+				t.Errorf("pages at offsets %s, want %s", got, test.wantOffsets)
+			}
+		})
+	}
+}
+
+func TestCreateLoadBalancerAdoption(t *testing.T) {
+	tests := []struct {
+		name string
+		// createFails fails the create call, created tells whether the clb exists anyway
+		createFails bool
+		created     bool
+		wantErr     bool
+		wantEvents  []string
+	}{
+		{name: "created", created: true},
+		{name: "create failed but clb created", createFails: true, created: true, wantEvents: []string{"LoadBalancerAdopted"}},
+		{name: "create failed", createFails: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.CreateLoadBalancer", func(params url.Values) interface{} {
+				if test.createFails {
+					return legacyError(5000, "request timed out")
+				}
+				return legacyTask(params)
+			})
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				if !test.created {
+					return legacyResponse(map[string]interface{}{"totalCount": 0, "loadBalancerSet": []interface{}{}})
+				}
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []interface{}{
+					map[string]interface{}{"loadBalancerId": "lb-1", "forward": ClbLoadBalancerKindApplication},
+				}})
+			})
+			cloud, recorder := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			plan := &LoadBalancerPlan{Name: loadBalancerSpecial(service), Kind: LoadBalancerKindApplication, Type: LoadBalancerTypePublic}
+			loadBalancer, err := cloud.createLoadBalancer(context.Background(), "kubernetes", service, nil, plan)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("createLoadBalancer returned %v, want an error", loadBalancer)
+				}
+			} else if err != nil || loadBalancer.LoadBalancerId != "lb-1" {
+				t.Errorf("createLoadBalancer = %v, %v, want lb-1", loadBalancer, err)
+			}
+			if got := len(api.callsOf("clb.CreateLoadBalancer")); got != 1 {
+				t.Errorf("%d create calls, want 1", got)
+			}
+			events := drainEvents(recorder)
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("events %v, want %v", events, test.wantEvents)
+			}
+			for i, event := range events {
+				if !strings.Contains(event, test.wantEvents[i]) {
+					t.Errorf("event %q, want %s", event, test.wantEvents[i])
+				}
+			}
+		})
+	}
+}
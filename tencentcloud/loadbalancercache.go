@@ -0,0 +1,85 @@
+package tencentcloud
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// loadBalancerLookups counts the clb lookups answered by the loadbalancer cache and the ones which went to
+	// the api, the cached share is the share of syncs served without a DescribeLoadBalancers call.
+	loadBalancerLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: providerName,
+			Name:      "loadbalancer_lookups_total",
+			Help:      "Number of clb lookups by name by whether the loadbalancer cache answered them.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(loadBalancerLookups)
+}
+
+// loadBalancerCache remembers the clbs found by name, so the backend syncs of every service every minute don't
+// describe each clb each time. The mutations of the sdk return task ids rather than the resulting clb, so
+// entries are dropped rather than updated: when a clb is ensured or deleted, when the security group drift sync
+// looks at it, and when a call on it fails. The next lookup describes the clb again. Clbs not found are never
+// remembered, so new ones are picked up right away.
+type loadBalancerCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]loadBalancerCacheEntry
+}
+
+type loadBalancerCacheEntry struct {
+	loadBalancer clb.LoadBalancer
+	expires      time.Time
+}
+
+func newLoadBalancerCache(ttlSeconds int) *loadBalancerCache {
+	return &loadBalancerCache{
+		ttl:     time.Duration(ttlSeconds) * time.Second,
+		entries: map[string]loadBalancerCacheEntry{},
+	}
+}
+
+// get returns a copy of the clb of the name, if it was found less than a ttl ago.
+func (cache *loadBalancerCache) get(name string) (*clb.LoadBalancer, bool) {
+	if cache.ttl == 0 {
+		return nil, false
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[name]
+	if !ok || time.Now().After(entry.expires) {
+		delete(cache.entries, name)
+		loadBalancerLookups.WithLabelValues("described").Inc()
+		return nil, false
+	}
+	loadBalancerLookups.WithLabelValues("cached").Inc()
+	loadBalancer := entry.loadBalancer
+	loadBalancer.LoadBalancerVips = append([]string{}, entry.loadBalancer.LoadBalancerVips...)
+	return &loadBalancer, true
+}
+
+func (cache *loadBalancerCache) add(name string, loadBalancer *clb.LoadBalancer) {
+	if cache.ttl == 0 {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry := loadBalancerCacheEntry{loadBalancer: *loadBalancer, expires: time.Now().Add(cache.ttl)}
+	entry.loadBalancer.LoadBalancerVips = append([]string{}, loadBalancer.LoadBalancerVips...)
+	cache.entries[name] = entry
+}
+
+func (cache *loadBalancerCache) forget(name string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.entries, name)
+}
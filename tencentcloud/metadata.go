@@ -0,0 +1,236 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/dbdd4us/qcloudapi-sdk-go/metadata"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	metadataRequestTimeout = 2 * time.Second
+	// metadataRetryPeriod is how long a failed private ip lookup is remembered, so an unreachable
+	// metadata service doesn't slow down every lookup with its retries.
+	metadataRetryPeriod = time.Minute
+	// localAddressesCheckPeriod is how often the private ip read from the metadata service is checked against
+	// the cvm api
+	localAddressesCheckPeriod = 10 * time.Minute
+)
+
+// localNode answers questions about the instance the controller manager runs on from the metadata service.
+// The private ip of the instance never changes, so it is read once and cached.
+type localNode struct {
+	metadata   *metadata.MetaData
+	client     *http.Client
+	enableIPv6 bool
+
+	lock        sync.Mutex
+	privateIp   string
+	lastErr     error
+	lastErrTime time.Time
+
+	// checkLock guards the result of the last check of the private ip against the cvm api, mismatched is
+	// the instance as the api describes it if the api doesn't list the private ip
+	checkLock  sync.Mutex
+	checkedAt  time.Time
+	mismatched *cvm.InstanceInfo
+}
+
+func newLocalNode(enableIPv6 bool) *localNode {
+	client := &http.Client{Timeout: metadataRequestTimeout}
+	return &localNode{
+		metadata:   metadata.NewMetaData(client),
+		client:     client,
+		enableIPv6: enableIPv6,
+	}
+}
+
+// getPrivateIp returns the private ipv4 address of the instance. Instances without one
+// are identified by their ipv6 address if ipv6 is enabled.
+func (node *localNode) getPrivateIp() (string, error) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.privateIp != "" {
+		return node.privateIp, nil
+	}
+	if node.lastErr != nil && time.Since(node.lastErrTime) < metadataRetryPeriod {
+		return "", node.lastErr
+	}
+	ip, err := metadataValue(node.metadata.PrivateIPv4())
+	if err != nil && node.enableIPv6 {
+		ip, err = node.getIPv6()
+	}
+	if err != nil {
+		node.lastErr, node.lastErrTime = err, time.Now()
+		return "", err
+	}
+	node.privateIp = ip
+	return ip, nil
+}
+
+// getRegion returns the region the instance is placed in.
+func (node *localNode) getRegion() (string, error) {
+	return metadataValue(node.metadata.Region())
+}
+
+// getIPv6 returns the first ipv6 address of the primary eni. The metadata client has no accessor for it.
+func (node *localNode) getIPv6() (string, error) {
+	mac, err := metadataValue(node.metadata.Mac())
+	if err != nil {
+		return "", err
+	}
+	response, err := node.client.Get(fmt.Sprintf("%s/network/interfaces/macs/%s/ipv6s", metadata.ENDPOINT, mac))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("unexpected status %d reading ipv6 addresses from metadata service", response.StatusCode))
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	return metadataValue(strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0]), nil)
+}
+
+// metadataValue turns an empty metadata response into an error, the metadata client
+// returns no error for non 200 responses.
+func metadataValue(value string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", errors.New("empty response from metadata service")
+	}
+	return value, nil
+}
+
+// isLocalNode returns true if the node name is the private ip of the instance the controller manager runs on.
+func (cloud *Cloud) isLocalNode(name types.NodeName) bool {
+	ip, err := cloud.localNode.getPrivateIp()
+	if err != nil {
+		return false
+	}
+	if string(name) == ip {
+		return true
+	}
+
+	// ipv6 addresses are no valid node names, ipv6 only nodes are matched by their internal ips
+	if !isIPv6(ip) {
+		return false
+	}
+	node, err := cloud.kubeClient.CoreV1().Nodes().Get(string(name), metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP && address.Address == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// localNodeAddresses returns the addresses of the instance the controller manager runs on from the metadata
+// service, unless the cvm api doesn't list its private ip. The addresses of the api are returned then, so the
+// addresses of the node agree with the lookups of other nodes.
+func (cloud *Cloud) localNodeAddresses(ctx context.Context) ([]v1.NodeAddress, error) {
+	privateIp, err := cloud.localNode.getPrivateIp()
+	if err != nil {
+		return nil, err
+	}
+	if instance := cloud.checkLocalPrivateIp(ctx, privateIp); instance != nil {
+		return cloud.nodeAddresses(instance)
+	}
+	addresses := []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: privateIp}}
+
+	// instances without a public ip get an empty response
+	publicIp, err := cloud.localNode.metadata.PublicIPv4()
+	if err != nil {
+		return nil, err
+	}
+	if publicIp != "" {
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: publicIp})
+	}
+	return addresses, nil
+}
+
+// checkLocalPrivateIp returns the instance as the cvm api describes it if the api doesn't list the private ip the
+// metadata service reports, for example after the network of the instance was reconfigured. The result is
+// remembered for localAddressesCheckPeriod, failed checks keep the previous result.
+func (cloud *Cloud) checkLocalPrivateIp(ctx context.Context, privateIp string) *cvm.InstanceInfo {
+	// the api lists ipv4 addresses only
+	if isIPv6(privateIp) {
+		return nil
+	}
+	node := cloud.localNode
+	node.checkLock.Lock()
+	defer node.checkLock.Unlock()
+	if time.Since(node.checkedAt) < localAddressesCheckPeriod {
+		return node.mismatched
+	}
+	node.checkedAt = time.Now()
+
+	instanceID, err := cloud.localInstanceID()
+	if err != nil {
+		glog.V(4).Infof("failed to check private ip %s of the local instance: %v", privateIp, err)
+		return node.mismatched
+	}
+	instance, err := cloud.getInstanceByInstanceID(ctx, instanceID)
+	if err != nil {
+		glog.V(4).Infof("failed to check private ip %s of local instance %s: %v", privateIp, instanceID, err)
+		return node.mismatched
+	}
+	for _, ip := range instance.PrivateIPAddresses {
+		if ip == privateIp {
+			if node.mismatched != nil {
+				glog.Infof("the cvm api lists private ip %s of local instance %s again", privateIp, instanceID)
+			}
+			node.mismatched = nil
+			return nil
+		}
+	}
+	if node.mismatched == nil {
+		glog.Warningf("the metadata service reports private ip %s for local instance %s, the cvm api lists %s, reporting the addresses of the api",
+			privateIp, instanceID, strings.Join(instance.PrivateIPAddresses, ", "))
+	}
+	node.mismatched = instance
+	return instance
+}
+
+func (cloud *Cloud) localInstanceID() (string, error) {
+	return metadataValue(cloud.localNode.metadata.InstanceID())
+}
+
+// localZonedInstanceID returns the instance id in the /<zone>/<instance-id> form of InstanceID.
+func (cloud *Cloud) localZonedInstanceID() (string, error) {
+	zone, err := metadataValue(cloud.localNode.metadata.Zone())
+	if err != nil {
+		return "", err
+	}
+	instanceID, err := cloud.localInstanceID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/%s/%s", zone, instanceID), nil
+}
@@ -0,0 +1,153 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/metadata"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+// fakeMetadata serves the metadata service of an instance from a map of paths below meta-data to values.
+type fakeMetadata struct {
+	server *httptest.Server
+	values map[string]string
+}
+
+func newFakeMetadata(values map[string]string) *fakeMetadata {
+	fake := &fakeMetadata{values: values}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := fake.values[strings.TrimPrefix(r.URL.Path, "/meta-data/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, value)
+	}))
+	return fake
+}
+
+// localNode returns a localNode reading from the fake, the metadata client always asks metadata.ENDPOINT.
+func (fake *fakeMetadata) localNode() *localNode {
+	server, _ := url.Parse(fake.server.URL)
+	client := &http.Client{Transport: rewriteHostTransport{host: server.Host}}
+	return &localNode{metadata: metadata.NewMetaData(client), client: client}
+}
+
+func (fake *fakeMetadata) close() {
+	fake.server.Close()
+}
+
+type rewriteHostTransport struct {
+	host string
+}
+
+func (transport rewriteHostTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request.URL.Host = transport.host
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestLocalNode(t *testing.T) {
+	fake := newFakeMetadata(map[string]string{
+		"instance-id":      "ins-1",
+		"local-ipv4":       "10.0.0.1",
+		"public-ipv4":      "1.2.3.4",
+		"placement/zone":   "ap-guangzhou-3",
+		"placement/region": "ap-guangzhou",
+	})
+	defer fake.close()
+	api := newFakeApi(t)
+	defer api.close()
+	api.handle("cvm.DescribeInstances", describeInstancesResult(
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, []string{"1.2.3.4"})))
+	cloud, _ := newTestCloud(t, Config{}, api, nil)
+	cloud.localNode = fake.localNode()
+	ctx := context.Background()
+
+	addresses, err := cloud.NodeAddresses(ctx, types.NodeName("10.0.0.1"))
+	wantAddresses := []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeExternalIP, Address: "1.2.3.4"}}
+	if err != nil || !reflect.DeepEqual(addresses, wantAddresses) {
+		t.Errorf("NodeAddresses = %v, %v, want %v", addresses, err, wantAddresses)
+	}
+	if externalID, err := cloud.ExternalID(ctx, types.NodeName("10.0.0.1")); err != nil || externalID != "ins-1" {
+		t.Errorf("ExternalID = %q, %v, want ins-1", externalID, err)
+	}
+	if instanceID, err := cloud.InstanceID(ctx, types.NodeName("10.0.0.1")); err != nil || instanceID != "/ap-guangzhou-3/ins-1" {
+		t.Errorf("InstanceID = %q, %v, want /ap-guangzhou-3/ins-1", instanceID, err)
+	}
+	// node names are private ips, which the hostname doesn't tell
+	if nodeName, err := cloud.CurrentNodeName(ctx, "host-1"); err != cloudprovider.NotImplemented || nodeName != "" {
+		t.Errorf("CurrentNodeName = %q, %v, want it not implemented", nodeName, err)
+	}
+
+	// the local private ip is only checked against the cvm api, by instance id
+	calls := api.callsOf("cvm.DescribeInstances")
+	if got := strings.Join(api.actions(), ","); got != "cvm.DescribeInstances" || calls[0].Get("Filters.0.Values.0") != "ins-1" {
+		t.Errorf("calls %s with %v, want a single DescribeInstances of ins-1", got, calls)
+	}
+}
+
+func TestLocalNodeAddressesWithoutPublicIp(t *testing.T) {
+	fake := newFakeMetadata(map[string]string{"instance-id": "ins-1", "local-ipv4": "10.0.0.1", "public-ipv4": ""})
+	defer fake.close()
+	api := newFakeApi(t)
+	defer api.close()
+	api.handle("cvm.DescribeInstances", describeInstancesResult(
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+	cloud, _ := newTestCloud(t, Config{}, api, nil)
+	cloud.localNode = fake.localNode()
+
+	addresses, err := cloud.NodeAddresses(context.Background(), types.NodeName("10.0.0.1"))
+	wantAddresses := []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}}
+	if err != nil || !reflect.DeepEqual(addresses, wantAddresses) {
+		t.Errorf("NodeAddresses = %v, %v, want %v", addresses, err, wantAddresses)
+	}
+}
+
+func TestLocalNodeAddressesCheckedAgainstApi(t *testing.T) {
+	fake := newFakeMetadata(map[string]string{"instance-id": "ins-1", "local-ipv4": "10.0.0.1", "public-ipv4": "1.2.3.4"})
+	defer fake.close()
+	api := newFakeApi(t)
+	defer api.close()
+	// the network of the instance was reconfigured, the metadata service still reports the old private ip
+	api.handle("cvm.DescribeInstances", describeInstancesResult(
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.9"}, []string{"5.6.7.8"})))
+	cloud, _ := newTestCloud(t, Config{}, api, nil)
+	cloud.localNode = fake.localNode()
+	ctx := context.Background()
+
+	apiAddresses := []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.9"}, {Type: v1.NodeExternalIP, Address: "5.6.7.8"}}
+	metadataAddresses := []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeExternalIP, Address: "1.2.3.4"}}
+	if addresses, err := cloud.NodeAddresses(ctx, types.NodeName("10.0.0.1")); err != nil || !reflect.DeepEqual(addresses, apiAddresses) {
+		t.Errorf("NodeAddresses = %v, %v, want the addresses of the api %v", addresses, err, apiAddresses)
+	}
+
+	// the result is remembered for localAddressesCheckPeriod, the api isn't asked again meanwhile
+	api.handle("cvm.DescribeInstances", describeInstancesResult(
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, []string{"1.2.3.4"})))
+	if addresses, err := cloud.NodeAddresses(ctx, types.NodeName("10.0.0.1")); err != nil || !reflect.DeepEqual(addresses, apiAddresses) {
+		t.Errorf("NodeAddresses = %v, %v, want the remembered addresses of the api %v", addresses, err, apiAddresses)
+	}
+	if calls := len(api.callsOf("cvm.DescribeInstances")); calls != 1 {
+		t.Errorf("%d DescribeInstances calls within the check period, want 1", calls)
+	}
+
+	// once the period is over the api lists the private ip again, the metadata addresses are back
+	cloud.localNode.checkedAt = time.Now().Add(-localAddressesCheckPeriod)
+	if addresses, err := cloud.NodeAddresses(ctx, types.NodeName("10.0.0.1")); err != nil || !reflect.DeepEqual(addresses, metadataAddresses) {
+		t.Errorf("NodeAddresses = %v, %v, want the addresses of the metadata service %v", addresses, err, metadataAddresses)
+	}
+	if calls := len(api.callsOf("cvm.DescribeInstances")); calls != 2 {
+		t.Errorf("%d DescribeInstances calls after the check period, want 2", calls)
+	}
+}
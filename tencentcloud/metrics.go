@@ -0,0 +1,28 @@
+package tencentcloud
+
+import (
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// metadataFallbacks counts lookups for the local node that went to the api because the metadata service failed.
+	// A rising count usually means the route to the metadata service is broken.
+	metadataFallbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: providerName,
+			Name:      "metadata_fallbacks_total",
+			Help:      "Number of local node lookups answered by the api because the metadata service failed.",
+		},
+		[]string{"method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metadataFallbacks)
+}
+
+func recordMetadataFallback(method string, err error) {
+	metadataFallbacks.WithLabelValues(method).Inc()
+	glog.V(2).Infof("%s: metadata lookup for the local node failed, falling back to the api: %v", method, err)
+}
@@ -0,0 +1,190 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// deletedNodeDeregistrationSeconds measures how long the instance of a deleted node stays registered with
+	// the clbs after the deletion was seen, compare it with backendNodesSyncPeriod.
+	deletedNodeDeregistrationSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: providerName,
+			Name:      "deleted_node_deregistration_seconds",
+			Help:      "Time from the deletion of a node to the deregistration of its instance from every clb.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deletedNodeDeregistrationSeconds)
+}
+
+// runNodeDeletionWatch deregisters the instances of deleted nodes right away. The service controller updates
+// the backends when it notices the node is gone, which races the termination of the instance after a scale
+// down, and the clb keeps sending traffic to a terminated instance until its health check fails.
+func (cloud *Cloud) runNodeDeletionWatch() {
+	listWatch := cache.NewListWatchFromClient(cloud.kubeClient.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
+	_, controller := cache.NewInformer(listWatch, &v1.Node{}, 0, cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			node, ok := obj.(*v1.Node)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				if node, ok = tombstone.Obj.(*v1.Node); !ok {
+					return
+				}
+			}
+			go cloud.deregisterDeletedNode(node, time.Now())
+		},
+	})
+	controller.Run(wait.NeverStop)
+}
+
+// deregisterDeletedNode deregisters the instance of the node from the clbs holding it, then has the backends of
+// every service synced without waiting for the next period, which also covers clbs the instance couldn't be
+// deregistered from here.
+func (cloud *Cloud) deregisterDeletedNode(node *v1.Node, deleted time.Time) {
+	defer cloud.syncBackendNodesNow()
+	if cloud.pause.isPaused() {
+		return
+	}
+	_, instanceId, err := parseProviderID(node.Spec.ProviderID)
+	if err != nil {
+		glog.V(2).Infof("not deregistering deleted node %s directly, it has no valid provider id: %v", node.Name, err)
+		return
+	}
+
+	services, err := cloud.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list services to deregister deleted node %s: %v", node.Name, err)
+		return
+	}
+
+	failed := false
+	for i := range services.Items {
+		service := &services.Items[i]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer || len(service.Status.LoadBalancer.Ingress) == 0 {
+			continue
+		}
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerStaticBackends]; ok {
+			continue
+		}
+		if len(unmanagedProtocols(cloud.config, service)) > 0 {
+			continue
+		}
+		withPorts, _, _, err := portGroupServices(service)
+		if err != nil {
+			continue
+		}
+		unlock := cloud.serviceLocks.lockService(service)
+		ctx, cancel, budget := cloud.withBackgroundReconcile()
+		for _, view := range withPorts {
+			err := cloud.deregisterInstance(ctx, loadBalancerSpecial(view), instanceId)
+			if err = cloud.endCallBudget(service, "deregister", budget, err); err != nil {
+				cloud.loadBalancerCache.forget(loadBalancerSpecial(view))
+				glog.Errorf("failed to deregister instance %s of deleted node %s from the loadbalancer of service %s/%s: %v",
+					instanceId, node.Name, service.Namespace, service.Name, err)
+				failed = true
+			}
+		}
+		cancel()
+		unlock()
+	}
+	if !failed {
+		elapsed := time.Since(deleted)
+		deletedNodeDeregistrationSeconds.Observe(elapsed.Seconds())
+		glog.Infof("deregistered instance %s of deleted node %s from every loadbalancer in %s", instanceId, node.Name, elapsed)
+	}
+}
+
+// deregisterInstance removes the instance from every listener of the clb it is registered with.
+func (cloud *Cloud) deregisterInstance(ctx context.Context, loadBalancerName string, instanceId string) error {
+	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
+	if err != nil {
+		if err == ErrCloudLoadBalancerNotFound {
+			return nil
+		}
+		return err
+	}
+
+	if loadBalancer.Forward == ClbLoadBalancerKindClassic {
+		backends, err := cloud.describeLoadBalancerListenersBackends(loadBalancer.LoadBalancerId)
+		if err != nil {
+			return err
+		}
+		for _, backend := range backends {
+			if backend.UnInstanceId != instanceId {
+				continue
+			}
+			result, err := waitUntilDone(
+				ctx,
+				func() (clb.AsyncTask, error) {
+					return cloud.clb.DeregisterInstancesFromLoadBalancer(loadBalancer.LoadBalancerId, []string{instanceId})
+				}, cloud.clb,
+			)
+			if err != nil {
+				return err
+			}
+			if result != clb.TaskSuccceed {
+				return errors.New("task is not succeed")
+			}
+			return nil
+		}
+		return nil
+	}
+
+	response, err := cloud.clb.DescribeForwardLBBackends(&clb.DescribeForwardLBBackendsArgs{
+		LoadBalancerId: loadBalancer.LoadBalancerId,
+	})
+	if err != nil {
+		return err
+	}
+	for _, listener := range response.Data {
+		backends := []clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts{}
+		for _, backend := range listener.Backends {
+			if backend.UnInstanceId == instanceId {
+				backends = append(backends, clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts{
+					InstanceId: backend.UnInstanceId,
+					Port:       backend.Port,
+				})
+			}
+		}
+		if len(backends) == 0 {
+			continue
+		}
+		listenerId := listener.ListenerId
+		result, err := waitUntilDone(
+			ctx,
+			func() (clb.AsyncTask, error) {
+				return cloud.clb.DeregisterInstancesFromForwardLBFourthListener(&clb.DeregisterInstancesFromForwardLBFourthListenerArgs{
+					LoadBalancerId: loadBalancer.LoadBalancerId,
+					ListenerId:     listenerId,
+					Backends:       backends,
+				})
+			}, cloud.clb,
+		)
+		if err != nil {
+			return err
+		}
+		if result != clb.TaskSuccceed {
+			return errors.New("task is not succeed")
+		}
+	}
+	return nil
+}
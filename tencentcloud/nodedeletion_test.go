@@ -0,0 +1,73 @@
+package tencentcloud
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestDeregisterDeletedNode(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+		budget     int
+		// wantDeregistered are the instances deregistered by listener
+		wantDeregistered []string
+		wantEvents       []string
+	}{
+		{name: "instance deregistered", providerID: "tencentcloud:///ap-guangzhou-3/ins-1", wantDeregistered: []string{"lbl-80=ins-1", "lbl-443=ins-1"}},
+		{name: "node without provider id", providerID: ""},
+		{name: "budget used up", providerID: "tencentcloud:///ap-guangzhou-3/ins-1", budget: 1, wantDeregistered: []string{"lbl-80=ins-1"},
+			wantEvents: []string{"TaskAndLookupBudgetExceeded"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []interface{}{
+					map[string]interface{}{"loadBalancerId": "lb-1", "forward": ClbLoadBalancerKindApplication},
+				}})
+			})
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+				fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP, fakeForwardBackend("ins-1", 30080), fakeForwardBackend("ins-2", 30080)),
+				fakeForwardListener("lbl-443", 443, ClbLoadBalancerListenerProtocolTCP, fakeForwardBackend("ins-1", 30443))))
+			api.handle("clb.DeregisterInstancesFromForwardLBFourthListener", legacyTask)
+			kube := newFakeKube(t)
+			defer kube.close()
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080), fakeServicePort("https", 443, v1.ProtocolTCP, 30443))
+			service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+			kube.services = []v1.Service{*service}
+			cloud, recorder := newTestCloud(t, Config{ReconcileTaskAndLookupBudget: test.budget}, api, kube)
+
+			node := fakeNode("10.0.0.1")
+			node.Spec.ProviderID = test.providerID
+			cloud.deregisterDeletedNode(node, time.Now())
+
+			deregistered := []string{}
+			for _, call := range api.callsOf("clb.DeregisterInstancesFromForwardLBFourthListener") {
+				deregistered = append(deregistered, call.Get("listenerId")+"="+call.Get("backends.0.instanceId"))
+			}
+			if strings.Join(deregistered, ",") != strings.Join(test.wantDeregistered, ",") {
+				t.Errorf("deregistered %v, want %v", deregistered, test.wantDeregistered)
+			}
+			select {
+			case <-cloud.backendNodesSyncNow:
+			default:
+				t.Errorf("no backend sync asked for")
+			}
+			events := drainEvents(recorder)
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("events %v, want %v", events, test.wantEvents)
+			}
+			for i, event := range events {
+				if !strings.Contains(event, test.wantEvents[i]) {
+					t.Errorf("event %q, want %s", event, test.wantEvents[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package tencentcloud
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubernetes/pkg/scheduler/algorithm"
+)
+
+var (
+	// nodeInitializationSeconds measures how long new nodes wait for the cloud node controller to initialize them,
+	// pods can't be scheduled to a node before.
+	nodeInitializationSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: providerName,
+			Name:      "node_initialization_seconds",
+			Help:      "Time from the creation of a node to the removal of its uninitialized taint.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(nodeInitializationSeconds)
+}
+
+func hasUninitializedTaint(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == algorithm.TaintExternalCloudProvider {
+			return true
+		}
+	}
+	return false
+}
+
+// runNodeInitializationWatch observes the time new nodes take to be initialized by the cloud node controller.
+func (cloud *Cloud) runNodeInitializationWatch() {
+	listWatch := cache.NewListWatchFromClient(cloud.kubeClient.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
+	_, controller := cache.NewInformer(listWatch, &v1.Node{}, 0, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			if hasUninitializedTaint(oldNode) && !hasUninitializedTaint(newNode) {
+				elapsed := time.Since(newNode.CreationTimestamp.Time)
+				nodeInitializationSeconds.Observe(elapsed.Seconds())
+				glog.V(2).Infof("node %s initialized %s after it was created, provider id %s", newNode.Name, elapsed, newNode.Spec.ProviderID)
+				if cloud.nodeLabelsEnabled() {
+					// label new nodes right away rather than on the next periodic sync
+					go func() {
+						if err := cloud.syncNodeLabel(newNode); err != nil {
+							glog.Errorf("failed to label initialized node %s: %v", newNode.Name, err)
+						}
+					}()
+				}
+			}
+		},
+	})
+	controller.Run(wait.NeverStop)
+}
@@ -0,0 +1,79 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+type nodeLookupTraceKey struct{}
+
+// nodeLookupTrace remembers the call a node lookup is waiting on, so a lookup running out of time can tell
+// which call was slow.
+type nodeLookupTrace struct {
+	lock  sync.Mutex
+	call  string
+	since time.Time
+}
+
+// traceNodeLookupCall records that the lookup of ctx moves on to the call, if ctx belongs to a lookup.
+func traceNodeLookupCall(ctx context.Context, call string) {
+	trace, ok := ctx.Value(nodeLookupTraceKey{}).(*nodeLookupTrace)
+	if !ok {
+		return
+	}
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	trace.call = call
+	trace.since = time.Now()
+}
+
+func (trace *nodeLookupTrace) current() (string, time.Duration) {
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	if trace.call == "" {
+		return "nothing", 0
+	}
+	return trace.call, time.Since(trace.since)
+}
+
+// lookupInstance runs the instance lookup of a method the cloud node controller calls to initialize nodes
+// within the configured node_initialization_timeout. The per attempt deadlines of the api calls are derived
+// from the overall one, so retries stop in time. A lookup running out of time names the call it was waiting on.
+func (cloud *Cloud) lookupInstance(ctx context.Context, method string, lookup func(ctx context.Context) (*cvm.InstanceInfo, error)) (*cvm.InstanceInfo, error) {
+	if cloud.config.NodeInitializationTimeout == 0 {
+		return lookup(ctx)
+	}
+	timeout := time.Duration(cloud.config.NodeInitializationTimeout) * time.Second
+	trace := &nodeLookupTrace{}
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, nodeLookupTraceKey{}, trace), timeout)
+	defer cancel()
+
+	type result struct {
+		instance *cvm.InstanceInfo
+		err      error
+	}
+	// calls which don't take a context are bounded by the timeout of the http client, they are abandoned
+	done := make(chan result, 1)
+	go func() {
+		instance, err := lookup(ctx)
+		done <- result{instance, err}
+	}()
+
+	var r result
+	select {
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	case r = <-done:
+	}
+	if r.err == context.DeadlineExceeded {
+		call, elapsed := trace.current()
+		return nil, errors.New(fmt.Sprintf("%s timed out after node_initialization_timeout %s, waited %s on %s",
+			method, timeout, elapsed.Truncate(time.Millisecond), call))
+	}
+	return r.instance, r.err
+}
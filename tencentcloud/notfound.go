@@ -0,0 +1,69 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+const (
+	// InstanceNotFoundReport reports a missing instance as not found, the node controller deletes
+	// nodes whose instance is reported not found.
+	InstanceNotFoundReport = "report"
+	// InstanceNotFoundRetry answers a missing instance with an error the caller retries, so a lookup
+	// missing the instance for a moment never leads to the deletion of its node.
+	InstanceNotFoundRetry = "retry"
+)
+
+// instanceNotFoundDefaults is how each method handles instances which can't be found unless configured
+// otherwise. None reports them, a node is only deleted once InstanceExistsByProviderID is configured to
+// report its instance as not found.
+var instanceNotFoundDefaults = map[string]string{
+	"NodeAddresses":              InstanceNotFoundRetry,
+	"NodeAddressesByProviderID":  InstanceNotFoundRetry,
+	"ExternalID":                 InstanceNotFoundRetry,
+	"InstanceID":                 InstanceNotFoundRetry,
+	"InstanceType":               InstanceNotFoundRetry,
+	"InstanceTypeByProviderID":   InstanceNotFoundRetry,
+	"InstanceExistsByProviderID": InstanceNotFoundRetry,
+}
+
+// instanceNotFoundPolicy decides per method of the instances interface what an instance which can't be
+// found yields, cloudprovider.InstanceNotFound or an error to retry.
+type instanceNotFoundPolicy map[string]string
+
+// newInstanceNotFoundPolicy applies the configured behaviors over the defaults.
+func newInstanceNotFoundPolicy(configured map[string]string) (instanceNotFoundPolicy, error) {
+	policy := instanceNotFoundPolicy{}
+	for method, behavior := range instanceNotFoundDefaults {
+		policy[method] = behavior
+	}
+	for method, behavior := range configured {
+		if _, ok := instanceNotFoundDefaults[method]; !ok {
+			return nil, errors.New(fmt.Sprintf("invalid instance_not_found method %q", method))
+		}
+		if behavior != InstanceNotFoundReport && behavior != InstanceNotFoundRetry {
+			return nil, errors.New(fmt.Sprintf("invalid instance_not_found behavior %q of method %s, must be %s or %s",
+				behavior, method, InstanceNotFoundReport, InstanceNotFoundRetry))
+		}
+		policy[method] = behavior
+	}
+	return policy, nil
+}
+
+// reports returns true if the method reports instances which can't be found as not found.
+func (policy instanceNotFoundPolicy) reports(method string) bool {
+	return policy[method] == InstanceNotFoundReport
+}
+
+// translate returns the error method answers err with, errors other than CloudInstanceNotFound are kept.
+func (policy instanceNotFoundPolicy) translate(method string, err error) error {
+	if err != CloudInstanceNotFound {
+		return err
+	}
+	if policy.reports(method) {
+		return cloudprovider.InstanceNotFound
+	}
+	return err
+}
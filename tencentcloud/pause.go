@@ -0,0 +1,75 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// PauseConfigMapName is the name of the configmap in kube-system pausing the provider while it exists.
+	// Paused, the provider makes no changes to clbs, routes or nodes, it only answers what it can read.
+	PauseConfigMapName = "tencentcloud-cloud-controller-manager-paused"
+)
+
+// ErrCloudPaused is returned by every change asked of the provider while it is paused, the callers retry it
+// until the pause is lifted.
+var ErrCloudPaused = errors.New(fmt.Sprintf("tencentcloud cloud controller manager is paused by configmap kube-system/%s", PauseConfigMapName))
+
+// pauseSwitch follows the existence of the pause configmap.
+type pauseSwitch struct {
+	lock   sync.Mutex
+	paused bool
+}
+
+func (p *pauseSwitch) isPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
+// set returns true if the state changed.
+func (p *pauseSwitch) set(paused bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	changed := p.paused != paused
+	p.paused = paused
+	return changed
+}
+
+// runPauseWatch follows the pause configmap and reports entering and leaving the paused state.
+func (cloud *Cloud) runPauseWatch() {
+	listWatch := cache.NewListWatchFromClient(cloud.kubeClient.CoreV1().RESTClient(), "configmaps", "kube-system",
+		fields.OneTermEqualSelector("metadata.name", PauseConfigMapName))
+	_, controller := cache.NewInformer(listWatch, &v1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			cloud.setPaused(true)
+		},
+		DeleteFunc: func(obj interface{}) {
+			cloud.setPaused(false)
+		},
+	})
+	controller.Run(wait.NeverStop)
+}
+
+func (cloud *Cloud) setPaused(paused bool) {
+	if !cloud.pause.set(paused) {
+		return
+	}
+	if paused {
+		glog.Warningf("PAUSED: configmap kube-system/%s exists, no changes are made until it is deleted", PauseConfigMapName)
+		cloud.recorder.Eventf(controllerReference, v1.EventTypeWarning, "Paused",
+			"Configmap kube-system/%s exists, clbs, routes and nodes are left alone until it is deleted", PauseConfigMapName)
+		return
+	}
+	glog.Infof("RESUMED: configmap kube-system/%s is gone, changes are made again", PauseConfigMapName)
+	cloud.recorder.Eventf(controllerReference, v1.EventTypeNormal, "Resumed",
+		"Configmap kube-system/%s was deleted, clbs, routes and nodes are managed again", PauseConfigMapName)
+}
@@ -0,0 +1,226 @@
+package tencentcloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// LoadBalancerPlan is the clb a service asks for, derived from the service, the nodes and the config alone.
+// EnsureLoadBalancer ensures the clb of the plan of every port group of the service.
+type LoadBalancerPlan struct {
+	// Name is the name the clb is found by, set as its special field
+	Name string
+	// DisplayName is the name of the clb shown in the console
+	DisplayName string
+	// Kind is LoadBalancerKindClassic or LoadBalancerKindApplication
+	Kind string
+	// Type is LoadBalancerTypePublic or LoadBalancerTypePrivate
+	Type string
+	// SubnetId is the subnet of a private clb, empty if it is selected when the clb is created
+	SubnetId string
+	// Hostname is the hostname annotation of the service, the domain of the clb is used if it is empty
+	Hostname string
+	// Publish tells whether the ingress of the service reports the ip, the hostname or both
+	Publish string
+
+	// listeners and backends are the mapping of the service ports and nodes the plan is checked with. The
+	// listener and backend ensure paths derive them from the service and the nodes again, they are also run by
+	// backend syncs which don't plan the clb, so they are not exported as part of the plan.
+	listeners []listenerPlan
+	// backends are registered with every listener
+	backends []backendPlan
+
+	// Warnings are problems of the service which don't keep its clb from being ensured
+	Warnings []PlanProblem
+}
+
+// listenerPlan is a listener of the clb, forwarding to the node port of the service port. A range listener
+// serves the ports up to EndPort, forwarding them to the node ports from NodePort on.
+type listenerPlan struct {
+	Port     int32
+	Protocol v1.Protocol
+	NodePort int32
+	// EndPort is the last port of a range listener, 0 for a listener of a single port
+	EndPort int32
+}
+
+// backendPlan is either a node, registered on the node port of each listener, or a static backend
+// registered on its own port.
+type backendPlan struct {
+	NodeName   string
+	InstanceId string
+	Port       int32
+}
+
+// PlanProblem is a problem of the service found while planning its clb, Reason is the reason of the event
+// recorded for it.
+type PlanProblem struct {
+	Reason  string
+	Message string
+}
+
+// PlanError is returned when the service can't have a clb as it is specified.
+type PlanError struct {
+	PlanProblem
+}
+
+func (e *PlanError) Error() string {
+	return e.Message
+}
+
+func planError(reason string, format string, args ...interface{}) error {
+	return &PlanError{PlanProblem{Reason: reason, Message: fmt.Sprintf(format, args...)}}
+}
+
+// PlanLoadBalancer returns the clb the service asks for, or a PlanError if it can't have one. Services with
+// port groups get a clb per group, PlanLoadBalancers plans all of them. No api is called, so instances and
+// subnets named by the service are only checked when its clb is ensured. Nodes about to be removed by the
+// cluster autoscaler are only left out when the backends are registered.
+func PlanLoadBalancer(config Config, service *v1.Service, nodes []*v1.Node) (*LoadBalancerPlan, error) {
+	if unmanaged := unmanagedProtocols(config, service); len(unmanaged) > 0 {
+		return nil, planError("ProtocolNotManaged", "loadbalancers for %s ports are not managed in this cluster, see loadbalancer_protocols",
+			strings.Join(unmanaged, ", "))
+	}
+	if service.Spec.SessionAffinity != v1.ServiceAffinityNone {
+		return nil, planError("UnsupportedSessionAffinity", "SessionAffinity is not supported currently")
+	}
+	hostname, err := loadBalancerHostname(service)
+	if err != nil {
+		return nil, planError("InvalidLoadBalancerHostname", "%v", err)
+	}
+	publish, err := loadBalancerPublish(service)
+	if err != nil {
+		return nil, planError("InvalidLoadBalancerPublish", "%v", err)
+	}
+	if invalid := invalidListeners(config, service); len(invalid) > 0 {
+		return nil, planError("InvalidLoadBalancerListeners", "invalid listeners: %s", strings.Join(invalid, "; "))
+	}
+	if value, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthCheckHttpCodes]; ok {
+		if _, err := parseHealthCheckHttpCodes(value); err != nil {
+			return nil, planError("InvalidHealthCheckHttpCodes", "invalid %s: %v", ServiceAnnotationLoadBalancerHealthCheckHttpCodes, err)
+		}
+	}
+
+	plan := &LoadBalancerPlan{
+		Name:        loadBalancerSpecial(service),
+		DisplayName: loadBalancerDisplayName(service),
+		Kind:        desiredLoadBalancerKind(service),
+		Type:        desiredLoadBalancerType(service),
+		Hostname:    hostname,
+		Publish:     publish,
+	}
+	if unsupported := unsupportedAnnotations(service); len(unsupported) > 0 {
+		problem := PlanProblem{Reason: "UnsupportedAnnotations", Message: fmt.Sprintf("unsupported annotations: %s", strings.Join(unsupported, "; "))}
+		if !config.IgnoreUnsupportedAnnotations {
+			return nil, &PlanError{problem}
+		}
+		plan.Warnings = append(plan.Warnings, problem)
+	}
+	if plan.Type == LoadBalancerTypePrivate {
+		plan.SubnetId = service.Annotations[ServiceAnnotationLoadBalancerTypeInternalSubnetId]
+	}
+
+	// range listeners are planned as asked for, clbs refusing them get a listener per port when they are ensured
+	ranges := []portRange{}
+	if plan.Kind == LoadBalancerKindApplication {
+		ranges = servicePortRanges(service)
+	}
+	followers := portRangeFollowers(ranges)
+	endPorts := map[string]int32{}
+	for _, r := range ranges {
+		endPorts[listenerKey(r.first())] = r.endPort()
+	}
+	for _, port := range service.Spec.Ports {
+		if followers[listenerKey(port)] {
+			continue
+		}
+		plan.listeners = append(plan.listeners, listenerPlan{Port: port.Port, Protocol: port.Protocol, NodePort: port.NodePort, EndPort: endPorts[listenerKey(port)]})
+	}
+
+	backends, static, err := staticBackends(service)
+	if err != nil {
+		return nil, planError("InvalidStaticBackends", "%v", err)
+	}
+	if static {
+		for _, backend := range backends {
+			plan.backends = append(plan.backends, backendPlan{InstanceId: backend.InstanceId, Port: int32(backend.Port)})
+		}
+		sortBackendPlans(plan.backends)
+		return plan, nil
+	}
+	if _, err := backendNodeSelector(service); err != nil {
+		return nil, planError("InvalidBackendSelector", "%v", err)
+	}
+	selected, err := filterBackendNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range selected {
+		plan.backends = append(plan.backends, backendPlan{NodeName: node.Name})
+	}
+	sortBackendPlans(plan.backends)
+	return plan, nil
+}
+
+// sortBackendPlans sorts the backends by instance id, node name and port, so the plan doesn't depend on the
+// order the nodes are listed in.
+func sortBackendPlans(backends []backendPlan) {
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].InstanceId != backends[j].InstanceId {
+			return backends[i].InstanceId < backends[j].InstanceId
+		}
+		if backends[i].NodeName != backends[j].NodeName {
+			return backends[i].NodeName < backends[j].NodeName
+		}
+		return backends[i].Port < backends[j].Port
+	})
+}
+
+// PlanLoadBalancers returns the plan of the clb of every port group of the service.
+func PlanLoadBalancers(config Config, service *v1.Service, nodes []*v1.Node) ([]*LoadBalancerPlan, error) {
+	withPorts, _, _, err := portGroupServices(service)
+	if err != nil {
+		return nil, planError("InvalidPortGroups", "%v", err)
+	}
+	plans := []*LoadBalancerPlan{}
+	for _, view := range withPorts {
+		plan, err := PlanLoadBalancer(config, view, nodes)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// desiredLoadBalancerKind returns the kind of clb the service asks for, application clbs by default.
+func desiredLoadBalancerKind(service *v1.Service) string {
+	if service.Annotations[ServiceAnnotationLoadBalancerKind] == LoadBalancerKindClassic {
+		return LoadBalancerKindClassic
+	}
+	return LoadBalancerKindApplication
+}
+
+// desiredLoadBalancerType returns the type of clb the service asks for, public clbs by default.
+func desiredLoadBalancerType(service *v1.Service) string {
+	if service.Annotations[ServiceAnnotationLoadBalancerType] == LoadBalancerTypePrivate {
+		return LoadBalancerTypePrivate
+	}
+	return LoadBalancerTypePublic
+}
+
+// loadBalancerDisplayName returns the name of the clb of the service shown in the console.
+func loadBalancerDisplayName(service *v1.Service) string {
+	name, ok := service.Annotations[ServiceAnnotationLoadBalancerName]
+	if !ok {
+		name = ServiceAnnotationLoadBalancerNameDefault
+	}
+	// legacy clbs carry no tags, the clb of a port group is told by its display name
+	if group := service.Annotations[annotationLoadBalancerPortGroup]; group != "" {
+		name = name + "-" + group
+	}
+	return name
+}
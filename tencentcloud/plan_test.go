@@ -0,0 +1,33 @@
+package tencentcloud
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestPlanLoadBalancerIgnoresNodeOrder(t *testing.T) {
+	service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080), fakeServicePort("dns", 53, v1.ProtocolUDP, 30053))
+	orders := [][]*v1.Node{
+		{fakeNode("10.0.0.1"), fakeNode("10.0.0.2"), fakeNode("10.0.0.3")},
+		{fakeNode("10.0.0.3"), fakeNode("10.0.0.1"), fakeNode("10.0.0.2")},
+		{fakeNode("10.0.0.2"), fakeNode("10.0.0.3"), fakeNode("10.0.0.1")},
+	}
+
+	hashes := []string{}
+	for _, nodes := range orders {
+		plan, err := PlanLoadBalancer(Config{}, service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// the backends are unexported, they are hashed with the rest of the plan by printing it
+		hashes = append(hashes, fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%+v", *plan)))))
+	}
+	for i := 1; i < len(hashes); i++ {
+		if hashes[i] != hashes[0] {
+			t.Errorf("plan of node order %d differs from the plan of node order 0", i)
+		}
+	}
+}
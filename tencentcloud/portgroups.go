@@ -0,0 +1,253 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+const (
+	// annotationLoadBalancerPortGroup marks the copies of a service standing for the clb of one port group,
+	// it is never set on services themselves.
+	annotationLoadBalancerPortGroup = "tencentcloud.com/loadbalancer-port-group"
+
+	maxPortGroupNameLength = 10
+)
+
+// port group names carry no dashes, the group of a clb is the suffix of its display name after the last dash
+var portGroupNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// loadBalancerSpecial returns the name the clb of the service is created with and looked up by, the special
+// field of the clb. Port groups get their own clb named after the group.
+func loadBalancerSpecial(service *v1.Service) string {
+	name := cloudprovider.GetLoadBalancerName(service)
+	if group := service.Annotations[annotationLoadBalancerPortGroup]; group != "" {
+		return name + "-" + group
+	}
+	return name
+}
+
+// parsePortGroups returns the group of every service port listed in the port groups annotation, and the
+// names of all groups of the annotation whether any service port is listed in them or not.
+func parsePortGroups(service *v1.Service) (map[int32]string, []string, error) {
+	value := service.Annotations[ServiceAnnotationLoadBalancerPortGroups]
+	if value == "" {
+		return map[int32]string{}, nil, nil
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q: %s",
+			ServiceAnnotationLoadBalancerPortGroups, value, fmt.Sprintf(format, args...))))
+	}
+	if _, ok := service.Annotations[ServiceAnnotationLoadBalancerHostname]; ok {
+		return nil, nil, invalid("a hostname can only point at one loadbalancer, annotation %s can't be used with port groups",
+			ServiceAnnotationLoadBalancerHostname)
+	}
+
+	groups := map[int32]string{}
+	listed := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, nil, invalid("entry %q is not <group>:<ports>", entry)
+		}
+		name := parts[0]
+		if len(name) > maxPortGroupNameLength || !portGroupNameRegexp.MatchString(name) {
+			return nil, nil, invalid("group name %q must be at most %d lowercase letters or digits", name, maxPortGroupNameLength)
+		}
+		from, to, err := parsePortRange(parts[1])
+		if err != nil {
+			return nil, nil, invalid("ports %q of group %s: %v", parts[1], name, err)
+		}
+		for _, port := range service.Spec.Ports {
+			if port.Port < from || port.Port > to {
+				continue
+			}
+			if group, ok := groups[port.Port]; ok && group != name {
+				return nil, nil, invalid("port %d is in groups %s and %s", port.Port, group, name)
+			}
+			groups[port.Port] = name
+		}
+		listed[name] = true
+	}
+	names := []string{}
+	for name := range listed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return groups, names, nil
+}
+
+// parsePortRange parses a port or an inclusive range of ports like 7000-7010.
+func parsePortRange(value string) (int32, int32, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	from, err := strconv.ParseInt(bounds[0], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	to := from
+	if len(bounds) == 2 {
+		if to, err = strconv.ParseInt(bounds[1], 10, 32); err != nil {
+			return 0, 0, err
+		}
+	}
+	if from < 1 || to > 65535 || from > to {
+		return 0, 0, errors.New("not a port range within 1-65535")
+	}
+	return int32(from), int32(to), nil
+}
+
+// portGroupService returns a copy of the service standing for the clb of the group, "" for the clb of the
+// ports in no group, which is the clb of the service without port groups. The copy keeps the ports given.
+func portGroupService(service *v1.Service, group string, ports []v1.ServicePort) *v1.Service {
+	view := service.DeepCopy()
+	if group != "" {
+		if view.Annotations == nil {
+			view.Annotations = map[string]string{}
+		}
+		view.Annotations[annotationLoadBalancerPortGroup] = group
+	}
+	view.Spec.Ports = ports
+	return view
+}
+
+// portGroupServices splits the service into one service per clb. Services with ports get a clb, the ones
+// without ports are of groups or of ungrouped ports the service no longer has, their clbs are deleted.
+// Without the port groups annotation the service itself is the only one with ports.
+func portGroupServices(service *v1.Service) ([]*v1.Service, []*v1.Service, []string, error) {
+	groups, names, err := parsePortGroups(service)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(names) == 0 {
+		return []*v1.Service{service}, nil, nil, nil
+	}
+
+	ports := map[string][]v1.ServicePort{}
+	for _, port := range service.Spec.Ports {
+		ports[groups[port.Port]] = append(ports[groups[port.Port]], port)
+	}
+	withPorts, withoutPorts := []*v1.Service{}, []*v1.Service{}
+	for _, group := range append([]string{""}, names...) {
+		view := portGroupService(service, group, ports[group])
+		if len(view.Spec.Ports) > 0 {
+			withPorts = append(withPorts, view)
+		} else {
+			withoutPorts = append(withoutPorts, view)
+		}
+	}
+	return withPorts, withoutPorts, names, nil
+}
+
+// ensurePortGroupLoadBalancers ensures the clb of every port group of the service and reports the ingresses of
+// all of them. Clbs of groups without ports left are deleted, so ports moving between groups only touch the
+// clbs of the groups involved.
+func (cloud *Cloud) ensurePortGroupLoadBalancers(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	withPorts, withoutPorts, names, err := portGroupServices(service)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &v1.LoadBalancerStatus{}
+	for _, view := range withPorts {
+		viewStatus, err := cloud.ensureLoadBalancer(ctx, clusterName, view, nodes)
+		if err != nil {
+			return nil, err
+		}
+		status.Ingress = append(status.Ingress, viewStatus.Ingress...)
+	}
+	for _, view := range withoutPorts {
+		if err := cloud.ensureLoadBalancerDeleted(ctx, clusterName, view); err != nil {
+			return nil, err
+		}
+	}
+	if err := cloud.deleteRemovedPortGroupLoadBalancers(ctx, clusterName, service, status, names); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// ensurePortGroupLoadBalancersDeleted deletes the clbs of every port group the service has or had. An invalid
+// annotation doesn't stop the deletion, the clbs of its groups are found like the ones of removed groups.
+func (cloud *Cloud) ensurePortGroupLoadBalancersDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	withPorts, withoutPorts, names, err := portGroupServices(service)
+	if err != nil {
+		glog.Warningf("deleting loadbalancers of service %s/%s with invalid port groups: %v", service.Namespace, service.Name, err)
+		withPorts, withoutPorts, names = []*v1.Service{service}, nil, nil
+	}
+	for _, view := range append(withPorts, withoutPorts...) {
+		if err := cloud.ensureLoadBalancerDeleted(ctx, clusterName, view); err != nil {
+			return err
+		}
+	}
+	return cloud.deleteRemovedPortGroupLoadBalancers(ctx, clusterName, service, &v1.LoadBalancerStatus{}, names)
+}
+
+// deleteRemovedPortGroupLoadBalancers deletes the clbs of groups removed from the annotation. Their names are
+// unknown by now, so they are found by the vips the service still reports but the status doesn't, and owned
+// ones are told apart by looking them up again by the name the group in their display name implies.
+// Clbs reported by an eip rather than their vip can't be found that way.
+func (cloud *Cloud) deleteRemovedPortGroupLoadBalancers(ctx context.Context, clusterName string, service *v1.Service, status *v1.LoadBalancerStatus, names []string) error {
+	reported := map[string]bool{}
+	for _, ingress := range status.Ingress {
+		reported[ingress.IP] = true
+	}
+	vips := []string{}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" && !reported[ingress.IP] {
+			vips = append(vips, ingress.IP)
+		}
+	}
+	if len(vips) == 0 {
+		return nil
+	}
+
+	forward := -1
+	candidates, err := cloud.describeLoadBalancers(&clb.DescribeLoadBalancersArgs{
+		LoadBalancerVips: &vips,
+		Forward:          &forward,
+	})
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	for _, candidate := range candidates {
+		i := strings.LastIndex(candidate.LoadBalancerName, "-")
+		if i < 0 {
+			continue
+		}
+		group := candidate.LoadBalancerName[i+1:]
+		if known[group] || len(group) > maxPortGroupNameLength || !portGroupNameRegexp.MatchString(group) {
+			continue
+		}
+		view := portGroupService(service, group, nil)
+		owned, err := cloud.getLoadBalancerByName(loadBalancerSpecial(view))
+		if err == ErrCloudLoadBalancerNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if owned.LoadBalancerId != candidate.LoadBalancerId {
+			continue
+		}
+		glog.Infof("deleting loadbalancer %s of removed port group %s of service %s/%s", candidate.LoadBalancerId, group, service.Namespace, service.Name)
+		if err := cloud.ensureLoadBalancerDeleted(ctx, clusterName, view); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package tencentcloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+
+	"k8s.io/api/core/v1"
+)
+
+// portRange is a run of service ports of one protocol served by a single listener of an application clb. A range
+// listener forwards each port to the backend port as far from the first node port as the port is from the first
+// port, so both the ports and the node ports of a range go up by one.
+type portRange struct {
+	Ports []v1.ServicePort
+}
+
+func (r portRange) first() v1.ServicePort {
+	return r.Ports[0]
+}
+
+func (r portRange) endPort() int32 {
+	return r.Ports[len(r.Ports)-1].Port
+}
+
+func (r portRange) String() string {
+	return fmt.Sprintf("%d-%d/%s", r.first().Port, r.endPort(), r.first().Protocol)
+}
+
+// portRangesRequested returns true if the service asks for range listeners, see ServiceAnnotationLoadBalancerPortRanges.
+func portRangesRequested(service *v1.Service) bool {
+	return service.Annotations[ServiceAnnotationLoadBalancerPortRanges] == "true"
+}
+
+// servicePortRanges returns the runs of at least two service ports whose ports and node ports go up by one,
+// sorted by protocol and port. Services not asking for range listeners have none.
+func servicePortRanges(service *v1.Service) []portRange {
+	if !portRangesRequested(service) {
+		return nil
+	}
+	ports := append([]v1.ServicePort{}, service.Spec.Ports...)
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Protocol != ports[j].Protocol {
+			return ports[i].Protocol < ports[j].Protocol
+		}
+		return ports[i].Port < ports[j].Port
+	})
+
+	ranges := []portRange{}
+	run := []v1.ServicePort{}
+	flush := func() {
+		if len(run) > 1 {
+			ranges = append(ranges, portRange{Ports: run})
+		}
+	}
+	for _, port := range ports {
+		if len(run) > 0 {
+			last := run[len(run)-1]
+			if port.Protocol == last.Protocol && port.Port == last.Port+1 && port.NodePort == last.NodePort+1 {
+				run = append(run, port)
+				continue
+			}
+		}
+		flush()
+		run = []v1.ServicePort{port}
+	}
+	flush()
+	return ranges
+}
+
+// portRangeFollowers returns the ports of the ranges but their first one by port and protocol. Once the
+// listener of a range exists, they are served by the listener of its first port.
+func portRangeFollowers(ranges []portRange) map[string]bool {
+	followers := map[string]bool{}
+	for _, r := range ranges {
+		for _, port := range r.Ports[1:] {
+			followers[listenerKey(port)] = true
+		}
+	}
+	return followers
+}
+
+func listenerKey(port v1.ServicePort) string {
+	return fmt.Sprintf("%d/%s", port.Port, port.Protocol)
+}
+
+// isPortRangeUnsupportedError returns true if the clb refused to create a range listener, because the clb or
+// the account doesn't support them.
+func isPortRangeUnsupportedError(err error) bool {
+	e, ok := err.(common.VersionAPIError)
+	if !ok {
+		return false
+	}
+	code := e.Response.Error.Code
+	if strings.HasPrefix(code, "UnsupportedOperation") {
+		return true
+	}
+	return strings.HasPrefix(code, "InvalidParameter") && strings.Contains(e.Response.Error.Message, "EndPort")
+}
+
+// mapServicePortProtoClbV3Proto returns the listener protocol of the clb v3 api serving the protocol.
+func mapServicePortProtoClbV3Proto(proto v1.Protocol) string {
+	if proto == v1.ProtocolUDP {
+		return "UDP"
+	}
+	return "TCP"
+}
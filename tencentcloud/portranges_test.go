@@ -0,0 +1,284 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestServicePortRanges(t *testing.T) {
+	enabled := map[string]string{ServiceAnnotationLoadBalancerPortRanges: "true"}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []v1.ServicePort
+		want        []string
+	}{
+		{
+			name:  "not requested",
+			ports: []v1.ServicePort{fakeServicePort("a", 8000, v1.ProtocolTCP, 30000), fakeServicePort("b", 8001, v1.ProtocolTCP, 30001)},
+			want:  []string{},
+		},
+		{
+			name:        "ports and node ports contiguous",
+			annotations: enabled,
+			ports: []v1.ServicePort{
+				fakeServicePort("a", 8000, v1.ProtocolTCP, 30000),
+				fakeServicePort("b", 8001, v1.ProtocolTCP, 30001),
+				fakeServicePort("c", 8002, v1.ProtocolTCP, 30002),
+			},
+			want: []string{"8000-8002/TCP"},
+		},
+		{
+			name:        "node ports not contiguous",
+			annotations: enabled,
+			ports:       []v1.ServicePort{fakeServicePort("a", 8000, v1.ProtocolTCP, 30000), fakeServicePort("b", 8001, v1.ProtocolTCP, 31234)},
+			want:        []string{},
+		},
+		{
+			name:        "listed out of order",
+			annotations: enabled,
+			ports: []v1.ServicePort{
+				fakeServicePort("c", 8002, v1.ProtocolTCP, 30002),
+				fakeServicePort("a", 8000, v1.ProtocolTCP, 30000),
+				fakeServicePort("b", 8001, v1.ProtocolTCP, 30001),
+			},
+			want: []string{"8000-8002/TCP"},
+		},
+		{
+			name:        "protocols apart",
+			annotations: enabled,
+			ports: []v1.ServicePort{
+				fakeServicePort("a", 8000, v1.ProtocolTCP, 30000),
+				fakeServicePort("b", 8001, v1.ProtocolUDP, 30001),
+				fakeServicePort("c", 8000, v1.ProtocolUDP, 30000),
+			},
+			want: []string{"8000-8001/UDP"},
+		},
+		{
+			name:        "gaps split ranges",
+			annotations: enabled,
+			ports: []v1.ServicePort{
+				fakeServicePort("a", 8000, v1.ProtocolTCP, 30000),
+				fakeServicePort("b", 8001, v1.ProtocolTCP, 30001),
+				fakeServicePort("c", 8003, v1.ProtocolTCP, 30003),
+				fakeServicePort("d", 8004, v1.ProtocolTCP, 30004),
+				fakeServicePort("e", 9000, v1.ProtocolTCP, 30005),
+			},
+			want: []string{"8000-8001/TCP", "8003-8004/TCP"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, r := range servicePortRanges(fakeService(test.annotations, test.ports...)) {
+				got = append(got, r.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ranges %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnsureApplicationLoadBalancerListenersPortRanges(t *testing.T) {
+	ports := []v1.ServicePort{
+		fakeServicePort("a", 8000, v1.ProtocolTCP, 30000),
+		fakeServicePort("b", 8001, v1.ProtocolTCP, 30001),
+		fakeServicePort("c", 8002, v1.ProtocolTCP, 30002),
+		fakeServicePort("dns", 53, v1.ProtocolUDP, 30053),
+	}
+	tests := []struct {
+		name        string
+		legacy      []map[string]interface{}
+		v3          []map[string]interface{}
+		unsupported bool
+		wantCalls   []string
+		wantRange   bool
+		wantCreated []string
+		wantEvent   string
+	}{
+		{
+			name:        "range created",
+			wantCalls:   []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clbv3.CreateListener", "clbv3.DescribeTaskStatus", "clb.CreateForwardLBFourthLayerListeners"},
+			wantRange:   true,
+			wantCreated: []string{"53"},
+		},
+		{
+			name:        "range unsupported",
+			unsupported: true,
+			wantCalls:   []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clbv3.CreateListener", "clb.CreateForwardLBFourthLayerListeners"},
+			wantRange:   true,
+			wantCreated: []string{"53", "8000", "8001", "8002"},
+			wantEvent:   "PortRangeUnsupported",
+		},
+		{
+			name: "range listener exists",
+			legacy: []map[string]interface{}{
+				fakeFourthLayerListener("lbl-8000", 8000, ClbLoadBalancerListenerProtocolTCP),
+				fakeFourthLayerListener("lbl-53", 53, ClbLoadBalancerListenerProtocolUDP),
+			},
+			v3: []map[string]interface{}{
+				fakeListenerV3("lbl-8000", 8000, 8002, "TCP"),
+				fakeListenerV3("lbl-53", 53, 0, "UDP"),
+			},
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.DescribeForwardLBListeners", "clbv3.DescribeListeners"},
+		},
+		{
+			name: "port of the range served by its own listener",
+			legacy: []map[string]interface{}{
+				fakeFourthLayerListener("lbl-8000", 8000, ClbLoadBalancerListenerProtocolTCP),
+				fakeFourthLayerListener("lbl-53", 53, ClbLoadBalancerListenerProtocolUDP),
+			},
+			v3: []map[string]interface{}{
+				fakeListenerV3("lbl-8000", 8000, 0, "TCP"),
+				fakeListenerV3("lbl-53", 53, 0, "UDP"),
+			},
+			wantCalls:   []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.CreateForwardLBFourthLayerListeners", "clb.DescribeForwardLBListeners", "clbv3.DescribeListeners"},
+			wantCreated: []string{"8001", "8002"},
+		},
+		{
+			name: "range listener of other ports",
+			legacy: []map[string]interface{}{
+				fakeFourthLayerListener("lbl-8000", 8000, ClbLoadBalancerListenerProtocolTCP),
+				fakeFourthLayerListener("lbl-53", 53, ClbLoadBalancerListenerProtocolUDP),
+			},
+			v3: []map[string]interface{}{
+				fakeListenerV3("lbl-8000", 8000, 8001, "TCP"),
+				fakeListenerV3("lbl-53", 53, 0, "UDP"),
+			},
+			wantCalls: []string{"clb.DescribeForwardLBListeners", "clbv3.DescribeListeners", "clb.DeleteForwardLBListener",
+				"clbv3.CreateListener", "clbv3.DescribeTaskStatus", "clb.DescribeForwardLBListeners", "clbv3.DescribeListeners"},
+			wantRange: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeForwardLBListeners", describeForwardLBListenersResult(test.legacy...))
+			api.handle("clbv3.DescribeListeners", describeListenersV3Result(test.v3...))
+			api.handle("clbv3.CreateListener", func(params url.Values) interface{} {
+				if test.unsupported {
+					return v3Error("UnsupportedOperation", "port range listeners are not supported")
+				}
+				return v3Task(params)
+			})
+			api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+			api.handle("clb.CreateForwardLBFourthLayerListeners", legacyTask)
+			api.handle("clb.DeleteForwardLBListener", legacyTask)
+			cloud, recorder := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(map[string]string{ServiceAnnotationLoadBalancerPortRanges: "true"}, ports...)
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+			if err := cloud.ensureApplicationLoadBalancerListeners(context.Background(), "kubernetes", service, loadBalancer); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %s", got, strings.Join(test.wantCalls, ","))
+			}
+			if test.wantRange {
+				create := api.callsOf("clbv3.CreateListener")[0]
+				if create.Get("Ports.0") != "8000" || create.Get("EndPort") != "8002" || create.Get("Protocol") != "TCP" ||
+					create.Get("ListenerNames.0") != "default/web/8000" || create.Get("HealthCheck.HealthSwitch") != "1" {
+					t.Errorf("range listener created with %v, want 8000-8002/TCP named default/web/8000", create)
+				}
+			}
+			created := []string{}
+			for _, call := range api.callsOf("clb.CreateForwardLBFourthLayerListeners") {
+				for i := 0; call.Get(fmt.Sprintf("listeners.%d.loadBalancerPort", i)) != ""; i++ {
+					created = append(created, call.Get(fmt.Sprintf("listeners.%d.loadBalancerPort", i)))
+				}
+			}
+			if test.wantCreated == nil {
+				test.wantCreated = []string{}
+			}
+			if !reflect.DeepEqual(created, test.wantCreated) {
+				t.Errorf("listeners of ports %v created, want %v", created, test.wantCreated)
+			}
+			events := strings.Join(drainEvents(recorder), "\n")
+			if (test.wantEvent != "") != strings.Contains(events, "PortRangeUnsupported") {
+				t.Errorf("events %q, want %q", events, test.wantEvent)
+			}
+		})
+	}
+}
+
+func TestEnsureApplicationLoadBalancerBackendsPortRanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		listeners     []map[string]interface{}
+		wantRegisters map[string]string
+	}{
+		{
+			name:          "range listener",
+			listeners:     []map[string]interface{}{fakeForwardListener("lbl-8000", 8000, ClbLoadBalancerListenerProtocolTCP)},
+			wantRegisters: map[string]string{"lbl-8000": "30000"},
+		},
+		{
+			name: "listener per port",
+			listeners: []map[string]interface{}{
+				fakeForwardListener("lbl-8000", 8000, ClbLoadBalancerListenerProtocolTCP),
+				fakeForwardListener("lbl-8001", 8001, ClbLoadBalancerListenerProtocolTCP),
+			},
+			wantRegisters: map[string]string{"lbl-8000": "30000", "lbl-8001": "30001"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(test.listeners...))
+			api.handle("clb.RegisterInstancesWithForwardLBFourthListener", legacyTask)
+			api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(map[string]string{ServiceAnnotationLoadBalancerPortRanges: "true"},
+				fakeServicePort("a", 8000, v1.ProtocolTCP, 30000), fakeServicePort("b", 8001, v1.ProtocolTCP, 30001))
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+			err := cloud.ensureApplicationLoadBalancerBackends(context.Background(), "kubernetes", service, []*v1.Node{fakeNode("10.0.0.1")}, loadBalancer)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			registers := map[string]string{}
+			for _, call := range api.callsOf("clb.RegisterInstancesWithForwardLBFourthListener") {
+				registers[call.Get("listenerId")] = call.Get("backends.0.port")
+			}
+			if !reflect.DeepEqual(registers, test.wantRegisters) {
+				t.Errorf("registered node ports %v by listener, want %v", registers, test.wantRegisters)
+			}
+		})
+	}
+}
+
+func TestPlanLoadBalancerPortRanges(t *testing.T) {
+	service := fakeService(map[string]string{ServiceAnnotationLoadBalancerPortRanges: "true"},
+		fakeServicePort("a", 8000, v1.ProtocolTCP, 30000), fakeServicePort("b", 8001, v1.ProtocolTCP, 30001),
+		fakeServicePort("dns", 53, v1.ProtocolUDP, 30053))
+	plan, err := PlanLoadBalancer(Config{}, service, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []listenerPlan{
+		{Port: 8000, Protocol: v1.ProtocolTCP, NodePort: 30000, EndPort: 8001},
+		{Port: 53, Protocol: v1.ProtocolUDP, NodePort: 30053},
+	}
+	if !reflect.DeepEqual(plan.listeners, want) {
+		t.Errorf("listeners %+v, want %+v", plan.listeners, want)
+	}
+
+	service.Annotations[ServiceAnnotationLoadBalancerKind] = LoadBalancerKindClassic
+	if _, err := PlanLoadBalancer(Config{}, service, nil); err == nil || !strings.Contains(err.Error(), ServiceAnnotationLoadBalancerPortRanges) {
+		t.Errorf("classic loadbalancer planned with error %v, want the annotation to be unsupported", err)
+	}
+}
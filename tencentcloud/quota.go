@@ -0,0 +1,178 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// quotaCachePeriod is how long quota limits are remembered, they only change on request to the support.
+	quotaCachePeriod = 5 * time.Minute
+
+	// clbCreationSpacing is the time between clb creations while the quota is low, services waiting for
+	// their turn are retried by the service controller
+	clbCreationSpacing = 30 * time.Second
+
+	clbQuotaIdPublic  = "TOTAL_OPEN_CLB_QUOTA"
+	clbQuotaIdPrivate = "TOTAL_INTERNAL_CLB_QUOTA"
+)
+
+var (
+	clbQuotaUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: providerName,
+			Name:      "clb_quota_used",
+			Help:      "Clbs of the account by type, as of the last quota check.",
+		},
+		[]string{"type"},
+	)
+	clbQuotaLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: providerName,
+			Name:      "clb_quota_limit",
+			Help:      "Clb quota of the account by type, as of the last quota check.",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clbQuotaUsed)
+	prometheus.MustRegister(clbQuotaLimit)
+}
+
+type securityGroupLimits struct {
+	SecurityGroupLimit       int `json:"SecurityGroupLimit"`
+	SecurityGroupPolicyLimit int `json:"SecurityGroupPolicyLimit"`
+}
+
+// quotaCache remembers the quota limits of the account, so checking them before a write costs no api call.
+type quotaCache struct {
+	lock                    sync.Mutex
+	securityGroupLimits     *securityGroupLimits
+	securityGroupLimitsTime time.Time
+	// nextClbCreation is the earliest time the next clb may be created while the quota is low
+	nextClbCreation time.Time
+}
+
+// clbQuota is the usage of a clb quota of the account.
+type clbQuota struct {
+	Used  int
+	Limit int
+}
+
+func newQuotaCache() *quotaCache {
+	return &quotaCache{}
+}
+
+func (cloud *Cloud) getSecurityGroupLimits() (*securityGroupLimits, error) {
+	cloud.quotas.lock.Lock()
+	defer cloud.quotas.lock.Unlock()
+
+	if cloud.quotas.securityGroupLimits != nil && time.Since(cloud.quotas.securityGroupLimitsTime) < quotaCachePeriod {
+		return cloud.quotas.securityGroupLimits, nil
+	}
+	limits, err := cloud.describeSecurityGroupLimits()
+	if err != nil {
+		return nil, err
+	}
+	cloud.quotas.securityGroupLimits, cloud.quotas.securityGroupLimitsTime = limits, time.Now()
+	return limits, nil
+}
+
+// checkSecurityGroupQuota fails before a security group is created if the account has no security group left.
+// Quotas which can't be read are not checked, the write reports an exceeded quota itself.
+func (cloud *Cloud) checkSecurityGroupQuota() error {
+	limits, err := cloud.getSecurityGroupLimits()
+	if err != nil {
+		glog.V(4).Infof("failed to look up security group quota: %v", err)
+		return nil
+	}
+	used, err := cloud.countSecurityGroups()
+	if err != nil {
+		glog.V(4).Infof("failed to count security groups: %v", err)
+		return nil
+	}
+	if used+1 > limits.SecurityGroupLimit {
+		return errors.New(fmt.Sprintf("security group quota exceeded: %d of %d security groups used, 1 more needed", used, limits.SecurityGroupLimit))
+	}
+	return nil
+}
+
+// checkSecurityGroupPolicyQuota fails before the policies of a security group are replaced if there are more
+// than a security group can hold, for example because of too many source ranges.
+func (cloud *Cloud) checkSecurityGroupPolicyQuota(policies securityGroupPolicySet) error {
+	limits, err := cloud.getSecurityGroupLimits()
+	if err != nil {
+		glog.V(4).Infof("failed to look up security group quota: %v", err)
+		return nil
+	}
+	for direction, count := range map[string]int{"ingress": len(policies.Ingress), "egress": len(policies.Egress)} {
+		if count > limits.SecurityGroupPolicyLimit {
+			return errors.New(fmt.Sprintf("security group policy quota exceeded: %d %s policies needed, a security group holds %d",
+				count, direction, limits.SecurityGroupPolicyLimit))
+		}
+	}
+	return nil
+}
+
+// checkClbQuota fails before a clb of the type is created if the quota of the account is used up, and spaces out
+// creations while fewer clbs than clb_quota_headroom are left. Quotas which can't be read are not checked.
+func (cloud *Cloud) checkClbQuota(service *v1.Service, loadBalancerType string) error {
+	if cloud.config.ClbQuotaHeadroom == 0 {
+		return nil
+	}
+	quotaId := clbQuotaIdPublic
+	if loadBalancerType == LoadBalancerTypePrivate {
+		quotaId = clbQuotaIdPrivate
+	}
+	quotas, err := cloud.describeClbQuota()
+	if err != nil {
+		glog.V(4).Infof("failed to look up clb quota: %v", err)
+		return nil
+	}
+	for id, quota := range quotas {
+		switch id {
+		case clbQuotaIdPublic:
+			clbQuotaUsed.WithLabelValues(LoadBalancerTypePublic).Set(float64(quota.Used))
+			clbQuotaLimit.WithLabelValues(LoadBalancerTypePublic).Set(float64(quota.Limit))
+		case clbQuotaIdPrivate:
+			clbQuotaUsed.WithLabelValues(LoadBalancerTypePrivate).Set(float64(quota.Used))
+			clbQuotaLimit.WithLabelValues(LoadBalancerTypePrivate).Set(float64(quota.Limit))
+		}
+	}
+	quota, ok := quotas[quotaId]
+	if !ok {
+		return nil
+	}
+
+	left := quota.Limit - quota.Used
+	if left <= 0 {
+		return errors.New(fmt.Sprintf("%s clb quota exceeded: %d of %d clbs used, 1 more needed", loadBalancerType, quota.Used, quota.Limit))
+	}
+	if left >= cloud.config.ClbQuotaHeadroom {
+		return nil
+	}
+
+	cloud.quotas.lock.Lock()
+	wait := time.Until(cloud.quotas.nextClbCreation)
+	if wait <= 0 {
+		cloud.quotas.nextClbCreation = time.Now().Add(clbCreationSpacing)
+	}
+	cloud.quotas.lock.Unlock()
+
+	cloud.recorder.Eventf(service, v1.EventTypeWarning, "ClbQuotaLow",
+		"Only %d of %d %s clbs are left, clbs are created one per %s until the quota is raised", left, quota.Limit, loadBalancerType, clbCreationSpacing)
+	if wait > 0 {
+		return errors.New(fmt.Sprintf("%s clb quota is low, %d of %d clbs left, creation postponed for %s",
+			loadBalancerType, left, quota.Limit, wait.Truncate(time.Second)))
+	}
+	return nil
+}
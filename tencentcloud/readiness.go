@@ -0,0 +1,87 @@
+package tencentcloud
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+const clbCreateTimeLayout = "2006-01-02 15:04:05"
+
+// clbTimeZone is the zone the clb api reports times in
+var clbTimeZone = time.FixedZone("CST", 8*60*60)
+
+// loadBalancerNotReadyError withholds the vip of a new clb without backends, the service controller retries
+// the service until the clb has some or loadbalancer_ready_timeout passed.
+type loadBalancerNotReadyError struct {
+	loadBalancerId string
+	waited         time.Duration
+}
+
+func (e *loadBalancerNotReadyError) Error() string {
+	return fmt.Sprintf("loadbalancer %s has no backends registered yet after %s, its vip is published once it has",
+		e.loadBalancerId, e.waited.Truncate(time.Second))
+}
+
+// checkLoadBalancerReady fails until the clb of a service whose vip isn't published yet has a backend, so users
+// don't connect to a clb forwarding nowhere. After loadbalancer_ready_timeout since the clb was created the vip is
+// published anyway. Listeners exist once the clb is checked, they are ensured before.
+func (cloud *Cloud) checkLoadBalancerReady(service *v1.Service, loadBalancer *clb.LoadBalancer) error {
+	if cloud.config.LoadBalancerReadyTimeout == 0 || len(service.Status.LoadBalancer.Ingress) > 0 {
+		return nil
+	}
+	ready, err := cloud.loadBalancerHasBackends(loadBalancer)
+	if err != nil || ready {
+		return err
+	}
+	created, err := time.ParseInLocation(clbCreateTimeLayout, loadBalancer.CreateTime, clbTimeZone)
+	if err != nil {
+		glog.Warningf("not waiting for backends of loadbalancer %s, its creation time %q is unknown", loadBalancer.LoadBalancerId, loadBalancer.CreateTime)
+		return nil
+	}
+	waited := time.Since(created)
+	timeout := time.Duration(cloud.config.LoadBalancerReadyTimeout) * time.Second
+	if waited < timeout {
+		return &loadBalancerNotReadyError{loadBalancerId: loadBalancer.LoadBalancerId, waited: waited}
+	}
+	cloud.recorder.Eventf(service, v1.EventTypeWarning, "LoadBalancerNotReady",
+		"Publishing the vip of loadbalancer %s although it has no backends, loadbalancer_ready_timeout %s passed", loadBalancer.LoadBalancerId, timeout)
+	return nil
+}
+
+// loadBalancerHasBackends returns true if any listener of the clb has a backend, registered by instance or by ip.
+func (cloud *Cloud) loadBalancerHasBackends(loadBalancer *clb.LoadBalancer) (bool, error) {
+	if loadBalancer.Forward == ClbLoadBalancerKindClassic {
+		backends, err := cloud.describeLoadBalancerListenersBackends(loadBalancer.LoadBalancerId)
+		if err != nil {
+			return false, err
+		}
+		return len(backends) > 0, nil
+	}
+
+	response, err := cloud.clb.DescribeForwardLBBackends(&clb.DescribeForwardLBBackendsArgs{
+		LoadBalancerId: loadBalancer.LoadBalancerId,
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, listener := range response.Data {
+		if len(listener.Backends) > 0 {
+			return true, nil
+		}
+	}
+	targets, err := cloud.describeEniTargets(loadBalancer.LoadBalancerId)
+	if err != nil {
+		return false, err
+	}
+	for _, listenerTargets := range targets {
+		if len(listenerTargets) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package tencentcloud
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"k8s.io/api/core/v1"
+)
+
+func TestCheckLoadBalancerReady(t *testing.T) {
+	createdAgo := func(d time.Duration) string {
+		return time.Now().In(clbTimeZone).Add(-d).Format(clbCreateTimeLayout)
+	}
+	tests := []struct {
+		name       string
+		timeout    int
+		published  bool
+		createTime string
+		backends   []map[string]interface{}
+		// targets are the ips registered by DescribeTargets
+		targets    []string
+		wantCalls  []string
+		wantErr    bool
+		wantEvents []string
+	}{
+		{name: "readiness check disabled", createTime: createdAgo(time.Second)},
+		{name: "vip already published", timeout: 60, published: true, createTime: createdAgo(time.Second)},
+		{name: "backend registered by instance", timeout: 60, createTime: createdAgo(time.Second),
+			backends: []map[string]interface{}{fakeForwardBackend("ins-1", 30080)}, wantCalls: []string{"clb.DescribeForwardLBBackends"}},
+		{name: "backend registered by ip", timeout: 60, createTime: createdAgo(time.Second), targets: []string{"10.0.0.1"},
+			wantCalls: []string{"clb.DescribeForwardLBBackends", "clbv3.DescribeTargets"}},
+		{name: "new loadbalancer without backends", timeout: 60, createTime: createdAgo(time.Second),
+			wantCalls: []string{"clb.DescribeForwardLBBackends", "clbv3.DescribeTargets"}, wantErr: true},
+		{name: "timeout passed without backends", timeout: 60, createTime: createdAgo(time.Hour),
+			wantCalls: []string{"clb.DescribeForwardLBBackends", "clbv3.DescribeTargets"}, wantEvents: []string{"LoadBalancerNotReady"}},
+		{name: "creation time unknown", timeout: 60, createTime: "yesterday",
+			wantCalls: []string{"clb.DescribeForwardLBBackends", "clbv3.DescribeTargets"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+				fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP, test.backends...)))
+			api.handle("clbv3.DescribeTargets", func(url.Values) interface{} {
+				targets := []interface{}{}
+				for _, ip := range test.targets {
+					targets = append(targets, map[string]interface{}{"Type": clbTargetTypeEni, "Port": 30080, "PrivateIpAddresses": []string{ip}})
+				}
+				return v3Response(map[string]interface{}{"Listeners": []interface{}{
+					map[string]interface{}{"ListenerId": "lbl-80", "Targets": targets},
+				}})
+			})
+			cloud, recorder := newTestCloud(t, Config{LoadBalancerReadyTimeout: test.timeout}, api, nil)
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			if test.published {
+				service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+			}
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication, CreateTime: test.createTime}
+
+			err := cloud.checkLoadBalancerReady(service, loadBalancer)
+
+			if _, ok := err.(*loadBalancerNotReadyError); ok != test.wantErr || (!ok && err != nil) {
+				t.Errorf("checkLoadBalancerReady = %v, want a not ready error: %t", err, test.wantErr)
+			}
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %v", got, test.wantCalls)
+			}
+			events := drainEvents(recorder)
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("events %v, want %v", events, test.wantEvents)
+			}
+			for i, event := range events {
+				if !strings.Contains(event, test.wantEvents[i]) {
+					t.Errorf("event %q, want %s", event, test.wantEvents[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package tencentcloud
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+const (
+	regionEnv = "TENCENTCLOUD_CLOUD_CONTROLLER_MANAGER_REGION"
+)
+
+var (
+	regionFlag              = flag.String("tencentcloud-region", "", "Region of the tencentcloud apis, overrides the region of the cloud config and of the metadata service.")
+	allowRegionMismatchFlag = flag.Bool("tencentcloud-allow-region-mismatch", false, "Use the given region even if the metadata service reports the controller manager runs in another one.")
+)
+
+// resolveRegion returns the region of the apis. The --tencentcloud-region flag wins over the region of the cloud
+// config, which wins over the region environment variable, which wins over the region the metadata service
+// reports. A region given which differs from the metadata service's is most likely a mistake, as the nodes of
+// the cluster would be looked up in the wrong region, and is refused unless the mismatch is allowed.
+func resolveRegion(configRegion string, node *localNode) (string, error) {
+	metadataRegion, metadataErr := node.getRegion()
+
+	region, source := "", ""
+	for _, candidate := range []struct{ region, source string }{
+		{*regionFlag, "flag --tencentcloud-region"},
+		{configRegion, "cloud config"},
+		{os.Getenv(regionEnv), "environment variable " + regionEnv},
+	} {
+		if candidate.region != "" {
+			region, source = candidate.region, candidate.source
+			break
+		}
+	}
+
+	if region == "" {
+		if metadataErr != nil {
+			return "", errors.New(fmt.Sprintf("no region given by flag --tencentcloud-region, cloud config or environment variable %s, and the metadata service can't tell it: %v",
+				regionEnv, metadataErr))
+		}
+		glog.Infof("using region %s of the metadata service", metadataRegion)
+		return metadataRegion, nil
+	}
+
+	if metadataErr == nil && metadataRegion != region {
+		if !*allowRegionMismatchFlag {
+			return "", errors.New(fmt.Sprintf("region %s of %s differs from region %s of the metadata service, pass --tencentcloud-allow-region-mismatch to use it anyway",
+				region, source, metadataRegion))
+		}
+		glog.Warningf("using region %s of %s, the metadata service reports region %s", region, source, metadataRegion)
+		return region, nil
+	}
+	glog.Infof("using region %s of %s", region, source)
+	return region, nil
+}
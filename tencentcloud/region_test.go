@@ -0,0 +1,55 @@
+package tencentcloud
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolveRegion(t *testing.T) {
+	tests := []struct {
+		name          string
+		flag          string
+		config        string
+		env           string
+		metadata      string
+		allowMismatch bool
+		want          string
+		wantErr       bool
+	}{
+		{name: "flag wins", flag: "ap-shanghai", config: "ap-beijing", env: "ap-chengdu", metadata: "ap-shanghai", want: "ap-shanghai"},
+		{name: "cloud config wins over the environment", config: "ap-beijing", env: "ap-chengdu", metadata: "ap-beijing", want: "ap-beijing"},
+		{name: "environment wins over the metadata service", env: "ap-chengdu", metadata: "ap-chengdu", want: "ap-chengdu"},
+		{name: "metadata service", metadata: "ap-guangzhou", want: "ap-guangzhou"},
+		{name: "given without metadata service", config: "ap-beijing", want: "ap-beijing"},
+		{name: "no region", wantErr: true},
+		{name: "mismatch refused", config: "ap-beijing", metadata: "ap-guangzhou", wantErr: true},
+		{name: "mismatch allowed", flag: "ap-beijing", metadata: "ap-guangzhou", allowMismatch: true, want: "ap-beijing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := map[string]string{}
+			if test.metadata != "" {
+				values["placement/region"] = test.metadata
+			}
+			fake := newFakeMetadata(values)
+			defer fake.close()
+			flag, allowMismatch := *regionFlag, *allowRegionMismatchFlag
+			defer func() { *regionFlag, *allowRegionMismatchFlag = flag, allowMismatch }()
+			*regionFlag, *allowRegionMismatchFlag = test.flag, test.allowMismatch
+			env := os.Getenv(regionEnv)
+			defer os.Setenv(regionEnv, env)
+			os.Setenv(regionEnv, test.env)
+
+			region, err := resolveRegion(test.config, fake.localNode())
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("resolveRegion = %s, want an error", region)
+				}
+				return
+			}
+			if err != nil || region != test.want {
+				t.Errorf("resolveRegion = %s, %v, want %s", region, err, test.want)
+			}
+		})
+	}
+}
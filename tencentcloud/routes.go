@@ -28,6 +28,9 @@ func (cloud *Cloud) ListRoutes(ctx context.Context, clusterName string) ([]*clou
 // route.Name will be ignored, although the cloud-provider may use nameHint
 // to create a more user-meaningful name.
 func (cloud *Cloud) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	if cloud.pause.isPaused() {
+		return ErrCloudPaused
+	}
 	_, err := cloud.ccs.CreateClusterRoute(&ccs.CreateClusterRouteArgs{
 		RouteTableName:       cloud.config.ClusterRouteTable,
 		GatewayIp:            string(route.TargetNode),
@@ -40,6 +43,9 @@ func (cloud *Cloud) CreateRoute(ctx context.Context, clusterName string, nameHin
 // DeleteRoute deletes the specified managed route
 // Route should be as returned by ListRoutes
 func (cloud *Cloud) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	if cloud.pause.isPaused() {
+		return ErrCloudPaused
+	}
 	_, err := cloud.ccs.DeleteClusterRoute(&ccs.DeleteClusterRouteArgs{
 		RouteTableName:       cloud.config.ClusterRouteTable,
 		GatewayIp:            string(route.TargetNode),
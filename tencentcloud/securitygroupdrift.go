@@ -0,0 +1,128 @@
+package tencentcloud
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// securityGroupDriftSyncPeriod is how often the security groups of source ranges are compared with their services.
+const securityGroupDriftSyncPeriod = 10 * time.Minute
+
+// runSecurityGroupDriftSync repairs the security groups created for loadBalancerSourceRanges after they were
+// edited or unbound in the console, which silently widens or breaks access to the clb. The service controller
+// only ensures them when the service changes.
+func (cloud *Cloud) runSecurityGroupDriftSync() {
+	wait.Until(cloud.syncSecurityGroupDrift, securityGroupDriftSyncPeriod, wait.NeverStop)
+}
+
+func (cloud *Cloud) syncSecurityGroupDrift() {
+	if cloud.pause.isPaused() {
+		return
+	}
+	services, err := cloud.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list services for security group drift sync: %v", err)
+		return
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer || len(service.Status.LoadBalancer.Ingress) == 0 {
+			continue
+		}
+		if len(sourceRangeEntries(service)) == 0 || len(unmanagedProtocols(cloud.config, service)) > 0 {
+			continue
+		}
+		withPorts, _, _, err := portGroupServices(service)
+		if err != nil {
+			continue
+		}
+		unlock := cloud.serviceLocks.lockService(service)
+		for _, view := range withPorts {
+			if err := cloud.repairSecurityGroupDrift(view); err != nil {
+				glog.Errorf("failed to repair the security group of service %s/%s: %v", service.Namespace, service.Name, err)
+			}
+		}
+		unlock()
+	}
+}
+
+// repairSecurityGroupDrift restores the policies of the security group of the clb of the service, and binds it
+// again if it was unbound. Clbs and groups not created yet are left to the service controller.
+func (cloud *Cloud) repairSecurityGroupDrift(service *v1.Service) error {
+	loadBalancerName := loadBalancerSpecial(service)
+	// drift is looked for in what the api reports now
+	cloud.loadBalancerCache.forget(loadBalancerName)
+	owned, err := cloud.getOwnedSecurityGroups(loadBalancerName)
+	if err != nil || len(owned) == 0 {
+		return err
+	}
+	loadBalancer, err := cloud.getLoadBalancerByName(loadBalancerName)
+	if err != nil {
+		if err == ErrCloudLoadBalancerNotFound {
+			return nil
+		}
+		return err
+	}
+
+	securityGroupId := owned[0].SecurityGroupId
+	cidrs, _, _ := parseLoadBalancerSourceRanges(service)
+	desired := sourceRangePolicies(cidrs, service.Spec.Ports)
+	current, err := cloud.describeSecurityGroupPolicies(securityGroupId)
+	if err != nil {
+		return err
+	}
+
+	fixed := []string{}
+	for _, direction := range []struct {
+		name             string
+		current, desired []securityGroupPolicy
+	}{
+		{"ingress", current.Ingress, desired.Ingress},
+		{"egress", current.Egress, desired.Egress},
+	} {
+		missing, unwanted := diffSecurityGroupPolicies(direction.current, direction.desired)
+		if len(missing) > 0 {
+			fixed = append(fixed, fmt.Sprintf("restored %s policies %s", direction.name, strings.Join(missing, ", ")))
+		}
+		if len(unwanted) > 0 {
+			fixed = append(fixed, fmt.Sprintf("removed %s policies %s", direction.name, strings.Join(unwanted, ", ")))
+		}
+	}
+	if len(fixed) > 0 {
+		if err := cloud.modifySecurityGroupPolicies(securityGroupId, desired); err != nil {
+			return err
+		}
+	}
+
+	bound, err := cloud.describeLoadBalancerSecurityGroups(loadBalancer.LoadBalancerId)
+	if err != nil {
+		return err
+	}
+	isBound := false
+	for _, id := range bound {
+		if id == securityGroupId {
+			isBound = true
+		}
+	}
+	if !isBound {
+		if err := cloud.setLoadBalancerSecurityGroups(loadBalancer.LoadBalancerId, append(bound, securityGroupId)); err != nil {
+			return err
+		}
+		fixed = append(fixed, fmt.Sprintf("bound it to loadbalancer %s again", loadBalancer.LoadBalancerId))
+	}
+
+	if len(fixed) == 0 {
+		return nil
+	}
+	glog.Infof("repaired security group %s of loadbalancer %s: %s", securityGroupId, loadBalancerName, strings.Join(fixed, "; "))
+	cloud.recorder.Eventf(service, v1.EventTypeWarning, "SecurityGroupDriftRepaired",
+		"Security group %s was changed outside of the service, %s", securityGroupId, strings.Join(fixed, "; "))
+	return nil
+}
@@ -0,0 +1,49 @@
+package tencentcloud
+
+import (
+	"sync"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// serviceLocks serializes the mutations of the clb of each service. The service controller syncs
+// a service from one worker at a time, but node updates and the backend sync run beside it.
+type serviceLocks struct {
+	lock  sync.Mutex
+	locks map[types.UID]*serviceLock
+}
+
+type serviceLock struct {
+	sync.Mutex
+	// users counts the holders and waiters of the lock, it is dropped once nobody uses it
+	users int
+}
+
+func newServiceLocks() *serviceLocks {
+	return &serviceLocks{locks: map[types.UID]*serviceLock{}}
+}
+
+// lockService waits until no other mutation of the clb of the service runs, the returned function releases the lock.
+func (locks *serviceLocks) lockService(service *v1.Service) func() {
+	locks.lock.Lock()
+	lock, ok := locks.locks[service.UID]
+	if !ok {
+		lock = &serviceLock{}
+		locks.locks[service.UID] = lock
+	}
+	lock.users++
+	locks.lock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		locks.lock.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(locks.locks, service.UID)
+		}
+		locks.lock.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package tencentcloud
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestLockService(t *testing.T) {
+	locks := newServiceLocks()
+	service := fakeService(nil)
+	other := fakeService(nil)
+	other.UID = types.UID("uid-other")
+
+	holders := &concurrency{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lockService(service)
+			defer unlock()
+			holders.during(10 * time.Millisecond)
+		}()
+	}
+
+	// other services aren't held up
+	unlock := locks.lockService(service)
+	done := make(chan struct{})
+	go func() {
+		locks.lockService(other)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("lock of another service waited for the lock of the service")
+	}
+	unlock()
+
+	wg.Wait()
+	if holders.max != 1 {
+		t.Errorf("%d holders of the lock at once, want 1", holders.max)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after every holder released them, want 0", len(locks.locks))
+	}
+}
+
+func TestConcurrentReconcilesSerialized(t *testing.T) {
+	api := newFakeApi(t)
+	defer api.close()
+	lookups := &concurrency{}
+	api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+		lookups.during(50 * time.Millisecond)
+		return legacyResponse(map[string]interface{}{"totalCount": 0, "loadBalancerSet": []interface{}{}})
+	})
+	api.handle("vpc.DescribeSecurityGroups", func(url.Values) interface{} {
+		return v3Response(map[string]interface{}{"TotalCount": 0, "SecurityGroupSet": []interface{}{}})
+	})
+	cloud, _ := newTestCloud(t, Config{}, api, nil)
+	service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cloud.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", service); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(api.callsOf("clb.DescribeLoadBalancers")); n != 4 {
+		t.Errorf("%d clb lookups, want 4", n)
+	}
+	if lookups.max != 1 {
+		t.Errorf("%d reconciles of the service ran at once, want 1", lookups.max)
+	}
+}
+
+// concurrency tracks the most callers of during at once.
+type concurrency struct {
+	lock    sync.Mutex
+	current int
+	max     int
+}
+
+func (c *concurrency) during(d time.Duration) {
+	c.lock.Lock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.lock.Unlock()
+
+	time.Sleep(d)
+
+	c.lock.Lock()
+	c.current--
+	c.lock.Unlock()
+}
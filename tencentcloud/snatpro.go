@@ -0,0 +1,217 @@
+package tencentcloud
+
+import (
+	"context"
+	"sort"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// snat pro lets an application clb forward to backends outside of its vpc, like nodes in a vpc joined
+// through ccn. Those are registered by their private ip and reached from snat ips allocated in a subnet
+// of the vpc of the clb. With backend_registration eni the nodes of the vpc of the cluster are registered
+// by their private ip as well.
+
+const (
+	clbTargetTypeEni = "ENI"
+
+	// BackendRegistrationInstance registers nodes by instance id, which survives changes of their ips
+	BackendRegistrationInstance = "instance"
+	// BackendRegistrationEni registers nodes by the private ip of their primary eni, for direct pod and eni setups
+	BackendRegistrationEni = "eni"
+)
+
+// registersByEni returns true if the nodes in the vpc of the cluster are registered with the clb by ip.
+// Classic clbs can only register them by instance id.
+func (cloud *Cloud) registersByEni(loadBalancer *clb.LoadBalancer) bool {
+	return cloud.config.BackendRegistration == BackendRegistrationEni && loadBalancer.Forward != ClbLoadBalancerKindClassic
+}
+
+// backendInstances splits the instances into those registered by instance id and those registered by ip. Instances
+// outside of the vpc of the cluster are registered by ip through snat pro, those of the vpc by instance id unless
+// registersByEni. Instances which can't be registered are reported by an event each.
+func (cloud *Cloud) backendInstances(service *v1.Service, loadBalancer *clb.LoadBalancer, instances []cvm.InstanceInfo) (byId []cvm.InstanceInfo, byIp []cvm.InstanceInfo) {
+	snatPro := service.Annotations[ServiceAnnotationLoadBalancerSnatProSubnetId] != ""
+	eni := cloud.registersByEni(loadBalancer)
+	for _, instance := range instances {
+		if instance.VirtualPrivateCloud.VpcID == cloud.config.VpcId {
+			switch {
+			case !eni:
+				byId = append(byId, instance)
+			case len(instance.PrivateIPAddresses) == 0:
+				cloud.recorder.Eventf(service, v1.EventTypeWarning, "NodeWithoutIp",
+					"Not registering instance %s by ip, it has no private ip", instance.InstanceID)
+			default:
+				byIp = append(byIp, instance)
+			}
+			continue
+		}
+		switch {
+		case loadBalancer.Forward == ClbLoadBalancerKindClassic:
+			cloud.recorder.Eventf(service, v1.EventTypeWarning, "ForeignVpcNode",
+				"Not registering instance %s, it is in vpc %s and classic loadbalancers can't forward out of vpc %s",
+				instance.InstanceID, instance.VirtualPrivateCloud.VpcID, cloud.config.VpcId)
+		case !snatPro:
+			cloud.recorder.Eventf(service, v1.EventTypeWarning, "ForeignVpcNode",
+				"Not registering instance %s, it is in vpc %s rather than %s, set annotation %s to register it through SNAT Pro",
+				instance.InstanceID, instance.VirtualPrivateCloud.VpcID, cloud.config.VpcId, ServiceAnnotationLoadBalancerSnatProSubnetId)
+		case len(instance.PrivateIPAddresses) == 0:
+			cloud.recorder.Eventf(service, v1.EventTypeWarning, "ForeignVpcNode",
+				"Not registering instance %s of vpc %s, it has no private ip", instance.InstanceID, instance.VirtualPrivateCloud.VpcID)
+		default:
+			byIp = append(byIp, instance)
+		}
+	}
+	return byId, byIp
+}
+
+// eniTargetsPlan is the change of the backends of a clb registered by ip, by listener id. The targets to add are
+// registered before the backends registered by instance id are deregistered, the targets to delete after, so
+// switching the backend registration never leaves a listener without backends.
+type eniTargetsPlan struct {
+	toAdd    map[string][]eniTarget
+	toDelete map[string][]eniTarget
+	// snatIpsToRelease are released once the targets are deleted
+	snatIpsToRelease []string
+}
+
+// planEniTargets plans the backends registered by ip of the listeners of the service ports, enabling snat pro and
+// allocating a snat ip first if the service asks for it. Without the annotation the snat ips are released again.
+// listenerIds are the listeners of the service ports by listenerKey, registeredByIp tells whether any listener of
+// the clb has backends registered by ip.
+func (cloud *Cloud) planEniTargets(ctx context.Context, service *v1.Service, loadBalancer *clb.LoadBalancer, listenerIds map[string]string, byIp []cvm.InstanceInfo, registeredByIp bool) (*eniTargetsPlan, error) {
+	plan := &eniTargetsPlan{toAdd: map[string][]eniTarget{}, toDelete: map[string][]eniTarget{}}
+	subnetId := service.Annotations[ServiceAnnotationLoadBalancerSnatProSubnetId]
+	needed := subnetId != "" || len(byIp) > 0 || registeredByIp
+
+	snatPro, snatIps, err := cloud.describeLoadBalancerSnatIps(ctx, loadBalancer.LoadBalancerId)
+	if err != nil {
+		if !needed {
+			// accounts not registering backends by ip may not be allowed to use the clb v3 api
+			glog.V(4).Infof("failed to look up snat ips of loadbalancer %s: %v", loadBalancer.LoadBalancerId, err)
+			return plan, nil
+		}
+		return nil, err
+	}
+	if !needed && !snatPro && len(snatIps) == 0 {
+		return plan, nil
+	}
+
+	if subnetId != "" {
+		if !snatPro {
+			if err := cloud.enableLoadBalancerSnatPro(ctx, loadBalancer.LoadBalancerId); err != nil {
+				return nil, err
+			}
+			glog.Infof("enabled snat pro on loadbalancer %s", loadBalancer.LoadBalancerId)
+		}
+		allocated := false
+		for _, snatIp := range snatIps {
+			if snatIp.SubnetId == subnetId {
+				allocated = true
+			}
+		}
+		if !allocated {
+			if err := cloud.createLoadBalancerSnatIp(ctx, loadBalancer.LoadBalancerId, subnetId); err != nil {
+				return nil, err
+			}
+			glog.Infof("allocated a snat ip in subnet %s for loadbalancer %s", subnetId, loadBalancer.LoadBalancerId)
+		}
+	}
+
+	current, err := cloud.describeEniTargets(loadBalancer.LoadBalancerId)
+	if err != nil {
+		return nil, err
+	}
+	for _, port := range service.Spec.Ports {
+		listenerId := listenerIds[listenerKey(port)]
+		if listenerId == "" {
+			continue
+		}
+		desired := []eniTarget{}
+		for _, instance := range byIp {
+			desired = append(desired, eniTarget{EniIp: instance.PrivateIPAddresses[0], Port: int(port.NodePort)})
+		}
+		if toAdd := eniTargetsDifference(desired, current[listenerId]); len(toAdd) > 0 {
+			plan.toAdd[listenerId] = toAdd
+		}
+		if toDelete := eniTargetsDifference(current[listenerId], desired); len(toDelete) > 0 {
+			plan.toDelete[listenerId] = toDelete
+		}
+	}
+
+	// the clb is ours, so are the snat ips on it. They are released with the clb otherwise.
+	if subnetId == "" {
+		for _, snatIp := range snatIps {
+			plan.snatIpsToRelease = append(plan.snatIpsToRelease, snatIp.Ip)
+		}
+	}
+	return plan, nil
+}
+
+// registerEniTargetsOfPlan registers the targets the plan adds.
+func (cloud *Cloud) registerEniTargetsOfPlan(ctx context.Context, loadBalancer *clb.LoadBalancer, plan *eniTargetsPlan) error {
+	return cloud.applyEniTargets(ctx, loadBalancer.LoadBalancerId, plan.toAdd, cloud.registerEniTargets)
+}
+
+// deregisterEniTargetsOfPlan deregisters the targets the plan deletes and releases the snat ips no longer used.
+func (cloud *Cloud) deregisterEniTargetsOfPlan(ctx context.Context, loadBalancer *clb.LoadBalancer, plan *eniTargetsPlan) error {
+	if err := cloud.applyEniTargets(ctx, loadBalancer.LoadBalancerId, plan.toDelete, cloud.deregisterEniTargets); err != nil {
+		return err
+	}
+	if len(plan.snatIpsToRelease) > 0 {
+		if err := cloud.deleteLoadBalancerSnatIps(ctx, loadBalancer.LoadBalancerId, plan.snatIpsToRelease); err != nil {
+			return err
+		}
+		glog.Infof("released snat ips %v of loadbalancer %s", plan.snatIpsToRelease, loadBalancer.LoadBalancerId)
+	}
+	return nil
+}
+
+// applyEniTargets registers or deregisters the targets by listener id, in chunks like the backends registered
+// by instance id.
+func (cloud *Cloud) applyEniTargets(ctx context.Context, loadBalancerId string, targets map[string][]eniTarget,
+	apply func(ctx context.Context, loadBalancerId string, listenerId string, targets []eniTarget) error) error {
+	listenerIds := make([]string, 0, len(targets))
+	for listenerId := range targets {
+		listenerIds = append(listenerIds, listenerId)
+	}
+	sort.Strings(listenerIds)
+
+	for _, listenerId := range listenerIds {
+		listenerTargets := targets[listenerId]
+		for start := 0; start < len(listenerTargets); start += maxBackendsPerRequest {
+			if err := apply(ctx, loadBalancerId, listenerId, listenerTargets[start:backendsChunkEnd(start, len(listenerTargets))]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eniTargetsDifference returns the targets of a missing from b, sorted by ip and port.
+func eniTargetsDifference(a []eniTarget, b []eniTarget) []eniTarget {
+	difference := []eniTarget{}
+	for _, target := range a {
+		found := false
+		for _, other := range b {
+			if target == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			difference = append(difference, target)
+		}
+	}
+	sort.Slice(difference, func(i, j int) bool {
+		if difference[i].EniIp != difference[j].EniIp {
+			return difference[i].EniIp < difference[j].EniIp
+		}
+		return difference[i].Port < difference[j].Port
+	})
+	return difference
+}
@@ -0,0 +1,172 @@
+package tencentcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestEnsureApplicationLoadBalancerBackendsRegistration(t *testing.T) {
+	eniTarget := map[string]interface{}{"Type": clbTargetTypeEni, "Port": 30080, "PrivateIpAddresses": []string{"10.0.0.1"}}
+	tests := []struct {
+		name         string
+		registration string
+		backends     []map[string]interface{}
+		targets      []map[string]interface{}
+		wantCalls    []string
+	}{
+		{
+			name: "registered by instance id",
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends", "clb.RegisterInstancesWithForwardLBFourthListener",
+				"clbv3.DescribeLoadBalancers"},
+		},
+		{
+			name:         "registered by ip",
+			registration: BackendRegistrationEni,
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends", "clbv3.DescribeLoadBalancers", "clbv3.DescribeTargets",
+				"clbv3.RegisterTargets", "clbv3.DescribeTaskStatus"},
+		},
+		{
+			name:         "switched to registration by ip",
+			registration: BackendRegistrationEni,
+			backends:     []map[string]interface{}{fakeForwardBackend("ins-1", 30080)},
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends", "clbv3.DescribeLoadBalancers", "clbv3.DescribeTargets",
+				"clbv3.RegisterTargets", "clbv3.DescribeTaskStatus", "clb.DeregisterInstancesFromForwardLBFourthListener"},
+		},
+		{
+			name:         "switched to registration by instance id",
+			registration: BackendRegistrationInstance,
+			backends:     []map[string]interface{}{fakeForwardBackend("", 30080)},
+			targets:      []map[string]interface{}{eniTarget},
+			wantCalls: []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends", "clb.RegisterInstancesWithForwardLBFourthListener",
+				"clbv3.DescribeLoadBalancers", "clbv3.DescribeTargets", "clbv3.DeregisterTargets", "clbv3.DescribeTaskStatus"},
+		},
+		{
+			name:         "registered by ip already",
+			registration: BackendRegistrationEni,
+			backends:     []map[string]interface{}{fakeForwardBackend("", 30080)},
+			targets:      []map[string]interface{}{eniTarget},
+			wantCalls:    []string{"cvmv3.DescribeInstances", "clb.DescribeForwardLBBackends", "clbv3.DescribeLoadBalancers", "clbv3.DescribeTargets"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+				fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP, test.backends...)))
+			api.handle("clb.RegisterInstancesWithForwardLBFourthListener", legacyTask)
+			api.handle("clb.DeregisterInstancesFromForwardLBFourthListener", legacyTask)
+			api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+			api.handle("clbv3.DescribeTargets", func(url.Values) interface{} {
+				return v3Response(map[string]interface{}{"Listeners": []map[string]interface{}{{"ListenerId": "lbl-80", "Targets": test.targets}}})
+			})
+			api.handle("clbv3.RegisterTargets", v3Task)
+			api.handle("clbv3.DeregisterTargets", v3Task)
+			api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+			cloud, _ := newTestCloud(t, Config{BackendRegistration: test.registration}, api, nil)
+
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+			if err := cloud.ensureApplicationLoadBalancerBackends(context.Background(), "kubernetes", service, []*v1.Node{fakeNode("10.0.0.1")}, loadBalancer); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := strings.Join(api.actions(), ","); got != strings.Join(test.wantCalls, ",") {
+				t.Errorf("calls %s, want %s", got, strings.Join(test.wantCalls, ","))
+			}
+			for _, action := range []string{"clbv3.RegisterTargets", "clbv3.DeregisterTargets"} {
+				for _, call := range api.callsOf(action) {
+					if call.Get("ListenerId") != "lbl-80" || call.Get("Targets.0.EniIp") != "10.0.0.1" || call.Get("Targets.0.Port") != "30080" ||
+						call.Get("Targets.1.EniIp") != "" {
+						t.Errorf("%s with %v, want 10.0.0.1:30080 of lbl-80", action, call)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBackendInstancesRegistration(t *testing.T) {
+	instances := []map[string]interface{}{
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil),
+		fakeInstance("ins-2", "ap-guangzhou-3", "vpc-test", nil, nil),
+	}
+	tests := []struct {
+		name         string
+		registration string
+		forward      int
+		wantById     int
+		wantByIp     int
+		wantEvents   int
+	}{
+		{"instance id on application clbs", BackendRegistrationInstance, ClbLoadBalancerKindApplication, 2, 0, 0},
+		{"ip on application clbs", BackendRegistrationEni, ClbLoadBalancerKindApplication, 0, 1, 1},
+		{"instance id on classic clbs", BackendRegistrationEni, ClbLoadBalancerKindClassic, 2, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("cvm.DescribeInstances", describeInstancesResult(instances...))
+			cloud, recorder := newTestCloud(t, Config{BackendRegistration: test.registration}, api, nil)
+			response, err := describeInstances(context.Background(), cloud.cvm, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			byId, byIp := cloud.backendInstances(fakeService(nil), &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: test.forward}, response.InstanceSet)
+			if len(byId) != test.wantById || len(byIp) != test.wantByIp {
+				t.Errorf("%d instances by id and %d by ip, want %d and %d", len(byId), len(byIp), test.wantById, test.wantByIp)
+			}
+			if events := drainEvents(recorder); len(events) != test.wantEvents {
+				t.Errorf("events %v, want %d", events, test.wantEvents)
+			}
+		})
+	}
+}
+
+// TestEnsureApplicationLoadBalancerBackendsSamePortNumber registers the targets of a TCP and a UDP port with the
+// same number with their own listeners.
+func TestEnsureApplicationLoadBalancerBackendsSamePortNumber(t *testing.T) {
+	api := newFakeApi(t)
+	defer api.close()
+	api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+		fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+	api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+		fakeForwardListener("lbl-tcp", 80, ClbLoadBalancerListenerProtocolTCP),
+		fakeForwardListener("lbl-udp", 80, ClbLoadBalancerListenerProtocolUDP)))
+	api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+	api.handle("clbv3.DescribeTargets", func(url.Values) interface{} {
+		return v3Response(map[string]interface{}{"Listeners": []map[string]interface{}{}})
+	})
+	api.handle("clbv3.RegisterTargets", v3Task)
+	api.handle("clbv3.DescribeTaskStatus", v3TaskSucceeded)
+	cloud, _ := newTestCloud(t, Config{BackendRegistration: BackendRegistrationEni}, api, nil)
+
+	service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080), fakeServicePort("dns", 80, v1.ProtocolUDP, 30053))
+	loadBalancer := &clb.LoadBalancer{LoadBalancerId: "lb-1", Forward: ClbLoadBalancerKindApplication}
+	if err := cloud.ensureApplicationLoadBalancerBackends(context.Background(), "kubernetes", service, []*v1.Node{fakeNode("10.0.0.1")}, loadBalancer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	registered := []string{}
+	for _, call := range api.callsOf("clbv3.RegisterTargets") {
+		for i := 0; call.Get(fmt.Sprintf("Targets.%d.EniIp", i)) != ""; i++ {
+			registered = append(registered, fmt.Sprintf("%s %s:%s", call.Get("ListenerId"),
+				call.Get(fmt.Sprintf("Targets.%d.EniIp", i)), call.Get(fmt.Sprintf("Targets.%d.Port", i))))
+		}
+	}
+	want := []string{"lbl-tcp 10.0.0.1:30080", "lbl-udp 10.0.0.1:30053"}
+	if strings.Join(registered, ",") != strings.Join(want, ",") {
+		t.Errorf("registered targets %v, want %v", registered, want)
+	}
+}
@@ -0,0 +1,361 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// securityGroupDescriptionPrefix marks the security groups created for loadBalancerSourceRanges,
+	// groups of the same name created by hand are never touched.
+	securityGroupDescriptionPrefix = eventSourceComponent + ": "
+
+	// TagKeyLoadBalancerSecurityGroup marks security groups created by the provider, the value is the name of the clb
+	// the group is created for
+	TagKeyLoadBalancerSecurityGroup = "tencentcloud-cloud-controller-manager/loadbalancer"
+
+	securityGroupPolicyAll    = "ALL"
+	securityGroupPolicyAccept = "ACCEPT"
+)
+
+// sourceRange is a normalized entry of loadBalancerSourceRanges together with the entry as written.
+type sourceRange struct {
+	entry string
+	cidr  *net.IPNet
+}
+
+// loadBalancerSourceRanges returns the normalized cidrs of loadBalancerSourceRanges, falling back to
+// the source ranges annotation like kubernetes does. Bare ips are turned into /32 cidrs. Malformed,
+// duplicate and overlapped entries are reported through events and skipped. The clbs created by the
+// provider are ipv4 only, so ipv6 ranges are reported and skipped as well.
+//
+// restricted is true if any source range is given, even if none of them is usable. Access is denied
+// to everybody then instead of silently opening the clb to the world.
+func (cloud *Cloud) loadBalancerSourceRanges(service *v1.Service) (cidrs []string, restricted bool) {
+	cidrs, restricted, ignored := parseLoadBalancerSourceRanges(service)
+	for _, reason := range ignored {
+		cloud.recorder.Eventf(service, v1.EventTypeWarning, "InvalidLoadBalancerSourceRange", "Ignoring %s", reason)
+	}
+	return cidrs, restricted
+}
+
+// parseLoadBalancerSourceRanges is loadBalancerSourceRanges without events, the entries skipped are described
+// by ignored.
+func parseLoadBalancerSourceRanges(service *v1.Service) (cidrs []string, restricted bool, ignored []string) {
+	entries := sourceRangeEntries(service)
+	restricted = len(entries) > 0
+
+	ranges := []sourceRange{}
+	seen := map[string]string{}
+	for _, entry := range entries {
+		cidr, err := parseSourceRange(entry)
+		if err != nil {
+			ignored = append(ignored, fmt.Sprintf("source range %q: %v", entry, err))
+			continue
+		}
+		if cidr.IP.To4() == nil {
+			ignored = append(ignored, fmt.Sprintf("ipv6 source range %q, the loadbalancer is not dual stack", entry))
+			continue
+		}
+		if first, ok := seen[cidr.String()]; ok {
+			ignored = append(ignored, fmt.Sprintf("source range %q, it duplicates %q", entry, first))
+			continue
+		}
+		seen[cidr.String()] = entry
+		ranges = append(ranges, sourceRange{entry: entry, cidr: cidr})
+	}
+
+	for _, r := range ranges {
+		if covering := coveringSourceRange(r, ranges); covering != nil {
+			ignored = append(ignored, fmt.Sprintf("source range %q, it is covered by %q", r.entry, covering.entry))
+			continue
+		}
+		cidrs = append(cidrs, r.cidr.String())
+	}
+	return cidrs, restricted, ignored
+}
+
+// sourceRangeEntries returns the non empty source ranges of the service as written.
+func sourceRangeEntries(service *v1.Service) []string {
+	values := service.Spec.LoadBalancerSourceRanges
+	if len(values) == 0 {
+		if value, ok := service.Annotations[v1.AnnotationLoadBalancerSourceRangesKey]; ok {
+			values = strings.Split(value, ",")
+		}
+	}
+	entries := []string{}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			entries = append(entries, value)
+		}
+	}
+	return entries
+}
+
+// parseSourceRange parses a cidr, or a bare ip as a single address cidr.
+func parseSourceRange(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, errors.New("not an ip address or cidr")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, cidr, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, errors.New("not an ip address or cidr")
+	}
+	return cidr, nil
+}
+
+// coveringSourceRange returns another range of ranges containing r, if any.
+func coveringSourceRange(r sourceRange, ranges []sourceRange) *sourceRange {
+	ones, _ := r.cidr.Mask.Size()
+	for i := range ranges {
+		if ranges[i].cidr.String() == r.cidr.String() {
+			continue
+		}
+		otherOnes, _ := ranges[i].cidr.Mask.Size()
+		if otherOnes <= ones && ranges[i].cidr.Contains(r.cidr.IP) {
+			return &ranges[i]
+		}
+	}
+	return nil
+}
+
+// sourceRangePolicies returns the security group policies admitting the cidrs to the listeners of the ports only.
+// Traffic not accepted by a policy is dropped by security groups. A policy per protocol lists all ports of the
+// protocol, so the policies grow with the source ranges only.
+func sourceRangePolicies(cidrs []string, ports []v1.ServicePort) securityGroupPolicySet {
+	policies := securityGroupPolicySet{
+		Egress: []securityGroupPolicy{{
+			Protocol:  securityGroupPolicyAll,
+			Port:      securityGroupPolicyAll,
+			CidrBlock: "0.0.0.0/0",
+			Action:    securityGroupPolicyAccept,
+		}},
+		Ingress: []securityGroupPolicy{},
+	}
+	protocolPorts := map[string][]int{}
+	for _, port := range ports {
+		protocol := string(port.Protocol)
+		protocolPorts[protocol] = append(protocolPorts[protocol], int(port.Port))
+	}
+	protocols := []string{}
+	for protocol := range protocolPorts {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+
+	for _, cidr := range cidrs {
+		for _, protocol := range protocols {
+			sort.Ints(protocolPorts[protocol])
+			portList := []string{}
+			for _, port := range protocolPorts[protocol] {
+				portList = append(portList, strconv.Itoa(port))
+			}
+			policies.Ingress = append(policies.Ingress, securityGroupPolicy{
+				Protocol:  protocol,
+				Port:      strings.Join(portList, ","),
+				CidrBlock: cidr,
+				Action:    securityGroupPolicyAccept,
+			})
+		}
+	}
+	return policies
+}
+
+// securityGroupPoliciesEqual returns true if a and b hold the same policies. Every policy created by the provider
+// accepts, so their order doesn't matter. Descriptions are not compared, they are not even decoded.
+func securityGroupPoliciesEqual(a []securityGroupPolicy, b []securityGroupPolicy) bool {
+	added, removed := diffSecurityGroupPolicies(a, b)
+	return len(added) == 0 && len(removed) == 0
+}
+
+// diffSecurityGroupPolicies returns the policies of desired missing from current, and the ones of current not desired.
+func diffSecurityGroupPolicies(current []securityGroupPolicy, desired []securityGroupPolicy) (missing []string, unwanted []string) {
+	counts := map[string]int{}
+	for _, policy := range current {
+		counts[policy.key()]++
+	}
+	for _, policy := range desired {
+		counts[policy.key()]--
+	}
+	for key, count := range counts {
+		for ; count < 0; count++ {
+			missing = append(missing, key)
+		}
+		for ; count > 0; count-- {
+			unwanted = append(unwanted, key)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unwanted)
+	return missing, unwanted
+}
+
+// key describes the policy, policies differing in case only have the same key.
+func (policy securityGroupPolicy) key() string {
+	return fmt.Sprintf("%s %s:%s from %s", strings.ToUpper(policy.Action), strings.ToUpper(policy.Protocol),
+		strings.ToUpper(policy.Port), policy.CidrBlock)
+}
+
+// getOwnedSecurityGroups returns the security groups created for the source ranges of the clb.
+func (cloud *Cloud) getOwnedSecurityGroups(loadBalancerName string) ([]securityGroup, error) {
+	securityGroups, err := cloud.describeSecurityGroupsByName(loadBalancerName)
+	if err != nil {
+		return nil, err
+	}
+	owned := []securityGroup{}
+	for _, securityGroup := range securityGroups {
+		// groups created before they were tagged are known by their description only
+		if strings.HasPrefix(securityGroup.SecurityGroupDesc, securityGroupDescriptionPrefix) ||
+			hasVpcTag(securityGroup.TagSet, TagKeyLoadBalancerSecurityGroup, loadBalancerName) {
+			owned = append(owned, securityGroup)
+		}
+	}
+	return owned, nil
+}
+
+// ensureLoadBalancerSecurityGroup restricts access to the clb to loadBalancerSourceRanges with a security
+// group bound to the clb. The group is removed again when the source ranges are dropped from the service.
+// Security groups bound to the clb by hand are left alone.
+func (cloud *Cloud) ensureLoadBalancerSecurityGroup(service *v1.Service, loadBalancer *clb.LoadBalancer) error {
+	loadBalancerName := loadBalancerSpecial(service)
+	cidrs, restricted := cloud.loadBalancerSourceRanges(service)
+
+	owned, err := cloud.getOwnedSecurityGroups(loadBalancerName)
+	if err != nil {
+		if !restricted {
+			// accounts not using source ranges may not be allowed to read security groups
+			glog.V(4).Infof("failed to look up security groups of loadbalancer %s: %v", loadBalancerName, err)
+			return nil
+		}
+		return err
+	}
+
+	if !restricted && len(owned) == 0 {
+		return nil
+	}
+
+	bound, err := cloud.describeLoadBalancerSecurityGroups(loadBalancer.LoadBalancerId)
+	if err != nil {
+		return err
+	}
+
+	if !restricted {
+		if err := cloud.unbindSecurityGroups(loadBalancer.LoadBalancerId, bound, owned); err != nil {
+			return err
+		}
+		return cloud.deleteSecurityGroups(owned)
+	}
+
+	// checked before the group is created, so a group which can't hold the policies isn't left behind
+	desired := sourceRangePolicies(cidrs, service.Spec.Ports)
+	if err := cloud.checkSecurityGroupPolicyQuota(desired); err != nil {
+		return err
+	}
+
+	securityGroupId := ""
+	if len(owned) > 0 {
+		securityGroupId = owned[0].SecurityGroupId
+	} else {
+		if err := cloud.checkSecurityGroupQuota(); err != nil {
+			return err
+		}
+		securityGroupId, err = cloud.createLoadBalancerSecurityGroup(loadBalancerName,
+			fmt.Sprintf("%ssource ranges of service %s/%s", securityGroupDescriptionPrefix, service.Namespace, service.Name))
+		if err != nil {
+			return err
+		}
+		glog.Infof("created security group %s for loadbalancer %s", securityGroupId, loadBalancerName)
+	}
+
+	current, err := cloud.describeSecurityGroupPolicies(securityGroupId)
+	if err != nil {
+		return err
+	}
+	if !securityGroupPoliciesEqual(current.Ingress, desired.Ingress) || !securityGroupPoliciesEqual(current.Egress, desired.Egress) {
+		if err := cloud.modifySecurityGroupPolicies(securityGroupId, desired); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range bound {
+		if id == securityGroupId {
+			return nil
+		}
+	}
+	return cloud.setLoadBalancerSecurityGroups(loadBalancer.LoadBalancerId, append(bound, securityGroupId))
+}
+
+// createLoadBalancerSecurityGroup creates a tagged security group for the clb, or an untagged one once tagging
+// is denied. Untagged groups are still known by their description.
+func (cloud *Cloud) createLoadBalancerSecurityGroup(loadBalancerName string, description string) (string, error) {
+	if !cloud.tags.isDenied() {
+		securityGroupId, err := cloud.createSecurityGroup(loadBalancerName, description,
+			[]vpcTag{{Key: TagKeyLoadBalancerSecurityGroup, Value: loadBalancerName}})
+		if !isTagPermissionError(err) {
+			return securityGroupId, err
+		}
+		cloud.tags.deny(err)
+	}
+	return cloud.createSecurityGroup(loadBalancerName, description, nil)
+}
+
+func (cloud *Cloud) unbindSecurityGroups(loadBalancerId string, bound []string, securityGroups []securityGroup) error {
+	remaining := []string{}
+	for _, id := range bound {
+		unbind := false
+		for _, securityGroup := range securityGroups {
+			if securityGroup.SecurityGroupId == id {
+				unbind = true
+				break
+			}
+		}
+		if !unbind {
+			remaining = append(remaining, id)
+		}
+	}
+	if len(remaining) == len(bound) {
+		return nil
+	}
+	return cloud.setLoadBalancerSecurityGroups(loadBalancerId, remaining)
+}
+
+func (cloud *Cloud) deleteSecurityGroups(securityGroups []securityGroup) error {
+	for _, securityGroup := range securityGroups {
+		if err := cloud.deleteSecurityGroup(securityGroup.SecurityGroupId); err != nil {
+			return err
+		}
+		glog.Infof("deleted security group %s", securityGroup.SecurityGroupId)
+	}
+	return nil
+}
+
+// deleteLoadBalancerSecurityGroups deletes the security groups created for the clb once the clb is gone.
+func (cloud *Cloud) deleteLoadBalancerSecurityGroups(service *v1.Service) error {
+	owned, err := cloud.getOwnedSecurityGroups(loadBalancerSpecial(service))
+	if err != nil {
+		if len(sourceRangeEntries(service)) == 0 {
+			glog.V(4).Infof("failed to look up security groups of service %s/%s: %v", service.Namespace, service.Name, err)
+			return nil
+		}
+		return err
+	}
+	return cloud.deleteSecurityGroups(owned)
+}
@@ -0,0 +1,135 @@
+package tencentcloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// specErrorRetryPeriod is how long a service failing because of its spec isn't retried while the spec
+	// stays the same. It is bounded so that fixes outside of the spec, like a created subnet, get noticed.
+	specErrorRetryPeriod = 10 * time.Minute
+
+	// legacyAPIErrorInvalidParameter is the code the legacy apis answer invalid parameters with
+	legacyAPIErrorInvalidParameter = 4000
+)
+
+// specError is an error caused by the spec of the service, retrying won't help until the spec changes.
+type specError struct {
+	err error
+}
+
+func (e *specError) Error() string {
+	return e.err.Error()
+}
+
+func newSpecError(err error) error {
+	return &specError{err: err}
+}
+
+// isSpecError returns true if err can't be resolved by retrying the same request, either because the provider
+// rejected the spec of the service or the api rejected the parameters derived from it. Every other error, like
+// a clb still being provisioned or an unreachable api, is worth retrying.
+func isSpecError(err error) bool {
+	switch e := err.(type) {
+	case *specError:
+		return true
+	case common.LegacyAPIError:
+		return e.Code == legacyAPIErrorInvalidParameter
+	case common.VersionAPIError:
+		code := e.Response.Error.Code
+		return strings.HasPrefix(code, "InvalidParameter") || strings.HasPrefix(code, "MissingParameter")
+	}
+	return false
+}
+
+// specErrorCache remembers the services whose last sync failed because of their spec, so the service
+// controller retrying them with its usual backoff doesn't spend api quota on them until the spec changes.
+// Failures are remembered per operation, a service failing to be ensured must still be deletable.
+type specErrorCache struct {
+	lock    sync.Mutex
+	entries map[specErrorKey]specErrorEntry
+}
+
+type specErrorKey struct {
+	operation string
+	uid       types.UID
+}
+
+type specErrorEntry struct {
+	fingerprint string
+	err         error
+	time        time.Time
+}
+
+func newSpecErrorCache() *specErrorCache {
+	return &specErrorCache{entries: map[specErrorKey]specErrorEntry{}}
+}
+
+// check returns the error the operation last failed with on the service if its spec is unchanged since.
+func (cache *specErrorCache) check(operation string, service *v1.Service) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := specErrorKey{operation: operation, uid: service.UID}
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.fingerprint != serviceFingerprint(service) || time.Since(entry.time) > specErrorRetryPeriod {
+		delete(cache.entries, key)
+		return nil
+	}
+	glog.V(4).Infof("not trying to %s loadbalancer of service %s/%s, its spec is unchanged since it failed with: %v", operation, service.Namespace, service.Name, entry.err)
+	return entry.err
+}
+
+// record classifies the result of the operation on the service, remembering spec errors.
+func (cache *specErrorCache) record(operation string, service *v1.Service, err error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := specErrorKey{operation: operation, uid: service.UID}
+	if err == nil || !isSpecError(err) {
+		delete(cache.entries, key)
+		return
+	}
+	glog.V(2).Infof("failed to %s loadbalancer of service %s/%s because of its spec, not retrying until it changes: %v", operation, service.Namespace, service.Name, err)
+	cache.entries[key] = specErrorEntry{fingerprint: serviceFingerprint(service), err: err, time: time.Now()}
+}
+
+// forget drops everything remembered about the service once its loadbalancer is gone.
+func (cache *specErrorCache) forget(service *v1.Service) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key := range cache.entries {
+		if key.uid == service.UID {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// serviceFingerprint hashes everything of the service the loadbalancer is derived from.
+func serviceFingerprint(service *v1.Service) string {
+	data, err := json.Marshal(struct {
+		Annotations map[string]string
+		Spec        v1.ServiceSpec
+	}{service.Annotations, service.Spec})
+	if err != nil {
+		// never matches, so the service is synced as usual
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,78 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestIsSpecError(t *testing.T) {
+	versionError := func(code string) error {
+		err := common.VersionAPIError{}
+		err.Response.Error.Code = code
+		return err
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"spec error", newSpecError(errors.New("invalid annotation")), true},
+		{"legacy invalid parameter", common.LegacyAPIError{Code: legacyAPIErrorInvalidParameter}, true},
+		{"legacy internal error", common.LegacyAPIError{Code: 5000}, false},
+		{"v3 invalid parameter", versionError("InvalidParameter"), true},
+		{"v3 invalid parameter value", versionError("InvalidParameterValue.Length"), true},
+		{"v3 missing parameter", versionError("MissingParameter"), true},
+		{"v3 clb still provisioning", versionError("FailedOperation.ResourceInOperation"), false},
+		{"timeout", context.DeadlineExceeded, false},
+		{"other error", errors.New("connection reset"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isSpecError(test.err); got != test.want {
+				t.Errorf("isSpecError(%v) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSpecErrorsNotRetried(t *testing.T) {
+	tests := []struct {
+		name string
+		// code is the code the clb lookup fails with
+		code        int
+		wantLookups []int
+	}{
+		// the spec changes before the third sync
+		{"spec error", legacyAPIErrorInvalidParameter, []int{1, 1, 2}},
+		{"retriable error", 5000, []int{1, 2, 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				return legacyError(test.code, "failed")
+			})
+			cloud, _ := newTestCloud(t, Config{}, api, nil)
+
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			for i, wantLookups := range test.wantLookups {
+				if i == 2 {
+					service.Annotations = map[string]string{ServiceAnnotationLoadBalancerKind: LoadBalancerKindClassic}
+				}
+				if err := cloud.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", service); err == nil {
+					t.Errorf("sync %d succeeded, want an error", i)
+				}
+				if got := len(api.callsOf("clb.DescribeLoadBalancers")); got != wantLookups {
+					t.Errorf("%d clb lookups after sync %d, want %d", got, i, wantLookups)
+				}
+			}
+		})
+	}
+}
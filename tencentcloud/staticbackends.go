@@ -0,0 +1,223 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// staticBackend is an instance:port target listed by the static backends annotation.
+type staticBackend struct {
+	InstanceId string
+	Port       int
+}
+
+// staticBackends returns the targets listed by the static backends annotation of the service, and whether
+// the service lists its backends itself.
+func staticBackends(service *v1.Service) ([]staticBackend, bool, error) {
+	value, ok := service.Annotations[ServiceAnnotationLoadBalancerStaticBackends]
+	if !ok {
+		return nil, false, nil
+	}
+	backends := []staticBackend{}
+	seen := map[staticBackend]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, true, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q, %q is not <instance id>:<port>",
+				ServiceAnnotationLoadBalancerStaticBackends, value, item)))
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, true, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation %q, %q has no valid port",
+				ServiceAnnotationLoadBalancerStaticBackends, value, item)))
+		}
+		backend := staticBackend{InstanceId: parts[0], Port: port}
+		if !seen[backend] {
+			seen[backend] = true
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, true, newSpecError(errors.New(fmt.Sprintf("invalid %s annotation, it lists no backends", ServiceAnnotationLoadBalancerStaticBackends)))
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].InstanceId != backends[j].InstanceId {
+			return backends[i].InstanceId < backends[j].InstanceId
+		}
+		return backends[i].Port < backends[j].Port
+	})
+	return backends, true, nil
+}
+
+// validateStaticBackends checks that the listed instances exist and are in the vpc of the cluster, the clbs
+// of the cluster can't register instances of other vpcs by id.
+func (cloud *Cloud) validateStaticBackends(ctx context.Context, backends []staticBackend) error {
+	instanceIds := []string{}
+	listed := map[string]bool{}
+	for _, backend := range backends {
+		if !listed[backend.InstanceId] {
+			listed[backend.InstanceId] = true
+			instanceIds = append(instanceIds, backend.InstanceId)
+		}
+	}
+
+	found := map[string]cvm.InstanceInfo{}
+	for start := 0; start < len(instanceIds); start += maxBackendsPerRequest {
+		chunk := instanceIds[start:backendsChunkEnd(start, len(instanceIds))]
+		response, err := describeInstances(ctx, cloud.cvmV3, &cvm.DescribeInstancesArgs{
+			Version:     cvm.DefaultVersion,
+			InstanceIds: &chunk,
+		})
+		if err != nil {
+			return err
+		}
+		for _, instance := range response.InstanceSet {
+			found[instance.InstanceID] = instance
+		}
+	}
+
+	for _, instanceId := range instanceIds {
+		instance, ok := found[instanceId]
+		if !ok {
+			return newSpecError(errors.New(fmt.Sprintf("instance %s of annotation %s does not exist",
+				instanceId, ServiceAnnotationLoadBalancerStaticBackends)))
+		}
+		if instance.VirtualPrivateCloud.VpcID != cloud.config.VpcId {
+			return newSpecError(errors.New(fmt.Sprintf("instance %s of annotation %s is in vpc %s rather than %s",
+				instanceId, ServiceAnnotationLoadBalancerStaticBackends, instance.VirtualPrivateCloud.VpcID, cloud.config.VpcId)))
+		}
+	}
+	return nil
+}
+
+// ensureStaticBackends registers exactly the listed targets with every listener of the service, ignoring the
+// nodes of the cluster. New targets are registered before the ones no longer listed are deregistered.
+// Classic clbs register backends on the clb rather than per listener port, so only application clbs are supported.
+func (cloud *Cloud) ensureStaticBackends(ctx context.Context, service *v1.Service, loadBalancer *clb.LoadBalancer, backends []staticBackend) error {
+	if loadBalancer.Forward != ClbLoadBalancerKindApplication {
+		return newSpecError(errors.New(fmt.Sprintf("annotation %s is only supported by application loadbalancers",
+			ServiceAnnotationLoadBalancerStaticBackends)))
+	}
+	if err := cloud.validateStaticBackends(ctx, backends); err != nil {
+		return err
+	}
+
+	response, err := cloud.clb.DescribeForwardLBBackends(&clb.DescribeForwardLBBackendsArgs{
+		LoadBalancerId: loadBalancer.LoadBalancerId,
+	})
+	if err != nil {
+		return err
+	}
+
+	listeners := []clb.ForwardLBListener{}
+	followers := portRangeFollowers(servicePortRanges(service))
+	for _, port := range service.Spec.Ports {
+		listener := cloud.findForwardListener(response.Data, port)
+		if listener == nil && followers[listenerKey(port)] {
+			continue
+		}
+		if listener == nil {
+			return errors.New(fmt.Sprintf("can not find the listener of port %d/%s on loadbalancer %s", port.Port, port.Protocol, loadBalancer.LoadBalancerId))
+		}
+		listeners = append(listeners, *listener)
+	}
+
+	desired := map[staticBackend]bool{}
+	for _, backend := range backends {
+		desired[backend] = true
+	}
+
+	for _, listener := range listeners {
+		registered := map[staticBackend]bool{}
+		for _, backend := range listener.Backends {
+			registered[staticBackend{InstanceId: backend.UnInstanceId, Port: backend.Port}] = true
+		}
+		backendToRegister := []clb.RegisterInstancesWithForwardLBFourthListenerBackendOpts{}
+		for _, backend := range backends {
+			if !registered[backend] {
+				backendToRegister = append(backendToRegister, clb.RegisterInstancesWithForwardLBFourthListenerBackendOpts{
+					InstanceId: backend.InstanceId,
+					Port:       backend.Port,
+				})
+			}
+		}
+		listenerId := listener.ListenerId
+		for start := 0; start < len(backendToRegister); start += maxBackendsPerRequest {
+			chunk := backendToRegister[start:backendsChunkEnd(start, len(backendToRegister))]
+			glog.Infof("registering %d static backend(s) with listener %s of loadbalancer %s", len(chunk), listenerId, loadBalancer.LoadBalancerId)
+			result, err := waitUntilDone(
+				ctx,
+				func() (clb.AsyncTask, error) {
+					return cloud.clb.RegisterInstancesWithForwardLBFourthListener(&clb.RegisterInstancesWithForwardLBFourthListenerArgs{
+						LoadBalancerId: loadBalancer.LoadBalancerId,
+						ListenerId:     listenerId,
+						Backends:       chunk,
+					})
+				}, cloud.clb,
+			)
+			if err != nil {
+				return err
+			}
+			if result != clb.TaskSuccceed {
+				return errors.New("task is not succeed")
+			}
+		}
+	}
+
+	for _, listener := range listeners {
+		backendToDeRegister := []clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts{}
+		for _, backend := range listener.Backends {
+			// backends registered by ip are left alone
+			if backend.UnInstanceId == "" {
+				continue
+			}
+			if !desired[staticBackend{InstanceId: backend.UnInstanceId, Port: backend.Port}] {
+				backendToDeRegister = append(backendToDeRegister, clb.DeregisterInstancesWithForwardLBFourthListenerBackendOpts{
+					InstanceId: backend.UnInstanceId,
+					Port:       backend.Port,
+				})
+			}
+		}
+		sort.Slice(backendToDeRegister, func(i, j int) bool {
+			if backendToDeRegister[i].InstanceId != backendToDeRegister[j].InstanceId {
+				return backendToDeRegister[i].InstanceId < backendToDeRegister[j].InstanceId
+			}
+			return backendToDeRegister[i].Port < backendToDeRegister[j].Port
+		})
+		listenerId := listener.ListenerId
+		for start := 0; start < len(backendToDeRegister); start += maxBackendsPerRequest {
+			chunk := backendToDeRegister[start:backendsChunkEnd(start, len(backendToDeRegister))]
+			result, err := waitUntilDone(
+				ctx,
+				func() (clb.AsyncTask, error) {
+					return cloud.clb.DeregisterInstancesFromForwardLBFourthListener(&clb.DeregisterInstancesFromForwardLBFourthListenerArgs{
+						LoadBalancerId: loadBalancer.LoadBalancerId,
+						ListenerId:     listenerId,
+						Backends:       chunk,
+					})
+				}, cloud.clb,
+			)
+			if err != nil {
+				return err
+			}
+			if result != clb.TaskSuccceed {
+				return errors.New("task is not succeed")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package tencentcloud
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/clb"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+// subnetZoneCache remembers the zone of every subnet seen, subnets never move between zones.
+// It also remembers the private clbs whose zone was compared with their backends already.
+type subnetZoneCache struct {
+	lock    sync.Mutex
+	zones   map[string]string
+	checked map[string]bool
+}
+
+func newSubnetZoneCache() *subnetZoneCache {
+	return &subnetZoneCache{zones: map[string]string{}, checked: map[string]bool{}}
+}
+
+// nodeSubnets returns the number of backend nodes of the service in each subnet of the vpc of the cluster.
+// Nodes in other vpcs are left out, a private clb can only be placed in its own vpc.
+func (cloud *Cloud) nodeSubnets(ctx context.Context, service *v1.Service, nodes []*v1.Node) (map[string]int, error) {
+	nodes, err := filterBackendNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	nodeLanIps := []string{}
+	for _, node := range nodes {
+		nodeLanIps = append(nodeLanIps, node.Name)
+	}
+	if len(nodeLanIps) == 0 {
+		return map[string]int{}, nil
+	}
+
+	instances, err := cloud.describeInstancesByMultiLanIp(ctx, nodeLanIps)
+	if err != nil {
+		return nil, err
+	}
+	return instanceSubnets(instances, cloud.config.VpcId), nil
+}
+
+func instanceSubnets(instances []cvm.InstanceInfo, vpcId string) map[string]int {
+	subnets := map[string]int{}
+	for _, instance := range instances {
+		if instance.VirtualPrivateCloud.VpcID != vpcId || instance.VirtualPrivateCloud.SubnetID == "" {
+			continue
+		}
+		subnets[instance.VirtualPrivateCloud.SubnetID]++
+	}
+	return subnets
+}
+
+// selectInternalSubnet picks the subnet a private clb without the subnet annotation is created in: the subnet
+// holding most of the backend nodes, so most traffic stays within a subnet. Ties go to the smallest subnet id,
+// so the choice doesn't change between syncs.
+func (cloud *Cloud) selectInternalSubnet(ctx context.Context, service *v1.Service, nodes []*v1.Node) (string, error) {
+	subnets, err := cloud.nodeSubnets(ctx, service, nodes)
+	if err != nil {
+		return "", err
+	}
+	if len(subnets) == 0 {
+		return "", errors.New("no backend node in the vpc of the cluster to select the subnet of the private loadbalancer from")
+	}
+
+	subnetIds := make([]string, 0, len(subnets))
+	for subnetId := range subnets {
+		subnetIds = append(subnetIds, subnetId)
+	}
+	sort.Slice(subnetIds, func(i, j int) bool {
+		if subnets[subnetIds[i]] != subnets[subnetIds[j]] {
+			return subnets[subnetIds[i]] > subnets[subnetIds[j]]
+		}
+		return subnetIds[i] < subnetIds[j]
+	})
+	return subnetIds[0], nil
+}
+
+func (cloud *Cloud) getSubnetZone(subnetId string) (string, error) {
+	cloud.subnetZones.lock.Lock()
+	zone, ok := cloud.subnetZones.zones[subnetId]
+	cloud.subnetZones.lock.Unlock()
+	if ok {
+		return zone, nil
+	}
+
+	zone, err := cloud.describeSubnetZone(subnetId)
+	if err != nil {
+		return "", err
+	}
+	cloud.subnetZones.lock.Lock()
+	cloud.subnetZones.zones[subnetId] = zone
+	cloud.subnetZones.lock.Unlock()
+	return zone, nil
+}
+
+// checkLoadBalancerZoneSpread reports through an event if most backends of a private clb are in another
+// zone than the clb, traffic crossing zones costs latency and money. Each clb is checked once after it
+// is created or adopted, failures only skip the check.
+func (cloud *Cloud) checkLoadBalancerZoneSpread(ctx context.Context, service *v1.Service, loadBalancer *clb.LoadBalancer, nodes []*v1.Node) {
+	if loadBalancer.LoadBalancerType != ClbLoadBalancerTypePrivate {
+		return
+	}
+	cloud.subnetZones.lock.Lock()
+	checked := cloud.subnetZones.checked[loadBalancer.LoadBalancerId]
+	cloud.subnetZones.lock.Unlock()
+	if checked {
+		return
+	}
+
+	zones, err := cloud.backendZones(ctx, service, nodes)
+	if err != nil {
+		glog.V(4).Infof("failed to look up zones of backends of loadbalancer %s: %v", loadBalancer.LoadBalancerId, err)
+		return
+	}
+	subnetId, err := cloud.describeLoadBalancerSubnet(ctx, loadBalancer.LoadBalancerId)
+	if err != nil {
+		glog.V(4).Infof("failed to look up subnet of loadbalancer %s: %v", loadBalancer.LoadBalancerId, err)
+		return
+	}
+	zone, err := cloud.getSubnetZone(subnetId)
+	if err != nil {
+		glog.V(4).Infof("failed to look up zone of subnet %s: %v", subnetId, err)
+		return
+	}
+
+	total, majorityZone := 0, ""
+	for z, count := range zones {
+		total += count
+		if majorityZone == "" || count > zones[majorityZone] || (count == zones[majorityZone] && z < majorityZone) {
+			majorityZone = z
+		}
+	}
+	if majorityZone != "" && majorityZone != zone && zones[majorityZone]*2 > total {
+		cloud.recorder.Eventf(service, v1.EventTypeNormal, "LoadBalancerZoneMismatch",
+			"%d of %d backends are in zone %s but the loadbalancer is in subnet %s of zone %s, set annotation %s to a subnet of zone %s to keep traffic within the zone",
+			zones[majorityZone], total, majorityZone, subnetId, zone, ServiceAnnotationLoadBalancerTypeInternalSubnetId, majorityZone)
+	}
+
+	cloud.subnetZones.lock.Lock()
+	cloud.subnetZones.checked[loadBalancer.LoadBalancerId] = true
+	cloud.subnetZones.lock.Unlock()
+}
+
+// backendZones returns the number of backend nodes of the service in the vpc of the cluster per zone.
+func (cloud *Cloud) backendZones(ctx context.Context, service *v1.Service, nodes []*v1.Node) (map[string]int, error) {
+	nodes, err := filterBackendNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	nodeLanIps := []string{}
+	for _, node := range nodes {
+		nodeLanIps = append(nodeLanIps, node.Name)
+	}
+	zones := map[string]int{}
+	if len(nodeLanIps) == 0 {
+		return zones, nil
+	}
+
+	instances, err := cloud.describeInstancesByMultiLanIp(ctx, nodeLanIps)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if instance.VirtualPrivateCloud.VpcID == cloud.config.VpcId {
+			zones[instance.Placement.Zone]++
+		}
+	}
+	return zones, nil
+}
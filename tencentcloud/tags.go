@@ -0,0 +1,84 @@
+package tencentcloud
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+	"github.com/golang/glog"
+)
+
+// tagPermission tracks whether the credentials may tag resources. Some CAM policies allow managing clbs, eips
+// and security groups but not the tag apis they call behind the scenes, creating tagged resources fails then.
+//
+// Once tagging is denied resources are created untagged, and owned ones are told by their name together with
+// the clb they are bound to or the ids recorded here when they were created or last seen bound. The record is
+// lost on restart, an untagged resource neither bound nor recorded is never touched.
+type tagPermission struct {
+	lock     sync.Mutex
+	denied   bool
+	recorded map[string]map[string]bool
+}
+
+func newTagPermission() *tagPermission {
+	return &tagPermission{recorded: map[string]map[string]bool{}}
+}
+
+// isTagPermissionError returns true if the api rejected a request because the credentials may not use the tag apis.
+func isTagPermissionError(err error) bool {
+	e, ok := err.(common.VersionAPIError)
+	if !ok {
+		return false
+	}
+	code := e.Response.Error.Code
+	if !strings.HasPrefix(code, "UnauthorizedOperation") && !strings.HasPrefix(code, "AuthFailure.UnauthorizedOperation") {
+		return false
+	}
+	return strings.Contains(strings.ToLower(e.Response.Error.Message), "tag")
+}
+
+// deny switches to untagged ownership for good, the warning is logged once.
+func (p *tagPermission) deny(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.denied {
+		return
+	}
+	p.denied = true
+	glog.Errorf("TAGGING DENIED: the credentials may not use the tag apis (%v). Eips and security groups are created "+
+		"untagged from now on and owned ones are told by their name and the clb they are bound to. Unbound eips "+
+		"left behind by a previous run can't be told apart from ones created by hand, they are neither reused "+
+		"nor released. Grant the tag permissions and restart to get tag based ownership back.", err)
+}
+
+func (p *tagPermission) isDenied() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.denied
+}
+
+// record remembers the resource as owned by the clb of the name.
+func (p *tagPermission) record(loadBalancerName string, id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.recorded[loadBalancerName] == nil {
+		p.recorded[loadBalancerName] = map[string]bool{}
+	}
+	p.recorded[loadBalancerName][id] = true
+}
+
+func (p *tagPermission) isRecorded(loadBalancerName string, id string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.recorded[loadBalancerName][id]
+}
+
+// forget drops the record of a resource which is gone.
+func (p *tagPermission) forget(loadBalancerName string, id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.recorded[loadBalancerName], id)
+	if len(p.recorded[loadBalancerName]) == 0 {
+		delete(p.recorded, loadBalancerName)
+	}
+}
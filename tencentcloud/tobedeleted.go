@@ -0,0 +1,55 @@
+package tencentcloud
+
+import (
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// taintToBeDeletedByClusterAutoscaler is put on nodes the cluster autoscaler is about to remove.
+const taintToBeDeletedByClusterAutoscaler = "ToBeDeletedByClusterAutoscaler"
+
+func isNodeToBeDeleted(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == taintToBeDeletedByClusterAutoscaler {
+			return true
+		}
+	}
+	return false
+}
+
+// nodesToBeDeleted returns the sorted names of the nodes the cluster autoscaler is about to remove, joined by commas.
+func nodesToBeDeleted(nodes []*v1.Node) string {
+	names := []string{}
+	for _, node := range nodes {
+		if isNodeToBeDeleted(node) {
+			names = append(names, node.Name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// excludeNodesToBeDeleted leaves out the nodes the cluster autoscaler is about to remove, so traffic moves to the
+// other backends before the instance is terminated. Nodes whose scale down is aborted lose the taint and are
+// registered again.
+func (cloud *Cloud) excludeNodesToBeDeleted(service *v1.Service, nodes []*v1.Node) []*v1.Node {
+	if cloud.config.KeepNodesToBeDeleted {
+		return nodes
+	}
+	kept := []*v1.Node{}
+	excluded := []string{}
+	for _, node := range nodes {
+		if isNodeToBeDeleted(node) {
+			excluded = append(excluded, node.Name)
+			continue
+		}
+		kept = append(kept, node)
+	}
+	if len(excluded) > 0 {
+		cloud.recorder.Eventf(service, v1.EventTypeNormal, "BackendNodesExcluded",
+			"Not registering nodes %s as backends, they are about to be removed by the cluster autoscaler", strings.Join(excluded, ", "))
+	}
+	return kept
+}
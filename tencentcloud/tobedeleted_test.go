@@ -0,0 +1,112 @@
+package tencentcloud
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func toBeDeletedNode(name string) *v1.Node {
+	node := fakeNode(name)
+	node.Spec.Taints = []v1.Taint{{Key: taintToBeDeletedByClusterAutoscaler, Effect: v1.TaintEffectNoSchedule}}
+	return node
+}
+
+func TestExcludeNodesToBeDeleted(t *testing.T) {
+	tests := []struct {
+		name        string
+		keep        bool
+		nodes       []*v1.Node
+		wantNodes   string
+		wantDeleted string
+		wantEvents  int
+	}{
+		{"no node to be deleted", false, []*v1.Node{fakeNode("10.0.0.1"), fakeNode("10.0.0.2")}, "10.0.0.1,10.0.0.2", "", 0},
+		{"node to be deleted excluded", false, []*v1.Node{toBeDeletedNode("10.0.0.2"), fakeNode("10.0.0.1"), toBeDeletedNode("10.0.0.0")}, "10.0.0.1", "10.0.0.0,10.0.0.2", 1},
+		{"node to be deleted kept", true, []*v1.Node{fakeNode("10.0.0.1"), toBeDeletedNode("10.0.0.2")}, "10.0.0.1,10.0.0.2", "10.0.0.2", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cloud, recorder := newTestCloud(t, Config{KeepNodesToBeDeleted: test.keep}, newFakeApi(t), nil)
+
+			names := []string{}
+			for _, node := range cloud.excludeNodesToBeDeleted(fakeService(nil), test.nodes) {
+				names = append(names, node.Name)
+			}
+			if got := strings.Join(names, ","); got != test.wantNodes {
+				t.Errorf("nodes %s, want %s", got, test.wantNodes)
+			}
+			if got := nodesToBeDeleted(test.nodes); got != test.wantDeleted {
+				t.Errorf("nodes to be deleted %q, want %q", got, test.wantDeleted)
+			}
+			if events := drainEvents(recorder); len(events) != test.wantEvents {
+				t.Errorf("events %v, want %d", events, test.wantEvents)
+			}
+		})
+	}
+}
+
+func TestSyncBackendNodesToBeDeleted(t *testing.T) {
+	tests := []struct {
+		name            string
+		lastToBeDeleted string
+		registerFails   bool
+		wantSynced      bool
+		want            string
+	}{
+		{"taint appeared", "", false, true, "10.0.0.2"},
+		{"taint unchanged", "10.0.0.2", false, false, "10.0.0.2"},
+		{"taint went away", "10.0.0.2,10.0.0.3", false, true, "10.0.0.2"},
+		{"sync failed", "", true, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeApi(t)
+			defer api.close()
+			api.handle("clb.DescribeLoadBalancers", func(url.Values) interface{} {
+				return legacyResponse(map[string]interface{}{"totalCount": 1, "loadBalancerSet": []interface{}{
+					map[string]interface{}{"loadBalancerId": "lb-1", "forward": ClbLoadBalancerKindApplication},
+				}})
+			})
+			api.handle("cvmv3.DescribeInstances", describeInstancesResult(
+				fakeInstance("ins-1", "ap-guangzhou-3", "vpc-test", []string{"10.0.0.1"}, nil)))
+			api.handle("clb.DescribeForwardLBBackends", describeForwardLBBackendsResult(
+				fakeForwardListener("lbl-80", 80, ClbLoadBalancerListenerProtocolTCP)))
+			api.handle("clb.RegisterInstancesWithForwardLBFourthListener", func(params url.Values) interface{} {
+				if test.registerFails {
+					return legacyError(5000, "internal error")
+				}
+				return legacyTask(params)
+			})
+			api.handle("clbv3.DescribeLoadBalancers", describeLoadBalancersV3Result("lb-1"))
+			kube := newFakeKube(t)
+			defer kube.close()
+			ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+			kube.nodes = []v1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.1"}, Status: ready},
+				{ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.2"}, Spec: toBeDeletedNode("10.0.0.2").Spec, Status: ready},
+			}
+			service := fakeService(nil, fakeServicePort("http", 80, v1.ProtocolTCP, 30080))
+			service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+			kube.services = []v1.Service{*service}
+			cloud, _ := newTestCloud(t, Config{}, api, kube)
+
+			got := cloud.syncBackendNodes(test.lastToBeDeleted, false)
+
+			if got != test.want {
+				t.Errorf("sync returned %q, want %q", got, test.want)
+			}
+			if synced := len(api.callsOf("clb.DescribeForwardLBBackends")) > 0; synced != test.wantSynced {
+				t.Errorf("service synced %t, want %t", synced, test.wantSynced)
+			}
+			for _, call := range api.callsOf("clb.RegisterInstancesWithForwardLBFourthListener") {
+				if id := call.Get("backends.0.instanceId"); id != "ins-1" {
+					t.Errorf("registered %s, want the node which isn't to be deleted only", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package tencentcloud
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dbdd4us/qcloudapi-sdk-go/common"
+	"github.com/dbdd4us/qcloudapi-sdk-go/cvm"
+)
+
+const (
+	VpcV3Host = "vpc.tencentcloudapi.com"
+	VpcV3Path = "/"
+
+	VpcDefaultVersion = "2017-03-12"
+
+	VpcFilterNameAttachmentInstanceId = "attachment.instance-id"
+	VpcFilterNameAddressIpv6          = "address-ipv6"
+	VpcFilterNameAddressIp            = "address-ip"
+	VpcFilterNameVpcId                = "vpc-id"
+	VpcFilterNameAddressName          = "address-name"
+	VpcFilterNameSecurityGroupName    = "security-group-name"
+
+	AddressInternetChargeTypeBandwidthPackage = "BANDWIDTH_PACKAGE"
+
+	BandwidthPackageResourceTypeLoadBalance = "LoadBalance"
+
+	VpcFilterNameBandwidthPackageResourceId = "resource.resource-id"
+)
+
+// qcloudapi-sdk-go does not ship a vpc client, the vpc v3 api is called through the common client.
+
+type vpcResponse struct {
+	Response interface{} `json:"Response"`
+}
+
+type describeNetworkInterfacesArgs struct {
+	Version string        `qcloud_arg:"Version,required"`
+	Filters *[]cvm.Filter `qcloud_arg:"Filters"`
+	Offset  *int          `qcloud_arg:"Offset"`
+	Limit   *int          `qcloud_arg:"Limit"`
+}
+
+type describeNetworkInterfacesResponse struct {
+	TotalCount          int                `json:"TotalCount"`
+	NetworkInterfaceSet []networkInterface `json:"NetworkInterfaceSet"`
+	RequestID           string             `json:"RequestId"`
+}
+
+type networkInterface struct {
+	NetworkInterfaceId string `json:"NetworkInterfaceId"`
+	VpcId              string `json:"VpcId"`
+	SubnetId           string `json:"SubnetId"`
+	Zone               string `json:"Zone"`
+	Primary            bool   `json:"Primary"`
+	State              string `json:"State"`
+
+	PrivateIpAddressSet []struct {
+		PrivateIpAddress string `json:"PrivateIpAddress"`
+		Primary          bool   `json:"Primary"`
+		PublicIpAddress  string `json:"PublicIpAddress"`
+	} `json:"PrivateIpAddressSet"`
+
+	Ipv6AddressSet []struct {
+		Address string `json:"Address"`
+	} `json:"Ipv6AddressSet"`
+
+	Attachment struct {
+		InstanceId string `json:"InstanceId"`
+	} `json:"Attachment"`
+}
+
+func newVpcClient(credential common.CredentialInterface, region string) (*common.Client, error) {
+	return common.NewClient(credential, common.Opts{Region: region, Host: VpcV3Host, Path: VpcV3Path})
+}
+
+// describeInstanceNetworkInterfaces returns every eni attached to the instance, the primary one included.
+func (cloud *Cloud) describeInstanceNetworkInterfaces(instanceID string) ([]networkInterface, error) {
+	return cloud.describeNetworkInterfaces([]cvm.Filter{cvm.NewFilter(VpcFilterNameAttachmentInstanceId, instanceID)})
+}
+
+// describeNetworkInterfacesByIpv6 returns the enis of the vpc holding the ipv6 address.
+func (cloud *Cloud) describeNetworkInterfacesByIpv6(ipv6 string) ([]networkInterface, error) {
+	return cloud.describeNetworkInterfaces([]cvm.Filter{
+		cvm.NewFilter(VpcFilterNameAddressIpv6, ipv6),
+		cvm.NewFilter(VpcFilterNameVpcId, cloud.config.VpcId),
+	})
+}
+
+// describeNetworkInterfacesByIp returns the enis of the vpc holding the private ipv4 address, primary or secondary.
+func (cloud *Cloud) describeNetworkInterfacesByIp(ip string) ([]networkInterface, error) {
+	return cloud.describeNetworkInterfaces([]cvm.Filter{
+		cvm.NewFilter(VpcFilterNameAddressIp, ip),
+		cvm.NewFilter(VpcFilterNameVpcId, cloud.config.VpcId),
+	})
+}
+
+func (cloud *Cloud) describeNetworkInterfaces(filters []cvm.Filter) ([]networkInterface, error) {
+	networkInterfaces := []networkInterface{}
+
+	offset := 0
+	limit := 100
+
+	for {
+		response := &describeNetworkInterfacesResponse{}
+		err := cloud.vpc.Invoke("DescribeNetworkInterfaces", &describeNetworkInterfacesArgs{
+			Version: VpcDefaultVersion,
+			Filters: &filters,
+			Offset:  &offset,
+			Limit:   &limit,
+		}, &vpcResponse{Response: response})
+		if err != nil {
+			return []networkInterface{}, err
+		}
+		networkInterfaces = append(networkInterfaces, response.NetworkInterfaceSet...)
+
+		if len(response.NetworkInterfaceSet) > 0 && len(networkInterfaces) < response.TotalCount {
+			offset = len(networkInterfaces)
+		} else {
+			break
+		}
+	}
+
+	return networkInterfaces, nil
+}
+
+type vpcTag struct {
+	Key   string `qcloud_arg:"Key" json:"Key"`
+	Value string `qcloud_arg:"Value" json:"Value"`
+}
+
+func hasVpcTag(tags []vpcTag, key string, value string) bool {
+	for _, tag := range tags {
+		if tag.Key == key && tag.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+type allocateAddressesArgs struct {
+	Version            string    `qcloud_arg:"Version,required"`
+	AddressCount       int       `qcloud_arg:"AddressCount"`
+	InternetChargeType *string   `qcloud_arg:"InternetChargeType"`
+	BandwidthPackageId *string   `qcloud_arg:"BandwidthPackageId"`
+	AddressName        *string   `qcloud_arg:"AddressName"`
+	Tags               *[]vpcTag `qcloud_arg:"Tags"`
+}
+
+type allocateAddressesResponse struct {
+	AddressSet []string `json:"AddressSet"`
+	RequestID  string   `json:"RequestId"`
+}
+
+type describeAddressesArgs struct {
+	Version string        `qcloud_arg:"Version,required"`
+	Filters *[]cvm.Filter `qcloud_arg:"Filters"`
+	Offset  *int          `qcloud_arg:"Offset"`
+	Limit   *int          `qcloud_arg:"Limit"`
+}
+
+type describeAddressesResponse struct {
+	TotalCount int       `json:"TotalCount"`
+	AddressSet []address `json:"AddressSet"`
+	RequestID  string    `json:"RequestId"`
+}
+
+type address struct {
+	AddressId     string   `json:"AddressId"`
+	AddressName   string   `json:"AddressName"`
+	AddressStatus string   `json:"AddressStatus"`
+	AddressIp     string   `json:"AddressIp"`
+	InstanceId    string   `json:"InstanceId"`
+	TagSet        []vpcTag `json:"TagSet"`
+}
+
+type associateAddressArgs struct {
+	Version    string `qcloud_arg:"Version,required"`
+	AddressId  string `qcloud_arg:"AddressId,required"`
+	InstanceId string `qcloud_arg:"InstanceId,required"`
+}
+
+type disassociateAddressArgs struct {
+	Version   string `qcloud_arg:"Version,required"`
+	AddressId string `qcloud_arg:"AddressId,required"`
+}
+
+type releaseAddressesArgs struct {
+	Version    string   `qcloud_arg:"Version,required"`
+	AddressIds []string `qcloud_arg:"AddressIds,required"`
+}
+
+type vpcTaskResponse struct {
+	TaskId    string `json:"TaskId"`
+	RequestID string `json:"RequestId"`
+}
+
+func (cloud *Cloud) allocateAddress(name string, bandwidthPackageId string, tags []vpcTag) (string, error) {
+	chargeType := AddressInternetChargeTypeBandwidthPackage
+	args := &allocateAddressesArgs{
+		Version:      VpcDefaultVersion,
+		AddressCount: 1,
+		AddressName:  &name,
+		Tags:         &tags,
+	}
+	if bandwidthPackageId != "" {
+		args.InternetChargeType = &chargeType
+		args.BandwidthPackageId = &bandwidthPackageId
+	}
+	response := &allocateAddressesResponse{}
+	if err := cloud.vpc.Invoke("AllocateAddresses", args, &vpcResponse{Response: response}); err != nil {
+		return "", err
+	}
+	if len(response.AddressSet) != 1 {
+		return "", errors.New(fmt.Sprintf("unexpected addresses %v allocated, request id %s", response.AddressSet, response.RequestID))
+	}
+	return response.AddressSet[0], nil
+}
+
+func (cloud *Cloud) describeAddressesByName(name string) ([]address, error) {
+	addresses := []address{}
+
+	offset := 0
+	limit := 100
+
+	for {
+		response := &describeAddressesResponse{}
+		err := cloud.vpc.Invoke("DescribeAddresses", &describeAddressesArgs{
+			Version: VpcDefaultVersion,
+			Filters: &[]cvm.Filter{cvm.NewFilter(VpcFilterNameAddressName, name)},
+			Offset:  &offset,
+			Limit:   &limit,
+		}, &vpcResponse{Response: response})
+		if err != nil {
+			return []address{}, err
+		}
+		addresses = append(addresses, response.AddressSet...)
+
+		if len(response.AddressSet) > 0 && len(addresses) < response.TotalCount {
+			offset = len(addresses)
+		} else {
+			break
+		}
+	}
+
+	return addresses, nil
+}
+
+func (cloud *Cloud) associateAddress(addressId string, instanceId string) error {
+	return cloud.vpc.Invoke("AssociateAddress", &associateAddressArgs{
+		Version:    VpcDefaultVersion,
+		AddressId:  addressId,
+		InstanceId: instanceId,
+	}, &vpcResponse{Response: &vpcTaskResponse{}})
+}
+
+func (cloud *Cloud) disassociateAddress(addressId string) error {
+	return cloud.vpc.Invoke("DisassociateAddress", &disassociateAddressArgs{
+		Version:   VpcDefaultVersion,
+		AddressId: addressId,
+	}, &vpcResponse{Response: &vpcTaskResponse{}})
+}
+
+func (cloud *Cloud) releaseAddress(addressId string) error {
+	return cloud.vpc.Invoke("ReleaseAddresses", &releaseAddressesArgs{
+		Version:    VpcDefaultVersion,
+		AddressIds: []string{addressId},
+	}, &vpcResponse{Response: &vpcTaskResponse{}})
+}
+
+type securityGroup struct {
+	SecurityGroupId   string   `json:"SecurityGroupId"`
+	SecurityGroupName string   `json:"SecurityGroupName"`
+	SecurityGroupDesc string   `json:"SecurityGroupDesc"`
+	TagSet            []vpcTag `json:"TagSet"`
+}
+
+type securityGroupPolicy struct {
+	Protocol  string `qcloud_arg:"Protocol" json:"Protocol"`
+	Port      string `qcloud_arg:"Port" json:"Port"`
+	CidrBlock string `qcloud_arg:"CidrBlock" json:"CidrBlock"`
+	Action    string `qcloud_arg:"Action" json:"Action"`
+}
+
+type securityGroupPolicySet struct {
+	Egress  []securityGroupPolicy `qcloud_arg:"Egress" json:"Egress"`
+	Ingress []securityGroupPolicy `qcloud_arg:"Ingress" json:"Ingress"`
+}
+
+type describeSecurityGroupsArgs struct {
+	Version string        `qcloud_arg:"Version,required"`
+	Filters *[]cvm.Filter `qcloud_arg:"Filters"`
+	Offset  *int          `qcloud_arg:"Offset"`
+	Limit   *int          `qcloud_arg:"Limit"`
+}
+
+type describeSecurityGroupsResponse struct {
+	TotalCount       int             `json:"TotalCount"`
+	SecurityGroupSet []securityGroup `json:"SecurityGroupSet"`
+	RequestID        string          `json:"RequestId"`
+}
+
+type createSecurityGroupArgs struct {
+	Version          string    `qcloud_arg:"Version,required"`
+	GroupName        string    `qcloud_arg:"GroupName,required"`
+	GroupDescription string    `qcloud_arg:"GroupDescription,required"`
+	Tags             *[]vpcTag `qcloud_arg:"Tags"`
+}
+
+type createSecurityGroupResponse struct {
+	SecurityGroup securityGroup `json:"SecurityGroup"`
+	RequestID     string        `json:"RequestId"`
+}
+
+type securityGroupIdArgs struct {
+	Version         string `qcloud_arg:"Version,required"`
+	SecurityGroupId string `qcloud_arg:"SecurityGroupId,required"`
+}
+
+type describeSecurityGroupPoliciesResponse struct {
+	SecurityGroupPolicySet securityGroupPolicySet `json:"SecurityGroupPolicySet"`
+	RequestID              string                 `json:"RequestId"`
+}
+
+type modifySecurityGroupPoliciesArgs struct {
+	Version                string                 `qcloud_arg:"Version,required"`
+	SecurityGroupId        string                 `qcloud_arg:"SecurityGroupId,required"`
+	SecurityGroupPolicySet securityGroupPolicySet `qcloud_arg:"SecurityGroupPolicySet,required"`
+}
+
+type vpcRequestResponse struct {
+	RequestID string `json:"RequestId"`
+}
+
+func (cloud *Cloud) describeSecurityGroupsByName(name string) ([]securityGroup, error) {
+	securityGroups := []securityGroup{}
+
+	offset := 0
+	limit := 100
+
+	for {
+		response := &describeSecurityGroupsResponse{}
+		err := cloud.vpc.Invoke("DescribeSecurityGroups", &describeSecurityGroupsArgs{
+			Version: VpcDefaultVersion,
+			Filters: &[]cvm.Filter{cvm.NewFilter(VpcFilterNameSecurityGroupName, name)},
+			Offset:  &offset,
+			Limit:   &limit,
+		}, &vpcResponse{Response: response})
+		if err != nil {
+			return []securityGroup{}, err
+		}
+		securityGroups = append(securityGroups, response.SecurityGroupSet...)
+
+		if len(response.SecurityGroupSet) > 0 && len(securityGroups) < response.TotalCount {
+			offset = len(securityGroups)
+		} else {
+			break
+		}
+	}
+
+	return securityGroups, nil
+}
+
+type describeSecurityGroupLimitsArgs struct {
+	Version string `qcloud_arg:"Version,required"`
+}
+
+type describeSecurityGroupLimitsResponse struct {
+	SecurityGroupLimitSet securityGroupLimits `json:"SecurityGroupLimitSet"`
+	RequestID             string              `json:"RequestId"`
+}
+
+func (cloud *Cloud) describeSecurityGroupLimits() (*securityGroupLimits, error) {
+	response := &describeSecurityGroupLimitsResponse{}
+	err := cloud.vpc.Invoke("DescribeSecurityGroupLimits", &describeSecurityGroupLimitsArgs{
+		Version: VpcDefaultVersion,
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	return &response.SecurityGroupLimitSet, nil
+}
+
+// countSecurityGroups returns the number of security groups of the account in the region.
+func (cloud *Cloud) countSecurityGroups() (int, error) {
+	offset := 0
+	limit := 1
+	response := &describeSecurityGroupsResponse{}
+	err := cloud.vpc.Invoke("DescribeSecurityGroups", &describeSecurityGroupsArgs{
+		Version: VpcDefaultVersion,
+		Offset:  &offset,
+		Limit:   &limit,
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return 0, err
+	}
+	return response.TotalCount, nil
+}
+
+func (cloud *Cloud) createSecurityGroup(name string, description string, tags []vpcTag) (string, error) {
+	response := &createSecurityGroupResponse{}
+	err := cloud.vpc.Invoke("CreateSecurityGroup", &createSecurityGroupArgs{
+		Version:          VpcDefaultVersion,
+		GroupName:        name,
+		GroupDescription: description,
+		Tags:             &tags,
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return "", err
+	}
+	return response.SecurityGroup.SecurityGroupId, nil
+}
+
+func (cloud *Cloud) describeSecurityGroupPolicies(securityGroupId string) (*securityGroupPolicySet, error) {
+	response := &describeSecurityGroupPoliciesResponse{}
+	err := cloud.vpc.Invoke("DescribeSecurityGroupPolicies", &securityGroupIdArgs{
+		Version:         VpcDefaultVersion,
+		SecurityGroupId: securityGroupId,
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	return &response.SecurityGroupPolicySet, nil
+}
+
+// modifySecurityGroupPolicies replaces all policies of the security group at once.
+func (cloud *Cloud) modifySecurityGroupPolicies(securityGroupId string, policies securityGroupPolicySet) error {
+	return cloud.vpc.Invoke("ModifySecurityGroupPolicies", &modifySecurityGroupPoliciesArgs{
+		Version:                VpcDefaultVersion,
+		SecurityGroupId:        securityGroupId,
+		SecurityGroupPolicySet: policies,
+	}, &vpcResponse{Response: &vpcRequestResponse{}})
+}
+
+func (cloud *Cloud) deleteSecurityGroup(securityGroupId string) error {
+	return cloud.vpc.Invoke("DeleteSecurityGroup", &securityGroupIdArgs{
+		Version:         VpcDefaultVersion,
+		SecurityGroupId: securityGroupId,
+	}, &vpcResponse{Response: &vpcRequestResponse{}})
+}
+
+type bandwidthPackage struct {
+	BandwidthPackageId string `json:"BandwidthPackageId"`
+	NetworkType        string `json:"NetworkType"`
+	ChargeType         string `json:"ChargeType"`
+	Status             string `json:"Status"`
+	ResourceSet        []struct {
+		ResourceType string `json:"ResourceType"`
+		ResourceId   string `json:"ResourceId"`
+	} `json:"ResourceSet"`
+}
+
+type describeBandwidthPackagesArgs struct {
+	Version             string   `qcloud_arg:"Version,required"`
+	BandwidthPackageIds []string `qcloud_arg:"BandwidthPackageIds,required"`
+}
+
+type describeBandwidthPackagesResponse struct {
+	TotalCount          int                `json:"TotalCount"`
+	BandwidthPackageSet []bandwidthPackage `json:"BandwidthPackageSet"`
+	RequestID           string             `json:"RequestId"`
+}
+
+type describeBandwidthPackagesByFilterArgs struct {
+	Version string        `qcloud_arg:"Version,required"`
+	Filters *[]cvm.Filter `qcloud_arg:"Filters"`
+}
+
+type bandwidthPackageResourcesArgs struct {
+	Version            string   `qcloud_arg:"Version,required"`
+	BandwidthPackageId string   `qcloud_arg:"BandwidthPackageId,required"`
+	ResourceType       string   `qcloud_arg:"ResourceType,required"`
+	ResourceIds        []string `qcloud_arg:"ResourceIds,required"`
+}
+
+// describeBandwidthPackage returns the bandwidth package of the account, nil if there is none of that id.
+func (cloud *Cloud) describeBandwidthPackage(bandwidthPackageId string) (*bandwidthPackage, error) {
+	response := &describeBandwidthPackagesResponse{}
+	err := cloud.vpc.Invoke("DescribeBandwidthPackages", &describeBandwidthPackagesArgs{
+		Version:             VpcDefaultVersion,
+		BandwidthPackageIds: []string{bandwidthPackageId},
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	for i := range response.BandwidthPackageSet {
+		if response.BandwidthPackageSet[i].BandwidthPackageId == bandwidthPackageId {
+			return &response.BandwidthPackageSet[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// describeResourceBandwidthPackages returns the bandwidth packages holding the resource.
+func (cloud *Cloud) describeResourceBandwidthPackages(resourceId string) ([]bandwidthPackage, error) {
+	response := &describeBandwidthPackagesResponse{}
+	err := cloud.vpc.Invoke("DescribeBandwidthPackages", &describeBandwidthPackagesByFilterArgs{
+		Version: VpcDefaultVersion,
+		Filters: &[]cvm.Filter{cvm.NewFilter(VpcFilterNameBandwidthPackageResourceId, resourceId)},
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return nil, err
+	}
+	return response.BandwidthPackageSet, nil
+}
+
+func (cloud *Cloud) addBandwidthPackageResource(bandwidthPackageId string, resourceType string, resourceId string) error {
+	return cloud.vpc.Invoke("AddBandwidthPackageResources", &bandwidthPackageResourcesArgs{
+		Version:            VpcDefaultVersion,
+		BandwidthPackageId: bandwidthPackageId,
+		ResourceType:       resourceType,
+		ResourceIds:        []string{resourceId},
+	}, &vpcResponse{Response: &vpcTaskResponse{}})
+}
+
+func (cloud *Cloud) removeBandwidthPackageResource(bandwidthPackageId string, resourceType string, resourceId string) error {
+	return cloud.vpc.Invoke("RemoveBandwidthPackageResources", &bandwidthPackageResourcesArgs{
+		Version:            VpcDefaultVersion,
+		BandwidthPackageId: bandwidthPackageId,
+		ResourceType:       resourceType,
+		ResourceIds:        []string{resourceId},
+	}, &vpcResponse{Response: &vpcTaskResponse{}})
+}
+
+type describeSubnetsArgs struct {
+	Version   string   `qcloud_arg:"Version,required"`
+	SubnetIds []string `qcloud_arg:"SubnetIds,required"`
+}
+
+type describeSubnetsResponse struct {
+	SubnetSet []struct {
+		SubnetId string `json:"SubnetId"`
+		VpcId    string `json:"VpcId"`
+		Zone     string `json:"Zone"`
+	} `json:"SubnetSet"`
+	RequestID string `json:"RequestId"`
+}
+
+// describeSubnetZone returns the zone of the subnet.
+func (cloud *Cloud) describeSubnetZone(subnetId string) (string, error) {
+	response := &describeSubnetsResponse{}
+	err := cloud.vpc.Invoke("DescribeSubnets", &describeSubnetsArgs{
+		Version:   VpcDefaultVersion,
+		SubnetIds: []string{subnetId},
+	}, &vpcResponse{Response: response})
+	if err != nil {
+		return "", err
+	}
+	for _, subnet := range response.SubnetSet {
+		if subnet.SubnetId == subnetId {
+			return subnet.Zone, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("subnet %s not found", subnetId))
+}